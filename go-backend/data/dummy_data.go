@@ -3,6 +3,7 @@ package data
 import (
 	"time"
 	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
 )
 
 // Users contains dummy user data
@@ -13,6 +14,8 @@ var Users = []models.User{
 		Password:       "$2a$10$92IXUNpkjO0rOQ5byMi.Ye4oKoEa3Ro9llC/.og/at2.uheWG/igi", // password: password123
 		FullName:       "Test User",
 		IsAdmin:        false,
+		Role:           models.RoleStudent,
+		EmailVerified:  true,
 		CreatedAt:      time.Now().Add(-7 * 24 * time.Hour),
 		LastLogin:      timePtr(time.Now().Add(-1 * time.Hour)),
 		EnrolledCourses: []string{"1", "2"},
@@ -28,6 +31,8 @@ var Users = []models.User{
 		Password:       "$2a$10$92IXUNpkjO0rOQ5byMi.Ye4oKoEa3Ro9llC/.og/at2.uheWG/igi", // password: password123
 		FullName:       "Admin User",
 		IsAdmin:        true,
+		Role:           models.RoleAdmin,
+		EmailVerified:  true,
 		CreatedAt:      time.Now().Add(-30 * 24 * time.Hour),
 		LastLogin:      timePtr(time.Now().Add(-10 * time.Minute)),
 		EnrolledCourses: []string{"1", "2", "3"},
@@ -51,7 +56,7 @@ var Courses = []models.Course{
 		ID:              "1",
 		Title:          "Introduction to Personal Finance",
 		Description:    "Learn the basics of managing your personal finances. This course covers essential topics like budgeting, saving, and investing to help you take control of your financial future.",
-		Price:          49.99,
+		Price:          money.New(499000, money.IDR),
 		Category:       "Finance",
 		Level:          "Beginner",
 		MentorName:     "John Doe",
@@ -61,12 +66,15 @@ var Courses = []models.Course{
 		Topics:         []string{"Budgeting", "Saving", "Investing", "Debt Management"},
 		CreatedAt:      time.Now().Add(-30 * 24 * time.Hour), // 30 days ago
 		EnrolledCount:  150,
+		Rating:         4.7,
+		RatingCount:    64,
+		Status:         models.CoursePublished,
 	},
 	{
 		ID:             "2",
 		Title:          "Stock Market Fundamentals",
 		Description:    "Understand how the stock market works and how to start investing. Learn about different investment vehicles and strategies to grow your wealth.",
-		Price:          79.99,
+		Price:          money.New(799000, money.IDR),
 		Category:       "Investing",
 		Level:          "Intermediate",
 		MentorName:     "Jane Smith",
@@ -76,12 +84,15 @@ var Courses = []models.Course{
 		Topics:         []string{"Stocks", "Bonds", "ETFs", "Market Analysis"},
 		CreatedAt:      time.Now().Add(-15 * 24 * time.Hour), // 15 days ago
 		EnrolledCount:  89,
+		Rating:         4.5,
+		RatingCount:    31,
+		Status:         models.CoursePublished,
 	},
 	{
 		ID:             "3",
 		Title:          "Advanced Investment Strategies",
 		Description:    "Take your investing skills to the next level with advanced strategies used by professional investors.",
-		Price:          129.99,
+		Price:          money.New(1299000, money.IDR),
 		Category:       "Investing",
 		Level:          "Advanced",
 		MentorName:     "Michael Johnson",
@@ -91,6 +102,9 @@ var Courses = []models.Course{
 		Topics:         []string{"Options Trading", "Futures", "Hedging", "Portfolio Management"},
 		CreatedAt:      time.Now().Add(-7 * 24 * time.Hour), // 7 days ago
 		EnrolledCount:  42,
+		Rating:         4.8,
+		RatingCount:    12,
+		Status:         models.CoursePublished,
 	},
 }
 
@@ -100,9 +114,9 @@ var Payments = []models.Payment{
 		ID:            "1",
 		UserID:        "1",
 		CourseID:      "1",
-		Amount:        49.99,
+		Amount:        money.New(499000, money.IDR),
 		PaymentMethod: "credit_card",
-		Status:        "completed",
+		Status:        models.PaymentPaid,
 		CreatedAt:     time.Now(),
 	},
 }
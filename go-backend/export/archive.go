@@ -0,0 +1,197 @@
+// Package export builds copies of the personal data held about a user, for
+// access requests under data protection laws such as the GDPR and
+// Indonesia's UU PDP, and runs the background worker that produces them.
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cuanin/emergent-backend/repository"
+)
+
+// auditLimit caps the audit events included in an archive.
+const auditLimit = 10000
+
+const readme = `This archive contains the personal data Emergent holds about your account.
+Each table is provided as JSON and as CSV.
+
+account.json        Your profile and account settings
+enrollments         The courses you are enrolled in and your progress
+badges              The badges you have earned
+payments            Your purchases
+login_history       Sign-ins to your account, with IP address and browser
+linked_accounts     Social login accounts linked to yours
+audit_log           Actions recorded on your account, such as data exports
+
+Your password, two-factor authentication secret and recovery codes are
+left out: they only serve to sign you in and are useless to anyone else.
+`
+
+// enrollment is one row of enrollments.json.
+type enrollment struct {
+	CourseID    string `json:"course_id"`
+	CourseTitle string `json:"course_title"`
+	Progress    int    `json:"progress"`
+}
+
+// Build collects everything stored about the user and returns it as a ZIP
+// archive.
+func Build(ctx context.Context, store repository.Store, userID string) ([]byte, error) {
+	user, err := store.Users.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	enrollments := make([]enrollment, 0, len(user.EnrolledCourses))
+	for _, courseID := range user.EnrolledCourses {
+		e := enrollment{CourseID: courseID, Progress: user.Progress[courseID]}
+		course, err := store.Courses.GetByID(ctx, courseID)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			return nil, err
+		}
+		e.CourseTitle = course.Title
+		enrollments = append(enrollments, e)
+	}
+	payments, err := store.Payments.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	logins, err := store.Activity.ListLogins(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := store.Users.ListIdentities(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := store.Activity.ListAudit(ctx, userID, auditLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	a := newArchive()
+	a.text("README.txt", readme)
+	a.json("account.json", user)
+
+	a.json("enrollments.json", enrollments)
+	rows := [][]string{{"course_id", "course_title", "progress"}}
+	for _, e := range enrollments {
+		rows = append(rows, []string{e.CourseID, e.CourseTitle, strconv.Itoa(e.Progress)})
+	}
+	a.csv("enrollments.csv", rows)
+
+	a.json("badges.json", user.Badges)
+	rows = [][]string{{"badge"}}
+	for _, b := range user.Badges {
+		rows = append(rows, []string{b})
+	}
+	a.csv("badges.csv", rows)
+
+	a.json("payments.json", payments)
+	rows = [][]string{{"id", "course_id", "amount", "currency", "payment_method", "status", "created_at"}}
+	for _, p := range payments {
+		rows = append(rows, []string{p.ID, p.CourseID, p.Amount.Decimal(), p.Amount.Currency, p.PaymentMethod, p.Status, timestamp(p.CreatedAt)})
+	}
+	a.csv("payments.csv", rows)
+
+	a.json("login_history.json", logins)
+	rows = [][]string{{"created_at", "method", "success", "ip", "user_agent"}}
+	for _, l := range logins {
+		rows = append(rows, []string{timestamp(l.CreatedAt), l.Method, strconv.FormatBool(l.Success), l.IP, l.UserAgent})
+	}
+	a.csv("login_history.csv", rows)
+
+	a.json("linked_accounts.json", identities)
+	rows = [][]string{{"provider", "subject", "email", "created_at"}}
+	for _, i := range identities {
+		rows = append(rows, []string{i.Provider, i.Subject, i.Email, timestamp(i.CreatedAt)})
+	}
+	a.csv("linked_accounts.csv", rows)
+
+	a.json("audit_log.json", audit)
+	rows = [][]string{{"created_at", "action", "actor_id", "target_id", "detail", "ip"}}
+	for _, e := range audit {
+		rows = append(rows, []string{timestamp(e.CreatedAt), e.Action, e.ActorID, e.TargetID, e.Detail, e.IP})
+	}
+	a.csv("audit_log.csv", rows)
+
+	return a.close()
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// archive writes files into a ZIP and reports any error from close.
+type archive struct {
+	buf bytes.Buffer
+	zw  *zip.Writer
+	err error
+}
+
+func newArchive() *archive {
+	a := &archive{}
+	a.zw = zip.NewWriter(&a.buf)
+	return a
+}
+
+func (a *archive) write(name string, content []byte) {
+	if a.err != nil {
+		return
+	}
+	w, err := a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err == nil {
+		_, err = w.Write(content)
+	}
+	a.err = err
+}
+
+func (a *archive) text(name, content string) {
+	a.write(name, []byte(content))
+}
+
+func (a *archive) json(name string, v any) {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		a.err = errors.Join(a.err, err)
+		return
+	}
+	a.write(name, content)
+}
+
+// csv writes rows as a CSV file. Cells that spreadsheet apps would run as
+// formulas are prefixed with a quote: login history includes the User-Agent
+// of failed attempts, which anyone can choose. Numbers are left alone.
+func (a *archive) csv(name string, rows [][]string) {
+	for _, row := range rows {
+		for i, cell := range row {
+			if cell == "" || !strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+				continue
+			}
+			if _, err := strconv.ParseFloat(cell, 64); err != nil {
+				row[i] = "'" + cell
+			}
+		}
+	}
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	if err := w.WriteAll(rows); err != nil {
+		a.err = errors.Join(a.err, err)
+		return
+	}
+	a.write(name, b.Bytes())
+}
+
+func (a *archive) close() ([]byte, error) {
+	if err := errors.Join(a.err, a.zw.Close()); err != nil {
+		return nil, err
+	}
+	return a.buf.Bytes(), nil
+}
@@ -0,0 +1,161 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/cuanin/emergent-backend/mailer"
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/randtoken"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultTTL is how long a finished export can be downloaded.
+	DefaultTTL = 7 * 24 * time.Hour
+	// pollInterval is how often the worker looks for exports requested
+	// through other servers.
+	pollInterval = 30 * time.Second
+	// staleAfter is how long an export may run before another worker
+	// assumes its server stopped and takes it over.
+	staleAfter  = 15 * time.Minute
+	mailTimeout = 30 * time.Second
+)
+
+// Config holds the settings of a Worker.
+type Config struct {
+	// Mailer sends the download link when an export is ready.
+	Mailer mailer.Mailer
+	// DownloadURL is the public URL of the download endpoint. The token is
+	// added as the "token" query parameter.
+	DownloadURL string
+	// TTL is how long a finished export can be downloaded. Defaults to
+	// DefaultTTL.
+	TTL time.Duration
+}
+
+// Worker builds requested exports in the background. Several servers can
+// run a worker against the same store; each export is claimed by one.
+type Worker struct {
+	store repository.Store
+	cfg   Config
+	wake  chan struct{}
+}
+
+// NewWorker returns a Worker that reads and writes through store.
+func NewWorker(store repository.Store, cfg Config) *Worker {
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultTTL
+	}
+	return &Worker{store: store, cfg: cfg, wake: make(chan struct{}, 1)}
+}
+
+// Wake tells the worker that an export was requested, so that it does not
+// wait for the next poll.
+func (w *Worker) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run processes exports until ctx is cancelled. It also deletes the archives
+// of expired exports.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		w.runPending(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
+
+func (w *Worker) runPending(ctx context.Context) {
+	if err := w.store.Exports.ExpireExports(ctx, time.Now()); err != nil {
+		log.Printf("Failed to expire data exports: %v", err)
+	}
+	for ctx.Err() == nil {
+		now := time.Now()
+		job, err := w.store.Exports.ClaimExport(ctx, now, now.Add(-staleAfter))
+		if errors.Is(err, repository.ErrNotFound) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to claim data export: %v", err)
+			return
+		}
+		w.process(ctx, job)
+	}
+}
+
+// process builds the archive of a claimed export and emails the user a
+// download link.
+func (w *Worker) process(ctx context.Context, job models.DataExport) {
+	archive, err := Build(ctx, w.store, job.UserID)
+	if err != nil {
+		log.Printf("Failed to build data export %s: %v", job.ID, err)
+		if err := w.store.Exports.FailExport(ctx, job.ID, "Failed to collect account data", time.Now()); err != nil {
+			log.Printf("Failed to mark data export %s failed: %v", job.ID, err)
+		}
+		w.audit(ctx, models.AuditExportFailed, job)
+		return
+	}
+
+	token, err := randtoken.New()
+	if err != nil {
+		log.Printf("Failed to create download token for data export %s: %v", job.ID, err)
+		return
+	}
+	now := time.Now()
+	expiresAt := now.Add(w.cfg.TTL)
+	if err := w.store.Exports.CompleteExport(ctx, job.ID, archive, randtoken.Hash(token), now, expiresAt); err != nil {
+		log.Printf("Failed to store data export %s: %v", job.ID, err)
+		return
+	}
+	w.audit(ctx, models.AuditExportCompleted, job)
+
+	user, err := w.store.Users.GetByID(ctx, job.UserID)
+	if err != nil {
+		log.Printf("Failed to load user of data export %s: %v", job.ID, err)
+		return
+	}
+	if w.cfg.Mailer == nil {
+		return
+	}
+	mailCtx, cancel := context.WithTimeout(ctx, mailTimeout)
+	defer cancel()
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Your data export is ready",
+		Body: "Hi " + user.FullName + ",\n\n" +
+			"The copy of your personal data that you requested is ready. Download it here:\n\n" +
+			w.cfg.DownloadURL + "?token=" + url.QueryEscape(token) + "\n\n" +
+			"The link works until " + expiresAt.UTC().Format("2 January 2006 15:04 MST") + ". " +
+			"Anyone with the link can download the file, so do not share it.\n",
+	}
+	if err := w.cfg.Mailer.Send(mailCtx, msg); err != nil {
+		log.Printf("Failed to send %q to %s: %v", msg.Subject, msg.To, err)
+	}
+}
+
+func (w *Worker) audit(ctx context.Context, action string, job models.DataExport) {
+	err := w.store.Activity.RecordAudit(ctx, models.AuditEvent{
+		ID:        uuid.New().String(),
+		Action:    action,
+		UserID:    job.UserID,
+		TargetID:  job.ID,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to record %s for data export %s: %v", action, job.ID, err)
+	}
+}
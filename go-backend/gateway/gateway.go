@@ -0,0 +1,88 @@
+// Package gateway creates charges with payment providers: Midtrans for
+// Indonesian bank transfers, QRIS and e-wallets, and a simulator that
+// settles charges on request for development and tests.
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+)
+
+var (
+	// ErrUnsupportedMethod is returned for a payment method the provider
+	// does not offer.
+	ErrUnsupportedMethod = errors.New("unsupported payment method")
+	// ErrUnsupportedCurrency is returned for an amount in a currency the
+	// provider cannot charge.
+	ErrUnsupportedCurrency = errors.New("unsupported currency")
+	// ErrChargeNotFound is returned when the provider has no charge for an
+	// order.
+	ErrChargeNotFound = errors.New("charge not found")
+	// ErrInvalidSignature is returned for a notification that was not
+	// signed by the provider.
+	ErrInvalidSignature = errors.New("invalid notification signature")
+)
+
+// ChargeRequest asks a provider to collect a payment.
+type ChargeRequest struct {
+	// OrderID is our payment ID. Providers identify the charge by it when
+	// reporting on it.
+	OrderID string
+	Amount  money.Money
+	// Method is one of the provider's Methods.
+	Method        string
+	Description   string
+	CustomerName  string
+	CustomerEmail string
+	// Expiry is how long the payer has to pay. Zero leaves it to the
+	// provider.
+	Expiry time.Duration
+}
+
+// Charge is a payment the provider has started collecting.
+type Charge struct {
+	// Reference is the provider's ID for the charge.
+	Reference string
+	// Status is one of the models Payment statuses, normally pending.
+	Status    string
+	Action    *models.PaymentAction
+	ExpiresAt *time.Time
+}
+
+// Notification is a provider's report, sent to our webhook, that the status
+// of a charge has changed.
+type Notification struct {
+	// OrderID is the ID of the payment the charge was made for.
+	OrderID   string
+	Reference string
+	// Status is one of the models Payment statuses.
+	Status string
+	// Amount is the amount charged, to be checked against the payment.
+	Amount money.Money
+}
+
+// Provider is a payment gateway.
+type Provider interface {
+	// Name identifies the provider, e.g. "midtrans".
+	Name() string
+	// Methods lists the payment methods the provider accepts.
+	Methods() []string
+	// CreateCharge starts collecting a payment. The payer completes it by
+	// following the returned action.
+	CreateCharge(ctx context.Context, req ChargeRequest) (Charge, error)
+	// Status returns the current status of the charge for an order, as one
+	// of the models Payment statuses.
+	Status(ctx context.Context, orderID string) (string, error)
+	// ParseNotification checks the signature of a webhook request and
+	// returns the notification it carries. It returns ErrInvalidSignature
+	// if the request did not come from the provider.
+	ParseNotification(ctx context.Context, header http.Header, body []byte) (Notification, error)
+}
+
+// methods are the payment methods offered by both providers.
+var methods = []string{"bca_va", "bni_va", "bri_va", "permata_va", "qris", "gopay"}
@@ -0,0 +1,258 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+)
+
+// Midtrans API base URLs.
+const (
+	MidtransSandbox    = "https://api.sandbox.midtrans.com"
+	MidtransProduction = "https://api.midtrans.com"
+)
+
+// Midtrans times are in Western Indonesia Time, without a zone.
+var midtransZone = time.FixedZone("WIB", 7*60*60)
+
+// Midtrans charges through the Midtrans Core API, which returns virtual
+// account numbers, QRIS codes and GoPay links for us to show the payer.
+type Midtrans struct {
+	// ServerKey authenticates our requests.
+	ServerKey string
+	// BaseURL defaults to MidtransSandbox.
+	BaseURL string
+	// Client defaults to an http.Client with a 30 second timeout.
+	Client *http.Client
+}
+
+// midtransResponse holds the fields we use of the charge and status
+// responses.
+type midtransResponse struct {
+	StatusCode        string `json:"status_code"`
+	StatusMessage     string `json:"status_message"`
+	TransactionID     string `json:"transaction_id"`
+	TransactionStatus string `json:"transaction_status"`
+	FraudStatus       string `json:"fraud_status"`
+	ExpiryTime        string `json:"expiry_time"`
+	VANumbers         []struct {
+		Bank     string `json:"bank"`
+		VANumber string `json:"va_number"`
+	} `json:"va_numbers"`
+	PermataVANumber string `json:"permata_va_number"`
+	QRString        string `json:"qr_string"`
+	Actions         []struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	} `json:"actions"`
+}
+
+// Name implements Provider.
+func (m *Midtrans) Name() string { return "midtrans" }
+
+// Methods implements Provider.
+func (m *Midtrans) Methods() []string { return methods }
+
+// CreateCharge implements Provider. Midtrans only charges rupiah.
+func (m *Midtrans) CreateCharge(ctx context.Context, req ChargeRequest) (Charge, error) {
+	if req.Amount.Currency != money.IDR {
+		return Charge{}, fmt.Errorf("midtrans: %w %s", ErrUnsupportedCurrency, req.Amount.Currency)
+	}
+	if req.Amount.Amount <= 0 {
+		return Charge{}, fmt.Errorf("midtrans: cannot charge %s", req.Amount)
+	}
+	body := map[string]any{
+		"transaction_details": map[string]any{"order_id": req.OrderID, "gross_amount": req.Amount.Amount},
+		"item_details": []map[string]any{{
+			"id": req.OrderID, "name": truncate(req.Description, 50), "price": req.Amount.Amount, "quantity": 1,
+		}},
+		"customer_details": map[string]any{"first_name": req.CustomerName, "email": req.CustomerEmail},
+	}
+	if req.Expiry > 0 {
+		body["custom_expiry"] = map[string]any{"expiry_duration": int(math.Ceil(req.Expiry.Minutes())), "unit": "minute"}
+	}
+	switch bank, _ := strings.CutSuffix(req.Method, "_va"); req.Method {
+	case "bca_va", "bni_va", "bri_va", "permata_va":
+		body["payment_type"] = "bank_transfer"
+		body["bank_transfer"] = map[string]any{"bank": bank}
+	case "qris":
+		body["payment_type"] = "qris"
+	case "gopay":
+		body["payment_type"] = "gopay"
+	default:
+		return Charge{}, ErrUnsupportedMethod
+	}
+
+	var resp midtransResponse
+	if err := m.do(ctx, http.MethodPost, "/v2/charge", body, &resp); err != nil {
+		return Charge{}, err
+	}
+	if resp.StatusCode != "200" && resp.StatusCode != "201" {
+		return Charge{}, fmt.Errorf("midtrans: %s %s", resp.StatusCode, resp.StatusMessage)
+	}
+	status, err := midtransStatus(resp.TransactionStatus, resp.FraudStatus)
+	if err != nil {
+		return Charge{}, err
+	}
+
+	charge := Charge{Reference: resp.TransactionID, Status: status}
+	switch {
+	case len(resp.VANumbers) > 0:
+		charge.Action = &models.PaymentAction{Type: models.ActionVirtualAccount, Bank: resp.VANumbers[0].Bank, VANumber: resp.VANumbers[0].VANumber}
+	case resp.PermataVANumber != "":
+		charge.Action = &models.PaymentAction{Type: models.ActionVirtualAccount, Bank: "permata", VANumber: resp.PermataVANumber}
+	case req.Method == "qris":
+		charge.Action = &models.PaymentAction{Type: models.ActionQRCode, QRString: resp.QRString, URL: resp.action("generate-qr-code")}
+	case req.Method == "gopay":
+		charge.Action = &models.PaymentAction{Type: models.ActionRedirect, URL: resp.action("deeplink-redirect")}
+	}
+	if resp.ExpiryTime != "" {
+		if t, err := time.ParseInLocation(time.DateTime, resp.ExpiryTime, midtransZone); err == nil {
+			charge.ExpiresAt = &t
+		}
+	}
+	return charge, nil
+}
+
+// Status implements Provider.
+func (m *Midtrans) Status(ctx context.Context, orderID string) (string, error) {
+	var resp midtransResponse
+	if err := m.do(ctx, http.MethodGet, "/v2/"+url.PathEscape(orderID)+"/status", nil, &resp); err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case "200", "201", "202", "407":
+		// 407 reports an expired transaction, 202 a denied one
+	case "404":
+		return "", ErrChargeNotFound
+	default:
+		return "", fmt.Errorf("midtrans: %s %s", resp.StatusCode, resp.StatusMessage)
+	}
+	return midtransStatus(resp.TransactionStatus, resp.FraudStatus)
+}
+
+// ParseNotification implements Provider. Midtrans signs a notification
+// with the SHA-512 hash of its order ID, status code and gross amount
+// followed by our server key. The signature does not cover the transaction
+// status, so that is fetched from the API instead of taken from the body.
+func (m *Midtrans) ParseNotification(ctx context.Context, _ http.Header, body []byte) (Notification, error) {
+	var n struct {
+		OrderID       string `json:"order_id"`
+		StatusCode    string `json:"status_code"`
+		GrossAmount   string `json:"gross_amount"`
+		SignatureKey  string `json:"signature_key"`
+		TransactionID string `json:"transaction_id"`
+	}
+	if err := json.Unmarshal(body, &n); err != nil {
+		return Notification{}, fmt.Errorf("midtrans: %w", err)
+	}
+	sum := sha512.Sum512([]byte(n.OrderID + n.StatusCode + n.GrossAmount + m.ServerKey))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(n.SignatureKey))) != 1 {
+		return Notification{}, ErrInvalidSignature
+	}
+	// gross_amount is written with two decimals, e.g. "499000.00"
+	amount, err := money.Parse(n.GrossAmount, money.IDR)
+	if err != nil {
+		return Notification{}, fmt.Errorf("midtrans: gross_amount: %w", err)
+	}
+	status, err := m.Status(ctx, n.OrderID)
+	if err != nil {
+		return Notification{}, err
+	}
+	return Notification{OrderID: n.OrderID, Reference: n.TransactionID, Status: status, Amount: amount}, nil
+}
+
+// midtransStatus maps a Midtrans transaction status to a payment status. A
+// card capture held for fraud review stays pending.
+func midtransStatus(transaction, fraud string) (string, error) {
+	switch transaction {
+	case "settlement":
+		return models.PaymentPaid, nil
+	case "capture":
+		if fraud == "challenge" {
+			return models.PaymentPending, nil
+		}
+		return models.PaymentPaid, nil
+	case "pending", "authorize":
+		return models.PaymentPending, nil
+	case "deny", "cancel", "failure":
+		return models.PaymentFailed, nil
+	case "expire":
+		return models.PaymentExpired, nil
+	case "refund", "chargeback":
+		return models.PaymentRefunded, nil
+	case "partial_refund", "partial_chargeback":
+		// Part of the money was returned; the course stays paid for
+		return models.PaymentPaid, nil
+	}
+	return "", fmt.Errorf("midtrans: unknown transaction status %q", transaction)
+}
+
+// action returns the URL of the named action in the response, or "".
+func (r *midtransResponse) action(name string) string {
+	for _, a := range r.Actions {
+		if a.Name == name {
+			return a.URL
+		}
+	}
+	return ""
+}
+
+// do sends a request to the API and decodes its JSON response into out.
+// Midtrans reports most errors in the status_code of the body, so only
+// responses that are not JSON are treated as errors here.
+func (m *Midtrans) do(ctx context.Context, method, path string, body, out any) error {
+	base := m.BaseURL
+	if base == "" {
+		base = MidtransSandbox
+	}
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(base, "/")+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(m.ServerKey, "")
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := m.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("midtrans: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("midtrans: %s: %w", resp.Status, err)
+	}
+	return nil
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+)
+
+// SimulatorSignatureHeader carries the signature of a simulator
+// notification: the hex HMAC-SHA256 of the body keyed by WebhookSecret.
+const SimulatorSignatureHeader = "X-Simulator-Signature"
+
+// Simulator is a Provider that keeps charges in memory and settles them only
+// when told to, for development and tests. Its virtual account numbers and
+// QR codes look real but no bank will accept them.
+type Simulator struct {
+	// WebhookSecret signs notifications sent to our webhook. Without it,
+	// every notification is refused.
+	WebhookSecret string
+
+	mu      sync.Mutex
+	charges map[string]*simulatedCharge // by order ID
+}
+
+// SimulatorNotification is the body of a simulator notification.
+type SimulatorNotification struct {
+	OrderID string      `json:"order_id"`
+	Status  string      `json:"status"`
+	Amount  money.Money `json:"amount"`
+}
+
+type simulatedCharge struct {
+	status    string
+	expiresAt time.Time
+}
+
+// NewSimulator returns a Simulator with no charges.
+func NewSimulator() *Simulator {
+	return &Simulator{charges: make(map[string]*simulatedCharge)}
+}
+
+// Name implements Provider.
+func (s *Simulator) Name() string { return "simulator" }
+
+// Methods implements Provider.
+func (s *Simulator) Methods() []string { return methods }
+
+// CreateCharge implements Provider.
+func (s *Simulator) CreateCharge(_ context.Context, req ChargeRequest) (Charge, error) {
+	if !slices.Contains(methods, req.Method) {
+		return Charge{}, ErrUnsupportedMethod
+	}
+	charge := Charge{Reference: "sim-" + req.OrderID, Status: models.PaymentPending}
+	switch {
+	case strings.HasSuffix(req.Method, "_va"):
+		charge.Action = &models.PaymentAction{
+			Type:     models.ActionVirtualAccount,
+			Bank:     strings.TrimSuffix(req.Method, "_va"),
+			VANumber: randomDigits(12),
+		}
+	case req.Method == "qris":
+		charge.Action = &models.PaymentAction{Type: models.ActionQRCode, QRString: "SIMULATOR." + req.OrderID}
+	default:
+		charge.Action = &models.PaymentAction{Type: models.ActionRedirect, URL: "simulator://pay/" + req.OrderID}
+	}
+
+	sc := &simulatedCharge{status: models.PaymentPending}
+	if req.Expiry > 0 {
+		sc.expiresAt = time.Now().Add(req.Expiry)
+		charge.ExpiresAt = &sc.expiresAt
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.charges[req.OrderID]; ok {
+		return Charge{}, fmt.Errorf("simulator: order %s was already charged", req.OrderID)
+	}
+	s.charges[req.OrderID] = sc
+	return charge, nil
+}
+
+// Status implements Provider. A pending charge expires once its expiry
+// has passed.
+func (s *Simulator) Status(_ context.Context, orderID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.charges[orderID]
+	if !ok {
+		return "", ErrChargeNotFound
+	}
+	return sc.current(), nil
+}
+
+// Settle sets the status of the charge for an order, as if the payer had
+// paid, the payment had failed or expired, or the money was refunded.
+func (s *Simulator) Settle(_ context.Context, orderID, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.charges[orderID]
+	if !ok {
+		return ErrChargeNotFound
+	}
+	sc.status = status
+	return nil
+}
+
+// ParseNotification implements Provider.
+func (s *Simulator) ParseNotification(_ context.Context, header http.Header, body []byte) (Notification, error) {
+	got, err := hex.DecodeString(header.Get(SimulatorSignatureHeader))
+	if s.WebhookSecret == "" || err != nil || !hmac.Equal(got, s.sign(body)) {
+		return Notification{}, ErrInvalidSignature
+	}
+	var n SimulatorNotification
+	if err := json.Unmarshal(body, &n); err != nil {
+		return Notification{}, fmt.Errorf("simulator: %w", err)
+	}
+	return Notification{OrderID: n.OrderID, Reference: "sim-" + n.OrderID, Status: n.Status, Amount: n.Amount}, nil
+}
+
+// sign returns the HMAC-SHA256 of a notification body.
+func (s *Simulator) sign(body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(s.WebhookSecret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// current returns the status of the charge, expiring it if it is overdue.
+// The caller must hold s.mu.
+func (sc *simulatedCharge) current() string {
+	if sc.status == models.PaymentPending && !sc.expiresAt.IsZero() && time.Now().After(sc.expiresAt) {
+		sc.status = models.PaymentExpired
+	}
+	return sc.status
+}
+
+// randomDigits returns n random decimal digits.
+func randomDigits(n int) string {
+	var b strings.Builder
+	for range n {
+		d, _ := rand.Int(rand.Reader, big.NewInt(10))
+		b.WriteString(d.String())
+	}
+	return b.String()
+}
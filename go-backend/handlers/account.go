@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cuanin/emergent-backend/mailer"
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/randtoken"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	verifyEmailTokenTTL   = 24 * time.Hour
+	resetPasswordTokenTTL = time.Hour
+	mailTimeout           = 30 * time.Second
+)
+
+// sendMail delivers msg in the background so that slow mail servers do not
+// hold up the request, and so that response times do not reveal whether an
+// account exists.
+func (h *Handler) sendMail(msg mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+		if err := h.mailer.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send %q to %s: %v", msg.Subject, msg.To, err)
+		}
+	}()
+}
+
+// createActionToken stores a new single-use token for user and returns the
+// raw token value to be sent by email.
+func (h *Handler) createActionToken(ctx context.Context, user models.User, purpose string, ttl time.Duration) (string, error) {
+	raw, err := randtoken.New()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = h.tokens.CreateActionToken(ctx, models.ActionToken{
+		ID:        randtoken.Hash(raw),
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	return raw, err
+}
+
+// consumeActionToken redeems a token sent by email, returning false after
+// writing the error response if it is unknown, used or expired.
+func (h *Handler) consumeActionToken(c *gin.Context, raw, purpose string) (models.ActionToken, bool) {
+	now := time.Now()
+	token, err := h.tokens.ConsumeActionToken(c.Request.Context(), randtoken.Hash(raw), purpose, now)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) || errors.Is(err, repository.ErrTokenUsed) {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid or already used token"})
+			return models.ActionToken{}, false
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to verify token"})
+		return models.ActionToken{}, false
+	}
+	if now.After(token.ExpiresAt) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Token has expired"})
+		return models.ActionToken{}, false
+	}
+	return token, true
+}
+
+// sendVerificationEmail emails user a link that confirms their address.
+func (h *Handler) sendVerificationEmail(ctx context.Context, user models.User) error {
+	token, err := h.createActionToken(ctx, user, models.TokenVerifyEmail, verifyEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+	h.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: "Hi " + user.FullName + ",\n\n" +
+			"Please confirm your email address by opening the link below:\n\n" +
+			h.appURL + "/verify-email?token=" + url.QueryEscape(token) + "\n\n" +
+			"The link expires in 24 hours.\n",
+	})
+	return nil
+}
+
+// ForgotPassword emails a password reset link. It responds the same way
+// whether or not the email is registered.
+func (h *Handler) ForgotPassword(c *gin.Context) {
+	var req models.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request data"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.users.GetByEmail(ctx, req.Email)
+	switch {
+	case err == nil && user.DeletedAt != nil:
+		// Deleted accounts cannot be recovered
+	case err == nil:
+		token, err := h.createActionToken(ctx, user, models.TokenResetPassword, resetPasswordTokenTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create reset token"})
+			return
+		}
+		h.sendMail(mailer.Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: "Hi " + user.FullName + ",\n\n" +
+				"Someone asked to reset the password for your account. If it was you, open the link below:\n\n" +
+				h.appURL + "/reset-password?token=" + url.QueryEscape(token) + "\n\n" +
+				"The link expires in 1 hour. If you did not ask for this, you can ignore this email.\n",
+		})
+	case !errors.Is(err, repository.ErrNotFound):
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to look up user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the email is registered, a password reset link has been sent"})
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword and
+// signs the user out of every session.
+func (h *Handler) ResetPassword(c *gin.Context) {
+	var req models.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+
+	token, ok := h.consumeActionToken(c, req.Token, models.TokenResetPassword)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, token.UserID)
+	if err != nil || user.DeletedAt != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid or already used token"})
+		return
+	}
+
+	hashedPassword, err := hashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to process password"})
+		return
+	}
+	user.Password = hashedPassword
+	// The reset link proves the user controls the address it was sent to
+	if token.Email == user.Email {
+		user.EmailVerified = true
+	}
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update password"})
+		return
+	}
+	if err := h.endSessions(ctx, user.ID, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset"})
+}
+
+// VerifyEmail confirms the user's email address using a token sent at
+// registration.
+func (h *Handler) VerifyEmail(c *gin.Context) {
+	raw := c.Query("token")
+	if raw == "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Token is required"})
+		return
+	}
+
+	token, ok := h.consumeActionToken(c, raw, models.TokenVerifyEmail)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, token.UserID)
+	if err != nil || user.Email != token.Email {
+		// The account is gone or its email changed after the link was sent
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid or already used token"})
+		return
+	}
+
+	user.EmailVerified = true
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// recordLogin adds a sign-in attempt to the user's login history. Failures
+// are logged rather than returned so that they do not block logins.
+func (h *Handler) recordLogin(c *gin.Context, userID, method string, success bool) {
+	err := h.activity.RecordLogin(c.Request.Context(), models.LoginEvent{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Method:    method,
+		Success:   success,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to record login for user %s: %v", userID, err)
+	}
+}
+
+// recordAudit adds event to the audit log as an action taken by the current
+// user, if any. Only Action, UserID, TargetID and Detail need to be set.
+func (h *Handler) recordAudit(c *gin.Context, event models.AuditEvent) error {
+	event.ID = uuid.New().String()
+	event.ActorID = c.GetString("user_id")
+	event.IP = c.ClientIP()
+	event.CreatedAt = time.Now()
+	return h.activity.RecordAudit(c.Request.Context(), event)
+}
+
+// GetAuditLog lists audit events, newest first, optionally for one user
+// given by the user_id query parameter. limit defaults to 100.
+func (h *Handler) GetAuditLog(c *gin.Context) {
+	limit := defaultAuditLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "limit must be between 1 and " + strconv.Itoa(maxAuditLimit)})
+			return
+		}
+		limit = n
+	}
+
+	events, err := h.activity.ListAudit(c.Request.Context(), c.Query("user_id"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
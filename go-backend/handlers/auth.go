@@ -1,39 +1,25 @@
 package handlers
 
 import (
-	"fmt"
-	"os"
+	"errors"
+	"log"
+	"math"
+	"strconv"
 	"time"
 
-	"github.com/cuanin/emergent-backend/data"
 	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/rbac"
+	"github.com/cuanin/emergent-backend/repository"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// Users returns a copy of the users slice to avoid direct modification
-func getUsers() []models.User {
-	return append([]models.User(nil), data.Users...)
-}
-
-// Dummy courses data
-var courses = []models.Course{
-	{
-		ID:          "1",
-		Title:       "Introduction to Personal Finance",
-		Description: "Learn the basics of managing your personal finances.",
-		Price:       49.99,
-		Category:    "Finance",
-		Level:       "Beginner",
-		MentorName:  "John Doe",
-		Duration:    "2 hours",
-		Topics:      []string{"Budgeting", "Saving", "Investing"},
-		CreatedAt:   time.Now(),
-	},
-	// Add more dummy courses as needed
-}
+// dummyPasswordHash is checked in place of a password hash when there is
+// none, for an unknown email or an account without a password, so that
+// refusing such logins takes as long as refusing a wrong password.
+const dummyPasswordHash = "$2a$10$rmtM27BAJnx8.aXmeYg24uokB6g655zVguJzasYR4lGLQMxoz39Re"
 
 func hashPassword(password string) (string, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -43,26 +29,24 @@ func hashPassword(password string) (string, error) {
 	return string(hashedPassword), nil
 }
 
-func generateJWT(user models.User) (string, error) {
-	// Create token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+func (h *Handler) generateJWT(user models.User) (string, error) {
+	now := time.Now()
+
+	// Sign token with claims; jti identifies the token for revocation
+	return h.keys.Sign(jwt.MapClaims{
+		"jti":      uuid.New().String(),
+		"typ":      "access",
 		"user_id":  user.ID,
 		"email":    user.Email,
 		"is_admin": user.IsAdmin,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(), // 24 hours
+		"role":     user.EffectiveRole(),
+		"iat":      now.Unix(),
+		"exp":      now.Add(h.accessTokenTTL).Unix(),
 	})
-
-	// Generate encoded token
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
-	if err != nil {
-		return "", err
-	}
-
-	return tokenString, nil
 }
 
 // Register handles user registration
-func Register(c *gin.Context) {
+func (h *Handler) Register(c *gin.Context) {
 	var req models.RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(400, models.ErrorResponse{Error: "Invalid request data"})
@@ -75,14 +59,6 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	// Check if user already exists
-	for _, user := range data.Users {
-		if user.Email == req.Email {
-			c.JSON(409, models.ErrorResponse{Error: "Email already registered"})
-			return
-		}
-	}
-
 	// Hash password
 	hashedPassword, err := hashPassword(req.Password)
 	if err != nil {
@@ -93,21 +69,35 @@ func Register(c *gin.Context) {
 	// Create new user with UUID
 	newUser := models.User{
 		ID:              uuid.New().String(),
-		Email:          req.Email,
-		Password:       hashedPassword,
-		FullName:       req.FullName,
-		IsAdmin:        false,
-		CreatedAt:      time.Now(),
+		Email:           req.Email,
+		Password:        hashedPassword,
+		FullName:        req.FullName,
+		IsAdmin:         false,
+		Role:            models.RoleStudent,
+		EmailVerified:   false, // until the emailed link is opened
+		CreatedAt:       time.Now(),
 		EnrolledCourses: []string{},
-		Badges:         []string{"New User"}, // Add default badge
-		Progress:       make(map[string]int),
+		Badges:          []string{"New User"}, // Add default badge
+		Progress:        make(map[string]int),
 	}
 
-	// Add to users slice
-	data.Users = append(data.Users, newUser)
+	// Save user; the repository rejects duplicate emails
+	if err := h.users.Create(c.Request.Context(), newUser); err != nil {
+		if errors.Is(err, repository.ErrDuplicateEmail) {
+			c.JSON(409, models.ErrorResponse{Error: "Email already registered"})
+			return
+		}
+		c.JSON(500, models.ErrorResponse{Error: "Failed to create user"})
+		return
+	}
 
-	// Generate JWT token
-	token, err := generateJWT(newUser)
+	// Send the verification link; the account works without it
+	if err := h.sendVerificationEmail(c.Request.Context(), newUser); err != nil {
+		log.Printf("Failed to send verification email to %s: %v", newUser.Email, err)
+	}
+
+	// Generate access and refresh tokens
+	tokens, err := h.issueTokens(c.Request.Context(), newUser, "")
 	if err != nil {
 		c.JSON(500, models.ErrorResponse{Error: "Failed to generate authentication token"})
 		return
@@ -116,13 +106,15 @@ func Register(c *gin.Context) {
 	// Return user data without password
 	newUser.Password = ""
 	c.JSON(201, gin.H{
-		"token": token,
-		"user":  newUser,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"user":          newUser,
 	})
 }
 
 // Login handles user login
-func Login(c *gin.Context) {
+func (h *Handler) Login(c *gin.Context) {
 	var req models.LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(400, models.ErrorResponse{Error: "Invalid request data"})
@@ -135,55 +127,144 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	// Reject attempts while the client IP or the account is locked out
+	ctx := c.Request.Context()
+	ip := c.ClientIP()
+	wait, err := h.loginGuard.Check(ctx, ip, req.Email)
+	if err != nil {
+		c.JSON(500, models.ErrorResponse{Error: "Failed to check login attempts"})
+		return
+	}
+	if wait > 0 {
+		tooManyAttempts(c, wait)
+		return
+	}
+
 	// Find user by email
-	var foundUser *models.User
-	fmt.Printf("Debug: Searching for user with email: %s\n", req.Email)
-	fmt.Printf("Debug: Available users: %+v\n", data.Users)
-	
-	for i, user := range data.Users {
-		fmt.Printf("Debug: Checking user %d - Email: %s\n", i, user.Email)
-		if user.Email == req.Email {
-			foundUser = &data.Users[i] // Get pointer to the actual user in the slice
-			fmt.Printf("Debug: Found user: %+v\n", *foundUser)
-			break
-		}
+	user, err := h.users.GetByEmail(ctx, req.Email)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		c.JSON(500, models.ErrorResponse{Error: "Failed to look up user"})
+		return
+	}
+	// Deleted accounts cannot sign in, whatever their password
+	if err == nil && user.DeletedAt != nil {
+		err = repository.ErrNotFound
 	}
 
-	// Check if user exists and password is correct
-	if foundUser == nil {
-		// Don't reveal if user exists or not for security
-		fmt.Println("Debug: User not found")
+	// Verify password. Unknown emails are checked against a dummy hash and
+	// count as failures too, so that neither the response nor its timing
+	// reveals which exist.
+	hash := user.Password
+	if err != nil || hash == "" {
+		hash = dummyPasswordHash
+	}
+	matched := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) == nil && hash != dummyPasswordHash
+	if !matched {
+		if err == nil {
+			h.recordLogin(c, user.ID, models.LoginPassword, false)
+		}
+		wait, err := h.loginGuard.Fail(ctx, ip, req.Email)
+		if err != nil {
+			c.JSON(500, models.ErrorResponse{Error: "Failed to record login attempt"})
+			return
+		}
+		if wait > 0 {
+			tooManyAttempts(c, wait)
+			return
+		}
 		c.JSON(401, models.ErrorResponse{Error: "Invalid email or password"})
 		return
 	}
 
-	// Verify password
-	fmt.Printf("Debug: Verifying password for user: %s\n", foundUser.Email)
-	fmt.Printf("Debug: Stored hash: %s\n", foundUser.Password)
-	
-	if err := bcrypt.CompareHashAndPassword([]byte(foundUser.Password), []byte(req.Password)); err != nil {
-		fmt.Printf("Debug: Password verification failed: %v\n", err)
-		c.JSON(401, models.ErrorResponse{Error: "Invalid email or password"})
+	// Suspended accounts are told so only once the password is right
+	if user.SuspendedAt != nil {
+		h.recordLogin(c, user.ID, models.LoginPassword, false)
+		accountSuspended(c)
+		return
+	}
+
+	// Accounts with two-factor authentication get a challenge instead of
+	// tokens. The failure counter is only reset once the second factor
+	// passes, so password logins cannot be used to keep guessing codes.
+	if user.TOTPEnabled {
+		mfaToken, err := h.generateMFAToken(user)
+		if err != nil {
+			c.JSON(500, models.ErrorResponse{Error: "Failed to generate authentication token"})
+			return
+		}
+		c.JSON(200, gin.H{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expires_in":   int(mfaTokenTTL.Seconds()),
+		})
 		return
 	}
 
-	// Generate JWT token
-	token, err := generateJWT(*foundUser)
+	if err := h.loginGuard.Succeed(ctx, req.Email); err != nil {
+		c.JSON(500, models.ErrorResponse{Error: "Failed to record login attempt"})
+		return
+	}
+	h.completeLogin(c, user, models.LoginPassword)
+}
+
+// completeLogin issues tokens to an authenticated user and responds with
+// them and the user's data. method is recorded in the login history.
+func (h *Handler) completeLogin(c *gin.Context, user models.User, method string) {
+	ctx := c.Request.Context()
+
+	// The account may have been suspended after a two-factor challenge
+	if user.SuspendedAt != nil {
+		h.recordLogin(c, user.ID, method, false)
+		accountSuspended(c)
+		return
+	}
+
+	// Tell members of roles that require two-factor authentication to set it up
+	mfaSetupRequired := false
+	if !user.TOTPEnabled {
+		required, err := rbac.MFARequiredRoles(ctx, h.settings)
+		if err != nil {
+			c.JSON(500, models.ErrorResponse{Error: "Failed to load settings"})
+			return
+		}
+		mfaSetupRequired = rbac.RequiresMFA(required, user.EffectiveRole())
+	}
+
+	// Generate access and refresh tokens
+	tokens, err := h.issueTokens(ctx, user, "")
 	if err != nil {
 		c.JSON(500, models.ErrorResponse{Error: "Failed to generate authentication token"})
 		return
 	}
 
-	// Update last login time (in a real app, you'd save this to the database)
+	// Update last login time
 	now := time.Now()
-	foundUser.LastLogin = &now
+	if err := h.users.UpdateLastLogin(ctx, user.ID, now); err != nil {
+		c.JSON(500, models.ErrorResponse{Error: "Failed to update user"})
+		return
+	}
+	user.LastLogin = &now
+	h.recordLogin(c, user.ID, method, true)
 
 	// Return user data without password
-	responseUser := *foundUser
-	responseUser.Password = ""
-	
+	user.Password = ""
+
 	c.JSON(200, gin.H{
-		"token": token,
-		"user":  responseUser,
+		"token":              tokens.AccessToken,
+		"refresh_token":      tokens.RefreshToken,
+		"expires_in":         tokens.ExpiresIn,
+		"mfa_setup_required": mfaSetupRequired,
+		"user":               user,
 	})
 }
+
+// accountSuspended responds 403 to a suspended user.
+func accountSuspended(c *gin.Context) {
+	c.JSON(403, models.ErrorResponse{Error: "Account suspended"})
+}
+
+// tooManyAttempts responds 429 with a Retry-After header in whole seconds.
+func tooManyAttempts(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.JSON(429, models.ErrorResponse{Error: "Too many failed login attempts, please try again later"})
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/throttle"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginLockedOutAfterFailures(t *testing.T) {
+	const maxFailures = 3
+	a := newAPITest(t, Config{LoginPolicy: throttle.Policy{
+		PerIP:        throttle.Limit{MaxFailures: 100, Window: time.Minute},
+		PerAccount:   throttle.Limit{MaxFailures: maxFailures, Window: time.Minute},
+		BaseLockout:  time.Minute,
+		MaxLockout:   time.Hour,
+		LockoutDecay: time.Hour,
+	}})
+	a.router.POST("/api/auth/login", a.h.Login)
+	user := a.newUser(t, models.RoleStudent)
+	wrong := models.LoginRequest{Email: user.Email, Password: "wrong"}
+	right := models.LoginRequest{Email: user.Email, Password: apiTestPassword}
+
+	for range maxFailures - 1 {
+		a.do(t, http.MethodPost, "/api/auth/login", "", wrong, http.StatusUnauthorized, nil)
+	}
+	// The failure that reaches the limit locks the account...
+	w := a.do(t, http.MethodPost, "/api/auth/login", "", wrong, http.StatusTooManyRequests, nil)
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+	// ...so the next attempt is refused even with the right password
+	a.do(t, http.MethodPost, "/api/auth/login", "", right, http.StatusTooManyRequests, nil)
+
+	// Other accounts can still log in from the same address
+	other := a.newUser(t, models.RoleStudent)
+	a.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: other.Email, Password: apiTestPassword}, http.StatusOK, nil)
+}
+
+func TestLoginRefusesUnknownEmails(t *testing.T) {
+	a := newAPITest(t, Config{})
+	a.router.POST("/api/auth/login", a.h.Login)
+	// The dummy hash is a real one, so checking it costs as much as a stored one
+	if cost, err := bcrypt.Cost([]byte(dummyPasswordHash)); err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("dummy hash cost = %d, %v, want %d", cost, err, bcrypt.DefaultCost)
+	}
+	// An account signed up through single sign-on has no password
+	passwordless := a.newUser(t, models.RoleStudent)
+	passwordless.Password = ""
+	if err := a.store.Users.Update(t.Context(), passwordless); err != nil {
+		t.Fatal(err)
+	}
+
+	var unknown, noPassword models.ErrorResponse
+	a.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: "nobody@example.com", Password: apiTestPassword}, http.StatusUnauthorized, &unknown)
+	a.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: passwordless.Email, Password: apiTestPassword}, http.StatusUnauthorized, &noPassword)
+	if unknown != noPassword {
+		t.Errorf("unknown email refused with %+v, account without a password with %+v", unknown, noPassword)
+	}
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// couponCodePattern is what a coupon code may look like once upper cased,
+// such as "MERDEKA45" or "EARLY-BIRD".
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// ListCoupons returns every coupon, newest first. Access to the coupon
+// endpoints is restricted by the coupons:manage permission in setupRoutes.
+func (h *Handler) ListCoupons(c *gin.Context) {
+	coupons, err := h.coupons.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load coupons"})
+		return
+	}
+	c.JSON(http.StatusOK, coupons)
+}
+
+// CreateCoupon adds a coupon. Codes are stored upper case and must be
+// unique.
+func (h *Handler) CreateCoupon(c *gin.Context) {
+	coupon, ok := couponFromRequest(c)
+	if !ok {
+		return
+	}
+	coupon.ID = uuid.New().String()
+	coupon.CreatedAt = time.Now()
+
+	if err := h.coupons.Create(c.Request.Context(), coupon); err != nil {
+		if errors.Is(err, repository.ErrDuplicateCouponCode) {
+			c.JSON(http.StatusConflict, models.ErrorResponse{Error: "A coupon with this code already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create coupon"})
+		return
+	}
+	c.JSON(http.StatusCreated, coupon)
+}
+
+// GetCoupon returns a coupon with how often it has been redeemed.
+func (h *Handler) GetCoupon(c *gin.Context) {
+	coupon, ok := h.loadCoupon(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, coupon)
+}
+
+// UpdateCoupon replaces a coupon's code, discount, limits and
+// restrictions. Redemptions already made keep counting towards the new
+// limits, and purchases already made keep their discount.
+func (h *Handler) UpdateCoupon(c *gin.Context) {
+	update, ok := couponFromRequest(c)
+	if !ok {
+		return
+	}
+	coupon, ok := h.loadCoupon(c)
+	if !ok {
+		return
+	}
+	update.ID = coupon.ID
+	update.Redemptions = coupon.Redemptions
+	update.CreatedAt = coupon.CreatedAt
+
+	if err := h.coupons.Update(c.Request.Context(), update); err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Coupon not found"})
+		case errors.Is(err, repository.ErrDuplicateCouponCode):
+			c.JSON(http.StatusConflict, models.ErrorResponse{Error: "A coupon with this code already exists"})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update coupon"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, update)
+}
+
+// DeleteCoupon removes a coupon so it can no longer be used. Payments made
+// with it keep its code and discount.
+func (h *Handler) DeleteCoupon(c *gin.Context) {
+	if err := h.coupons.Delete(c.Request.Context(), c.Param("id")); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Coupon not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to delete coupon"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Coupon deleted"})
+}
+
+// loadCoupon returns the coupon named by the :id path parameter, writing a
+// 404 if there is none.
+func (h *Handler) loadCoupon(c *gin.Context) (models.Coupon, bool) {
+	coupon, err := h.coupons.GetByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Coupon not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load coupon"})
+		}
+		return models.Coupon{}, false
+	}
+	return coupon, true
+}
+
+// couponFromRequest binds and checks a CouponRequest, writing a 400 if it
+// is invalid.
+func couponFromRequest(c *gin.Context) (models.Coupon, bool) {
+	var req models.CouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return models.Coupon{}, false
+	}
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+	if !couponCodePattern.MatchString(code) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "code must be 3 to 32 letters, digits, dashes or underscores"})
+		return models.Coupon{}, false
+	}
+	if (req.PercentOff > 0) == (req.AmountOff != nil) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Exactly one of percent_off and amount_off is required"})
+		return models.Coupon{}, false
+	}
+	if req.AmountOff != nil && req.AmountOff.Amount <= 0 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "amount_off must be more than zero"})
+		return models.Coupon{}, false
+	}
+	if req.MinSpend != nil && req.MinSpend.Amount < 0 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "min_spend cannot be negative"})
+		return models.Coupon{}, false
+	}
+
+	coupon := models.Coupon{
+		Code:           code,
+		PercentOff:     req.PercentOff,
+		AmountOff:      req.AmountOff,
+		MinSpend:       req.MinSpend,
+		CourseIDs:      req.CourseIDs,
+		Categories:     req.Categories,
+		ExpiresAt:      req.ExpiresAt,
+		MaxRedemptions: req.MaxRedemptions,
+		PerUserLimit:   req.PerUserLimit,
+	}
+	if coupon.CourseIDs == nil {
+		coupon.CourseIDs = []string{}
+	}
+	if coupon.Categories == nil {
+		coupon.Categories = []string{}
+	}
+	return coupon, true
+}
+
+// QuotePayment returns what the current user would pay for a course, with
+// the discount of the coupon named in the request. The coupon is checked
+// as PurchaseCourse would, but not redeemed, so a quote does not hold a
+// place under the coupon's limits.
+func (h *Handler) QuotePayment(c *gin.Context) {
+	var req models.QuoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+	course, ok := h.loadPurchasableCourse(c, req.CourseID)
+	if !ok {
+		return
+	}
+	quote, _, ok := h.quoteCourse(c, course, req.CouponCode)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, quote)
+}
+
+// quoteCourse prices a course for the current user, less the discount of
+// the coupon with code if code is not empty. It returns the coupon, or nil
+// without one, and writes an error response if the coupon cannot be used.
+func (h *Handler) quoteCourse(c *gin.Context, course models.Course, code string) (models.Quote, *models.Coupon, bool) {
+	quote := models.Quote{
+		CourseID: course.ID,
+		Price:    course.Price,
+		Discount: money.New(0, course.Price.Currency),
+		Total:    course.Price,
+	}
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return quote, nil, true
+	}
+
+	ctx := c.Request.Context()
+	coupon, err := h.coupons.GetByCode(ctx, code)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Coupon not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load coupon"})
+		}
+		return models.Quote{}, nil, false
+	}
+
+	price := course.Price
+	var problem string
+	switch {
+	case coupon.ExpiresAt != nil && !time.Now().Before(*coupon.ExpiresAt):
+		problem = "Coupon has expired"
+	case !coupon.AppliesTo(course):
+		problem = "Coupon does not apply to this course"
+	case (coupon.AmountOff != nil && coupon.AmountOff.Currency != price.Currency) ||
+		(coupon.MinSpend != nil && coupon.MinSpend.Currency != price.Currency):
+		problem = "Coupon does not apply to prices in " + price.Currency
+	case coupon.MinSpend != nil && price.Amount < coupon.MinSpend.Amount:
+		problem = "Coupon needs a price of at least " + coupon.MinSpend.String()
+	}
+	if problem != "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: problem})
+		return models.Quote{}, nil, false
+	}
+
+	// Redeem checks the limits again when purchasing, atomically; these
+	// checks only spare the buyer a quote they cannot pay
+	if coupon.MaxRedemptions > 0 && coupon.Redemptions >= coupon.MaxRedemptions {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Coupon has been fully redeemed"})
+		return models.Quote{}, nil, false
+	}
+	if coupon.PerUserLimit > 0 {
+		used, err := h.coupons.CountRedemptions(ctx, coupon.ID, c.GetString("user_id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load coupon"})
+			return models.Quote{}, nil, false
+		}
+		if used >= coupon.PerUserLimit {
+			c.JSON(http.StatusConflict, models.ErrorResponse{Error: "You have already used this coupon as often as allowed"})
+			return models.Quote{}, nil, false
+		}
+	}
+
+	quote.Discount = coupon.Discount(price)
+	quote.Total = money.New(price.Amount-quote.Discount.Amount, price.Currency)
+	quote.CouponCode = coupon.Code
+	return quote, &coupon, true
+}
+
+// redeemCoupon counts a payment against the coupon's limits, writing a
+// 409 if a limit was reached since the payment was quoted.
+func (h *Handler) redeemCoupon(c *gin.Context, coupon models.Coupon, payment models.Payment) bool {
+	err := h.coupons.Redeem(c.Request.Context(), coupon.ID, payment.UserID, payment.ID, payment.CreatedAt)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, repository.ErrCouponExhausted):
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Coupon has been fully redeemed"})
+	case errors.Is(err, repository.ErrCouponUserLimit):
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "You have already used this coupon as often as allowed"})
+	case errors.Is(err, repository.ErrNotFound):
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Coupon not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to redeem coupon"})
+	}
+	return false
+}
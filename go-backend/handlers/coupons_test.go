@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+)
+
+// quote asks what the user would pay for the course with coupon, and
+// fails the test unless the response has wantCode.
+func (p *paymentTest) quote(t *testing.T, userID, coupon string, wantCode int) models.Quote {
+	t.Helper()
+	body, _ := json.Marshal(models.QuoteRequest{CourseID: p.course.ID, CouponCode: coupon})
+	req := httptest.NewRequest(http.MethodPost, "/api/payment/quote", bytes.NewReader(body))
+	req.Header.Set("X-User-ID", userID)
+	w := httptest.NewRecorder()
+	p.router.ServeHTTP(w, req)
+	if w.Code != wantCode {
+		t.Fatalf("quote with %q = %d %s, want %d", coupon, w.Code, w.Body, wantCode)
+	}
+	var q models.Quote
+	if err := json.Unmarshal(w.Body.Bytes(), &q); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// setCoupon changes the coupon made by newCoupon with edit.
+func (p *paymentTest) setCoupon(t *testing.T, coupon models.Coupon, edit func(*models.Coupon)) {
+	t.Helper()
+	edit(&coupon)
+	if err := p.store.Coupons.Update(t.Context(), coupon); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// redemptions returns how often the coupon has been redeemed.
+func (p *paymentTest) redemptions(t *testing.T, coupon models.Coupon) int {
+	t.Helper()
+	got, err := p.store.Coupons.GetByID(t.Context(), coupon.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got.Redemptions
+}
+
+func TestQuoteMatchesPurchase(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		edit func(*models.Coupon)
+		want models.Quote
+	}{
+		{"percent off", func(c *models.Coupon) {}, models.Quote{
+			Discount: money.New(49900, money.IDR), Total: money.New(449100, money.IDR),
+		}},
+		{"amount off", func(c *models.Coupon) {
+			c.PercentOff, c.AmountOff = 0, ptr(money.New(100000, money.IDR))
+		}, models.Quote{
+			Discount: money.New(100000, money.IDR), Total: money.New(399000, money.IDR),
+		}},
+		// The discount never takes the price below nothing
+		{"amount off above the price", func(c *models.Coupon) {
+			c.PercentOff, c.AmountOff = 0, ptr(money.New(750000, money.IDR))
+		}, models.Quote{
+			Discount: money.New(499000, money.IDR), Total: money.New(0, money.IDR),
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPaymentTest(t, time.Hour)
+			coupon := p.newCoupon(t)
+			p.setCoupon(t, coupon, tt.edit)
+			userID := p.newUser(t)
+
+			// Codes are entered in any case
+			q := p.quote(t, userID, " once ", http.StatusOK)
+			want := tt.want
+			want.CourseID, want.Price, want.CouponCode = p.course.ID, p.course.Price, "ONCE"
+			if q != want {
+				t.Errorf("quote = %+v, want %+v", q, want)
+			}
+			// A quote holds no place under the coupon's limits
+			p.quote(t, userID, "ONCE", http.StatusOK)
+			if n := p.redemptions(t, coupon); n != 0 {
+				t.Errorf("redemptions after quoting = %d, want 0", n)
+			}
+
+			payment := p.purchase(t, userID, "once", http.StatusCreated)
+			if payment.AmountMoney != q.Total {
+				t.Errorf("purchase amount = %v, quoted %v", payment.AmountMoney, q.Total)
+			}
+			if n := p.redemptions(t, coupon); n != 1 {
+				t.Errorf("redemptions after purchase = %d, want 1", n)
+			}
+		})
+	}
+
+	p := newPaymentTest(t, time.Hour)
+	userID := p.newUser(t)
+	if q := p.quote(t, userID, "", http.StatusOK); q.Total != p.course.Price || q.Discount != money.New(0, money.IDR) {
+		t.Errorf("quote without a coupon = %+v, want the full price", q)
+	}
+	p.quote(t, userID, "MISSING", http.StatusNotFound)
+	p.purchase(t, userID, "MISSING", http.StatusNotFound)
+}
+
+func TestExpiredCoupon(t *testing.T) {
+	p := newPaymentTest(t, time.Hour)
+	coupon := p.newCoupon(t)
+	userID := p.newUser(t)
+
+	p.setCoupon(t, coupon, func(c *models.Coupon) { c.ExpiresAt = ptr(time.Now().Add(time.Hour)) })
+	p.quote(t, userID, "ONCE", http.StatusOK)
+
+	p.setCoupon(t, coupon, func(c *models.Coupon) { c.ExpiresAt = ptr(time.Now().Add(-time.Second)) })
+	if got := p.quote(t, userID, "ONCE", http.StatusBadRequest); got != (models.Quote{}) {
+		t.Errorf("quote with an expired coupon = %+v", got)
+	}
+	if got := p.purchase(t, userID, "ONCE", http.StatusBadRequest); got.Error != "Coupon has expired" {
+		t.Errorf("purchase with an expired coupon: error %q", got.Error)
+	}
+	if n := p.redemptions(t, coupon); n != 0 {
+		t.Errorf("redemptions = %d, want 0", n)
+	}
+	// The purchase can still be made without it
+	if got := p.purchase(t, userID, "", http.StatusCreated); got.AmountMoney != p.course.Price {
+		t.Errorf("amount = %v, want %v", got.AmountMoney, p.course.Price)
+	}
+}
+
+func TestCouponPerUserLimit(t *testing.T) {
+	p := newPaymentTest(t, time.Hour)
+	coupon := p.newCoupon(t)
+	p.setCoupon(t, coupon, func(c *models.Coupon) { c.MaxRedemptions, c.PerUserLimit = 0, 1 })
+	buyer, other := p.newUser(t), p.newUser(t)
+
+	p.purchase(t, buyer, "ONCE", http.StatusCreated)
+
+	// A pending purchase counts, so the buyer cannot use the coupon on
+	// another course
+	second := p.course
+	second.ID, second.Title = "", "Investing Basics"
+	if err := p.store.Courses.Create(t.Context(), &second); err != nil {
+		t.Fatal(err)
+	}
+	p.course = second
+	p.quote(t, buyer, "ONCE", http.StatusConflict)
+	if got := p.purchase(t, buyer, "ONCE", http.StatusConflict); got.Error == "" {
+		t.Error("the buyer redeemed the coupon twice")
+	}
+	// while others still can
+	p.quote(t, other, "ONCE", http.StatusOK)
+	p.purchase(t, other, "ONCE", http.StatusCreated)
+	if n := p.redemptions(t, coupon); n != 2 {
+		t.Errorf("redemptions = %d, want 2", n)
+	}
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/rbac"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+)
+
+// SetCourseStatus moves a course to another status and records who did it
+// in the course's status history. Access is restricted by the
+// courses:submit permission in setupRoutes, which is enough for a course's
+// mentor to send it to review or back; publishing, unlisting, archiving
+// and restoring a course, or taking it back to review, also need
+// courses:publish.
+func (h *Handler) SetCourseStatus(c *gin.Context) {
+	var req models.CourseStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+	course, ok := h.loadCourse(c)
+	if !ok {
+		return
+	}
+	if !h.policy.Allows(c.GetString("role"), statusPermission(course.Status, req.Status)) {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Insufficient permissions"})
+		return
+	}
+	if !h.canReview(c, course) {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Only the course's mentor can submit it for review"})
+		return
+	}
+	if !models.CanTransition(course.Status, req.Status) {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Cannot move a course from " + course.Status + " to " + req.Status})
+		return
+	}
+
+	change := models.CourseStatusChange{
+		CourseID:  course.ID,
+		From:      course.Status,
+		To:        req.Status,
+		ChangedBy: c.GetString("user_id"),
+		Note:      req.Note,
+		ChangedAt: time.Now(),
+	}
+	if err := h.courses.SetStatus(c.Request.Context(), change); err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Course not found"})
+		case errors.Is(err, repository.ErrStatusConflict):
+			c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Course status has changed; reload it and try again"})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update course status"})
+		}
+		return
+	}
+
+	course.Status = req.Status
+	course.ArchivedAt = nil
+	if req.Status == models.CourseArchived {
+		course.ArchivedAt = &change.ChangedAt
+	}
+	h.search.Put(course)
+	c.JSON(http.StatusOK, course)
+}
+
+// GetCourseStatusHistory returns the status changes of a course, oldest
+// first. Access is restricted by the courses:submit permission in
+// setupRoutes, and to the course's mentor and reviewers.
+func (h *Handler) GetCourseStatusHistory(c *gin.Context) {
+	course, ok := h.loadCourse(c)
+	if !ok {
+		return
+	}
+	if !h.canReview(c, course) {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Insufficient permissions"})
+		return
+	}
+	changes, err := h.courses.ListStatusChanges(c.Request.Context(), course.ID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Course not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load status history"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, changes)
+}
+
+// statusPermission returns the permission needed to move a course between
+// two statuses. Moving it between draft and review is part of writing it;
+// anything that changes what students see is publishing.
+func statusPermission(from, to string) string {
+	authoring := func(status string) bool {
+		return status == models.CourseDraft || status == models.CourseInReview
+	}
+	if authoring(from) && authoring(to) {
+		return rbac.SubmitCourse
+	}
+	return rbac.PublishCourse
+}
+
+// canSeeUnreleased reports whether the caller, who may be anonymous, can see
+// drafts and courses in review. Like other staff access, it waits until a
+// role that requires two-factor authentication has set it up.
+func (h *Handler) canSeeUnreleased(c *gin.Context) bool {
+	return !c.GetBool("mfa_setup_required") && h.policy.Allows(c.GetString("role"), rbac.SubmitCourse)
+}
+
+// isCourseAuthor reports whether the user with role authors course: they
+// are its mentor, or may manage any course. Whether the role may edit
+// curricula at all is checked separately.
+func (h *Handler) isCourseAuthor(userID, role string, course models.Course) bool {
+	return h.policy.Allows(role, rbac.ManageAnyCourse) || course.MentorID != "" && course.MentorID == userID
+}
+
+// canReview reports whether the caller may move course through review: as
+// its author, or as someone who publishes courses and so reviews them all.
+func (h *Handler) canReview(c *gin.Context, course models.Course) bool {
+	role := c.GetString("role")
+	return h.isCourseAuthor(c.GetString("user_id"), role, course) || h.policy.Allows(role, rbac.PublishCourse)
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/rbac"
+	"github.com/cuanin/emergent-backend/search"
+)
+
+func TestStatusPermission(t *testing.T) {
+	statuses := []string{models.CourseDraft, models.CourseInReview, models.CoursePublished, models.CourseUnlisted, models.CourseArchived}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := rbac.PublishCourse
+			if (from == models.CourseDraft || from == models.CourseInReview) && (to == models.CourseDraft || to == models.CourseInReview) {
+				want = rbac.SubmitCourse
+			}
+			if got := statusPermission(from, to); got != want {
+				t.Errorf("statusPermission(%s, %s) = %s, want %s", from, to, got, want)
+			}
+		}
+	}
+}
+
+func newStatusTest(t *testing.T) (*apiTest, models.User, models.Course) {
+	t.Helper()
+	a := newAPITest(t, Config{})
+	a.router.POST("/api/courses/:id/status", a.auth, a.h.SetCourseStatus)
+	a.router.GET("/api/courses/:id/status/history", a.auth, a.h.GetCourseStatusHistory)
+
+	mentor, course := a.newMentorCourse(t, models.CourseDraft)
+	return a, mentor, course
+}
+
+func TestSetCourseStatus(t *testing.T) {
+	a, mentor, course := newStatusTest(t)
+	admin := a.newUser(t, models.RoleAdmin)
+	path := "/api/courses/" + course.ID + "/status"
+	set := func(userID, status, note string, wantCode int) {
+		t.Helper()
+		a.do(t, http.MethodPost, path, userID, models.CourseStatusRequest{Status: status, Note: note}, wantCode, nil)
+	}
+	found := func() bool {
+		return slices.ContainsFunc(a.h.search.Search("budgeting"), func(r search.Result) bool { return r.ID == course.ID })
+	}
+
+	// The mentor writes the course and sends it between draft and review
+	set(mentor.ID, models.CoursePublished, "", http.StatusForbidden)
+	set(mentor.ID, models.CourseInReview, "", http.StatusOK)
+	set(mentor.ID, models.CourseDraft, "Needs another module", http.StatusOK)
+	set(mentor.ID, models.CourseInReview, "", http.StatusOK)
+	// but another mentor cannot, nor can the mentor publish it
+	set(a.newUser(t, models.RoleMentor).ID, models.CourseDraft, "", http.StatusForbidden)
+	set(mentor.ID, models.CoursePublished, "", http.StatusForbidden)
+	if found() {
+		t.Error("a course in review is found by search")
+	}
+
+	// An admin reviews and publishes it
+	set(admin.ID, models.CoursePublished, "Looks good", http.StatusOK)
+	if !found() {
+		t.Error("a published course is not found by search")
+	}
+	set(admin.ID, models.CourseDraft, "", http.StatusConflict)
+	set(admin.ID, "deleted", "", http.StatusBadRequest)
+
+	var archived courseResponse
+	a.do(t, http.MethodPost, path, admin.ID, models.CourseStatusRequest{Status: models.CourseArchived}, http.StatusOK, &archived)
+	if archived.ArchivedAt == nil {
+		t.Error("archived course has no archived_at")
+	}
+	if found() {
+		t.Error("an archived course is found by search")
+	}
+	var restored courseResponse
+	a.do(t, http.MethodPost, path, admin.ID, models.CourseStatusRequest{Status: models.CoursePublished}, http.StatusOK, &restored)
+	if restored.ArchivedAt != nil || !found() {
+		t.Errorf("restored course has archived_at %v, found by search %v", restored.ArchivedAt, found())
+	}
+	a.do(t, http.MethodPost, "/api/courses/missing/status", admin.ID, models.CourseStatusRequest{Status: models.CourseInReview}, http.StatusNotFound, nil)
+
+	// Every change is in the history, which only the mentor and reviewers
+	// can read
+	var history []models.CourseStatusChange
+	a.do(t, http.MethodGet, path+"/history", mentor.ID, nil, http.StatusOK, &history)
+	var steps []string
+	for _, change := range history {
+		steps = append(steps, change.From+">"+change.To)
+	}
+	want := []string{"draft>in_review", "in_review>draft", "draft>in_review", "in_review>published", "published>archived", "archived>published"}
+	if !slices.Equal(steps, want) {
+		t.Errorf("history = %v, want %v", steps, want)
+	}
+	if len(history) == len(want) && (history[1].Note != "Needs another module" || history[1].ChangedBy != mentor.ID || history[3].ChangedBy != admin.ID) {
+		t.Errorf("history does not record who made the changes and why: %+v", history)
+	}
+	a.do(t, http.MethodGet, path+"/history", a.newUser(t, models.RoleMentor).ID, nil, http.StatusForbidden, nil)
+}
@@ -1,100 +1,472 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/cuanin/emergent-backend/data"
 	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+	"github.com/cuanin/emergent-backend/rbac"
+	"github.com/cuanin/emergent-backend/repository"
 	"github.com/gin-gonic/gin"
 )
 
-// getCoursesCopy returns a copy of the courses slice to avoid direct modification
-func getCoursesCopy() []models.Course {
-	return append([]models.Course(nil), data.Courses...)
+const (
+	defaultCoursesPerPage = 20
+	maxCoursesPerPage     = 100
+)
+
+// GetCourses returns one page of the catalog, which only lists published
+// courses. The category, level, mentor and topic query parameters can be
+// repeated or hold comma-separated values, min_price and max_price bound
+// the price, and sort names a field to order by, with a leading "-" for
+// descending. Staff can list courses in other statuses with the status
+// parameter. The total count and links to other pages are sent in the
+// X-Total-Count and Link headers.
+func (h *Handler) GetCourses(c *gin.Context) {
+	page, ok := queryInt(c, "page", 1, 1, maxPage)
+	if !ok {
+		return
+	}
+	perPage, ok := queryInt(c, "per_page", defaultCoursesPerPage, 1, maxCoursesPerPage)
+	if !ok {
+		return
+	}
+	filter := repository.CourseFilter{
+		Statuses:   queryList(c, "status"),
+		Categories: queryList(c, "category"),
+		Levels:     queryList(c, "level"),
+		Mentors:    queryList(c, "mentor"),
+		Topics:     queryList(c, "topic"),
+		Offset:     (page - 1) * perPage,
+		Limit:      perPage,
+	}
+	if len(filter.Statuses) > 0 {
+		if !h.canSeeUnreleased(c) {
+			c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Insufficient permissions to list courses by status"})
+			return
+		}
+		for _, status := range filter.Statuses {
+			if !models.IsCourseStatus(status) {
+				c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "status must be draft, in_review, published, unlisted or archived"})
+				return
+			}
+		}
+	}
+	currency := c.DefaultQuery("currency", money.DefaultCurrency)
+	if !money.Supported(currency) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: money.ErrUnknownCurrency.Error()})
+		return
+	}
+	if filter.MinPrice, ok = queryPrice(c, "min_price", currency); !ok {
+		return
+	}
+	if filter.MaxPrice, ok = queryPrice(c, "max_price", currency); !ok {
+		return
+	}
+	if filter.MinPrice != nil && filter.MaxPrice != nil && filter.MinPrice.Amount > filter.MaxPrice.Amount {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "min_price cannot be more than max_price"})
+		return
+	}
+	sort := c.Query("sort")
+	filter.Desc = strings.HasPrefix(sort, "-")
+	filter.Sort = strings.TrimPrefix(sort, "-")
+	switch filter.Sort {
+	case "", repository.CourseSortCreatedAt, repository.CourseSortPrice, repository.CourseSortEnrolledCount, repository.CourseSortRating:
+	default:
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "sort must be created_at, price, enrolled_count or rating, optionally prefixed with -"})
+		return
+	}
+
+	courses, total, err := h.courses.Search(c.Request.Context(), filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load courses"})
+		return
+	}
+
+	setPageHeaders(c, page, perPage, total)
+	c.JSON(http.StatusOK, courses)
 }
 
-// GetCourses returns a list of courses with optional filtering
-func GetCourses(c *gin.Context) {
-	// Get query parameters
-	category := c.Query("category")
-	level := c.Query("level")
-
-	// Get a copy of courses
-	courses := getCoursesCopy()
-	
-	// Filter courses based on query parameters
-	filteredCourses := make([]models.Course, 0)
-	for _, course := range courses {
-		if (category == "" || course.Category == category) &&
-			(level == "" || course.Level == level) {
-			filteredCourses = append(filteredCourses, course)
+// queryList returns the values of a query parameter that may be repeated
+// or hold comma-separated values.
+func queryList(c *gin.Context, name string) []string {
+	var values []string
+	for _, v := range c.QueryArray(name) {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
 		}
 	}
+	return values
+}
 
-	c.JSON(http.StatusOK, filteredCourses)
+// queryPrice parses an optional non-negative price query parameter, given
+// in whole units of currency such as "499000" or "49.99". It writes a 400
+// if the value is invalid.
+func queryPrice(c *gin.Context, name, currency string) (*money.Money, bool) {
+	v := c.Query(name)
+	if v == "" {
+		return nil, true
+	}
+	price, err := money.Parse(v, currency)
+	if err != nil || price.Amount < 0 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: name + " must be a non-negative amount of " + currency})
+		return nil, false
+	}
+	return &price, true
 }
 
-// GetCourse returns a single course by ID
-func GetCourse(c *gin.Context) {
-	courseID := c.Param("id")
+// checkPrice writes a 400 and returns false if price is negative.
+func checkPrice(c *gin.Context, price money.Money) bool {
+	if price.Amount < 0 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "price cannot be negative"})
+		return false
+	}
+	return true
+}
 
-	// Find course by ID
-	for _, course := range getCoursesCopy() {
-		if course.ID == courseID {
-			c.JSON(http.StatusOK, course)
+// checkMentor writes a 400 and returns false unless id is empty or names an
+// active user whose role may edit curricula.
+func (h *Handler) checkMentor(c *gin.Context, id string) bool {
+	if id == "" {
+		return true
+	}
+	user, err := h.users.GetByID(c.Request.Context(), id)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load user"})
+		return false
+	}
+	if err != nil || user.Status() != models.UserActive || !h.policy.Allows(user.EffectiveRole(), rbac.EditCurriculum) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "mentor_id must be the ID of an active mentor"})
+		return false
+	}
+	return true
+}
+
+// setPageHeaders sets X-Total-Count and a Link header (RFC 8288) with the
+// first, prev, next and last pages of the current request.
+func setPageHeaders(c *gin.Context, page, perPage, total int) {
+	last := (total + perPage - 1) / perPage
+	if last < 1 {
+		last = 1
+	}
+	link := func(p int, rel string) string {
+		u := *c.Request.URL
+		q := u.Query()
+		q.Set("page", strconv.Itoa(p))
+		q.Set("per_page", strconv.Itoa(perPage))
+		u.RawQuery = q.Encode()
+		return "<" + u.RequestURI() + `>; rel="` + rel + `"`
+	}
+	links := []string{link(1, "first")}
+	if page > 1 {
+		links = append(links, link(min(page-1, last), "prev"))
+	}
+	if page < last {
+		links = append(links, link(page+1, "next"))
+	}
+	links = append(links, link(last, "last"))
+
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	c.Header("Link", strings.Join(links, ", "))
+}
+
+// maxSearchQuery is the longest search query accepted, in bytes.
+const maxSearchQuery = 200
+
+// SearchCourses finds courses whose title, description, topics or mentor
+// match the words of the q query parameter, most relevant first, one page
+// at a time.
+func (h *Handler) SearchCourses(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "q is required"})
+		return
+	}
+	if len(query) > maxSearchQuery {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "q must be at most " + strconv.Itoa(maxSearchQuery) + " characters"})
+		return
+	}
+	page, ok := queryInt(c, "page", 1, 1, maxPage)
+	if !ok {
+		return
+	}
+	perPage, ok := queryInt(c, "per_page", defaultCoursesPerPage, 1, maxCoursesPerPage)
+	if !ok {
+		return
+	}
+
+	// The index only holds the searched text; the rest is read fresh, and
+	// courses that are not listed are left out before paging so that the
+	// total and the pages agree
+	results := []models.CourseSearchResult{}
+	ctx := c.Request.Context()
+	for _, match := range h.search.Search(query) {
+		course, err := h.courses.GetByID(ctx, match.ID)
+		if errors.Is(err, repository.ErrNotFound) || err == nil && !course.Listed() {
+			continue
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load course"})
 			return
 		}
+		results = append(results, models.CourseSearchResult{Course: course, Score: match.Score, Highlights: match.Highlights})
 	}
+	total := len(results)
+	start := min((page-1)*perPage, total)
+	results = results[start:min(start+perPage, total)]
 
-	c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Course not found"})
+	c.JSON(http.StatusOK, models.CourseSearchResponse{
+		Query:   query,
+		Results: results,
+		Total:   total,
+		Page:    page,
+		PerPage: perPage,
+	})
 }
 
-// CreateCourse creates a new course (admin only)
-func CreateCourse(c *gin.Context) {
-	// In a real app, check if user is admin
-	// user := c.MustGet("user").(models.User)
-	// if !user.IsAdmin {
-	// 	c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Admin access required"})
-	// 	return
-	// }
+// GetCourse returns a single course by ID with the outline of its
+// curriculum. Lesson content is left out of the outline; enrolled users get
+// it from GetLesson. Unlisted and archived courses are still returned, so
+// that people with a link and buyers can use them, but drafts and courses
+// in review are only shown to staff.
+func (h *Handler) GetCourse(c *gin.Context) {
+	course, ok := h.loadCourse(c)
+	if !ok {
+		return
+	}
+	if !course.Released() && !h.canSeeUnreleased(c) {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Course not found"})
+		return
+	}
+	modules, err := h.curriculum.Outline(c.Request.Context(), course.ID)
+	if err != nil {
+		curriculumError(c, err, "Course not found", "Failed to load curriculum")
+		return
+	}
+	for i := range modules {
+		for j, lesson := range modules[i].Lessons {
+			modules[i].Lessons[j] = lesson.Summary()
+		}
+	}
+
+	c.JSON(http.StatusOK, models.CourseDetailResponse{Course: course, Modules: modules})
+}
 
+// CreateCourse creates a new course as a draft, which is not shown to
+// students until it is published. Access is restricted by the
+// courses:create permission in setupRoutes.
+func (h *Handler) CreateCourse(c *gin.Context) {
 	var req models.CourseCreateRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
 		return
 	}
+	if !checkPrice(c, *req.Price) || !h.checkMentor(c, req.MentorID) {
+		return
+	}
 
-	// Create new course (in a real app, save to database)
+	// Create new course; the repository assigns the ID
 	newCourse := models.Course{
-		ID:              strconv.Itoa(len(courses) + 1),
 		Title:           req.Title,
 		Description:     req.Description,
-		Price:           req.Price,
+		Price:           *req.Price,
 		Category:        req.Category,
 		Level:           req.Level,
 		MentorName:      req.MentorName,
-		VideoURL:        req.VideoURL,
+		MentorID:        req.MentorID,
 		PreviewVideoURL: req.PreviewVideoURL,
 		Duration:        req.Duration,
 		Topics:          req.Topics,
 		CreatedAt:       time.Now(),
 		EnrolledCount:   0,
+		Status:          models.CourseDraft,
+	}
+	if req.VideoURL != nil {
+		newCourse.VideoURL = *req.VideoURL
 	}
 
-	// In a real app, save the course to database here
-	data.Courses = append(data.Courses, newCourse)
+	if err := h.courses.Create(c.Request.Context(), &newCourse); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create course"})
+		return
+	}
+	h.search.Put(newCourse)
 
 	c.JSON(http.StatusCreated, newCourse)
 }
 
-// GetCategories returns a list of course categories with counts
-func GetCategories(c *gin.Context) {
+// ReplaceCourse overwrites every editable field of a course, except that
+// the video is kept when the request leaves video_url out. Access is
+// restricted by the courses:edit permission in setupRoutes.
+func (h *Handler) ReplaceCourse(c *gin.Context) {
+	var req models.CourseCreateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+	if !checkPrice(c, *req.Price) || !h.checkMentor(c, req.MentorID) {
+		return
+	}
+	course, ok := h.loadCourse(c)
+	if !ok {
+		return
+	}
+
+	course.Title = req.Title
+	course.Description = req.Description
+	course.Price = *req.Price
+	course.Category = req.Category
+	course.Level = req.Level
+	course.MentorName = req.MentorName
+	course.MentorID = req.MentorID
+	if req.VideoURL != nil {
+		course.VideoURL = *req.VideoURL
+	}
+	course.PreviewVideoURL = req.PreviewVideoURL
+	if course.LessonCount == 0 {
+		course.Duration = req.Duration
+	}
+	course.Topics = req.Topics
+	h.saveCourse(c, course)
+}
+
+// UpdateCourse changes the fields of a course that are present in the
+// request. Access is restricted by the courses:edit permission in
+// setupRoutes.
+func (h *Handler) UpdateCourse(c *gin.Context) {
+	var req models.CourseUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+	if req.Price != nil && !checkPrice(c, *req.Price) {
+		return
+	}
+	if req.MentorID != nil && !h.checkMentor(c, *req.MentorID) {
+		return
+	}
+	course, ok := h.loadCourse(c)
+	if !ok {
+		return
+	}
+
+	if req.Title != nil {
+		course.Title = *req.Title
+	}
+	if req.Description != nil {
+		course.Description = *req.Description
+	}
+	if req.Price != nil {
+		course.Price = *req.Price
+	}
+	if req.Category != nil {
+		course.Category = *req.Category
+	}
+	if req.Level != nil {
+		course.Level = *req.Level
+	}
+	if req.MentorName != nil {
+		course.MentorName = *req.MentorName
+	}
+	if req.MentorID != nil {
+		course.MentorID = *req.MentorID
+	}
+	if req.VideoURL != nil {
+		course.VideoURL = *req.VideoURL
+	}
+	if req.PreviewVideoURL != nil {
+		course.PreviewVideoURL = *req.PreviewVideoURL
+	}
+	// Once there are lessons the duration is computed from them
+	if req.Duration != nil && course.LessonCount == 0 {
+		course.Duration = *req.Duration
+	}
+	if req.Topics != nil {
+		course.Topics = *req.Topics
+	}
+	h.saveCourse(c, course)
+}
+
+// saveCourse stores an edited course and responds with it. A new price
+// only applies to later purchases; payments keep the amount that was paid.
+func (h *Handler) saveCourse(c *gin.Context, course models.Course) {
+	if course.Topics == nil {
+		course.Topics = []string{}
+	}
+	if err := h.courses.Update(c.Request.Context(), course); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Course not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update course"})
+		return
+	}
+	h.search.Put(course)
+	c.JSON(http.StatusOK, course)
+}
+
+// DeleteCourse removes a course nobody has bought. A course with buyers is
+// archived instead: it disappears from listings and can no longer be
+// purchased, but its buyers keep access. Access is restricted by the
+// courses:delete permission in setupRoutes.
+func (h *Handler) DeleteCourse(c *gin.Context) {
+	archived, err := h.courses.Delete(c.Request.Context(), c.Param("id"), c.GetString("user_id"), time.Now())
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Course not found"})
+			return
+		}
+		if errors.Is(err, repository.ErrStatusConflict) {
+			c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Course status changed while deleting; try again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to delete course"})
+		return
+	}
+	h.search.Remove(c.Param("id"))
+
+	if archived {
+		c.JSON(http.StatusOK, gin.H{"message": "Course has buyers and was archived", "archived": true})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Course deleted", "archived": false})
+}
+
+// loadCourse returns the course named by the :id path parameter, writing a
+// 404 if there is none.
+func (h *Handler) loadCourse(c *gin.Context) (models.Course, bool) {
+	course, err := h.courses.GetByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Course not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load course"})
+		}
+		return models.Course{}, false
+	}
+	return course, true
+}
+
+// GetCategories returns a list of course categories with counts. Only
+// published courses are counted.
+func (h *Handler) GetCategories(c *gin.Context) {
+	courses, err := h.courses.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load courses"})
+		return
+	}
+
 	// Count courses by category
 	categoryCount := make(map[string]int)
-	for _, course := range getCoursesCopy() {
-		categoryCount[course.Category]++
+	for _, course := range courses {
+		if course.Listed() {
+			categoryCount[course.Category]++
+		}
 	}
 
 	// Convert to response format
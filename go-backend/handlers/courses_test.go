@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+	"github.com/cuanin/emergent-backend/repository"
+)
+
+func newCoursesTest(t *testing.T) (*apiTest, models.User) {
+	t.Helper()
+	a := newAPITest(t, Config{})
+	a.router.GET("/api/courses", a.h.GetCourses)
+	a.router.PUT("/api/courses/:id", a.auth, a.h.ReplaceCourse)
+	a.router.PATCH("/api/courses/:id", a.auth, a.h.UpdateCourse)
+	a.router.DELETE("/api/courses/:id", a.auth, a.h.DeleteCourse)
+	return a, a.newUser(t, models.RoleAdmin)
+}
+
+// courseResponse is a course as handlers write it. Its price is read from
+// price_money, since price is a plain number without a currency.
+type courseResponse struct {
+	Title      string      `json:"title"`
+	Category   string      `json:"category"`
+	MentorID   string      `json:"mentor_id"`
+	Duration   string      `json:"duration"`
+	Topics     []string    `json:"topics"`
+	Status     string      `json:"status"`
+	ArchivedAt *time.Time  `json:"archived_at"`
+	PriceMoney money.Money `json:"price_money"`
+}
+
+// searchIDs returns the IDs of the courses the search index finds for query.
+func searchIDs(a *apiTest, query string) []string {
+	var ids []string
+	for _, r := range a.h.search.Search(query) {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+// newPricedCourse creates a published course in category with a price in
+// rupiah.
+func newPricedCourse(t *testing.T, a *apiTest, title, category string, price int64) models.Course {
+	t.Helper()
+	course := a.newCourse(t, title, models.CoursePublished)
+	course.Category = category
+	course.Price = money.New(price, money.IDR)
+	if err := a.store.Courses.Update(t.Context(), course); err != nil {
+		t.Fatal(err)
+	}
+	return course
+}
+
+func TestGetCoursesPages(t *testing.T) {
+	a, _ := newCoursesTest(t)
+	for i, title := range []string{"A", "B", "C", "D", "E"} {
+		newPricedCourse(t, a, title, "Budget", int64(i+1)*100000)
+	}
+	// Unreleased courses are neither listed nor counted
+	draft := a.newCourse(t, "Draft", models.CourseDraft)
+	draft.Category = "Budget"
+	if err := a.store.Courses.Update(t.Context(), draft); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(query string) ([]courseResponse, http.Header) {
+		t.Helper()
+		var courses []courseResponse
+		w := a.do(t, http.MethodGet, "/api/courses?"+query, "", nil, http.StatusOK, &courses)
+		return courses, w.Header()
+	}
+	titles := func(courses []courseResponse) string {
+		var s []string
+		for _, c := range courses {
+			s = append(s, c.Title)
+		}
+		return strings.Join(s, " ")
+	}
+
+	courses, header := list("category=Budget&sort=price&per_page=2&page=2")
+	if got := titles(courses); got != "C D" {
+		t.Errorf("second page = %q, want C D", got)
+	}
+	if got := header.Get("X-Total-Count"); got != "5" {
+		t.Errorf("X-Total-Count = %q, want 5", got)
+	}
+	link := func(page, rel string) string {
+		return "</api/courses?category=Budget&page=" + page + `&per_page=2&sort=price>; rel="` + rel + `"`
+	}
+	want := strings.Join([]string{link("1", "first"), link("1", "prev"), link("3", "next"), link("3", "last")}, ", ")
+	if got := header.Get("Link"); got != want {
+		t.Errorf("Link = %s\nwant %s", got, want)
+	}
+
+	// The first and last pages have no prev and next links
+	courses, header = list("category=Budget&sort=-price&per_page=2")
+	if got := titles(courses); got != "E D" {
+		t.Errorf("first page by descending price = %q, want E D", got)
+	}
+	if got := header.Get("Link"); strings.Contains(got, `rel="prev"`) || !strings.Contains(got, `rel="next"`) {
+		t.Errorf("Link on the first page = %s", got)
+	}
+	courses, header = list("category=Budget&sort=price&per_page=2&page=3")
+	if got := titles(courses); got != "E" {
+		t.Errorf("last page = %q, want E", got)
+	}
+	if got := header.Get("Link"); strings.Contains(got, `rel="next"`) || !strings.Contains(got, `rel="prev"`) {
+		t.Errorf("Link on the last page = %s", got)
+	}
+
+	// Past the end is empty, with prev pointing at the last page
+	courses, header = list("category=Budget&sort=price&per_page=2&page=9")
+	if len(courses) != 0 || header.Get("X-Total-Count") != "5" {
+		t.Errorf("page past the end = %q of %s, want none of 5", titles(courses), header.Get("X-Total-Count"))
+	}
+	if got := header.Get("Link"); !strings.Contains(got, link("3", "prev")) {
+		t.Errorf("Link past the end = %s, want prev to be page 3", got)
+	}
+
+	// Nothing found still has one page
+	courses, header = list("category=Nothing")
+	if len(courses) != 0 || header.Get("X-Total-Count") != "0" || !strings.Contains(header.Get("Link"), `page=1&per_page=20>; rel="last"`) {
+		t.Errorf("empty result = %q, X-Total-Count %s, Link %s", titles(courses), header.Get("X-Total-Count"), header.Get("Link"))
+	}
+
+	for _, query := range []string{"page=0", "page=x", "per_page=0", "per_page=101", "sort=title", "min_price=5&max_price=1", "status=draft"} {
+		code := http.StatusBadRequest
+		if query == "status=draft" {
+			code = http.StatusForbidden
+		}
+		a.do(t, http.MethodGet, "/api/courses?"+query, "", nil, code, nil)
+	}
+}
+
+func TestUpdateCourse(t *testing.T) {
+	a, admin := newCoursesTest(t)
+	course := a.newCourse(t, "Budgeting Basics", models.CoursePublished)
+	path := "/api/courses/" + course.ID
+
+	var got courseResponse
+	a.do(t, http.MethodPatch, path, admin.ID, models.CourseUpdateRequest{
+		Title: ptr("Cashflow Basics"),
+		Price: ptr(money.New(299000, money.IDR)),
+	}, http.StatusOK, &got)
+	if got.Title != "Cashflow Basics" || got.PriceMoney != money.New(299000, money.IDR) {
+		t.Errorf("patched course = %q for %v", got.Title, got.PriceMoney)
+	}
+
+	// Fields left out are kept, and the search index follows the title
+	stored, err := a.store.Courses.GetByID(t.Context(), course.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != "Cashflow Basics" || stored.Description != course.Description || stored.Category != course.Category || stored.Status != course.Status {
+		t.Errorf("stored course after PATCH = %+v", stored)
+	}
+	if ids := searchIDs(a, "cashflow"); !slices.Contains(ids, course.ID) {
+		t.Errorf("search for the new title = %v, want %s", ids, course.ID)
+	}
+
+	mentor := a.newUser(t, models.RoleMentor)
+	a.do(t, http.MethodPatch, path, admin.ID, models.CourseUpdateRequest{MentorID: ptr(mentor.ID)}, http.StatusOK, &got)
+	if got.MentorID != mentor.ID {
+		t.Errorf("mentor_id = %q, want %q", got.MentorID, mentor.ID)
+	}
+	var cleared courseResponse
+	a.do(t, http.MethodPatch, path, admin.ID, models.CourseUpdateRequest{MentorID: ptr("")}, http.StatusOK, &cleared)
+	if cleared.MentorID != "" {
+		t.Errorf("mentor_id after clearing it = %q", cleared.MentorID)
+	}
+
+	student := a.newUser(t, models.RoleStudent)
+	for _, req := range []models.CourseUpdateRequest{
+		{Price: ptr(money.New(-1, money.IDR))},
+		{Title: ptr("")},
+		{MentorID: ptr(student.ID)},
+		{MentorID: ptr("missing")},
+	} {
+		a.do(t, http.MethodPatch, path, admin.ID, req, http.StatusBadRequest, nil)
+	}
+	a.do(t, http.MethodPatch, "/api/courses/missing", admin.ID, models.CourseUpdateRequest{Title: ptr("x")}, http.StatusNotFound, nil)
+
+	// Invalid requests change nothing
+	stored, err = a.store.Courses.GetByID(t.Context(), course.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != "Cashflow Basics" || stored.Price != money.New(299000, money.IDR) || stored.MentorID != "" {
+		t.Errorf("stored course after invalid requests = %+v", stored)
+	}
+}
+
+func TestReplaceCourse(t *testing.T) {
+	a, admin := newCoursesTest(t)
+	course := a.newCourse(t, "Budgeting Basics", models.CoursePublished)
+	course.VideoURL = "https://cdn.example.com/course.mp4"
+	if err := a.store.Courses.Update(t.Context(), course); err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/courses/" + course.ID
+	price := money.New(1299, money.USD)
+	req := models.CourseCreateRequest{
+		Title:       "Stock Market Basics",
+		Description: "Reading a stock chart",
+		Price:       &price,
+		Category:    "Investing",
+		Level:       "Intermediate",
+		MentorName:  "Another Mentor",
+		Duration:    "3h",
+	}
+
+	var got courseResponse
+	a.do(t, http.MethodPut, path, admin.ID, req, http.StatusOK, &got)
+	if got.Title != req.Title || got.Category != req.Category || got.PriceMoney != price || got.Duration != "3h" {
+		t.Errorf("replaced course = %+v", got)
+	}
+	// Topics left out are cleared; the status is not part of the course's content
+	if got.Topics == nil || len(got.Topics) != 0 || got.Status != models.CoursePublished {
+		t.Errorf("replaced course has topics %v and status %q", got.Topics, got.Status)
+	}
+	// Responses never include the video, so a request without it keeps it
+	videoURL := func() string {
+		t.Helper()
+		stored, err := a.store.Courses.GetByID(t.Context(), course.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored.VideoURL
+	}
+	if got := videoURL(); got != course.VideoURL {
+		t.Errorf("video after a replace without video_url = %q, want %q", got, course.VideoURL)
+	}
+	req.VideoURL = ptr("")
+	a.do(t, http.MethodPut, path, admin.ID, req, http.StatusOK, nil)
+	if got := videoURL(); got != "" {
+		t.Errorf("video after a replace with an empty video_url = %q, want it removed", got)
+	}
+	req.VideoURL = nil
+
+	// Every field is required
+	a.do(t, http.MethodPut, path, admin.ID, models.CourseCreateRequest{Title: "Only a title"}, http.StatusBadRequest, nil)
+	negative := money.New(-1, money.USD)
+	req.Price = &negative
+	a.do(t, http.MethodPut, path, admin.ID, req, http.StatusBadRequest, nil)
+	req.Price = &price
+	a.do(t, http.MethodPut, "/api/courses/missing", admin.ID, req, http.StatusNotFound, nil)
+}
+
+func TestDeleteCourse(t *testing.T) {
+	a, admin := newCoursesTest(t)
+
+	// Nobody bought it, so it is removed
+	unsold := a.newCourse(t, "Unsold Course", models.CoursePublished)
+	var resp struct {
+		Archived bool `json:"archived"`
+	}
+	a.do(t, http.MethodDelete, "/api/courses/"+unsold.ID, admin.ID, nil, http.StatusOK, &resp)
+	if resp.Archived {
+		t.Error("a course nobody bought was archived, want it deleted")
+	}
+	if _, err := a.store.Courses.GetByID(t.Context(), unsold.ID); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetByID after deleting = %v, want ErrNotFound", err)
+	}
+	if ids := searchIDs(a, "unsold"); len(ids) != 0 {
+		t.Errorf("deleted course is still found: %v", ids)
+	}
+	a.do(t, http.MethodDelete, "/api/courses/"+unsold.ID, admin.ID, nil, http.StatusNotFound, nil)
+
+	// Someone is enrolled, so it is archived and they keep it
+	sold := a.newCourse(t, "Sold Course", models.CoursePublished)
+	buyer := a.newUser(t, models.RoleStudent)
+	if err := a.store.Users.Enroll(t.Context(), buyer.ID, sold.ID); err != nil {
+		t.Fatal(err)
+	}
+	a.do(t, http.MethodDelete, "/api/courses/"+sold.ID, admin.ID, nil, http.StatusOK, &resp)
+	if !resp.Archived {
+		t.Error("a course with a buyer was deleted, want it archived")
+	}
+	stored, err := a.store.Courses.GetByID(t.Context(), sold.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != models.CourseArchived || stored.ArchivedAt == nil {
+		t.Errorf("archived course has status %q, archived at %v", stored.Status, stored.ArchivedAt)
+	}
+	if ids := searchIDs(a, "sold"); slices.Contains(ids, sold.ID) {
+		t.Errorf("archived course is still found: %v", ids)
+	}
+	// Deleting it again leaves it archived
+	a.do(t, http.MethodDelete, "/api/courses/"+sold.ID, admin.ID, nil, http.StatusOK, &resp)
+	if !resp.Archived {
+		t.Error("deleting an archived course again removed it")
+	}
+}
@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+)
+
+// CreateModule adds a module to a course, at the end unless a position is
+// given. Access is restricted by the curriculum:edit permission in
+// setupRoutes and to the course's authors.
+func (h *Handler) CreateModule(c *gin.Context) {
+	var req models.ModuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+	course, ok := h.loadCurriculumCourse(c)
+	if !ok {
+		return
+	}
+
+	module := models.Module{
+		CourseID:  course.ID,
+		Title:     req.Title,
+		Position:  req.Position,
+		CreatedAt: time.Now(),
+	}
+	if err := h.curriculum.CreateModule(c.Request.Context(), &module); err != nil {
+		curriculumError(c, err, "Course not found", "Failed to create module")
+		return
+	}
+
+	c.JSON(http.StatusCreated, module)
+}
+
+// UpdateModule renames a module or moves it to another position. Access is
+// restricted by the curriculum:edit permission in setupRoutes and to the
+// course's authors.
+func (h *Handler) UpdateModule(c *gin.Context) {
+	var req models.ModuleUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+	if _, ok := h.loadCurriculumCourse(c); !ok {
+		return
+	}
+	modules, ok := h.loadOutline(c)
+	if !ok {
+		return
+	}
+	i := slices.IndexFunc(modules, func(m models.Module) bool { return m.ID == c.Param("module_id") })
+	if i < 0 {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Module not found"})
+		return
+	}
+
+	module := modules[i]
+	if req.Title != nil {
+		module.Title = *req.Title
+	}
+	if req.Position != nil {
+		module.Position = *req.Position
+	}
+	if err := h.curriculum.UpdateModule(c.Request.Context(), &module); err != nil {
+		curriculumError(c, err, "Module not found", "Failed to update module")
+		return
+	}
+
+	c.JSON(http.StatusOK, module)
+}
+
+// DeleteModule removes a module together with its lessons. Access is
+// restricted by the curriculum:edit permission in setupRoutes and to the
+// course's authors.
+func (h *Handler) DeleteModule(c *gin.Context) {
+	if _, ok := h.loadCurriculumCourse(c); !ok {
+		return
+	}
+	if err := h.curriculum.DeleteModule(c.Request.Context(), c.Param("id"), c.Param("module_id")); err != nil {
+		curriculumError(c, err, "Module not found", "Failed to delete module")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Module deleted"})
+}
+
+// CreateLesson adds a lesson to a module, at the end unless a position is
+// given. Access is restricted by the curriculum:edit permission in
+// setupRoutes and to the course's authors.
+func (h *Handler) CreateLesson(c *gin.Context) {
+	var req models.LessonRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+	course, ok := h.loadCurriculumCourse(c)
+	if !ok {
+		return
+	}
+
+	lesson := models.Lesson{
+		CourseID:        course.ID,
+		ModuleID:        c.Param("module_id"),
+		Title:           req.Title,
+		Position:        req.Position,
+		Type:            req.Type,
+		VideoURL:        req.VideoURL,
+		Content:         req.Content,
+		AttachmentURL:   req.AttachmentURL,
+		DurationSeconds: req.DurationSeconds,
+		CreatedAt:       time.Now(),
+	}
+	if msg := checkLessonContent(&lesson); msg != "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: msg})
+		return
+	}
+	if err := h.curriculum.CreateLesson(c.Request.Context(), &lesson); err != nil {
+		curriculumError(c, err, "Module not found", "Failed to create lesson")
+		return
+	}
+
+	c.JSON(http.StatusCreated, lesson)
+}
+
+// GetLesson returns a lesson with its content. Only users enrolled in the
+// course and its authors can see it. A video or attachment is opened
+// through a signed media link; its stored URL is only shown to authors.
+func (h *Handler) GetLesson(c *gin.Context) {
+	course, ok := h.loadCourse(c)
+	if !ok {
+		return
+	}
+	modules, ok := h.loadOutline(c)
+	if !ok {
+		return
+	}
+	lesson, ok := findLesson(modules, c.Param("lesson_id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Lesson not found"})
+		return
+	}
+	user, ok := h.loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	if !h.canViewContent(user, course) {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Enroll in the course to view its lessons"})
+		return
+	}
+
+	resp := models.LessonResponse{Lesson: lesson}
+	if lessonMediaURL(lesson) != "" {
+		resp.Media = h.mediaLink(user.ID, lesson.CourseID, lesson.ID)
+	}
+	if !h.canAuthor(user, course) {
+		resp.VideoURL, resp.AttachmentURL = "", ""
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// UpdateLesson changes the fields of a lesson that are present in the
+// request. Setting module_id moves the lesson to another module of the
+// course. Access is restricted by the curriculum:edit permission in
+// setupRoutes and to the course's authors.
+func (h *Handler) UpdateLesson(c *gin.Context) {
+	var req models.LessonUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+	if _, ok := h.loadCurriculumCourse(c); !ok {
+		return
+	}
+	modules, ok := h.loadOutline(c)
+	if !ok {
+		return
+	}
+	lesson, ok := findLesson(modules, c.Param("lesson_id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Lesson not found"})
+		return
+	}
+
+	if req.ModuleID != nil && *req.ModuleID != lesson.ModuleID {
+		if !slices.ContainsFunc(modules, func(m models.Module) bool { return m.ID == *req.ModuleID }) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Module not found"})
+			return
+		}
+		lesson.ModuleID = *req.ModuleID
+		// Without a position, a moved lesson goes to the end
+		lesson.Position = 0
+	}
+	if req.Title != nil {
+		lesson.Title = *req.Title
+	}
+	if req.Type != nil {
+		lesson.Type = *req.Type
+	}
+	if req.VideoURL != nil {
+		lesson.VideoURL = *req.VideoURL
+	}
+	if req.Content != nil {
+		lesson.Content = *req.Content
+	}
+	if req.AttachmentURL != nil {
+		lesson.AttachmentURL = *req.AttachmentURL
+	}
+	if req.DurationSeconds != nil {
+		lesson.DurationSeconds = *req.DurationSeconds
+	}
+	if req.Position != nil {
+		lesson.Position = *req.Position
+	}
+	if msg := checkLessonContent(&lesson); msg != "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: msg})
+		return
+	}
+	if err := h.curriculum.UpdateLesson(c.Request.Context(), &lesson); err != nil {
+		curriculumError(c, err, "Lesson not found", "Failed to update lesson")
+		return
+	}
+
+	c.JSON(http.StatusOK, lesson)
+}
+
+// DeleteLesson removes a lesson. Access is restricted by the
+// curriculum:edit permission in setupRoutes and to the course's authors.
+func (h *Handler) DeleteLesson(c *gin.Context) {
+	if _, ok := h.loadCurriculumCourse(c); !ok {
+		return
+	}
+	if err := h.curriculum.DeleteLesson(c.Request.Context(), c.Param("id"), c.Param("lesson_id")); err != nil {
+		curriculumError(c, err, "Lesson not found", "Failed to delete lesson")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Lesson deleted"})
+}
+
+// checkLessonContent makes sure the lesson has the content its type needs,
+// and drops content of the other types. It returns an error message, or ""
+// if the lesson is valid.
+func checkLessonContent(lesson *models.Lesson) string {
+	switch lesson.Type {
+	case models.LessonVideo:
+		lesson.Content, lesson.AttachmentURL = "", ""
+		if lesson.VideoURL == "" {
+			return "video_url is required for video lessons"
+		}
+	case models.LessonText:
+		lesson.VideoURL, lesson.AttachmentURL = "", ""
+		if lesson.Content == "" {
+			return "content is required for text lessons"
+		}
+	case models.LessonAttachment:
+		lesson.VideoURL, lesson.Content = "", ""
+		if lesson.AttachmentURL == "" {
+			return "attachment_url is required for attachment lessons"
+		}
+	}
+	return ""
+}
+
+// loadCurriculumCourse returns the course named by the :id path parameter
+// if the caller may change its curriculum, writing an error response if
+// not. Only the course's authors may, and only before it is released: a
+// released course goes back to review first, so that students never see
+// changes nobody has reviewed.
+func (h *Handler) loadCurriculumCourse(c *gin.Context) (models.Course, bool) {
+	course, ok := h.loadCourse(c)
+	if !ok {
+		return models.Course{}, false
+	}
+	if !h.isCourseAuthor(c.GetString("user_id"), c.GetString("role"), course) {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Only the course's mentor can edit its curriculum"})
+		return models.Course{}, false
+	}
+	if course.Released() {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Move the course back to review before editing its curriculum"})
+		return models.Course{}, false
+	}
+	return course, true
+}
+
+// loadOutline returns the curriculum of the course named by the :id path
+// parameter, writing a 404 if there is no such course.
+func (h *Handler) loadOutline(c *gin.Context) ([]models.Module, bool) {
+	modules, err := h.curriculum.Outline(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		curriculumError(c, err, "Course not found", "Failed to load curriculum")
+		return nil, false
+	}
+	return modules, true
+}
+
+// findLesson returns the lesson with the given ID from an outline.
+func findLesson(modules []models.Module, id string) (models.Lesson, bool) {
+	for _, m := range modules {
+		for _, l := range m.Lessons {
+			if l.ID == id {
+				return l, true
+			}
+		}
+	}
+	return models.Lesson{}, false
+}
+
+// curriculumError writes a 404 with notFound for repository.ErrNotFound, or
+// a 500 with failed otherwise.
+func curriculumError(c *gin.Context, err error, notFound, failed string) {
+	if errors.Is(err, repository.ErrNotFound) {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: notFound})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: failed})
+}
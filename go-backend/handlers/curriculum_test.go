@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+func newCurriculumTest(t *testing.T) (*apiTest, models.User, models.Course) {
+	t.Helper()
+	a := newAPITest(t, Config{})
+	a.router.POST("/api/courses/:id/modules", a.auth, a.h.CreateModule)
+	a.router.PATCH("/api/courses/:id/modules/:module_id", a.auth, a.h.UpdateModule)
+	a.router.DELETE("/api/courses/:id/modules/:module_id", a.auth, a.h.DeleteModule)
+	a.router.POST("/api/courses/:id/modules/:module_id/lessons", a.auth, a.h.CreateLesson)
+	a.router.PATCH("/api/courses/:id/lessons/:lesson_id", a.auth, a.h.UpdateLesson)
+	a.router.DELETE("/api/courses/:id/lessons/:lesson_id", a.auth, a.h.DeleteLesson)
+
+	mentor, course := a.newMentorCourse(t, models.CourseDraft)
+	return a, mentor, course
+}
+
+// outline returns the stored curriculum of the course, written as module
+// titles followed by their lessons' titles.
+func outline(t *testing.T, a *apiTest, courseID string) string {
+	t.Helper()
+	stored, err := a.store.Curriculum.Outline(t.Context(), courseID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var modules []string
+	for i, m := range stored {
+		if m.Position != i+1 {
+			t.Errorf("module %q is at position %d, want %d", m.Title, m.Position, i+1)
+		}
+		s := m.Title + ":"
+		for j, l := range m.Lessons {
+			if l.Position != j+1 {
+				t.Errorf("lesson %q is at position %d, want %d", l.Title, l.Position, j+1)
+			}
+			s += " " + l.Title
+		}
+		modules = append(modules, s)
+	}
+	return strings.Join(modules, ", ")
+}
+
+func TestCurriculumOrder(t *testing.T) {
+	a, mentor, course := newCurriculumTest(t)
+	base := "/api/courses/" + course.ID
+
+	addModule := func(title string, position int) models.Module {
+		t.Helper()
+		var m models.Module
+		a.do(t, http.MethodPost, base+"/modules", mentor.ID, models.ModuleRequest{Title: title, Position: position}, http.StatusCreated, &m)
+		return m
+	}
+	addLesson := func(module models.Module, title string, position int) models.Lesson {
+		t.Helper()
+		var l models.Lesson
+		a.do(t, http.MethodPost, base+"/modules/"+module.ID+"/lessons", mentor.ID, models.LessonRequest{
+			Title:           title,
+			Type:            models.LessonText,
+			Content:         "Text",
+			DurationSeconds: 600,
+			Position:        position,
+		}, http.StatusCreated, &l)
+		return l
+	}
+
+	intro := addModule("Intro", 0)
+	advanced := addModule("Advanced", 0)
+	addModule("Welcome", 1)
+	first := addLesson(intro, "First", 0)
+	addLesson(intro, "Second", 0)
+	addLesson(intro, "Zeroth", 1)
+	if got, want := outline(t, a, course.ID), "Welcome:, Intro: Zeroth First Second, Advanced:"; got != want {
+		t.Errorf("outline = %s, want %s", got, want)
+	}
+
+	a.do(t, http.MethodPatch, base+"/modules/"+advanced.ID, mentor.ID, models.ModuleUpdateRequest{Position: ptr(1)}, http.StatusOK, nil)
+	var moved models.Lesson
+	a.do(t, http.MethodPatch, base+"/lessons/"+first.ID, mentor.ID, models.LessonUpdateRequest{ModuleID: ptr(advanced.ID)}, http.StatusOK, &moved)
+	if moved.ModuleID != advanced.ID || moved.Position != 1 {
+		t.Errorf("moved lesson is in %s at %d, want %s at 1", moved.ModuleID, moved.Position, advanced.ID)
+	}
+	if got, want := outline(t, a, course.ID), "Advanced: First, Welcome:, Intro: Zeroth Second"; got != want {
+		t.Errorf("outline after moving = %s, want %s", got, want)
+	}
+
+	a.do(t, http.MethodDelete, base+"/modules/"+intro.ID, mentor.ID, nil, http.StatusOK, nil)
+	if got, want := outline(t, a, course.ID), "Advanced: First, Welcome:"; got != want {
+		t.Errorf("outline after deleting a module = %s, want %s", got, want)
+	}
+	stored, err := a.store.Courses.GetByID(t.Context(), course.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.LessonCount != 1 || stored.Duration != "10 minutes" {
+		t.Errorf("course has %d lessons lasting %q, want 1 lasting 10 minutes", stored.LessonCount, stored.Duration)
+	}
+
+	// Invalid edits
+	a.do(t, http.MethodPost, base+"/modules", mentor.ID, models.ModuleRequest{Title: "Negative", Position: -1}, http.StatusBadRequest, nil)
+	a.do(t, http.MethodPatch, base+"/modules/"+advanced.ID, mentor.ID, models.ModuleUpdateRequest{Position: ptr(0)}, http.StatusBadRequest, nil)
+	a.do(t, http.MethodPatch, base+"/modules/missing", mentor.ID, models.ModuleUpdateRequest{Title: ptr("x")}, http.StatusNotFound, nil)
+	a.do(t, http.MethodPatch, base+"/lessons/"+first.ID, mentor.ID, models.LessonUpdateRequest{ModuleID: ptr("missing")}, http.StatusNotFound, nil)
+	a.do(t, http.MethodPatch, base+"/lessons/"+first.ID, mentor.ID, models.LessonUpdateRequest{Type: ptr(models.LessonVideo)}, http.StatusBadRequest, nil)
+	a.do(t, http.MethodPost, base+"/modules/missing/lessons", mentor.ID, models.LessonRequest{Title: "x", Type: models.LessonText, Content: "x"}, http.StatusNotFound, nil)
+}
+
+func TestCurriculumAuthors(t *testing.T) {
+	a, mentor, course := newCurriculumTest(t)
+	base := "/api/courses/" + course.ID
+	req := models.ModuleRequest{Title: "Intro"}
+
+	// Only the course's mentor, or an admin
+	other := a.newUser(t, models.RoleMentor)
+	a.do(t, http.MethodPost, base+"/modules", other.ID, req, http.StatusForbidden, nil)
+	a.do(t, http.MethodPost, base+"/modules", a.newUser(t, models.RoleAdmin).ID, req, http.StatusCreated, nil)
+	var module models.Module
+	a.do(t, http.MethodPost, base+"/modules", mentor.ID, req, http.StatusCreated, &module)
+	a.do(t, http.MethodPost, "/api/courses/missing/modules", mentor.ID, req, http.StatusNotFound, nil)
+
+	// Not once the course is released
+	if err := a.store.Courses.SetStatus(t.Context(), models.CourseStatusChange{CourseID: course.ID, From: models.CourseDraft, To: models.CoursePublished}); err != nil {
+		t.Fatal(err)
+	}
+	a.do(t, http.MethodPost, base+"/modules", mentor.ID, req, http.StatusConflict, nil)
+	a.do(t, http.MethodPatch, base+"/modules/"+module.ID, mentor.ID, models.ModuleUpdateRequest{Position: ptr(1)}, http.StatusConflict, nil)
+	a.do(t, http.MethodDelete, base+"/modules/"+module.ID, mentor.ID, nil, http.StatusConflict, nil)
+}
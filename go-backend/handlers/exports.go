@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/randtoken"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// exportCooldown is how long after requesting an export a user has to wait
+// before requesting another, unless it failed.
+const exportCooldown = time.Hour
+
+// RequestExport starts building a copy of the current user's personal data.
+// The user is emailed a download link when it is ready.
+func (h *Handler) RequestExport(c *gin.Context) {
+	userID := c.GetString("user_id")
+	ctx := c.Request.Context()
+
+	exports, err := h.exports.ListExports(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load exports"})
+		return
+	}
+	now := time.Now()
+	for _, e := range exports {
+		switch {
+		case e.Status == models.ExportPending || e.Status == models.ExportRunning:
+			c.JSON(http.StatusConflict, models.ErrorResponse{Error: "An export is already in progress"})
+			return
+		case e.Status == models.ExportReady && now.Sub(e.RequestedAt) < exportCooldown:
+			wait := exportCooldown - now.Sub(e.RequestedAt)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, models.ErrorResponse{Error: "An export was requested recently, please use that one"})
+			return
+		}
+	}
+
+	job := models.DataExport{
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		Status:      models.ExportPending,
+		RequestedAt: now,
+	}
+	if err := h.exports.CreateExport(ctx, job); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create export"})
+		return
+	}
+	if err := h.recordAudit(c, models.AuditEvent{Action: models.AuditExportRequested, UserID: userID, TargetID: job.ID}); err != nil {
+		log.Printf("Failed to record export request %s: %v", job.ID, err)
+	}
+	if h.exportWorker != nil {
+		h.exportWorker.Wake()
+	}
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// ListExports returns the current user's exports, newest first.
+func (h *Handler) ListExports(c *gin.Context) {
+	exports, err := h.exports.ListExports(c.Request.Context(), c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load exports"})
+		return
+	}
+	c.JSON(http.StatusOK, exports)
+}
+
+// GetExport returns one of the current user's exports.
+func (h *Handler) GetExport(c *gin.Context) {
+	job, ok := h.loadOwnExport(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// DownloadExport sends the archive of one of the current user's exports.
+func (h *Handler) DownloadExport(c *gin.Context) {
+	job, ok := h.loadOwnExport(c)
+	if !ok {
+		return
+	}
+	h.sendExport(c, job)
+}
+
+// DownloadExportByToken sends the archive of the export whose emailed link
+// carries token. It needs no other authentication, so the link can be
+// opened in any browser.
+func (h *Handler) DownloadExportByToken(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Token is required"})
+		return
+	}
+	job, err := h.exports.GetExportByToken(c.Request.Context(), randtoken.Hash(token))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Invalid or expired download link"})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load export"})
+		}
+		return
+	}
+	h.sendExport(c, job)
+}
+
+// loadOwnExport returns the export named by the :id path parameter, writing
+// a 404 if it does not belong to the current user.
+func (h *Handler) loadOwnExport(c *gin.Context) (models.DataExport, bool) {
+	job, err := h.exports.GetExport(c.Request.Context(), c.Param("id"))
+	if err == nil && job.UserID != c.GetString("user_id") {
+		err = repository.ErrNotFound
+	}
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Export not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load export"})
+		}
+		return models.DataExport{}, false
+	}
+	return job, true
+}
+
+// sendExport responds with the archive of a ready export and records the
+// download in the audit log.
+func (h *Handler) sendExport(c *gin.Context, job models.DataExport) {
+	if job.Status == models.ExportExpired || (job.ExpiresAt != nil && time.Now().After(*job.ExpiresAt)) {
+		c.JSON(http.StatusGone, models.ErrorResponse{Error: "Export has expired"})
+		return
+	}
+	if job.Status != models.ExportReady {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Export is not ready"})
+		return
+	}
+
+	archive, err := h.exports.GetExportArchive(c.Request.Context(), job.ID)
+	if errors.Is(err, repository.ErrNotFound) {
+		c.JSON(http.StatusGone, models.ErrorResponse{Error: "Export has expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load export"})
+		return
+	}
+	// Downloads of personal data must be accounted for, so a download that
+	// cannot be recorded is refused.
+	if err := h.recordAudit(c, models.AuditEvent{Action: models.AuditExportDownloaded, UserID: job.UserID, TargetID: job.ID}); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to record download"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Disposition", `attachment; filename="emergent-data-`+job.RequestedAt.UTC().Format("2006-01-02")+`.zip"`)
+	c.Data(http.StatusOK, "application/zip", archive)
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/export"
+	"github.com/cuanin/emergent-backend/models"
+)
+
+// newExportTest returns an apiTest with a running export worker whose
+// archives can be downloaded for ttl.
+func newExportTest(t *testing.T, ttl time.Duration) (*apiTest, mailbox) {
+	t.Helper()
+	mail := newMailbox()
+	a := newAPITest(t, Config{})
+	worker := export.NewWorker(a.store, export.Config{
+		Mailer:      mail,
+		DownloadURL: "http://localhost:8080/api/exports/download",
+		TTL:         ttl,
+	})
+	a.h.exportWorker = worker
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		worker.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	a.router.POST("/api/user/exports", a.auth, a.h.RequestExport)
+	a.router.GET("/api/user/exports", a.auth, a.h.ListExports)
+	a.router.GET("/api/user/exports/:id", a.auth, a.h.GetExport)
+	a.router.GET("/api/user/exports/:id/download", a.auth, a.h.DownloadExport)
+	a.router.GET("/api/exports/download", a.h.DownloadExportByToken)
+	return a, mail
+}
+
+// requestExport requests an export and waits for the link to it to be
+// emailed, returning the export and the link's token.
+func requestExport(t *testing.T, a *apiTest, mail mailbox, user models.User) (models.DataExport, string) {
+	t.Helper()
+	var job models.DataExport
+	a.do(t, http.MethodPost, "/api/user/exports", user.ID, nil, http.StatusAccepted, &job)
+	if job.Status != models.ExportPending {
+		t.Fatalf("new export is %s, want %s", job.Status, models.ExportPending)
+	}
+	token := mailToken(t, mail.receive(t, user.Email))
+	a.do(t, http.MethodGet, "/api/user/exports/"+job.ID, user.ID, nil, http.StatusOK, &job)
+	return job, token
+}
+
+// checkArchive checks that w holds a ZIP archive of user's account.
+func checkArchive(t *testing.T, w []byte, user models.User) {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(w), int64(len(w)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := zr.Open("account.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var account models.User
+	if err := json.NewDecoder(f).Decode(&account); err != nil {
+		t.Fatal(err)
+	}
+	if account.ID != user.ID || account.Email != user.Email {
+		t.Errorf("account.json = %+v, want user %s", account, user.ID)
+	}
+}
+
+func TestExportLifecycle(t *testing.T) {
+	a, mail := newExportTest(t, time.Hour)
+	user := a.newUser(t, models.RoleStudent)
+
+	job, token := requestExport(t, a, mail, user)
+	if job.Status != models.ExportReady || job.ExpiresAt == nil {
+		t.Fatalf("export after the link was sent = %+v, want it ready", job)
+	}
+
+	// Both the emailed link and the authenticated endpoint serve it
+	w := a.do(t, http.MethodGet, "/api/exports/download?token="+url.QueryEscape(token), "", nil, http.StatusOK, nil)
+	if got := w.Header().Get("Content-Type"); got != "application/zip" {
+		t.Errorf("Content-Type = %q, want application/zip", got)
+	}
+	checkArchive(t, w.Body.Bytes(), user)
+	w = a.do(t, http.MethodGet, "/api/user/exports/"+job.ID+"/download", user.ID, nil, http.StatusOK, nil)
+	checkArchive(t, w.Body.Bytes(), user)
+	a.do(t, http.MethodGet, "/api/exports/download?token=wrong", "", nil, http.StatusNotFound, nil)
+
+	// Other users cannot see it
+	other := a.newUser(t, models.RoleStudent)
+	a.do(t, http.MethodGet, "/api/user/exports/"+job.ID, other.ID, nil, http.StatusNotFound, nil)
+	a.do(t, http.MethodGet, "/api/user/exports/"+job.ID+"/download", other.ID, nil, http.StatusNotFound, nil)
+	var list []models.DataExport
+	a.do(t, http.MethodGet, "/api/user/exports", other.ID, nil, http.StatusOK, &list)
+	if len(list) != 0 {
+		t.Errorf("other user's exports = %+v, want none", list)
+	}
+
+	// A finished export has to be used for a while before asking again
+	w = a.do(t, http.MethodPost, "/api/user/exports", user.ID, nil, http.StatusTooManyRequests, nil)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After on a repeated export request")
+	}
+
+	// Every step is in the audit log
+	events, err := a.store.Activity.ListAudit(t.Context(), user.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := map[string]int{}
+	for _, e := range events {
+		if e.TargetID == job.ID {
+			count[e.Action]++
+		}
+	}
+	if count[models.AuditExportRequested] != 1 || count[models.AuditExportCompleted] != 1 || count[models.AuditExportDownloaded] != 2 {
+		t.Errorf("audit events for the export = %v", count)
+	}
+}
+
+func TestExportInProgress(t *testing.T) {
+	a := newAPITest(t, Config{})
+	a.router.POST("/api/user/exports", a.auth, a.h.RequestExport)
+	a.router.GET("/api/user/exports/:id/download", a.auth, a.h.DownloadExport)
+	user := a.newUser(t, models.RoleStudent)
+
+	// Without a worker the export stays pending
+	var job models.DataExport
+	a.do(t, http.MethodPost, "/api/user/exports", user.ID, nil, http.StatusAccepted, &job)
+	a.do(t, http.MethodPost, "/api/user/exports", user.ID, nil, http.StatusConflict, nil)
+	a.do(t, http.MethodGet, "/api/user/exports/"+job.ID+"/download", user.ID, nil, http.StatusConflict, nil)
+}
+
+func TestExportExpires(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	a, mail := newExportTest(t, ttl)
+	user := a.newUser(t, models.RoleStudent)
+
+	job, token := requestExport(t, a, mail, user)
+	time.Sleep(2 * ttl)
+	a.do(t, http.MethodGet, "/api/exports/download?token="+url.QueryEscape(token), "", nil, http.StatusGone, nil)
+	a.do(t, http.MethodGet, "/api/user/exports/"+job.ID+"/download", user.ID, nil, http.StatusGone, nil)
+}
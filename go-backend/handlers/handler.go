@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"os"
+	"time"
+
+	"github.com/cuanin/emergent-backend/export"
+	"github.com/cuanin/emergent-backend/gateway"
+	"github.com/cuanin/emergent-backend/jwtkeys"
+	"github.com/cuanin/emergent-backend/mailer"
+	"github.com/cuanin/emergent-backend/media"
+	"github.com/cuanin/emergent-backend/oidcauth"
+	"github.com/cuanin/emergent-backend/rbac"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/cuanin/emergent-backend/search"
+	"github.com/cuanin/emergent-backend/throttle"
+)
+
+// Config holds the optional settings of a Handler.
+type Config struct {
+	// Keys sign and verify JWTs. Defaults to HS256 with JWT_SECRET.
+	Keys *jwtkeys.KeySet
+	// AccessTokenTTL and RefreshTokenTTL are how long the tokens issued at
+	// login last. They default to DefaultAccessTokenTTL and
+	// DefaultRefreshTokenTTL.
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// Mailer delivers account emails. Messages are logged when nil.
+	Mailer mailer.Mailer
+	// AppURL is the base URL of the web app, used for links sent by email.
+	AppURL string
+	// LoginPolicy limits failed logins. The zero value means
+	// throttle.DefaultPolicy.
+	LoginPolicy throttle.Policy
+	// MFAIssuer names the service in authenticator apps. Defaults to
+	// "Emergent".
+	MFAIssuer string
+	// OIDCProviders are the social login providers by name.
+	OIDCProviders map[string]*oidcauth.Provider
+	// Exports is woken when a user requests a data export. When nil,
+	// requests wait for a worker that polls the store.
+	Exports *export.Worker
+	// Search is the course search index, which the handlers keep up to date
+	// as courses change. Defaults to an empty index.
+	Search *search.Index
+	// Policy grants permissions checked inside handlers, such as who may
+	// read lessons of courses they are not enrolled in. Defaults to
+	// rbac.DefaultPolicy.
+	Policy rbac.Policy
+	// Media signs the links that open course videos and lesson files.
+	// Defaults to a random key, so links stop working on restart.
+	Media *media.Signer
+	// MediaURL is the address of the endpoint that checks media links.
+	// Defaults to http://localhost:8080/api/media.
+	MediaURL string
+	// MediaTTL is how long a media link stays valid. Defaults to
+	// media.DefaultTTL.
+	MediaTTL time.Duration
+	// MediaProxy streams media through the API instead of redirecting to
+	// where it is stored, so that its URL is never revealed.
+	MediaProxy bool
+	// PaymentProvider charges course purchases. Defaults to a
+	// gateway.Simulator.
+	PaymentProvider gateway.Provider
+	// PaymentExpiry is how long a buyer has to complete a payment. Defaults
+	// to 24 hours.
+	PaymentExpiry time.Duration
+}
+
+// Handler serves the API endpoints on top of a storage backend.
+type Handler struct {
+	users      repository.UserRepository
+	courses    repository.CourseRepository
+	curriculum repository.CurriculumRepository
+	payments   repository.PaymentRepository
+	tokens     repository.TokenRepository
+	settings   repository.SettingsRepository
+	activity   repository.ActivityRepository
+	exports    repository.ExportRepository
+	coupons    repository.CouponRepository
+
+	keys       *jwtkeys.KeySet
+	mailer     mailer.Mailer
+	appURL     string
+	loginGuard *throttle.Guard
+	mfaIssuer  string
+
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+
+	oidcProviders map[string]*oidcauth.Provider
+	exportWorker  *export.Worker
+	search        *search.Index
+	policy        rbac.Policy
+
+	mediaSigner *media.Signer
+	mediaURL    string
+	mediaTTL    time.Duration
+	mediaProxy  bool
+
+	paymentProvider gateway.Provider
+	paymentExpiry   time.Duration
+}
+
+// New returns a Handler that reads and writes through the given store.
+func New(store repository.Store, cfg Config) *Handler {
+	if cfg.Keys == nil {
+		cfg.Keys = jwtkeys.NewHMAC([]byte(os.Getenv("JWT_SECRET")))
+	}
+	if cfg.AccessTokenTTL <= 0 {
+		cfg.AccessTokenTTL = DefaultAccessTokenTTL
+	}
+	if cfg.RefreshTokenTTL <= 0 {
+		cfg.RefreshTokenTTL = DefaultRefreshTokenTTL
+	}
+	if cfg.Mailer == nil {
+		cfg.Mailer = &mailer.LogMailer{}
+	}
+	if cfg.AppURL == "" {
+		cfg.AppURL = "http://localhost:3000"
+	}
+	if cfg.LoginPolicy == (throttle.Policy{}) {
+		cfg.LoginPolicy = throttle.DefaultPolicy()
+	}
+	if cfg.MFAIssuer == "" {
+		cfg.MFAIssuer = "Emergent"
+	}
+	if cfg.Search == nil {
+		cfg.Search = search.New()
+	}
+	if cfg.Policy == nil {
+		cfg.Policy = rbac.DefaultPolicy()
+	}
+	if cfg.Media == nil {
+		cfg.Media = media.NewRandomSigner()
+	}
+	if cfg.MediaURL == "" {
+		cfg.MediaURL = "http://localhost:8080/api/media"
+	}
+	if cfg.MediaTTL <= 0 {
+		cfg.MediaTTL = media.DefaultTTL
+	}
+	if cfg.PaymentProvider == nil {
+		cfg.PaymentProvider = gateway.NewSimulator()
+	}
+	if cfg.PaymentExpiry <= 0 {
+		cfg.PaymentExpiry = 24 * time.Hour
+	}
+	return &Handler{
+		users:      store.Users,
+		courses:    store.Courses,
+		curriculum: store.Curriculum,
+		payments:   store.Payments,
+		tokens:     store.Tokens,
+		settings:   store.Settings,
+		activity:   store.Activity,
+		exports:    store.Exports,
+		coupons:    store.Coupons,
+		keys:       cfg.Keys,
+		mailer:     cfg.Mailer,
+		appURL:     cfg.AppURL,
+		loginGuard: throttle.New(store.Throttles, cfg.LoginPolicy),
+		mfaIssuer:  cfg.MFAIssuer,
+
+		accessTokenTTL:  cfg.AccessTokenTTL,
+		refreshTokenTTL: cfg.RefreshTokenTTL,
+
+		oidcProviders: cfg.OIDCProviders,
+		exportWorker:  cfg.Exports,
+		search:        cfg.Search,
+		policy:        cfg.Policy,
+
+		mediaSigner: cfg.Media,
+		mediaURL:    cfg.MediaURL,
+		mediaTTL:    cfg.MediaTTL,
+		mediaProxy:  cfg.MediaProxy,
+
+		paymentProvider: cfg.PaymentProvider,
+		paymentExpiry:   cfg.PaymentExpiry,
+	}
+}
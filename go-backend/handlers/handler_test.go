@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/jwtkeys"
+	"github.com/cuanin/emergent-backend/mailer"
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// apiTestPassword is the password of the accounts made by apiTest.newUser.
+const apiTestPassword = "correct horse battery staple"
+
+// apiTest serves handlers on an in-memory store. Tests register the routes
+// they exercise on router, with auth in place of the auth middleware.
+type apiTest struct {
+	store  repository.Store
+	h      *Handler
+	router *gin.Engine
+}
+
+func newAPITest(t *testing.T, cfg Config) *apiTest {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	if cfg.Keys == nil {
+		cfg.Keys = jwtkeys.NewHMAC([]byte("test-secret"))
+	}
+	store := repository.NewMemoryStore()
+	return &apiTest{store, New(store, cfg), gin.New()}
+}
+
+// auth authenticates the user named in the X-User-ID header with their
+// stored role, as the auth middleware does for an access token. The token's
+// jti is taken from the X-Token-ID header.
+func (a *apiTest) auth(c *gin.Context) {
+	user, err := a.store.Users.GetByID(c.Request.Context(), c.GetHeader("X-User-ID"))
+	if err != nil || user.DeletedAt != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, models.ErrorResponse{Error: "User not found"})
+		return
+	}
+	role := user.EffectiveRole()
+	c.Set("user_id", user.ID)
+	c.Set("role", role)
+	c.Set("is_admin", role == models.RoleAdmin)
+	c.Set("jti", c.GetHeader("X-Token-ID"))
+	c.Set("token_expires_at", time.Now().Add(a.h.accessTokenTTL))
+}
+
+// newUser creates a verified account with role and apiTestPassword.
+func (a *apiTest) newUser(t *testing.T, role string) models.User {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(apiTestPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := models.User{
+		ID:              uuid.New().String(),
+		Email:           uuid.New().String() + "@example.com",
+		Password:        string(hash),
+		FullName:        "Test User",
+		Role:            role,
+		EmailVerified:   true,
+		CreatedAt:       time.Now(),
+		EnrolledCourses: []string{},
+		Badges:          []string{},
+		Progress:        map[string]int{},
+	}
+	if err := a.store.Users.Create(t.Context(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// request builds a request with body as JSON, made by userID if it is not
+// empty.
+func (a *apiTest) request(method, path, userID string, body any) *http.Request {
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(b))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if userID != "" {
+		req.Header.Set("X-User-ID", userID)
+	}
+	return req
+}
+
+// serve serves req and fails the test unless it gets wantCode.
+func (a *apiTest) serve(t *testing.T, req *http.Request, wantCode int) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, req)
+	if w.Code != wantCode {
+		t.Fatalf("%s %s = %d %s, want %d", req.Method, req.URL, w.Code, w.Body, wantCode)
+	}
+	return w
+}
+
+// do sends a request with body as JSON, made by userID if it is not empty,
+// and decodes the response into resp if it is not nil.
+func (a *apiTest) do(t *testing.T, method, path, userID string, body any, wantCode int, resp any) *httptest.ResponseRecorder {
+	t.Helper()
+	w := a.serve(t, a.request(method, path, userID, body), wantCode)
+	if resp != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, w.Body)
+		}
+	}
+	return w
+}
+
+// mailbox is a Mailer that keeps what it is sent for the test to read.
+type mailbox chan mailer.Message
+
+func newMailbox() mailbox {
+	return make(mailbox, 16)
+}
+
+// Send implements mailer.Mailer.
+func (m mailbox) Send(_ context.Context, msg mailer.Message) error {
+	m <- msg
+	return nil
+}
+
+// receive waits for the next message to to, skipping messages to others,
+// or for the next message to anyone if to is empty.
+func (m mailbox) receive(t *testing.T, to string) mailer.Message {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case msg := <-m:
+			if to == "" || msg.To == to {
+				return msg
+			}
+		case <-timeout:
+			if to == "" {
+				t.Fatal("no email")
+			}
+			t.Fatalf("no email to %s", to)
+		}
+	}
+}
+
+var linkToken = regexp.MustCompile(`[?&]token=([^\s&]+)`)
+
+// mailToken returns the token in the link in msg.
+func mailToken(t *testing.T, msg mailer.Message) string {
+	t.Helper()
+	match := linkToken.FindStringSubmatch(msg.Body)
+	if match == nil {
+		t.Fatalf("no link with a token in %q", msg.Body)
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// newCourse creates a course priced at Rp 499.000 with the given title and
+// status.
+func (a *apiTest) newCourse(t *testing.T, title, status string) models.Course {
+	t.Helper()
+	course := models.Course{
+		Title:       title,
+		Description: "About " + title,
+		Price:       money.New(499000, money.IDR),
+		Category:    "Finance",
+		Level:       "Beginner",
+		MentorName:  "Mentor",
+		Duration:    "1h",
+		Topics:      []string{},
+		CreatedAt:   time.Now(),
+		Status:      status,
+	}
+	if err := a.store.Courses.Create(t.Context(), &course); err != nil {
+		t.Fatal(err)
+	}
+	a.h.search.Put(course)
+	return course
+}
+
+// newMentorCourse creates a mentor and a course with status that they
+// teach.
+func (a *apiTest) newMentorCourse(t *testing.T, status string) (models.User, models.Course) {
+	t.Helper()
+	mentor := a.newUser(t, models.RoleMentor)
+	course := a.newCourse(t, "Budgeting Basics", status)
+	course.MentorID = mentor.ID
+	if err := a.store.Courses.Update(t.Context(), course); err != nil {
+		t.Fatal(err)
+	}
+	return mentor, course
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/cuanin/emergent-backend/media"
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/rbac"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+)
+
+// GetCourseMedia returns a signed link to the full video of a course. Only
+// users enrolled in the course and its authors get one.
+func (h *Handler) GetCourseMedia(c *gin.Context) {
+	course, ok := h.loadCourse(c)
+	if !ok {
+		return
+	}
+	user, ok := h.loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	if !h.canViewContent(user, course) {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Enroll in the course to watch its video"})
+		return
+	}
+	if course.VideoURL == "" {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Course has no video"})
+		return
+	}
+
+	c.JSON(http.StatusOK, h.mediaLink(user.ID, course.ID, ""))
+}
+
+// ServeMedia opens the media a signed link points to, by redirecting to
+// where it is stored or, with MediaProxy, by streaming it. The link needs no
+// other credentials, but the user it was issued to must still be active and
+// have access to the course.
+func (h *Handler) ServeMedia(c *gin.Context) {
+	link, err := h.mediaSigner.Verify(c.Request.URL.Query(), time.Now())
+	if errors.Is(err, media.ErrLinkExpired) {
+		c.JSON(http.StatusGone, models.ErrorResponse{Error: "Media link has expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Invalid media link"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, link.UserID)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+	if err != nil || user.Status() != models.UserActive {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Media link is no longer valid"})
+		return
+	}
+	course, err := h.courses.GetByID(ctx, link.CourseID)
+	if errors.Is(err, repository.ErrNotFound) {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Media not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load media"})
+		return
+	}
+	if !h.canViewContent(user, course) {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Media link is no longer valid"})
+		return
+	}
+
+	target, err := h.mediaTarget(ctx, link)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load media"})
+		return
+	}
+	if target == "" {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Media not found"})
+		return
+	}
+
+	if h.mediaProxy {
+		proxyMedia(c, target)
+		return
+	}
+	c.Header("Cache-Control", "private, no-store")
+	c.Redirect(http.StatusFound, target)
+}
+
+// canViewContent reports whether user may open the paid content of a
+// course, its video and its lessons: they bought it or author it.
+func (h *Handler) canViewContent(user models.User, course models.Course) bool {
+	return slices.Contains(user.EnrolledCourses, course.ID) || h.canAuthor(user, course)
+}
+
+// canAuthor reports whether user may edit the curriculum of course, and so
+// see where its media is stored.
+func (h *Handler) canAuthor(user models.User, course models.Course) bool {
+	role := user.EffectiveRole()
+	return h.policy.Allows(role, rbac.EditCurriculum) && h.isCourseAuthor(user.ID, role, course)
+}
+
+// mediaLink signs a link for the user to the video of a course, or to the
+// media of one of its lessons.
+func (h *Handler) mediaLink(userID, courseID, lessonID string) *models.MediaLink {
+	expires := time.Now().Add(h.mediaTTL).Truncate(time.Second)
+	q := h.mediaSigner.Sign(media.Link{
+		CourseID:  courseID,
+		LessonID:  lessonID,
+		UserID:    userID,
+		ExpiresAt: expires,
+	})
+	return &models.MediaLink{URL: h.mediaURL + "?" + q.Encode(), ExpiresAt: expires}
+}
+
+// mediaTarget returns the stored URL of the media a link points to, which is
+// empty if the course or lesson no longer has any.
+func (h *Handler) mediaTarget(ctx context.Context, link media.Link) (string, error) {
+	if link.LessonID == "" {
+		course, err := h.courses.GetByID(ctx, link.CourseID)
+		if err != nil {
+			return "", err
+		}
+		return course.VideoURL, nil
+	}
+	modules, err := h.curriculum.Outline(ctx, link.CourseID)
+	if err != nil {
+		return "", err
+	}
+	lesson, _ := findLesson(modules, link.LessonID)
+	return lessonMediaURL(lesson), nil
+}
+
+// lessonMediaURL returns the URL of a lesson's video or attachment, or "" for
+// a text lesson.
+func lessonMediaURL(lesson models.Lesson) string {
+	switch lesson.Type {
+	case models.LessonVideo:
+		return lesson.VideoURL
+	case models.LessonAttachment:
+		return lesson.AttachmentURL
+	}
+	return ""
+}
+
+// proxyMedia streams the media at target to the client. Range requests are
+// passed through, so players can seek; the client's cookies and credentials
+// are not.
+func proxyMedia(c *gin.Context, target string) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		log.Printf("Cannot proxy media URL %q", target)
+		c.JSON(http.StatusBadGateway, models.ErrorResponse{Error: "Failed to load media"})
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL = u
+			r.Out.Host = u.Host
+			r.Out.Header.Del("Authorization")
+			r.Out.Header.Del("Cookie")
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Failed to proxy media from %s: %v", u.Host, err)
+			c.JSON(http.StatusBadGateway, models.ErrorResponse{Error: "Failed to load media"})
+		},
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
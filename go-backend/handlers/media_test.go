@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/media"
+	"github.com/cuanin/emergent-backend/models"
+)
+
+const (
+	testMediaURL = "http://api.test/api/media"
+	testVideoURL = "https://cdn.example.com/course.mp4"
+)
+
+func newMediaTest(t *testing.T) (*apiTest, *media.Signer, models.Course) {
+	t.Helper()
+	signer := media.NewRandomSigner()
+	a := newAPITest(t, Config{Media: signer, MediaURL: testMediaURL, MediaTTL: time.Hour})
+	a.router.GET("/api/courses/:id/media", a.auth, a.h.GetCourseMedia)
+	a.router.GET("/api/courses/:id/lessons/:lesson_id", a.auth, a.h.GetLesson)
+	a.router.GET("/api/media", a.h.ServeMedia)
+
+	course := a.newCourse(t, "Budgeting Basics", models.CoursePublished)
+	course.VideoURL = testVideoURL
+	if err := a.store.Courses.Update(t.Context(), course); err != nil {
+		t.Fatal(err)
+	}
+	return a, signer, course
+}
+
+// mediaLink asks for a link to the video of the course as userID.
+func mediaLink(t *testing.T, a *apiTest, courseID, userID string) models.MediaLink {
+	t.Helper()
+	var link models.MediaLink
+	a.do(t, http.MethodGet, "/api/courses/"+courseID+"/media", userID, nil, http.StatusOK, &link)
+	return link
+}
+
+// openMedia follows a media link without credentials and fails the test
+// unless it gets wantCode.
+func openMedia(t *testing.T, a *apiTest, link string, wantCode int) *http.Response {
+	t.Helper()
+	path, ok := strings.CutPrefix(link, testMediaURL)
+	if !ok {
+		t.Fatalf("media link %s is not on %s", link, testMediaURL)
+	}
+	return a.do(t, http.MethodGet, "/api/media"+path, "", nil, wantCode, nil).Result()
+}
+
+func TestCourseMedia(t *testing.T) {
+	a, _, course := newMediaTest(t)
+	student := a.newUser(t, models.RoleStudent)
+
+	// Only buyers get a link
+	a.do(t, http.MethodGet, "/api/courses/"+course.ID+"/media", student.ID, nil, http.StatusForbidden, nil)
+	if err := a.store.Users.Enroll(t.Context(), student.ID, course.ID); err != nil {
+		t.Fatal(err)
+	}
+	link := mediaLink(t, a, course.ID, student.ID)
+	if until := time.Until(link.ExpiresAt); until <= 59*time.Minute || until > time.Hour {
+		t.Errorf("link expires in %v, want an hour", until)
+	}
+	if strings.Contains(link.URL, "cdn.example.com") {
+		t.Errorf("link %s gives away where the video is stored", link.URL)
+	}
+
+	resp := openMedia(t, a, link.URL, http.StatusFound)
+	if got := resp.Header.Get("Location"); got != testVideoURL {
+		t.Errorf("Location = %q, want %q", got, testVideoURL)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "private, no-store" {
+		t.Errorf("Cache-Control = %q, want private, no-store", got)
+	}
+
+	// The link is checked against the account each time it is opened
+	if err := a.store.Users.SetSuspension(t.Context(), student.ID, ptr(time.Now()), "spam"); err != nil {
+		t.Fatal(err)
+	}
+	openMedia(t, a, link.URL, http.StatusForbidden)
+
+	a.do(t, http.MethodGet, "/api/courses/missing/media", student.ID, nil, http.StatusNotFound, nil)
+	course.VideoURL = ""
+	if err := a.store.Courses.Update(t.Context(), course); err != nil {
+		t.Fatal(err)
+	}
+	admin := a.newUser(t, models.RoleAdmin)
+	a.do(t, http.MethodGet, "/api/courses/"+course.ID+"/media", admin.ID, nil, http.StatusNotFound, nil)
+}
+
+func TestCourseMediaAuthors(t *testing.T) {
+	a, _, course := newMediaTest(t)
+	mentor := a.newUser(t, models.RoleMentor)
+	course.MentorID = mentor.ID
+	if err := a.store.Courses.Update(t.Context(), course); err != nil {
+		t.Fatal(err)
+	}
+
+	// The course's mentor and admins get links without buying it
+	link := mediaLink(t, a, course.ID, mentor.ID)
+	openMedia(t, a, link.URL, http.StatusFound)
+	openMedia(t, a, mediaLink(t, a, course.ID, a.newUser(t, models.RoleAdmin).ID).URL, http.StatusFound)
+	a.do(t, http.MethodGet, "/api/courses/"+course.ID+"/media", a.newUser(t, models.RoleMentor).ID, nil, http.StatusForbidden, nil)
+
+	// A mentor taken off the course loses the links they were given
+	course.MentorID = ""
+	if err := a.store.Courses.Update(t.Context(), course); err != nil {
+		t.Fatal(err)
+	}
+	openMedia(t, a, link.URL, http.StatusForbidden)
+}
+
+func TestServeMediaRejectsBadLinks(t *testing.T) {
+	a, signer, course := newMediaTest(t)
+	student := a.newUser(t, models.RoleStudent)
+	other := a.newUser(t, models.RoleStudent)
+	for _, u := range []models.User{student, other} {
+		if err := a.store.Users.Enroll(t.Context(), u.ID, course.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sign := func(link media.Link) string {
+		return testMediaURL + "?" + signer.Sign(link).Encode()
+	}
+
+	expired := sign(media.Link{CourseID: course.ID, UserID: student.ID, ExpiresAt: time.Now().Add(-time.Second)})
+	openMedia(t, a, expired, http.StatusGone)
+
+	// Handing a link to someone else means changing its user, which
+	// breaks the signature
+	link, err := url.Parse(mediaLink(t, a, course.ID, student.ID).URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := link.Query()
+	q.Set("user", other.ID)
+	openMedia(t, a, testMediaURL+"?"+q.Encode(), http.StatusForbidden)
+	openMedia(t, a, testMediaURL, http.StatusForbidden)
+
+	// A signed link to a user who did not buy the course, or a course that
+	// is gone, opens nothing
+	stranger := a.newUser(t, models.RoleStudent)
+	openMedia(t, a, sign(media.Link{CourseID: course.ID, UserID: stranger.ID, ExpiresAt: time.Now().Add(time.Hour)}), http.StatusForbidden)
+	openMedia(t, a, sign(media.Link{CourseID: "missing", UserID: student.ID, ExpiresAt: time.Now().Add(time.Hour)}), http.StatusNotFound)
+}
+
+func TestLessonMedia(t *testing.T) {
+	a, _, course := newMediaTest(t)
+	module := models.Module{CourseID: course.ID, Title: "Intro"}
+	if err := a.store.Curriculum.CreateModule(t.Context(), &module); err != nil {
+		t.Fatal(err)
+	}
+	video := models.Lesson{CourseID: course.ID, ModuleID: module.ID, Title: "Video", Type: models.LessonVideo, VideoURL: "https://cdn.example.com/lesson.mp4"}
+	text := models.Lesson{CourseID: course.ID, ModuleID: module.ID, Title: "Text", Type: models.LessonText, Content: "Read this"}
+	for _, l := range []*models.Lesson{&video, &text} {
+		if err := a.store.Curriculum.CreateLesson(t.Context(), l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	student := a.newUser(t, models.RoleStudent)
+	path := "/api/courses/" + course.ID + "/lessons/"
+
+	a.do(t, http.MethodGet, path+video.ID, student.ID, nil, http.StatusForbidden, nil)
+	if err := a.store.Users.Enroll(t.Context(), student.ID, course.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Students get a signed link instead of the stored URL
+	var resp models.LessonResponse
+	a.do(t, http.MethodGet, path+video.ID, student.ID, nil, http.StatusOK, &resp)
+	if resp.VideoURL != "" || resp.Media == nil {
+		t.Fatalf("video lesson = %+v, want a media link without the video URL", resp)
+	}
+	if got := openMedia(t, a, resp.Media.URL, http.StatusFound).Header.Get("Location"); got != video.VideoURL {
+		t.Errorf("Location = %q, want %q", got, video.VideoURL)
+	}
+
+	var textResp models.LessonResponse
+	a.do(t, http.MethodGet, path+text.ID, student.ID, nil, http.StatusOK, &textResp)
+	if textResp.Content != "Read this" || textResp.Media != nil {
+		t.Errorf("text lesson = %+v, want its content and no media link", textResp)
+	}
+
+	// Once the lesson is gone its link opens nothing
+	if err := a.store.Curriculum.DeleteLesson(t.Context(), course.ID, video.ID); err != nil {
+		t.Fatal(err)
+	}
+	openMedia(t, a, resp.Media.URL, http.StatusNotFound)
+	a.do(t, http.MethodGet, path+"missing", student.ID, nil, http.StatusNotFound, nil)
+}
@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/randtoken"
+	"github.com/cuanin/emergent-backend/rbac"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/cuanin/emergent-backend/totp"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// mfaTokenTTL is how long the challenge returned by Login stays valid.
+	mfaTokenTTL = 5 * time.Minute
+	// recoveryCodeCount is the number of recovery codes issued at a time.
+	recoveryCodeCount = 10
+)
+
+// generateMFAToken returns the challenge token that proves the user passed
+// the password step of a login. It cannot be used as an access token.
+func (h *Handler) generateMFAToken(user models.User) (string, error) {
+	now := time.Now()
+	return h.keys.Sign(jwt.MapClaims{
+		"typ":     "mfa",
+		"user_id": user.ID,
+		"iat":     now.Unix(),
+		"exp":     now.Add(mfaTokenTTL).Unix(),
+	})
+}
+
+// parseMFAToken validates a challenge token and returns its user ID.
+func (h *Handler) parseMFAToken(tokenString string) (string, error) {
+	token, err := h.keys.Parse(tokenString, jwt.WithExpirationRequired())
+	if err != nil {
+		return "", err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["typ"] != "mfa" {
+		return "", jwt.ErrTokenInvalidClaims
+	}
+	userID, ok := claims["user_id"].(string)
+	if !ok {
+		return "", jwt.ErrTokenInvalidClaims
+	}
+	return userID, nil
+}
+
+// newRecoveryCodes returns recoveryCodeCount random codes of the form
+// "abcde-fghij".
+func newRecoveryCodes() ([]string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(encoding.EncodeToString(b))
+		codes[i] = s[:5] + "-" + s[5:10]
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode hashes a recovery code as typed by the user, ignoring
+// case, spaces and dashes.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return randtoken.Hash(code)
+}
+
+// issueRecoveryCodes replaces the user's recovery codes with new ones and
+// returns them. Only their hashes are stored.
+func (h *Handler) issueRecoveryCodes(ctx context.Context, userID string) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	if err := h.users.ReplaceRecoveryCodes(ctx, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// checkTOTP reports whether code is a valid, unused authenticator code for
+// user, and marks it used.
+func (h *Handler) checkTOTP(ctx context.Context, user models.User, code string) (bool, error) {
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	err := h.users.UseTOTPStep(ctx, user.ID, step)
+	if errors.Is(err, repository.ErrTokenUsed) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkSecondFactor verifies an authenticator code, or a recovery code if
+// one is given, which is then used up.
+func (h *Handler) checkSecondFactor(ctx context.Context, user models.User, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		err := h.users.UseRecoveryCode(ctx, user.ID, hashRecoveryCode(recoveryCode))
+		if errors.Is(err, repository.ErrNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	return h.checkTOTP(ctx, user, code)
+}
+
+// loadCurrentUser loads the authenticated user, responding with an error
+// if that fails.
+func (h *Handler) loadCurrentUser(c *gin.Context) (models.User, bool) {
+	user, err := h.users.GetByID(c.Request.Context(), c.GetString("user_id"))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "User not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load user"})
+		}
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// LoginMFA completes a login started by Login for an account with
+// two-factor authentication.
+func (h *Handler) LoginMFA(c *gin.Context) {
+	var req models.MFALoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request data"})
+		return
+	}
+	if req.Code == "" && req.RecoveryCode == "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "An authentication code or recovery code is required"})
+		return
+	}
+
+	userID, err := h.parseMFAToken(req.MFAToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Invalid or expired MFA token"})
+		return
+	}
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Invalid or expired MFA token"})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load user"})
+		}
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Invalid or expired MFA token"})
+		return
+	}
+
+	// Wrong codes count towards the same lockouts as wrong passwords
+	ip := c.ClientIP()
+	wait, err := h.loginGuard.Check(ctx, ip, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to check login attempts"})
+		return
+	}
+	if wait > 0 {
+		tooManyAttempts(c, wait)
+		return
+	}
+
+	ok, err := h.checkSecondFactor(ctx, user, req.Code, req.RecoveryCode)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to verify authentication code"})
+		return
+	}
+	if !ok {
+		h.recordLogin(c, user.ID, models.LoginTOTP, false)
+		wait, err := h.loginGuard.Fail(ctx, ip, user.Email)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to record login attempt"})
+			return
+		}
+		if wait > 0 {
+			tooManyAttempts(c, wait)
+			return
+		}
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Invalid authentication code"})
+		return
+	}
+
+	if err := h.loginGuard.Succeed(ctx, user.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to record login attempt"})
+		return
+	}
+	h.completeLogin(c, user, models.LoginTOTP)
+}
+
+// SetupTOTP generates a new authenticator secret for the current user. It
+// takes effect once confirmed with ConfirmTOTP.
+func (h *Handler) SetupTOTP(c *gin.Context) {
+	user, ok := h.loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to generate secret"})
+		return
+	}
+	user.TOTPSecret = secret
+	if err := h.users.Update(c.Request.Context(), user); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(h.mfaIssuer, user.Email, secret),
+	})
+}
+
+// ConfirmTOTP enables two-factor authentication once the user proves their
+// authenticator app works, and returns the one-time recovery codes.
+func (h *Handler) ConfirmTOTP(c *gin.Context) {
+	var req models.TOTPCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request data"})
+		return
+	}
+	user, ok := h.loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Two-factor authentication is already enabled"})
+		return
+	}
+	if user.TOTPSecret == "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Two-factor authentication setup has not been started"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	valid, err := h.checkTOTP(ctx, user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to verify authentication code"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid authentication code"})
+		return
+	}
+
+	user.TOTPEnabled = true
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update user"})
+		return
+	}
+	codes, err := h.issueRecoveryCodes(ctx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to generate recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"totp_enabled":   true,
+		"recovery_codes": codes,
+	})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes.
+func (h *Handler) RegenerateRecoveryCodes(c *gin.Context) {
+	var req models.TOTPCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request data"})
+		return
+	}
+	user, ok := h.loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Two-factor authentication is not enabled"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	valid, err := h.checkTOTP(ctx, user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to verify authentication code"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Invalid authentication code"})
+		return
+	}
+
+	codes, err := h.issueRecoveryCodes(ctx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to generate recovery codes"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// DisableTOTP turns two-factor authentication off after checking the
+// password and a second factor. Members of roles that require it cannot.
+func (h *Handler) DisableTOTP(c *gin.Context) {
+	var req models.TOTPDisableRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request data"})
+		return
+	}
+	user, ok := h.loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Two-factor authentication is not enabled"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	required, err := rbac.MFARequiredRoles(ctx, h.settings)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load settings"})
+		return
+	}
+	if rbac.RequiresMFA(required, user.EffectiveRole()) {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Two-factor authentication is required for your role"})
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)) != nil {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Invalid password"})
+		return
+	}
+	valid, err := h.checkSecondFactor(ctx, user, req.Code, req.RecoveryCode)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to verify authentication code"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Invalid authentication code"})
+		return
+	}
+
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update user"})
+		return
+	}
+	if err := h.users.ReplaceRecoveryCodes(ctx, user.ID, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to remove recovery codes"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// GetMFASettings returns the roles that must use two-factor authentication.
+func (h *Handler) GetMFASettings(c *gin.Context) {
+	required, err := rbac.MFARequiredRoles(c.Request.Context(), h.settings)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load settings"})
+		return
+	}
+	c.JSON(http.StatusOK, models.MFASettings{RequiredRoles: required})
+}
+
+// UpdateMFASettings sets the roles that must use two-factor authentication.
+func (h *Handler) UpdateMFASettings(c *gin.Context) {
+	var req models.MFASettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request data"})
+		return
+	}
+	if req.RequiredRoles == nil {
+		req.RequiredRoles = []string{}
+	}
+	for _, role := range req.RequiredRoles {
+		if role != models.RoleAdmin && role != models.RoleMentor && role != models.RoleStudent {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Unknown role: " + role})
+			return
+		}
+	}
+
+	// Keep admins from locking themselves out of this endpoint
+	user, ok := h.loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	if rbac.RequiresMFA(req.RequiredRoles, user.EffectiveRole()) && !user.TOTPEnabled {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Enable two-factor authentication on your own account first"})
+		return
+	}
+
+	raw, err := json.Marshal(req.RequiredRoles)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to save settings"})
+		return
+	}
+	if err := h.settings.PutSetting(c.Request.Context(), rbac.MFARequiredRolesSetting, string(raw), time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to save settings"})
+		return
+	}
+	c.JSON(http.StatusOK, req)
+}
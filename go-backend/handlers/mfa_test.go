@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/totp"
+)
+
+// newTOTPUser creates a student with two-factor authentication enabled.
+func newTOTPUser(t *testing.T, a *apiTest) models.User {
+	t.Helper()
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := a.newUser(t, models.RoleStudent)
+	user.TOTPSecret = secret
+	user.TOTPEnabled = true
+	if err := a.store.Users.Update(t.Context(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestLoginMFARejectsUsedCode(t *testing.T) {
+	a := newAPITest(t, Config{})
+	a.router.POST("/api/auth/login", a.h.Login)
+	a.router.POST("/api/auth/login/2fa", a.h.LoginMFA)
+	user := newTOTPUser(t, a)
+
+	challenge := func() string {
+		t.Helper()
+		var resp struct {
+			MFARequired bool   `json:"mfa_required"`
+			MFAToken    string `json:"mfa_token"`
+		}
+		a.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: user.Email, Password: apiTestPassword}, http.StatusOK, &resp)
+		if !resp.MFARequired || resp.MFAToken == "" {
+			t.Fatalf("login returned %+v, want a two-factor challenge", resp)
+		}
+		return resp.MFAToken
+	}
+
+	code, err := totp.Generate(user.TOTPSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens tokensResponse
+	a.do(t, http.MethodPost, "/api/auth/login/2fa", "", models.MFALoginRequest{MFAToken: challenge(), Code: code}, http.StatusOK, &tokens)
+	if tokens.Token == "" {
+		t.Fatal("two-factor login returned no token")
+	}
+
+	// The same code cannot be used again, even within its step
+	a.do(t, http.MethodPost, "/api/auth/login/2fa", "", models.MFALoginRequest{MFAToken: challenge(), Code: code}, http.StatusUnauthorized, nil)
+	// and neither can the code of the previous step
+	earlier, _ := totp.Generate(user.TOTPSecret, time.Now().Add(-30*time.Second))
+	if earlier != code {
+		a.do(t, http.MethodPost, "/api/auth/login/2fa", "", models.MFALoginRequest{MFAToken: challenge(), Code: earlier}, http.StatusUnauthorized, nil)
+	}
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/oidcauth"
+	"github.com/cuanin/emergent-backend/randtoken"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// oidcStateTTL is how long a user has to finish logging in at the provider.
+	oidcStateTTL = 10 * time.Minute
+	// oidcStateCookie binds a pending login to the browser that started it.
+	oidcStateCookie = "oidc_state"
+	oidcCookiePath  = "/api/auth/oidc"
+)
+
+// errEmailNotVerified is returned when the provider does not vouch for the
+// user's email address, which is needed to create or link an account.
+var errEmailNotVerified = errors.New("email not verified by provider")
+
+// OIDCStart redirects the browser to the provider's login page.
+func (h *Handler) OIDCStart(c *gin.Context) {
+	provider, ok := h.oidcProviders[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Unknown login provider"})
+		return
+	}
+
+	state, err := randtoken.New()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to start login"})
+		return
+	}
+	nonce, err := randtoken.New()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to start login"})
+		return
+	}
+	now := time.Now()
+	pending := models.OIDCState{
+		ID:           randtoken.Hash(state),
+		Provider:     provider.Name(),
+		CodeVerifier: oidcauth.NewVerifier(),
+		Nonce:        nonce,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(oidcStateTTL),
+	}
+
+	ctx := c.Request.Context()
+	authURL, err := provider.AuthCodeURL(ctx, state, pending.CodeVerifier, nonce)
+	if err != nil {
+		log.Printf("OIDC provider %s: %v", provider.Name(), err)
+		c.JSON(http.StatusBadGateway, models.ErrorResponse{Error: "Login provider is unavailable"})
+		return
+	}
+	if err := h.tokens.CreateOIDCState(ctx, pending); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to start login"})
+		return
+	}
+
+	h.setOIDCCookie(c, state, int(oidcStateTTL.Seconds()))
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback finishes a login when the provider redirects back, then
+// sends the browser to the web app with our tokens in the URL fragment.
+func (h *Handler) OIDCCallback(c *gin.Context) {
+	provider, ok := h.oidcProviders[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Unknown login provider"})
+		return
+	}
+	if reason := c.Query("error"); reason != "" {
+		h.oidcRedirect(c, url.Values{"error": {reason}})
+		return
+	}
+
+	// The state must match the cookie set by OIDCStart in this browser and
+	// a pending login that has not been used yet.
+	state := c.Query("state")
+	cookie, _ := c.Cookie(oidcStateCookie)
+	h.setOIDCCookie(c, "", -1)
+	if state == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+		h.oidcRedirect(c, url.Values{"error": {"invalid_state"}})
+		return
+	}
+	ctx := c.Request.Context()
+	pending, err := h.tokens.ConsumeOIDCState(ctx, randtoken.Hash(state))
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		h.oidcRedirect(c, url.Values{"error": {"server_error"}})
+		return
+	}
+	if err != nil || pending.Provider != provider.Name() || time.Now().After(pending.ExpiresAt) {
+		h.oidcRedirect(c, url.Values{"error": {"invalid_state"}})
+		return
+	}
+
+	claims, err := provider.Exchange(ctx, c.Query("code"), pending.CodeVerifier, pending.Nonce)
+	if err != nil {
+		log.Printf("OIDC provider %s: %v", provider.Name(), err)
+		h.oidcRedirect(c, url.Values{"error": {"login_failed"}})
+		return
+	}
+
+	user, err := h.oidcUser(ctx, provider.Name(), claims)
+	if errors.Is(err, errEmailNotVerified) {
+		h.oidcRedirect(c, url.Values{"error": {"email_not_verified"}})
+		return
+	}
+	if err != nil {
+		log.Printf("OIDC login for %s: %v", claims.Email, err)
+		h.oidcRedirect(c, url.Values{"error": {"server_error"}})
+		return
+	}
+	if user.SuspendedAt != nil {
+		h.recordLogin(c, user.ID, "oidc:"+provider.Name(), false)
+		h.oidcRedirect(c, url.Values{"error": {"account_suspended"}})
+		return
+	}
+
+	// Two-factor authentication applies to social logins too
+	if user.TOTPEnabled {
+		mfaToken, err := h.generateMFAToken(user)
+		if err != nil {
+			h.oidcRedirect(c, url.Values{"error": {"server_error"}})
+			return
+		}
+		h.oidcRedirect(c, url.Values{
+			"mfa_required": {"true"},
+			"mfa_token":    {mfaToken},
+			"expires_in":   {strconv.Itoa(int(mfaTokenTTL.Seconds()))},
+		})
+		return
+	}
+
+	tokens, err := h.issueTokens(ctx, user, "")
+	if err != nil {
+		h.oidcRedirect(c, url.Values{"error": {"server_error"}})
+		return
+	}
+	if err := h.users.UpdateLastLogin(ctx, user.ID, time.Now()); err != nil {
+		h.oidcRedirect(c, url.Values{"error": {"server_error"}})
+		return
+	}
+	h.recordLogin(c, user.ID, "oidc:"+provider.Name(), true)
+	h.oidcRedirect(c, url.Values{
+		"token":         {tokens.AccessToken},
+		"refresh_token": {tokens.RefreshToken},
+		"expires_in":    {strconv.Itoa(tokens.ExpiresIn)},
+	})
+}
+
+// oidcUser returns the user linked to the provider account. An account seen
+// for the first time is linked to the user with the same verified email, or
+// to a new user.
+func (h *Handler) oidcUser(ctx context.Context, provider string, claims oidcauth.Claims) (models.User, error) {
+	user, err := h.users.GetByIdentity(ctx, provider, claims.Subject)
+	if !errors.Is(err, repository.ErrNotFound) {
+		return user, err
+	}
+	if claims.Email == "" || !claims.EmailVerified {
+		return models.User{}, errEmailNotVerified
+	}
+
+	user, err = h.users.GetByEmail(ctx, claims.Email)
+	switch {
+	case err == nil:
+		if !user.EmailVerified {
+			// Whoever registered this address never proved they own it,
+			// and the provider says the person logging in does. Lock out
+			// the password and sessions the registrant may have set up.
+			if err := h.takeOverUnverifiedAccount(ctx, &user); err != nil {
+				return models.User{}, err
+			}
+		}
+	case errors.Is(err, repository.ErrNotFound):
+		name := claims.Name
+		if name == "" {
+			name, _, _ = strings.Cut(claims.Email, "@")
+		}
+		user = models.User{
+			ID:              uuid.New().String(),
+			Email:           claims.Email,
+			FullName:        name,
+			Role:            models.RoleStudent,
+			EmailVerified:   true,
+			CreatedAt:       time.Now(),
+			EnrolledCourses: []string{},
+			Badges:          []string{"New User"},
+			Progress:        make(map[string]int),
+		}
+		if err := h.users.Create(ctx, user); err != nil {
+			return models.User{}, err
+		}
+	default:
+		return models.User{}, err
+	}
+
+	err = h.users.LinkIdentity(ctx, models.Identity{
+		Provider:  provider,
+		Subject:   claims.Subject,
+		UserID:    user.ID,
+		Email:     claims.Email,
+		CreatedAt: time.Now(),
+	})
+	if errors.Is(err, repository.ErrDuplicateIdentity) {
+		// A concurrent callback linked it first
+		return h.users.GetByIdentity(ctx, provider, claims.Subject)
+	}
+	return user, err
+}
+
+// takeOverUnverifiedAccount marks the account verified, replaces its
+// password with a random one and signs out its sessions.
+func (h *Handler) takeOverUnverifiedAccount(ctx context.Context, user *models.User) error {
+	random, err := randtoken.New()
+	if err != nil {
+		return err
+	}
+	if user.Password, err = hashPassword(random); err != nil {
+		return err
+	}
+	user.EmailVerified = true
+	if err := h.users.Update(ctx, *user); err != nil {
+		return err
+	}
+	return h.endSessions(ctx, user.ID, time.Now())
+}
+
+func (h *Handler) setOIDCCookie(c *gin.Context, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, value, maxAge, oidcCookiePath, "", strings.HasPrefix(h.appURL, "https://"), true)
+}
+
+// oidcRedirect sends the browser to the web app's callback page. Values go
+// in the fragment, which browsers do not send to servers or in Referer.
+func (h *Handler) oidcRedirect(c *gin.Context, values url.Values) {
+	c.Redirect(http.StatusFound, h.appURL+"/auth/callback#"+values.Encode())
+}
@@ -0,0 +1,350 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/jwtkeys"
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/oidcauth"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const oidcTestClientID = "emergent"
+
+// mockIssuer is an OpenID Connect provider serving discovery, its JWKS and
+// a token endpoint. Logins are made with login rather than a login page.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	logins map[string]mockLogin // by authorization code
+}
+
+// mockLogin is what the issuer remembers about an authorization code.
+type mockLogin struct {
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, logins: map[string]mockLogin{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// token redeems an authorization code once, if the PKCE verifier matches
+// the challenge the login was started with.
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	login, ok := m.logins[r.FormValue("code")]
+	delete(m.logins, r.FormValue("code"))
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != login.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   m.URL,
+		"aud":   oidcTestClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": login.nonce,
+	}
+	for k, v := range login.claims {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// login signs in at the issuer as the user with claims, for the login
+// started with authURL, and returns the authorization code.
+func (m *mockIssuer) login(t *testing.T, authURL string, claims jwt.MapClaims) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("client_id") != oidcTestClientID || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("login started without a PKCE challenge: %s", authURL)
+	}
+	code := uuid.New().String()
+	m.mu.Lock()
+	m.logins[code] = mockLogin{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: claims}
+	m.mu.Unlock()
+	return code
+}
+
+// oidcTest runs logins through the OIDC handlers against a mockIssuer.
+type oidcTest struct {
+	issuer *mockIssuer
+	store  repository.Store
+	router *gin.Engine
+}
+
+func newOIDCTest(t *testing.T) *oidcTest {
+	gin.SetMode(gin.TestMode)
+	issuer := newMockIssuer(t)
+	store := repository.NewMemoryStore()
+	h := New(store, Config{
+		Keys:   jwtkeys.NewHMAC([]byte("test-secret")),
+		AppURL: "http://app.test",
+		OIDCProviders: map[string]*oidcauth.Provider{"mock": oidcauth.NewProvider(oidcauth.Config{
+			Name:         "mock",
+			Issuer:       issuer.URL,
+			ClientID:     oidcTestClientID,
+			ClientSecret: "secret",
+			RedirectURL:  "http://api.test/api/auth/oidc/mock/callback",
+		})},
+	})
+	r := gin.New()
+	r.GET("/api/auth/oidc/:provider/start", h.OIDCStart)
+	r.GET("/api/auth/oidc/:provider/callback", h.OIDCCallback)
+	return &oidcTest{issuer, store, r}
+}
+
+// start begins a login and returns the provider URL it redirects to and
+// the state cookie it sets.
+func (o *oidcTest) start(t *testing.T) (string, *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	o.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/mock/start", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("start = %d %s, want a redirect", w.Code, w.Body)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			return w.Header().Get("Location"), cookie
+		}
+	}
+	t.Fatal("start set no state cookie")
+	return "", nil
+}
+
+// callback returns from the provider with code and the state of authURL,
+// sending cookie if it is not nil, and returns the values the web app is
+// redirected with.
+func (o *oidcTest) callback(t *testing.T, authURL, code string, cookie *http.Cookie) url.Values {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := url.Values{"state": {u.Query().Get("state")}, "code": {code}}
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/oidc/mock/callback?"+q.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	o.router.ServeHTTP(w, req)
+
+	location := w.Header().Get("Location")
+	fragment, ok := strings.CutPrefix(location, "http://app.test/auth/callback#")
+	if w.Code != http.StatusFound || !ok {
+		t.Fatalf("callback = %d to %q, want a redirect to the web app", w.Code, location)
+	}
+	values, err := url.ParseQuery(fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+// verifiedClaims are the claims of a provider account with a verified email.
+func verifiedClaims(subject, email string) jwt.MapClaims {
+	return jwt.MapClaims{"sub": subject, "email": email, "email_verified": true, "name": "Social User"}
+}
+
+func TestOIDCLoginCreatesAccount(t *testing.T) {
+	o := newOIDCTest(t)
+	authURL, cookie := o.start(t)
+	code := o.issuer.login(t, authURL, verifiedClaims("sub-1", "social@example.com"))
+
+	values := o.callback(t, authURL, code, cookie)
+	if values.Get("error") != "" || values.Get("token") == "" || values.Get("refresh_token") == "" {
+		t.Fatalf("callback redirected with %v, want tokens", values)
+	}
+	user, err := o.store.Users.GetByIdentity(t.Context(), "mock", "sub-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "social@example.com" || !user.EmailVerified {
+		t.Errorf("user = %+v, want a verified account for social@example.com", user)
+	}
+}
+
+func TestOIDCCallbackChecksState(t *testing.T) {
+	o := newOIDCTest(t)
+	authURL, cookie := o.start(t)
+	_, otherCookie := o.start(t)
+	claims := verifiedClaims("sub-1", "social@example.com")
+
+	for _, tc := range []struct {
+		name   string
+		cookie *http.Cookie
+	}{
+		{"no cookie", nil},
+		{"cookie of another login", otherCookie},
+		{"tampered cookie", &http.Cookie{Name: oidcStateCookie, Value: cookie.Value + "x"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			values := o.callback(t, authURL, o.issuer.login(t, authURL, claims), tc.cookie)
+			if got := values.Get("error"); got != "invalid_state" {
+				t.Errorf("error = %q, want invalid_state", got)
+			}
+		})
+	}
+
+	// The state is still pending after the refused callbacks, and can be
+	// used once
+	if values := o.callback(t, authURL, o.issuer.login(t, authURL, claims), cookie); values.Get("token") == "" {
+		t.Fatalf("callback redirected with %v, want tokens", values)
+	}
+	values := o.callback(t, authURL, o.issuer.login(t, authURL, claims), cookie)
+	if got := values.Get("error"); got != "invalid_state" {
+		t.Errorf("reusing the state: error = %q, want invalid_state", got)
+	}
+}
+
+func TestOIDCCallbackSendsPKCEVerifier(t *testing.T) {
+	o := newOIDCTest(t)
+	// A code issued to another login, such as the attacker's own, does not
+	// redeem with this login's verifier
+	attackerURL, _ := o.start(t)
+	victimURL, victimCookie := o.start(t)
+	code := o.issuer.login(t, attackerURL, verifiedClaims("attacker", "attacker@example.com"))
+
+	values := o.callback(t, victimURL, code, victimCookie)
+	if got := values.Get("error"); got != "login_failed" {
+		t.Errorf("error = %q, want login_failed", got)
+	}
+	if _, err := o.store.Users.GetByEmail(t.Context(), "attacker@example.com"); err == nil {
+		t.Error("the attacker's account was created")
+	}
+}
+
+func TestOIDCCallbackChecksNonce(t *testing.T) {
+	o := newOIDCTest(t)
+	authURL, cookie := o.start(t)
+	code := o.issuer.login(t, authURL, verifiedClaims("sub-1", "social@example.com"))
+	o.issuer.mu.Lock()
+	login := o.issuer.logins[code]
+	login.nonce = "replayed"
+	o.issuer.logins[code] = login
+	o.issuer.mu.Unlock()
+
+	values := o.callback(t, authURL, code, cookie)
+	if got := values.Get("error"); got != "login_failed" {
+		t.Errorf("error = %q, want login_failed", got)
+	}
+}
+
+func TestOIDCDoesNotLinkUnverifiedEmail(t *testing.T) {
+	o := newOIDCTest(t)
+	existing := models.User{
+		ID:              uuid.New().String(),
+		Email:           "existing@example.com",
+		Password:        "hash",
+		FullName:        "Existing",
+		Role:            models.RoleStudent,
+		EmailVerified:   true,
+		CreatedAt:       time.Now(),
+		EnrolledCourses: []string{},
+		Badges:          []string{},
+		Progress:        map[string]int{},
+	}
+	if err := o.store.Users.Create(t.Context(), existing); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, verified := range []any{false, "false", nil} {
+		authURL, cookie := o.start(t)
+		claims := jwt.MapClaims{"sub": "sub-1", "email": existing.Email}
+		if verified != nil {
+			claims["email_verified"] = verified
+		}
+		values := o.callback(t, authURL, o.issuer.login(t, authURL, claims), cookie)
+		if got := values.Get("error"); got != "email_not_verified" {
+			t.Errorf("email_verified %v: error = %q, want email_not_verified", verified, got)
+		}
+	}
+
+	identities, err := o.store.Users.ListIdentities(t.Context(), existing.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 0 {
+		t.Errorf("identities = %+v, want none", identities)
+	}
+	user, err := o.store.Users.GetByID(t.Context(), existing.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Password != existing.Password {
+		t.Error("the account's password was replaced")
+	}
+}
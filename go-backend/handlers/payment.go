@@ -1,37 +1,30 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"log"
 	"net/http"
-	// "strconv"
+	"slices"
+	"strings"
 	"time"
 
-	"github.com/cuanin/emergent-backend/data"
+	"github.com/cuanin/emergent-backend/gateway"
 	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+	"github.com/cuanin/emergent-backend/repository"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
-// getPaymentsCopy returns a copy of the payments slice to avoid direct modification
-func getPaymentsCopy() []models.Payment {
-	return append([]models.Payment(nil), data.Payments...)
-}
-
-// getUserCoursesCopy returns a copy of the userCourses map to avoid direct modification
-func getUserCoursesCopy() map[string][]string {
-	copied := make(map[string][]string)
-	for k, v := range data.UserCourses {
-		courses := make([]string, len(v))
-		copy(courses, v)
-		copied[k] = courses
-	}
-	return copied
-}
-
-// PurchaseCourse handles course purchase
-func PurchaseCourse(c *gin.Context) {
+// PurchaseCourse starts the purchase of a course by charging its price
+// through the payment provider. The payment is created pending, with the
+// provider's instructions for the buyer; the buyer is enrolled once the
+// provider confirms it was paid.
+func (h *Handler) PurchaseCourse(c *gin.Context) {
 	// Get user from context (set by auth middleware)
-	userID, exists := c.Get("user_id")
-	if !exists {
+	userID := c.GetString("user_id")
+	if userID == "" {
 		c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "User not authenticated"})
 		return
 	}
@@ -41,124 +34,375 @@ func PurchaseCourse(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
 		return
 	}
-
-	// Find course
-	var course *models.Course
-	var courseIndex int
-	for i, c := range data.Courses {
-		if c.ID == req.CourseID {
-			course = &data.Courses[i]
-			courseIndex = i
-			break
-		}
+	methods := h.paymentProvider.Methods()
+	if !slices.Contains(methods, req.PaymentMethod) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "payment_method must be one of: " + strings.Join(methods, ", ")})
+		return
 	}
 
-	if course == nil {
-		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Course not found"})
+	ctx := c.Request.Context()
+
+	course, ok := h.loadPurchasableCourse(c, req.CourseID)
+	if !ok {
+		return
+	}
+	user, ok := h.loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	if slices.Contains(user.EnrolledCourses, course.ID) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "User already enrolled in this course"})
+		return
+	}
+	// A double click or a retry without an Idempotency-Key gets the purchase
+	// already under way instead of a second charge
+	pending, ok := h.pendingPayment(c, userID, course.ID)
+	if !ok {
+		return
+	}
+	if pending != nil {
+		c.JSON(http.StatusOK, pending)
 		return
 	}
 
-	// Check if user is already enrolled
-	for _, user := range data.Users {
-		if user.ID == userID {
-			for _, courseID := range user.EnrolledCourses {
-				if courseID == req.CourseID {
-					c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "User already enrolled in this course"})
-					return
-				}
-			}
-			break
-		}
+	quote, coupon, ok := h.quoteCourse(c, course, req.CouponCode)
+	if !ok {
+		return
 	}
 
 	// Create payment
 	payment := models.Payment{
 		ID:            uuid.New().String(),
-		UserID:        userID.(string),
+		UserID:        userID,
 		CourseID:      req.CourseID,
-		Amount:        course.Price, // Use course price instead of request amount for security
+		Amount:        quote.Total, // priced by us, never by the request
 		PaymentMethod: req.PaymentMethod,
-		Status:        "completed",
+		Status:        models.PaymentPending,
+		CouponCode:    quote.CouponCode,
+		Provider:      h.paymentProvider.Name(),
 		CreatedAt:     time.Now(),
 	}
+	if coupon != nil {
+		payment.Discount = &quote.Discount
+		if !h.redeemCoupon(c, *coupon, payment) {
+			return
+		}
+	}
+	// release gives the coupon back if the purchase goes no further
+	release := func() {
+		if coupon == nil {
+			return
+		}
+		if err := h.coupons.Release(context.WithoutCancel(ctx), payment.ID); err != nil {
+			log.Printf("Failed to release coupon %s for payment %s: %v", coupon.Code, payment.ID, err)
+		}
+	}
 
-	// Save payment
-	data.Payments = append(data.Payments, payment)
-
-	// Update user's enrolled courses and progress
-	for i := range data.Users {
-		if data.Users[i].ID == userID {
-			data.Users[i].EnrolledCourses = append(data.Users[i].EnrolledCourses, req.CourseID)
-			if data.Users[i].Progress == nil {
-				data.Users[i].Progress = make(map[string]int)
-			}
-			data.Users[i].Progress[req.CourseID] = 0 // Initialize progress at 0%
-			break
+	charge := gateway.Charge{Status: models.PaymentPaid}
+	if payment.Amount.Amount > 0 {
+		var err error
+		charge, err = h.paymentProvider.CreateCharge(ctx, gateway.ChargeRequest{
+			OrderID:       payment.ID,
+			Amount:        payment.Amount,
+			Method:        payment.PaymentMethod,
+			Description:   course.Title,
+			CustomerName:  user.FullName,
+			CustomerEmail: user.Email,
+			Expiry:        h.paymentExpiry,
+		})
+		if errors.Is(err, gateway.ErrUnsupportedCurrency) {
+			release()
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Payments in " + payment.Amount.Currency + " are not accepted"})
+			return
+		}
+		if err != nil {
+			release()
+			log.Printf("Failed to create %s charge for payment %s: %v", payment.Provider, payment.ID, err)
+			c.JSON(http.StatusBadGateway, models.ErrorResponse{Error: "Payment provider is unavailable"})
+			return
 		}
+		payment.Reference = charge.Reference
+		payment.Action = charge.Action
+		payment.ExpiresAt = charge.ExpiresAt
+	} else {
+		// The coupon covers the whole price, so there is nothing to charge
+		payment.Provider = ""
+	}
+	if err := h.payments.Create(ctx, payment); err != nil {
+		release()
+		if errors.Is(err, repository.ErrPaymentPending) {
+			c.JSON(http.StatusConflict, models.ErrorResponse{Error: "A payment for this course is already pending"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to save payment"})
+		return
 	}
 
-	// Update course enrollment count
-	data.Courses[courseIndex].EnrolledCount++
+	// Some methods, such as saved cards, are settled by the charge itself
+	if charge.Status != models.PaymentPending {
+		var err error
+		if payment, err = h.settlePayment(ctx, payment, charge.Status); err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to save payment"})
+			return
+		}
+	}
 
 	c.JSON(http.StatusCreated, payment)
 }
 
+// GetPayment returns one of the user's payments. A pending payment is
+// first checked with the provider, so polling this endpoint is enough to
+// find out when the course has been paid for.
+func (h *Handler) GetPayment(c *gin.Context) {
+	payment, ok := h.loadPayment(c)
+	if !ok {
+		return
+	}
+	payment, err := h.refreshPayment(c.Request.Context(), payment)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update payment"})
+		return
+	}
+	c.JSON(http.StatusOK, payment)
+}
+
+// SimulatePayment settles a payment made with the payment simulator as
+// paid, failed or expired, or refunds it, standing in for the buyer's bank.
+// It is only available while the simulator is the payment provider.
+func (h *Handler) SimulatePayment(c *gin.Context) {
+	sim, ok := h.paymentProvider.(*gateway.Simulator)
+	if !ok {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Payment simulator is not enabled"})
+		return
+	}
+	var req models.SimulatePaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+	payment, ok := h.loadPayment(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	payment, err := h.refreshPayment(ctx, payment)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update payment"})
+		return
+	}
+	if payment.Status != req.Status && !models.CanTransitionPayment(payment.Status, req.Status) {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Cannot move a payment from " + payment.Status + " to " + req.Status})
+		return
+	}
+	if err := sim.Settle(ctx, payment.ID, req.Status); err != nil {
+		if errors.Is(err, gateway.ErrChargeNotFound) {
+			// Simulated charges do not survive a restart
+			c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Payment is unknown to the simulator"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to settle payment"})
+		return
+	}
+	payment, err = h.settlePayment(ctx, payment, req.Status)
+	if errors.Is(err, errPaymentTransition) {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Cannot move a payment from " + payment.Status + " to " + req.Status})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update payment"})
+		return
+	}
+	c.JSON(http.StatusOK, payment)
+}
+
+// loadPurchasableCourse returns the course with id if it can be bought,
+// writing a 404 if it does not exist or is unreleased and a 409 if it was
+// archived.
+func (h *Handler) loadPurchasableCourse(c *gin.Context, id string) (models.Course, bool) {
+	course, err := h.courses.GetByID(c.Request.Context(), id)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load course"})
+		return models.Course{}, false
+	}
+	if err != nil || !course.Released() {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Course not found"})
+		return models.Course{}, false
+	}
+	if course.ArchivedAt != nil {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Course is no longer available"})
+		return models.Course{}, false
+	}
+	return course, true
+}
+
+// loadPayment returns the current user's payment named by the :id path
+// parameter, writing a 404 if there is no such payment.
+func (h *Handler) loadPayment(c *gin.Context) (models.Payment, bool) {
+	payment, err := h.payments.GetByID(c.Request.Context(), c.Param("id"))
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load payment"})
+		return models.Payment{}, false
+	}
+	if err != nil || payment.UserID != c.GetString("user_id") {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Payment not found"})
+		return models.Payment{}, false
+	}
+	return payment, true
+}
+
+// pendingPayment returns the user's pending payment for the course, or nil
+// if there is none once it has been checked with the provider. It writes an
+// error response if the payments cannot be loaded.
+func (h *Handler) pendingPayment(c *gin.Context, userID, courseID string) (*models.Payment, bool) {
+	ctx := c.Request.Context()
+	payments, err := h.payments.ListByUser(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load payments"})
+		return nil, false
+	}
+	i := slices.IndexFunc(payments, func(p models.Payment) bool {
+		return p.CourseID == courseID && p.Status == models.PaymentPending
+	})
+	if i < 0 {
+		return nil, true
+	}
+	payment, err := h.refreshPayment(ctx, payments[i])
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update payment"})
+		return nil, false
+	}
+	if payment.Status != models.PaymentPending {
+		return nil, true
+	}
+	return &payment, true
+}
+
+// refreshPayment asks the provider about a pending payment and settles it
+// once the provider reports an outcome. It returns the payment as it now
+// stands. If the provider cannot be reached, the payment is returned
+// unchanged.
+func (h *Handler) refreshPayment(ctx context.Context, payment models.Payment) (models.Payment, error) {
+	if payment.Status != models.PaymentPending || payment.Provider != h.paymentProvider.Name() {
+		return payment, nil
+	}
+	status, err := h.paymentProvider.Status(ctx, payment.ID)
+	if err != nil {
+		log.Printf("Failed to check %s payment %s: %v", payment.Provider, payment.ID, err)
+		return payment, nil
+	}
+	if status == models.PaymentPending {
+		return payment, nil
+	}
+	updated, err := h.settlePayment(ctx, payment, status)
+	if errors.Is(err, errPaymentTransition) {
+		log.Printf("Ignoring %s status %q of payment %s, which is %s", payment.Provider, status, payment.ID, updated.Status)
+		return updated, nil
+	}
+	return updated, err
+}
+
+// errPaymentTransition is returned by settlePayment for a status the
+// payment cannot move to from the one it is in.
+var errPaymentTransition = errors.New("invalid payment status change")
+
+// settlePayment moves a payment to status, enrolling the buyer once it is
+// paid and unenrolling them if it is refunded. A payment already in status
+// is returned as is, so repeated notifications are harmless. If the
+// payment changes concurrently, the move is checked again from its new
+// status.
+func (h *Handler) settlePayment(ctx context.Context, payment models.Payment, status string) (models.Payment, error) {
+	for payment.Status != status {
+		if !models.CanTransitionPayment(payment.Status, status) {
+			return payment, errPaymentTransition
+		}
+		updated, err := h.payments.SetStatus(ctx, payment.ID, payment.Status, status, time.Now())
+		if err != nil && !errors.Is(err, repository.ErrStatusConflict) {
+			return updated, err
+		}
+		payment = updated
+	}
+	// A purchase that was never paid gives its coupon back. Releasing is
+	// repeated with the notification if it fails.
+	if payment.CouponCode != "" && (status == models.PaymentFailed || status == models.PaymentExpired) {
+		if err := h.coupons.Release(ctx, payment.ID); err != nil {
+			return payment, err
+		}
+	}
+	return payment, nil
+}
+
 // GetUserDashboard returns user's dashboard data
-func GetUserDashboard(c *gin.Context) {
+func (h *Handler) GetUserDashboard(c *gin.Context) {
 	// Get user from context (set by auth middleware)
-	userID, exists := c.Get("user_id")
-	if !exists {
+	userID := c.GetString("user_id")
+	if userID == "" {
 		c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "User not authenticated"})
 		return
 	}
 
+	ctx := c.Request.Context()
+
 	// Find user
-	var user *models.User
-	for i, u := range data.Users {
-		if u.ID == userID {
-			user = &data.Users[i]
-			break
+	user, err := h.users.GetByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "User not found"})
+			return
 		}
-	}
-
-	if user == nil {
-		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "User not found"})
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load user"})
 		return
 	}
 
 	// Get enrolled courses with progress
 	var enrolledCourses []models.EnrolledCourse
-	totalSpent := 0.0
 
 	for _, courseID := range user.EnrolledCourses {
-		for _, course := range data.Courses {
-			if course.ID == courseID {
-				enrolledCourse := models.EnrolledCourse{
-					Course:  course,
-					Progress: user.Progress[courseID],
-				}
-				enrolledCourses = append(enrolledCourses, enrolledCourse)
-				totalSpent += course.Price
-				break
-			}
+		course, err := h.courses.GetByID(ctx, courseID)
+		if errors.Is(err, repository.ErrNotFound) {
+			continue
 		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load course"})
+			return
+		}
+		enrolledCourses = append(enrolledCourses, models.EnrolledCourse{
+			Course:   course,
+			Progress: user.Progress[courseID],
+		})
 	}
 
 	// Get user's recent payments
-	recentPayments := []models.Payment{}
-	for _, payment := range data.Payments {
-		if payment.UserID == userID {
-			recentPayments = append(recentPayments, payment)
-			// Limit to last 5 payments
-			if len(recentPayments) >= 5 {
-				break
-			}
+	payments, err := h.payments.ListByUser(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load payments"})
+		return
+	}
+	// Count what was actually paid, which stays the same when a course's
+	// price changes
+	var paid []money.Money
+	for _, p := range payments {
+		if p.Status == models.PaymentPaid {
+			paid = append(paid, p.Amount)
 		}
 	}
+	totalSpent := money.Sum(paid...)
+	rupiah := money.New(0, money.IDR)
+	for _, total := range totalSpent {
+		if total.Currency == money.IDR {
+			rupiah = total
+		}
+	}
+	recentPayments := payments
+	// Limit to last 5 payments
+	if len(recentPayments) > 5 {
+		recentPayments = recentPayments[:5]
+	}
 
 	c.JSON(http.StatusOK, models.DashboardResponse{
 		EnrolledCourses: enrolledCourses,
-		TotalSpent:      totalSpent,
+		TotalSpent:      rupiah.Number(),
+		TotalSpentMoney: totalSpent,
 		Badges:          user.Badges,
 		RecentPayments:  recentPayments,
 	})
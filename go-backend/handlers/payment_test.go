@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/gateway"
+	"github.com/cuanin/emergent-backend/jwtkeys"
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const paymentTestWebhookSecret = "whsec"
+
+// paymentTest buys a course through the payment handlers, with the
+// simulator as the payment provider.
+type paymentTest struct {
+	store  repository.Store
+	course models.Course
+	router *gin.Engine
+}
+
+// newPaymentTest returns a paymentTest with a published course priced at
+// Rp 499.000. Payments expire after expiry.
+func newPaymentTest(t *testing.T, expiry time.Duration) *paymentTest {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	store := repository.NewMemoryStore()
+	course := models.Course{
+		Title:     "Personal Finance",
+		Price:     money.New(499000, money.IDR),
+		Category:  "Finance",
+		Topics:    []string{},
+		CreatedAt: time.Now(),
+		Status:    models.CoursePublished,
+	}
+	if err := store.Courses.Create(t.Context(), &course); err != nil {
+		t.Fatal(err)
+	}
+	sim := gateway.NewSimulator()
+	sim.WebhookSecret = paymentTestWebhookSecret
+	h := New(store, Config{
+		Keys:            jwtkeys.NewHMAC([]byte("test-secret")),
+		PaymentProvider: sim,
+		PaymentExpiry:   expiry,
+	})
+
+	// Requests name their user in a header, in place of an access token
+	asUser := func(c *gin.Context) { c.Set("user_id", c.GetHeader("X-User-ID")) }
+	r := gin.New()
+	r.POST("/api/payment", asUser, h.PurchaseCourse)
+	r.POST("/api/payment/quote", asUser, h.QuotePayment)
+	r.POST("/api/payment/webhook/:provider", h.PaymentWebhook)
+	r.GET("/api/payment/:id", asUser, h.GetPayment)
+	r.POST("/api/payment/:id/simulate", asUser, h.SimulatePayment)
+	return &paymentTest{store, course, r}
+}
+
+// newUser registers a student and returns their ID.
+func (p *paymentTest) newUser(t *testing.T) string {
+	t.Helper()
+	user := models.User{
+		ID:              uuid.New().String(),
+		Email:           uuid.New().String() + "@example.com",
+		FullName:        "Buyer",
+		Role:            models.RoleStudent,
+		EmailVerified:   true,
+		CreatedAt:       time.Now(),
+		EnrolledCourses: []string{},
+		Badges:          []string{},
+		Progress:        map[string]int{},
+	}
+	if err := p.store.Users.Create(t.Context(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user.ID
+}
+
+// newCoupon creates a coupon for 10% off that can be redeemed once.
+func (p *paymentTest) newCoupon(t *testing.T) models.Coupon {
+	t.Helper()
+	coupon := models.Coupon{
+		ID:             uuid.New().String(),
+		Code:           "ONCE",
+		PercentOff:     10,
+		CourseIDs:      []string{},
+		Categories:     []string{},
+		MaxRedemptions: 1,
+		CreatedAt:      time.Now(),
+	}
+	if err := p.store.Coupons.Create(t.Context(), coupon); err != nil {
+		t.Fatal(err)
+	}
+	return coupon
+}
+
+// paymentResponse is what the payment endpoints return.
+type paymentResponse struct {
+	ID          string      `json:"id"`
+	Status      string      `json:"status"`
+	AmountMoney money.Money `json:"amount_money"`
+	Error       string      `json:"error"`
+}
+
+func (p *paymentTest) do(t *testing.T, req *http.Request, wantCode int) paymentResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	p.router.ServeHTTP(w, req)
+	if w.Code != wantCode {
+		t.Fatalf("%s %s = %d %s, want %d", req.Method, req.URL.Path, w.Code, w.Body, wantCode)
+	}
+	var resp paymentResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// purchase starts the purchase of the course by the user, with coupon if
+// it is not empty.
+func (p *paymentTest) purchase(t *testing.T, userID, coupon string, wantCode int) paymentResponse {
+	t.Helper()
+	body, _ := json.Marshal(models.PaymentRequest{CourseID: p.course.ID, PaymentMethod: "bca_va", CouponCode: coupon})
+	req := httptest.NewRequest(http.MethodPost, "/api/payment", bytes.NewReader(body))
+	req.Header.Set("X-User-ID", userID)
+	return p.do(t, req, wantCode)
+}
+
+// get polls the user's payment.
+func (p *paymentTest) get(t *testing.T, userID, id string) paymentResponse {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/payment/"+id, nil)
+	req.Header.Set("X-User-ID", userID)
+	return p.do(t, req, http.StatusOK)
+}
+
+// simulate settles the user's payment at the simulator with status.
+func (p *paymentTest) simulate(t *testing.T, userID, id, status string, wantCode int) paymentResponse {
+	t.Helper()
+	body, _ := json.Marshal(models.SimulatePaymentRequest{Status: status})
+	req := httptest.NewRequest(http.MethodPost, "/api/payment/"+id+"/simulate", bytes.NewReader(body))
+	req.Header.Set("X-User-ID", userID)
+	return p.do(t, req, wantCode)
+}
+
+// notify sends a signed simulator notification that the payment is now in
+// status.
+func (p *paymentTest) notify(t *testing.T, payment paymentResponse, status string, wantCode int) paymentResponse {
+	t.Helper()
+	body, _ := json.Marshal(gateway.SimulatorNotification{OrderID: payment.ID, Status: status, Amount: payment.AmountMoney})
+	mac := hmac.New(sha256.New, []byte(paymentTestWebhookSecret))
+	mac.Write(body)
+	req := httptest.NewRequest(http.MethodPost, "/api/payment/webhook/simulator", bytes.NewReader(body))
+	req.Header.Set(gateway.SimulatorSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	return p.do(t, req, wantCode)
+}
+
+// checkEnrolled fails the test unless the user's enrollment in the course
+// and its enrolled count are as given.
+func (p *paymentTest) checkEnrolled(t *testing.T, userID string, enrolled bool, count int) {
+	t.Helper()
+	user, err := p.store.Users.GetByID(t.Context(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(user.EnrolledCourses, p.course.ID) != enrolled {
+		t.Errorf("enrolled = %v, want %v", !enrolled, enrolled)
+	}
+	course, err := p.store.Courses.GetByID(t.Context(), p.course.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if course.EnrolledCount != count {
+		t.Errorf("enrolled count = %d, want %d", course.EnrolledCount, count)
+	}
+}
+
+func TestPurchasePaidByWebhook(t *testing.T) {
+	p := newPaymentTest(t, time.Hour)
+	userID := p.newUser(t)
+
+	payment := p.purchase(t, userID, "", http.StatusCreated)
+	if payment.Status != models.PaymentPending || payment.AmountMoney != p.course.Price {
+		t.Fatalf("purchase = %+v, want pending for %v", payment, p.course.Price)
+	}
+	p.checkEnrolled(t, userID, false, 0)
+
+	if got := p.notify(t, payment, models.PaymentPending, http.StatusOK); got.Status != models.PaymentPending {
+		t.Errorf("pending notification: status %q, want pending", got.Status)
+	}
+	p.checkEnrolled(t, userID, false, 0)
+
+	// Providers repeat notifications until they are acknowledged
+	for range 2 {
+		if got := p.notify(t, payment, models.PaymentPaid, http.StatusOK); got.Status != models.PaymentPaid {
+			t.Errorf("paid notification: status %q, want paid", got.Status)
+		}
+	}
+	p.checkEnrolled(t, userID, true, 1)
+	if got := p.get(t, userID, payment.ID); got.Status != models.PaymentPaid {
+		t.Errorf("payment status = %q, want paid", got.Status)
+	}
+	p.purchase(t, userID, "", http.StatusBadRequest)
+}
+
+func TestWebhookRejectsBadNotifications(t *testing.T) {
+	p := newPaymentTest(t, time.Hour)
+	userID := p.newUser(t)
+	payment := p.purchase(t, userID, "", http.StatusCreated)
+
+	wrongAmount := payment
+	wrongAmount.AmountMoney = money.New(1, money.IDR)
+	p.notify(t, wrongAmount, models.PaymentPaid, http.StatusBadRequest)
+
+	body := []byte(`{"order_id":"` + payment.ID + `","status":"paid","amount":{"amount":499000,"currency":"IDR"}}`)
+	req := httptest.NewRequest(http.MethodPost, "/api/payment/webhook/simulator", bytes.NewReader(body))
+	req.Header.Set(gateway.SimulatorSignatureHeader, hex.EncodeToString([]byte("forged")))
+	p.do(t, req, http.StatusUnauthorized)
+
+	p.checkEnrolled(t, userID, false, 0)
+}
+
+func TestPaymentBelongsToBuyer(t *testing.T) {
+	p := newPaymentTest(t, time.Hour)
+	buyer, other := p.newUser(t), p.newUser(t)
+	payment := p.purchase(t, buyer, "", http.StatusCreated)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/payment/"+payment.ID, nil)
+	req.Header.Set("X-User-ID", other)
+	p.do(t, req, http.StatusNotFound)
+	p.simulate(t, other, payment.ID, models.PaymentPaid, http.StatusNotFound)
+	p.checkEnrolled(t, buyer, false, 0)
+	p.checkEnrolled(t, other, false, 0)
+}
+
+func TestUnpaidPurchaseReleasesCoupon(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want string
+		// settle makes the payment fail or expire, and returns its status
+		settle func(t *testing.T, p *paymentTest, userID string, payment paymentResponse) string
+	}{
+		{"failed", models.PaymentFailed, func(t *testing.T, p *paymentTest, _ string, payment paymentResponse) string {
+			return p.notify(t, payment, models.PaymentFailed, http.StatusOK).Status
+		}},
+		{"expired by notification", models.PaymentExpired, func(t *testing.T, p *paymentTest, _ string, payment paymentResponse) string {
+			return p.notify(t, payment, models.PaymentExpired, http.StatusOK).Status
+		}},
+		{"expired while polled", models.PaymentExpired, func(t *testing.T, p *paymentTest, userID string, payment paymentResponse) string {
+			time.Sleep(100 * time.Millisecond)
+			return p.get(t, userID, payment.ID).Status
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newPaymentTest(t, 50*time.Millisecond)
+			coupon := p.newCoupon(t)
+			buyer, other := p.newUser(t), p.newUser(t)
+
+			payment := p.purchase(t, buyer, "once", http.StatusCreated)
+			if want := money.New(449100, money.IDR); payment.AmountMoney != want {
+				t.Errorf("amount = %v, want %v", payment.AmountMoney, want)
+			}
+			if got := p.purchase(t, other, "once", http.StatusConflict); got.Error == "" {
+				t.Error("the coupon was redeemed twice")
+			}
+
+			if status := tc.settle(t, p, buyer, payment); status != tc.want {
+				t.Fatalf("status = %q, want %q", status, tc.want)
+			}
+			got, err := p.store.Coupons.GetByID(t.Context(), coupon.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Redemptions != 0 {
+				t.Errorf("redemptions = %d, want 0", got.Redemptions)
+			}
+			p.purchase(t, other, "once", http.StatusCreated)
+			p.checkEnrolled(t, buyer, false, 0)
+		})
+	}
+}
+
+func TestRefundUnenrolls(t *testing.T) {
+	p := newPaymentTest(t, time.Hour)
+	var buyers []string
+	var payments []paymentResponse
+	for range 2 {
+		userID := p.newUser(t)
+		payment := p.purchase(t, userID, "", http.StatusCreated)
+		p.notify(t, payment, models.PaymentPaid, http.StatusOK)
+		buyers = append(buyers, userID)
+		payments = append(payments, payment)
+	}
+	p.checkEnrolled(t, buyers[0], true, 2)
+
+	for range 2 {
+		if got := p.notify(t, payments[0], models.PaymentRefunded, http.StatusOK); got.Status != models.PaymentRefunded {
+			t.Errorf("refund notification: status %q, want refunded", got.Status)
+		}
+	}
+	p.checkEnrolled(t, buyers[0], false, 1)
+	p.checkEnrolled(t, buyers[1], true, 1)
+
+	// A refunded payment cannot be paid again
+	got := p.notify(t, payments[0], models.PaymentPaid, http.StatusConflict)
+	if got.Error == "" {
+		t.Error("paying a refunded payment did not fail")
+	}
+	p.checkEnrolled(t, buyers[0], false, 1)
+}
+
+func TestPurchaseCoveredByCouponSkipsProvider(t *testing.T) {
+	p := newPaymentTest(t, time.Hour)
+	coupon := p.newCoupon(t)
+	coupon.PercentOff = 100
+	if err := p.store.Coupons.Update(t.Context(), coupon); err != nil {
+		t.Fatal(err)
+	}
+	userID := p.newUser(t)
+
+	payment := p.purchase(t, userID, "ONCE", http.StatusCreated)
+	if payment.Status != models.PaymentPaid || payment.AmountMoney.Amount != 0 {
+		t.Errorf("purchase = %+v, want paid for nothing", payment)
+	}
+	p.checkEnrolled(t, userID, true, 1)
+	// Nothing was charged, so the provider cannot send notifications for it
+	if got := p.notify(t, payment, models.PaymentRefunded, http.StatusNotFound); got.Error == "" {
+		t.Error("a notification was applied to a payment the provider never charged")
+	}
+}
+
+func TestRepeatedPurchaseReturnsPendingPayment(t *testing.T) {
+	p := newPaymentTest(t, 50*time.Millisecond)
+	userID := p.newUser(t)
+
+	// A double click without an Idempotency-Key gets the same payment
+	first := p.purchase(t, userID, "", http.StatusCreated)
+	if again := p.purchase(t, userID, "", http.StatusOK); again.ID != first.ID || again.Status != models.PaymentPending {
+		t.Errorf("repeated purchase = %+v, want pending payment %s", again, first.ID)
+	}
+	payments, err := p.store.Payments.ListByUser(t.Context(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 {
+		t.Errorf("%d payments stored, want 1", len(payments))
+	}
+
+	// Once it has expired a new purchase can be started
+	time.Sleep(100 * time.Millisecond)
+	second := p.purchase(t, userID, "", http.StatusCreated)
+	if second.ID == first.ID {
+		t.Error("purchase after expiry returned the expired payment")
+	}
+	if got := p.get(t, userID, first.ID); got.Status != models.PaymentExpired {
+		t.Errorf("first payment is %q, want expired", got.Status)
+	}
+	p.notify(t, second, models.PaymentPaid, http.StatusOK)
+	p.purchase(t, userID, "", http.StatusBadRequest)
+	p.checkEnrolled(t, userID, true, 1)
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/cuanin/emergent-backend/gateway"
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+)
+
+// maxNotificationSize limits the body of a payment notification.
+const maxNotificationSize = 64 << 10
+
+// PaymentWebhook applies a notification from the payment provider named by
+// the :provider path parameter to the payment it is about. Providers send
+// a notification again until it is acknowledged with a 2xx response, so the
+// same one may arrive several times; repeats leave the payment as it is.
+func (h *Handler) PaymentWebhook(c *gin.Context) {
+	provider := h.paymentProvider
+	if c.Param("provider") != provider.Name() {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Unknown payment provider"})
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxNotificationSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid notification"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	n, err := provider.ParseNotification(ctx, c.Request.Header, body)
+	switch {
+	case errors.Is(err, gateway.ErrInvalidSignature):
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Invalid signature"})
+		return
+	case errors.Is(err, gateway.ErrChargeNotFound):
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Payment not found"})
+		return
+	case err != nil:
+		log.Printf("Rejected %s notification: %v", provider.Name(), err)
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid notification"})
+		return
+	}
+
+	payment, err := h.payments.GetByID(ctx, n.OrderID)
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && payment.Provider != provider.Name()) {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "Payment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load payment"})
+		return
+	}
+	if n.Amount != payment.Amount {
+		log.Printf("Rejected %s notification for payment %s: amount %v, expected %v", provider.Name(), payment.ID, n.Amount, payment.Amount)
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Amount does not match the payment"})
+		return
+	}
+	// Providers also report new charges, and may deliver that report late
+	if n.Status == models.PaymentPending {
+		c.JSON(http.StatusOK, gin.H{"status": payment.Status})
+		return
+	}
+
+	payment, err = h.settlePayment(ctx, payment, n.Status)
+	if errors.Is(err, errPaymentTransition) {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Cannot move a payment from " + payment.Status + " to " + n.Status})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update payment"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": payment.Status})
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cuanin/emergent-backend/mailer"
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// GetProfile returns the current user's account.
+func (h *Handler) GetProfile(c *gin.Context) {
+	user, ok := h.loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// UpdateProfile changes the current user's name and avatar. A new email
+// address is not applied until the link sent to it is opened.
+func (h *Handler) UpdateProfile(c *gin.Context) {
+	var req models.UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+	user, ok := h.loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	// Validate everything before saving anything
+	if req.FullName != nil {
+		name := strings.TrimSpace(*req.FullName)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Full name cannot be empty"})
+			return
+		}
+		user.FullName = name
+	}
+	if req.AvatarURL != nil {
+		avatar := strings.TrimSpace(*req.AvatarURL)
+		if avatar != "" {
+			u, err := url.Parse(avatar)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Avatar URL must be an http or https URL"})
+				return
+			}
+		}
+		user.AvatarURL = avatar
+	}
+	newEmail := ""
+	if req.Email != nil && *req.Email != user.Email {
+		newEmail = *req.Email
+		_, err := h.users.GetByEmail(ctx, newEmail)
+		if err == nil {
+			c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Email already registered"})
+			return
+		}
+		if !errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to look up user"})
+			return
+		}
+	}
+
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update user"})
+		return
+	}
+
+	response := gin.H{"user": user}
+	if newEmail != "" {
+		if err := h.sendEmailChangeConfirmation(c, user, newEmail); err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to send confirmation email"})
+			return
+		}
+		response["pending_email"] = newEmail
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// sendEmailChangeConfirmation emails a confirmation link to the new address
+// and lets the current address know about the request.
+func (h *Handler) sendEmailChangeConfirmation(c *gin.Context, user models.User, newEmail string) error {
+	// The token records the new address; the account keeps the old one
+	pending := user
+	pending.Email = newEmail
+	token, err := h.createActionToken(c.Request.Context(), pending, models.TokenChangeEmail, verifyEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+	h.sendMail(mailer.Message{
+		To:      newEmail,
+		Subject: "Confirm your new email address",
+		Body: "Hi " + user.FullName + ",\n\n" +
+			"Please confirm that you want to use this address for your account by opening the link below:\n\n" +
+			h.appURL + "/confirm-email-change?token=" + url.QueryEscape(token) + "\n\n" +
+			"The link expires in 24 hours.\n",
+	})
+	h.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your email address is being changed",
+		Body: "Hi " + user.FullName + ",\n\n" +
+			"Someone asked to change the email address of your account to " + newEmail + ". " +
+			"It will change once the new address is confirmed. If this was not you, reset your password.\n",
+	})
+	return nil
+}
+
+// ConfirmEmailChange applies a new email address using the token sent to it
+// by UpdateProfile.
+func (h *Handler) ConfirmEmailChange(c *gin.Context) {
+	raw := c.Query("token")
+	if raw == "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Token is required"})
+		return
+	}
+
+	token, ok := h.consumeActionToken(c, raw, models.TokenChangeEmail)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, token.UserID)
+	if err != nil || user.DeletedAt != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid or already used token"})
+		return
+	}
+
+	user.Email = token.Email
+	user.EmailVerified = true
+	if err := h.users.Update(ctx, user); err != nil {
+		if errors.Is(err, repository.ErrDuplicateEmail) {
+			c.JSON(http.StatusConflict, models.ErrorResponse{Error: "Email already registered"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email address changed"})
+}
+
+// ChangePassword replaces the current user's password after checking the
+// current one. Every other session is signed out; the caller gets new
+// tokens.
+func (h *Handler) ChangePassword(c *gin.Context) {
+	var req models.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+	user, ok := h.loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	// Guesses count towards the login lockout, so a stolen access token
+	// cannot be used to brute-force the password
+	ip := c.ClientIP()
+	wait, err := h.loginGuard.Check(ctx, ip, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to check login attempts"})
+		return
+	}
+	if wait > 0 {
+		tooManyAttempts(c, wait)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.CurrentPassword)) != nil {
+		wait, err := h.loginGuard.Fail(ctx, ip, user.Email)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to record login attempt"})
+			return
+		}
+		if wait > 0 {
+			tooManyAttempts(c, wait)
+			return
+		}
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Current password is incorrect"})
+		return
+	}
+
+	hashedPassword, err := hashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to process password"})
+		return
+	}
+	user.Password = hashedPassword
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update password"})
+		return
+	}
+	if err := h.endSessions(ctx, user.ID, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to revoke sessions"})
+		return
+	}
+	tokens, err := h.issueTokens(ctx, user, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to generate authentication token"})
+		return
+	}
+
+	h.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your password was changed",
+		Body: "Hi " + user.FullName + ",\n\n" +
+			"The password for your account was just changed. If this was not you, reset your password now.\n",
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Password changed",
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+// DeleteAccount anonymises the current user and signs them out everywhere.
+// Accounts with a password must confirm it. Payments are kept, still
+// attributed to the anonymised record.
+func (h *Handler) DeleteAccount(c *gin.Context) {
+	var req models.DeleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request data"})
+		return
+	}
+	user, ok := h.loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	if user.Password != "" && bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)) != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Password is incorrect"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+	if err := h.users.Anonymize(ctx, user.ID, now); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to delete account"})
+		return
+	}
+	if err := h.recordAudit(c, models.AuditEvent{Action: models.AuditAccountDeleted, UserID: user.ID}); err != nil {
+		log.Printf("Failed to record deletion of user %s: %v", user.ID, err)
+	}
+	if err := h.endSessions(ctx, user.ID, now); err != nil {
+		log.Printf("Failed to revoke sessions of deleted user %s: %v", user.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted"})
+}
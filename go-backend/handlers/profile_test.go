@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/mailer"
+	"github.com/cuanin/emergent-backend/models"
+)
+
+func newProfileTest(t *testing.T) (*apiTest, mailbox) {
+	t.Helper()
+	mail := newMailbox()
+	a := newAPITest(t, Config{Mailer: mail})
+	a.router.POST("/api/auth/login", a.h.Login)
+	a.router.POST("/api/auth/refresh", a.h.RefreshToken)
+	a.router.GET("/api/auth/confirm-email-change", a.h.ConfirmEmailChange)
+	a.router.GET("/api/user/me", a.auth, a.h.GetProfile)
+	a.router.PATCH("/api/user/me", a.auth, a.h.UpdateProfile)
+	a.router.DELETE("/api/user/me", a.auth, a.h.DeleteAccount)
+	a.router.POST("/api/user/me/password", a.auth, a.h.ChangePassword)
+	return a, mail
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestUpdateProfile(t *testing.T) {
+	a, _ := newProfileTest(t)
+	user := a.newUser(t, models.RoleStudent)
+
+	var resp struct {
+		User models.User `json:"user"`
+	}
+	a.do(t, http.MethodPatch, "/api/user/me", user.ID, models.UpdateProfileRequest{
+		FullName:  ptr("  New Name "),
+		AvatarURL: ptr("https://example.com/me.png"),
+	}, http.StatusOK, &resp)
+	if resp.User.FullName != "New Name" || resp.User.AvatarURL != "https://example.com/me.png" {
+		t.Errorf("updated profile = %+v", resp.User)
+	}
+	if resp.User.Password != "" {
+		t.Error("profile response includes the password hash")
+	}
+
+	for _, req := range []models.UpdateProfileRequest{
+		{FullName: ptr("   ")},
+		{AvatarURL: ptr("javascript:alert(1)")},
+		{Email: ptr("not an email")},
+	} {
+		a.do(t, http.MethodPatch, "/api/user/me", user.ID, req, http.StatusBadRequest, nil)
+	}
+
+	// Invalid requests change nothing; fields left out are kept
+	a.do(t, http.MethodPatch, "/api/user/me", user.ID, models.UpdateProfileRequest{AvatarURL: ptr("")}, http.StatusOK, nil)
+	stored, err := a.store.Users.GetByID(t.Context(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.FullName != "New Name" || stored.AvatarURL != "" {
+		t.Errorf("stored profile = %q, %q, want New Name without an avatar", stored.FullName, stored.AvatarURL)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	a, mail := newProfileTest(t)
+	user := a.newUser(t, models.RoleStudent)
+	other := a.newUser(t, models.RoleStudent)
+
+	a.do(t, http.MethodPatch, "/api/user/me", user.ID, models.UpdateProfileRequest{Email: ptr(other.Email)}, http.StatusConflict, nil)
+
+	const newEmail = "new@example.com"
+	var resp struct {
+		User         models.User `json:"user"`
+		PendingEmail string      `json:"pending_email"`
+	}
+	a.do(t, http.MethodPatch, "/api/user/me", user.ID, models.UpdateProfileRequest{Email: ptr(newEmail)}, http.StatusOK, &resp)
+	if resp.PendingEmail != newEmail || resp.User.Email != user.Email {
+		t.Fatalf("profile after asking for a new email = %q pending %q, want %q pending %q", resp.User.Email, resp.PendingEmail, user.Email, newEmail)
+	}
+	// Both addresses are mailed, in either order
+	sent := map[string]mailer.Message{}
+	for range 2 {
+		msg := mail.receive(t, "")
+		sent[msg.To] = msg
+	}
+	if _, ok := sent[user.Email]; !ok {
+		t.Errorf("no email to the old address %s", user.Email)
+	}
+	msg, ok := sent[newEmail]
+	if !ok {
+		t.Fatalf("no email to %s", newEmail)
+	}
+	token := mailToken(t, msg)
+
+	confirm := "/api/auth/confirm-email-change?token=" + url.QueryEscape(token)
+	a.do(t, http.MethodGet, confirm, "", nil, http.StatusOK, nil)
+	stored, err := a.store.Users.GetByID(t.Context(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Email != newEmail || !stored.EmailVerified {
+		t.Errorf("email after confirming = %q verified %v, want %q verified", stored.Email, stored.EmailVerified, newEmail)
+	}
+	a.do(t, http.MethodGet, confirm, "", nil, http.StatusBadRequest, nil)
+}
+
+func TestChangePassword(t *testing.T) {
+	a, mail := newProfileTest(t)
+	user := a.newUser(t, models.RoleStudent)
+	session := login(t, a, user)
+
+	a.do(t, http.MethodPost, "/api/user/me/password", user.ID, models.ChangePasswordRequest{CurrentPassword: "wrong", NewPassword: "new password"}, http.StatusBadRequest, nil)
+	a.do(t, http.MethodPost, "/api/user/me/password", user.ID, models.ChangePasswordRequest{CurrentPassword: apiTestPassword, NewPassword: "short"}, http.StatusBadRequest, nil)
+
+	var resp tokensResponse
+	a.do(t, http.MethodPost, "/api/user/me/password", user.ID, models.ChangePasswordRequest{CurrentPassword: apiTestPassword, NewPassword: "new password"}, http.StatusOK, &resp)
+	if resp.Token == "" || resp.RefreshToken == "" {
+		t.Fatalf("password change returned %+v, want new tokens", resp)
+	}
+	mail.receive(t, user.Email)
+
+	// Other sessions are signed out; the caller's new one keeps working
+	refresh(t, a, session.RefreshToken, http.StatusUnauthorized)
+	refresh(t, a, resp.RefreshToken, http.StatusOK)
+
+	a.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: user.Email, Password: apiTestPassword}, http.StatusUnauthorized, nil)
+	a.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: user.Email, Password: "new password"}, http.StatusOK, nil)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	a, _ := newProfileTest(t)
+	a.router.POST("/api/auth/reset-password", a.h.ResetPassword)
+	user := a.newUser(t, models.RoleStudent)
+	session := login(t, a, user)
+	// A reset link sent before the account was deleted
+	reset, err := a.h.createActionToken(t.Context(), user, models.TokenResetPassword, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.do(t, http.MethodDelete, "/api/user/me", user.ID, models.DeleteAccountRequest{Password: "wrong"}, http.StatusBadRequest, nil)
+	a.do(t, http.MethodDelete, "/api/user/me", user.ID, nil, http.StatusBadRequest, nil)
+	a.do(t, http.MethodDelete, "/api/user/me", user.ID, models.DeleteAccountRequest{Password: apiTestPassword}, http.StatusOK, nil)
+
+	// The record is kept, anonymised, and every session is signed out
+	stored, err := a.store.Users.GetByID(t.Context(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.DeletedAt == nil || stored.Email == user.Email || stored.FullName == user.FullName || stored.Password != "" {
+		t.Errorf("deleted account = %+v, want it anonymised", stored)
+	}
+	if stored.SessionsEndedAt == nil {
+		t.Error("deleting the account did not end its sessions")
+	}
+	refresh(t, a, session.RefreshToken, http.StatusUnauthorized)
+	a.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: user.Email, Password: apiTestPassword}, http.StatusUnauthorized, nil)
+	a.do(t, http.MethodGet, "/api/user/me", user.ID, nil, http.StatusUnauthorized, nil)
+
+	// Links sent before cannot bring the account back
+	a.do(t, http.MethodPost, "/api/auth/reset-password", "", models.ResetPasswordRequest{Token: reset, Password: "new password"}, http.StatusBadRequest, nil)
+	a.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: stored.Email, Password: "new password"}, http.StatusUnauthorized, nil)
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/randtoken"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultAccessTokenTTL is how long access tokens last unless
+	// Config.AccessTokenTTL says otherwise.
+	DefaultAccessTokenTTL = 15 * time.Minute
+	// DefaultRefreshTokenTTL is how long refresh tokens last unless
+	// Config.RefreshTokenTTL says otherwise.
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// tokenPair is the access and refresh token issued at login or refresh.
+type tokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int // access token lifetime in seconds
+}
+
+// issueTokens creates an access token and a refresh token for user. An empty
+// familyID starts a new refresh token family, as at login.
+func (h *Handler) issueTokens(ctx context.Context, user models.User, familyID string) (tokenPair, error) {
+	accessToken, err := h.generateJWT(user)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	refreshToken, err := randtoken.New()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	if familyID == "" {
+		familyID = uuid.New().String()
+	}
+	now := time.Now()
+	if err := h.tokens.CreateRefreshToken(ctx, models.RefreshToken{
+		ID:        randtoken.Hash(refreshToken),
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(h.refreshTokenTTL),
+	}); err != nil {
+		return tokenPair{}, err
+	}
+
+	return tokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(h.accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// endSessions signs the user out everywhere: their refresh tokens are
+// revoked and the access tokens issued to them before at are refused.
+func (h *Handler) endSessions(ctx context.Context, userID string, at time.Time) error {
+	if err := h.users.EndSessions(ctx, userID, at); err != nil {
+		return err
+	}
+	return h.tokens.RevokeUserRefreshTokens(ctx, userID, at)
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token.
+// Each refresh token can be used once; presenting a used token again means it
+// was stolen, so the whole family is revoked.
+func (h *Handler) RefreshToken(c *gin.Context) {
+	var req models.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request data"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+	id := randtoken.Hash(req.RefreshToken)
+
+	stored, err := h.tokens.GetRefreshToken(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Invalid refresh token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load refresh token"})
+		return
+	}
+	if stored.RevokedAt != nil || now.After(stored.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Refresh token has expired or been revoked"})
+		return
+	}
+
+	if err := h.tokens.MarkRefreshTokenUsed(ctx, id, now); err != nil {
+		if errors.Is(err, repository.ErrTokenUsed) {
+			if err := h.tokens.RevokeRefreshFamily(ctx, stored.FamilyID, now); err != nil {
+				c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to revoke refresh tokens"})
+				return
+			}
+			c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Refresh token reuse detected; please log in again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to rotate refresh token"})
+		return
+	}
+
+	user, err := h.users.GetByID(ctx, stored.UserID)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load user"})
+		return
+	}
+	if err != nil || user.DeletedAt != nil {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "User not found"})
+		return
+	}
+	if user.SuspendedAt != nil {
+		accountSuspended(c)
+		return
+	}
+
+	tokens, err := h.issueTokens(ctx, user, stored.FamilyID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to generate authentication token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+// Logout revokes the access token used for the request and, if given, the
+// refresh token family it belongs to.
+func (h *Handler) Logout(c *gin.Context) {
+	var req models.LogoutRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request data"})
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+
+	// Set by the auth middleware
+	jti := c.GetString("jti")
+	expiresAt := c.GetTime("token_expires_at")
+	if err := h.tokens.RevokeAccessToken(ctx, jti, expiresAt); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to revoke access token"})
+		return
+	}
+
+	if req.RefreshToken != "" {
+		stored, err := h.tokens.GetRefreshToken(ctx, randtoken.Hash(req.RefreshToken))
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load refresh token"})
+			return
+		}
+		// Only the owner may revoke a refresh token family
+		if err == nil && stored.UserID == c.GetString("user_id") {
+			if err := h.tokens.RevokeRefreshFamily(ctx, stored.FamilyID, now); err != nil {
+				c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to revoke refresh token"})
+				return
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// JWKS publishes the public keys that verify our access tokens, so that
+// other services can check them without a shared secret.
+func (h *Handler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.keys.JWKS())
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/randtoken"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tokensResponse is what login and refresh return.
+type tokensResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func newTokensTest(t *testing.T) *apiTest {
+	t.Helper()
+	a := newAPITest(t, Config{})
+	a.router.POST("/api/auth/login", a.h.Login)
+	a.router.POST("/api/auth/refresh", a.h.RefreshToken)
+	a.router.POST("/api/auth/logout", a.auth, a.h.Logout)
+	return a
+}
+
+func login(t *testing.T, a *apiTest, user models.User) tokensResponse {
+	t.Helper()
+	var resp tokensResponse
+	a.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: user.Email, Password: apiTestPassword}, http.StatusOK, &resp)
+	if resp.Token == "" || resp.RefreshToken == "" {
+		t.Fatalf("login returned %+v", resp)
+	}
+	return resp
+}
+
+func refresh(t *testing.T, a *apiTest, refreshToken string, wantCode int) tokensResponse {
+	t.Helper()
+	var resp tokensResponse
+	a.do(t, http.MethodPost, "/api/auth/refresh", "", models.RefreshRequest{RefreshToken: refreshToken}, wantCode, &resp)
+	return resp
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	a := newTokensTest(t)
+	first := login(t, a, a.newUser(t, models.RoleStudent))
+
+	second := refresh(t, a, first.RefreshToken, http.StatusOK)
+	if second.Token == "" || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh returned %+v, want a new token pair", second)
+	}
+	refresh(t, a, second.RefreshToken, http.StatusOK)
+	refresh(t, a, "not-a-token", http.StatusUnauthorized)
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	a := newTokensTest(t)
+	user := a.newUser(t, models.RoleStudent)
+	stolen := login(t, a, user)
+	other := login(t, a, user)
+
+	rotated := refresh(t, a, stolen.RefreshToken, http.StatusOK)
+	// Replaying the rotated token revokes the token it was rotated to...
+	refresh(t, a, stolen.RefreshToken, http.StatusUnauthorized)
+	refresh(t, a, rotated.RefreshToken, http.StatusUnauthorized)
+	// ...but not the tokens of the user's other logins
+	refresh(t, a, other.RefreshToken, http.StatusOK)
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	a := newTokensTest(t)
+	user := a.newUser(t, models.RoleStudent)
+	tokens := login(t, a, user)
+	token, err := a.h.keys.Parse(tokens.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jti, _ := token.Claims.(jwt.MapClaims)["jti"].(string)
+
+	// Someone else cannot log the user's refresh token out
+	intruder := a.newUser(t, models.RoleStudent)
+	req := a.request(http.MethodPost, "/api/auth/logout", intruder.ID, models.LogoutRequest{RefreshToken: tokens.RefreshToken})
+	req.Header.Set("X-Token-ID", "intruder")
+	a.serve(t, req, http.StatusOK)
+	if revoked, err := a.store.Tokens.IsAccessTokenRevoked(t.Context(), jti); err != nil || revoked {
+		t.Fatalf("IsAccessTokenRevoked after another user's logout = %v, %v", revoked, err)
+	}
+	if stored, err := a.store.Tokens.GetRefreshToken(t.Context(), randtoken.Hash(tokens.RefreshToken)); err != nil || stored.RevokedAt != nil {
+		t.Fatalf("refresh token after another user's logout = %+v, %v, want it unrevoked", stored, err)
+	}
+
+	req = a.request(http.MethodPost, "/api/auth/logout", user.ID, models.LogoutRequest{RefreshToken: tokens.RefreshToken})
+	req.Header.Set("X-Token-ID", jti)
+	a.serve(t, req, http.StatusOK)
+	if revoked, err := a.store.Tokens.IsAccessTokenRevoked(t.Context(), jti); err != nil || !revoked {
+		t.Errorf("IsAccessTokenRevoked after logout = %v, %v, want true", revoked, err)
+	}
+	refresh(t, a, tokens.RefreshToken, http.StatusUnauthorized)
+}
+
+func TestTokenLifetimes(t *testing.T) {
+	a := newAPITest(t, Config{AccessTokenTTL: time.Minute, RefreshTokenTTL: 50 * time.Millisecond})
+	a.router.POST("/api/auth/login", a.h.Login)
+	a.router.POST("/api/auth/refresh", a.h.RefreshToken)
+	user := a.newUser(t, models.RoleStudent)
+
+	var resp struct {
+		tokensResponse
+		ExpiresIn int `json:"expires_in"`
+	}
+	a.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: user.Email, Password: apiTestPassword}, http.StatusOK, &resp)
+	if resp.ExpiresIn != 60 {
+		t.Errorf("expires_in = %d, want 60", resp.ExpiresIn)
+	}
+	token, err := a.h.keys.Parse(resp.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, err := token.Claims.GetExpirationTime(); err != nil || time.Until(exp.Time) > time.Minute {
+		t.Errorf("access token expires at %v, %v, want within a minute", exp, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	refresh(t, a, resp.RefreshToken, http.StatusUnauthorized)
+}
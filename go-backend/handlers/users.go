@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cuanin/emergent-backend/mailer"
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/randtoken"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultUsersPerPage = 20
+	maxUsersPerPage     = 100
+	// forcedResetTokenTTL is how long the link sent by ResetUserPassword
+	// works. It is longer than a self-service reset because the user did
+	// not ask for it and may not read the email right away.
+	forcedResetTokenTTL = 24 * time.Hour
+)
+
+// ListUsers searches the users, newest first. The q query parameter matches
+// part of the email or name; role and status (active, suspended or deleted)
+// narrow the results. Deleted users are only listed when asked for.
+func (h *Handler) ListUsers(c *gin.Context) {
+	page, ok := queryInt(c, "page", 1, 1, maxPage)
+	if !ok {
+		return
+	}
+	perPage, ok := queryInt(c, "per_page", defaultUsersPerPage, 1, maxUsersPerPage)
+	if !ok {
+		return
+	}
+	role := c.Query("role")
+	switch role {
+	case "", models.RoleAdmin, models.RoleMentor, models.RoleStudent:
+	default:
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "role must be admin, mentor or student"})
+		return
+	}
+	status := c.Query("status")
+	switch status {
+	case "", models.UserActive, models.UserSuspended, models.UserDeleted:
+	default:
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "status must be active, suspended or deleted"})
+		return
+	}
+
+	users, total, err := h.users.Search(c.Request.Context(), repository.UserFilter{
+		Query:  strings.TrimSpace(c.Query("q")),
+		Role:   role,
+		Status: status,
+		Offset: (page - 1) * perPage,
+		Limit:  perPage,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load users"})
+		return
+	}
+	c.JSON(http.StatusOK, models.UserListResponse{Users: users, Total: total, Page: page, PerPage: perPage})
+}
+
+// GetUser returns a user with their enrolled courses and payments.
+func (h *Handler) GetUser(c *gin.Context) {
+	user, ok := h.loadUser(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	enrollments := []models.EnrolledCourse{}
+	for _, courseID := range user.EnrolledCourses {
+		course, err := h.courses.GetByID(ctx, courseID)
+		if errors.Is(err, repository.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load course"})
+			return
+		}
+		enrollments = append(enrollments, models.EnrolledCourse{Course: course, Progress: user.Progress[courseID]})
+	}
+	payments, err := h.payments.ListByUser(ctx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load payments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.UserDetailResponse{User: user, Enrollments: enrollments, Payments: payments})
+}
+
+// UpdateUserRole changes a user's role. Setting is_admin is shorthand for
+// the admin role, or the student role when false. Admins cannot change
+// their own role, so that the last admin cannot lock everyone out.
+func (h *Handler) UpdateUserRole(c *gin.Context) {
+	var req models.UpdateUserRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+	if (req.Role == nil) == (req.IsAdmin == nil) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: "Exactly one of role and is_admin is required"})
+		return
+	}
+	user, ok := h.loadUser(c)
+	if !ok {
+		return
+	}
+	if user.ID == c.GetString("user_id") {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "You cannot change your own role"})
+		return
+	}
+
+	role := models.RoleStudent
+	switch {
+	case req.Role != nil:
+		role = *req.Role
+	case *req.IsAdmin:
+		role = models.RoleAdmin
+	}
+	previous := user.EffectiveRole()
+	if role == previous {
+		c.JSON(http.StatusOK, user)
+		return
+	}
+	user.Role = role
+	user.IsAdmin = role == models.RoleAdmin
+	if err := h.users.Update(c.Request.Context(), user); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update user"})
+		return
+	}
+	if err := h.recordAudit(c, models.AuditEvent{Action: models.AuditRoleChanged, UserID: user.ID, Detail: previous + " -> " + role}); err != nil {
+		log.Printf("Failed to record role change of user %s: %v", user.ID, err)
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// SuspendUser disables a user's account and signs them out everywhere. The
+// account and its data are kept until ReactivateUser.
+func (h *Handler) SuspendUser(c *gin.Context) {
+	var req models.SuspendUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err))
+		return
+	}
+	user, ok := h.loadUser(c)
+	if !ok {
+		return
+	}
+	if user.ID == c.GetString("user_id") {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "You cannot suspend your own account"})
+		return
+	}
+	if user.SuspendedAt != nil {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "User is already suspended"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+	reason := strings.TrimSpace(req.Reason)
+	if err := h.users.SetSuspension(ctx, user.ID, &now, reason); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to suspend user"})
+		return
+	}
+	// authMiddleware refuses suspended users; their sessions must not
+	// outlive a reactivation either.
+	if err := h.endSessions(ctx, user.ID, now); err != nil {
+		log.Printf("Failed to revoke sessions of suspended user %s: %v", user.ID, err)
+	}
+	if err := h.recordAudit(c, models.AuditEvent{Action: models.AuditUserSuspended, UserID: user.ID, Detail: reason}); err != nil {
+		log.Printf("Failed to record suspension of user %s: %v", user.ID, err)
+	}
+
+	user.SuspendedAt = &now
+	user.SuspendedReason = reason
+	c.JSON(http.StatusOK, user)
+}
+
+// ReactivateUser lifts a suspension.
+func (h *Handler) ReactivateUser(c *gin.Context) {
+	user, ok := h.loadUser(c)
+	if !ok {
+		return
+	}
+	if user.SuspendedAt == nil {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "User is not suspended"})
+		return
+	}
+
+	if err := h.users.SetSuspension(c.Request.Context(), user.ID, nil, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to reactivate user"})
+		return
+	}
+	if err := h.recordAudit(c, models.AuditEvent{Action: models.AuditUserReactivated, UserID: user.ID}); err != nil {
+		log.Printf("Failed to record reactivation of user %s: %v", user.ID, err)
+	}
+
+	user.SuspendedAt = nil
+	user.SuspendedReason = ""
+	c.JSON(http.StatusOK, user)
+}
+
+// ResetUserPassword forces a user to choose a new password: the current one
+// stops working, every session is signed out and the user is emailed a
+// reset link.
+func (h *Handler) ResetUserPassword(c *gin.Context) {
+	user, ok := h.loadUser(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	// Replace the password with one nobody knows
+	random, err := randtoken.New()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to process password"})
+		return
+	}
+	hashedPassword, err := hashPassword(random)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to process password"})
+		return
+	}
+	user.Password = hashedPassword
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to update password"})
+		return
+	}
+	if err := h.endSessions(ctx, user.ID, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to revoke sessions"})
+		return
+	}
+	token, err := h.createActionToken(ctx, user, models.TokenResetPassword, forcedResetTokenTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to create reset token"})
+		return
+	}
+	h.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Please choose a new password",
+		Body: "Hi " + user.FullName + ",\n\n" +
+			"An administrator has reset the password for your account, and you have been signed out. " +
+			"Choose a new password by opening the link below:\n\n" +
+			h.appURL + "/reset-password?token=" + url.QueryEscape(token) + "\n\n" +
+			"The link expires in 24 hours.\n",
+	})
+	if err := h.recordAudit(c, models.AuditEvent{Action: models.AuditPasswordReset, UserID: user.ID}); err != nil {
+		log.Printf("Failed to record password reset of user %s: %v", user.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset email sent"})
+}
+
+// loadUser returns the user named by the :id path parameter, writing a 404
+// if there is none. Deleted users can only be viewed, so any other method
+// gets a 409 for them.
+func (h *Handler) loadUser(c *gin.Context) (models.User, bool) {
+	user, err := h.users.GetByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: "User not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load user"})
+		}
+		return models.User{}, false
+	}
+	if user.DeletedAt != nil && c.Request.Method != http.MethodGet {
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: "User has been deleted"})
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// maxPage is the highest page number accepted. It keeps the offset of the
+// last page, at the largest page size, far from overflowing.
+const maxPage = 10000
+
+// queryInt parses an integer query parameter between min and max, where a
+// max of zero means no upper bound. It writes a 400 if the value is invalid.
+func queryInt(c *gin.Context, name string, def, min, max int) (int, bool) {
+	v := c.Query(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || (max > 0 && n > max) {
+		msg := name + " must be an integer of at least " + strconv.Itoa(min)
+		if max > 0 {
+			msg = name + " must be between " + strconv.Itoa(min) + " and " + strconv.Itoa(max)
+		}
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: msg})
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/google/uuid"
+)
+
+func newUsersTest(t *testing.T) (*apiTest, models.User) {
+	t.Helper()
+	mail := newMailbox()
+	a := newAPITest(t, Config{Mailer: mail})
+	a.router.POST("/api/auth/login", a.h.Login)
+	a.router.GET("/api/admin/users", a.auth, a.h.ListUsers)
+	a.router.GET("/api/admin/users/:id", a.auth, a.h.GetUser)
+	a.router.PUT("/api/admin/users/:id/role", a.auth, a.h.UpdateUserRole)
+	a.router.POST("/api/admin/users/:id/suspend", a.auth, a.h.SuspendUser)
+	a.router.POST("/api/admin/users/:id/reactivate", a.auth, a.h.ReactivateUser)
+	a.router.POST("/api/admin/users/:id/reset-password", a.auth, a.h.ResetUserPassword)
+	return a, a.newUser(t, models.RoleAdmin)
+}
+
+// newListedUser creates a user named name who signed up at createdAt.
+func newListedUser(t *testing.T, a *apiTest, name, role string, createdAt time.Time) models.User {
+	t.Helper()
+	user := models.User{
+		ID:              uuid.New().String(),
+		Email:           uuid.New().String() + "@example.com",
+		FullName:        name,
+		Role:            role,
+		CreatedAt:       createdAt,
+		EnrolledCourses: []string{},
+		Badges:          []string{},
+		Progress:        map[string]int{},
+	}
+	if err := a.store.Users.Create(t.Context(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func listUsers(t *testing.T, a *apiTest, admin models.User, query string) models.UserListResponse {
+	t.Helper()
+	var resp models.UserListResponse
+	a.do(t, http.MethodGet, "/api/admin/users?"+query, admin.ID, nil, http.StatusOK, &resp)
+	return resp
+}
+
+func names(users []models.User) []string {
+	var s []string
+	for _, u := range users {
+		s = append(s, u.FullName)
+	}
+	return s
+}
+
+func TestListUsers(t *testing.T) {
+	a, admin := newUsersTest(t)
+	start := time.Now().Add(-time.Hour)
+	for i := range 5 {
+		newListedUser(t, a, fmt.Sprintf("Pupil %d", i), models.RoleStudent, start.Add(time.Duration(i)*time.Minute))
+	}
+	mentor := newListedUser(t, a, "Mentor Smith", models.RoleMentor, start)
+	suspended := newListedUser(t, a, "Suspended Smith", models.RoleStudent, start)
+	deleted := newListedUser(t, a, "Deleted Smith", models.RoleStudent, start)
+	if err := a.store.Users.SetSuspension(t.Context(), suspended.ID, &start, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.store.Users.Anonymize(t.Context(), deleted.ID, start); err != nil {
+		t.Fatal(err)
+	}
+
+	// Newest first, in pages
+	page := listUsers(t, a, admin, "q=pupil&role=student&status=active&per_page=2")
+	if got := names(page.Users); page.Total != 5 || page.Page != 1 || page.PerPage != 2 || fmt.Sprint(got) != "[Pupil 4 Pupil 3]" {
+		t.Errorf("first page = %v of %d, want [Pupil 4 Pupil 3] of 5", got, page.Total)
+	}
+	page = listUsers(t, a, admin, "q=pupil&role=student&status=active&per_page=2&page=3")
+	if got := names(page.Users); page.Total != 5 || fmt.Sprint(got) != "[Pupil 0]" {
+		t.Errorf("last page = %v of %d, want [Pupil 0] of 5", got, page.Total)
+	}
+	if page := listUsers(t, a, admin, "q=pupil&per_page=2&page=10"); len(page.Users) != 0 {
+		t.Errorf("page past the end = %v, want none", names(page.Users))
+	}
+
+	// q matches part of the name or email, ignoring case
+	page = listUsers(t, a, admin, "q=SMITH")
+	if page.Total != 2 {
+		t.Errorf("q=SMITH = %v, want the mentor and the suspended user", names(page.Users))
+	}
+	page = listUsers(t, a, admin, "q="+mentor.Email[:8])
+	if page.Total != 1 || page.Users[0].ID != mentor.ID {
+		t.Errorf("search by email = %v, want %s", names(page.Users), mentor.FullName)
+	}
+
+	// Deleted users are only listed when asked for
+	if page := listUsers(t, a, admin, "q=smith&status=deleted"); page.Total != 0 {
+		t.Errorf("deleted users are still found by their old name: %v", names(page.Users))
+	}
+	if page := listUsers(t, a, admin, "status=deleted"); page.Total != 1 || page.Users[0].ID != deleted.ID {
+		t.Errorf("status=deleted = %v, want the deleted user", names(page.Users))
+	}
+	if page := listUsers(t, a, admin, "status=suspended"); page.Total != 1 || page.Users[0].ID != suspended.ID {
+		t.Errorf("status=suspended = %v, want the suspended user", names(page.Users))
+	}
+	if page := listUsers(t, a, admin, "role=mentor"); page.Total != 1 || page.Users[0].ID != mentor.ID {
+		t.Errorf("role=mentor = %v, want the mentor", names(page.Users))
+	}
+
+	for _, query := range []string{"page=0", "page=10001", "per_page=0", "per_page=101", "page=x", "role=owner", "status=gone"} {
+		a.do(t, http.MethodGet, "/api/admin/users?"+query, admin.ID, nil, http.StatusBadRequest, nil)
+	}
+}
+
+func TestUpdateUserRole(t *testing.T) {
+	a, admin := newUsersTest(t)
+	user := a.newUser(t, models.RoleStudent)
+	path := "/api/admin/users/" + user.ID + "/role"
+
+	var got models.User
+	a.do(t, http.MethodPut, path, admin.ID, models.UpdateUserRoleRequest{Role: ptr(models.RoleMentor)}, http.StatusOK, &got)
+	if got.Role != models.RoleMentor || got.IsAdmin {
+		t.Errorf("after setting mentor: role %q, is_admin %v", got.Role, got.IsAdmin)
+	}
+	a.do(t, http.MethodPut, path, admin.ID, models.UpdateUserRoleRequest{IsAdmin: ptr(true)}, http.StatusOK, &got)
+	if got.Role != models.RoleAdmin || !got.IsAdmin {
+		t.Errorf("after setting is_admin: role %q, is_admin %v", got.Role, got.IsAdmin)
+	}
+	a.do(t, http.MethodPut, path, admin.ID, models.UpdateUserRoleRequest{IsAdmin: ptr(false)}, http.StatusOK, &got)
+	if got.Role != models.RoleStudent || got.IsAdmin {
+		t.Errorf("after clearing is_admin: role %q, is_admin %v", got.Role, got.IsAdmin)
+	}
+
+	// Exactly one field, with a known role
+	a.do(t, http.MethodPut, path, admin.ID, models.UpdateUserRoleRequest{}, http.StatusBadRequest, nil)
+	a.do(t, http.MethodPut, path, admin.ID, models.UpdateUserRoleRequest{Role: ptr(models.RoleAdmin), IsAdmin: ptr(true)}, http.StatusBadRequest, nil)
+	a.do(t, http.MethodPut, path, admin.ID, models.UpdateUserRoleRequest{Role: ptr("owner")}, http.StatusBadRequest, nil)
+	a.do(t, http.MethodPut, "/api/admin/users/missing/role", admin.ID, models.UpdateUserRoleRequest{Role: ptr(models.RoleMentor)}, http.StatusNotFound, nil)
+
+	// Each change is audited
+	events, err := a.store.Activity.ListAudit(t.Context(), user.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := 0
+	for _, e := range events {
+		if e.Action == models.AuditRoleChanged {
+			changes++
+		}
+	}
+	if changes != 3 {
+		t.Errorf("%d role changes audited, want 3", changes)
+	}
+}
+
+func TestAdminCannotChangeOwnRole(t *testing.T) {
+	a, admin := newUsersTest(t)
+	path := "/api/admin/users/" + admin.ID
+
+	a.do(t, http.MethodPut, path+"/role", admin.ID, models.UpdateUserRoleRequest{Role: ptr(models.RoleStudent)}, http.StatusConflict, nil)
+	a.do(t, http.MethodPut, path+"/role", admin.ID, models.UpdateUserRoleRequest{IsAdmin: ptr(false)}, http.StatusConflict, nil)
+	a.do(t, http.MethodPost, path+"/suspend", admin.ID, models.SuspendUserRequest{}, http.StatusConflict, nil)
+	stored, err := a.store.Users.GetByID(t.Context(), admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.EffectiveRole() != models.RoleAdmin || stored.SuspendedAt != nil {
+		t.Errorf("admin after changing themselves = %+v, want unchanged", stored)
+	}
+
+	// Another admin can
+	other := a.newUser(t, models.RoleAdmin)
+	a.do(t, http.MethodPut, path+"/role", other.ID, models.UpdateUserRoleRequest{Role: ptr(models.RoleStudent)}, http.StatusOK, nil)
+}
+
+func TestSuspendAndReactivateUser(t *testing.T) {
+	a, admin := newUsersTest(t)
+	user := a.newUser(t, models.RoleStudent)
+	session := login(t, a, user)
+	a.router.POST("/api/auth/refresh", a.h.RefreshToken)
+	path := "/api/admin/users/" + user.ID
+
+	a.do(t, http.MethodPost, path+"/reactivate", admin.ID, nil, http.StatusConflict, nil)
+
+	var got models.User
+	a.do(t, http.MethodPost, path+"/suspend", admin.ID, models.SuspendUserRequest{Reason: "  spam  "}, http.StatusOK, &got)
+	if got.SuspendedAt == nil || got.SuspendedReason != "spam" {
+		t.Errorf("suspended user = %+v", got)
+	}
+	a.do(t, http.MethodPost, path+"/suspend", admin.ID, models.SuspendUserRequest{}, http.StatusConflict, nil)
+
+	// Suspended users cannot log in or refresh their sessions
+	a.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: user.Email, Password: apiTestPassword}, http.StatusForbidden, nil)
+	refresh(t, a, session.RefreshToken, http.StatusUnauthorized)
+	if page := listUsers(t, a, admin, "status=suspended"); page.Total != 1 {
+		t.Errorf("suspended users = %v, want the suspended user", names(page.Users))
+	}
+
+	var reactivated models.User
+	a.do(t, http.MethodPost, path+"/reactivate", admin.ID, nil, http.StatusOK, &reactivated)
+	if reactivated.SuspendedAt != nil || reactivated.SuspendedReason != "" {
+		t.Errorf("reactivated user = %+v", reactivated)
+	}
+	// The old session stays signed out; logging in again works
+	refresh(t, a, session.RefreshToken, http.StatusUnauthorized)
+	login(t, a, user)
+}
+
+func TestResetUserPassword(t *testing.T) {
+	a, admin := newUsersTest(t)
+	mail := a.h.mailer.(mailbox)
+	user := a.newUser(t, models.RoleStudent)
+
+	a.do(t, http.MethodPost, "/api/admin/users/"+user.ID+"/reset-password", admin.ID, nil, http.StatusOK, nil)
+	a.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: user.Email, Password: apiTestPassword}, http.StatusUnauthorized, nil)
+	stored, err := a.store.Users.GetByID(t.Context(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SessionsEndedAt == nil {
+		t.Error("password reset did not end the user's sessions")
+	}
+	mailToken(t, mail.receive(t, user.Email))
+}
@@ -0,0 +1,144 @@
+// Package idempotency makes mutating requests safe to retry. The first
+// response to a request carrying an Idempotency-Key header is stored, per
+// user and key, and replayed when the request is sent again.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Header carries the key chosen by the client for a request and its
+	// retries.
+	Header = "Idempotency-Key"
+	// ReplayedHeader is set to "true" on a replayed response.
+	ReplayedHeader = "Idempotent-Replayed"
+	// DefaultTTL is how long responses are kept by default.
+	DefaultTTL = 24 * time.Hour
+
+	maxKeyLength = 255
+	maxBodySize  = 1 << 20
+)
+
+// Middleware returns middleware that stores responses in repo for ttl. It
+// must run after authentication, which sets "user_id" in the context; a
+// request without a user or without a key is passed on unchanged.
+//
+// A retry while the first request is still running is refused with 409,
+// and a key reused for a request with another method, path or body with
+// 422. Server errors are not stored, so the request can be retried.
+func Middleware(repo repository.IdempotencyRepository, ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(Header)
+		userID := c.GetString("user_id")
+		if key == "" || userID == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, models.ErrorResponse{Error: "Idempotency-Key must be at most 255 characters"})
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBodySize))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, models.ErrorResponse{Error: "Invalid request body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now()
+		rec := models.IdempotencyRecord{
+			UserID:      userID,
+			Key:         key,
+			Fingerprint: fingerprint(c.Request, body),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(ttl),
+		}
+		ctx := c.Request.Context()
+		first, err := repo.BeginIdempotentRequest(ctx, rec)
+		switch {
+		case errors.Is(err, repository.ErrIdempotencyKeyUsed):
+			replay(c, rec, first)
+			return
+		case err != nil:
+			c.AbortWithStatusJSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to check Idempotency-Key"})
+			return
+		}
+
+		// Release the key unless a response is stored, including when the
+		// handler panics.
+		stored := false
+		defer func() {
+			if !stored {
+				if err := repo.ReleaseIdempotentRequest(context.WithoutCancel(ctx), userID, key); err != nil {
+					log.Printf("Failed to release Idempotency-Key of user %s: %v", userID, err)
+				}
+			}
+		}()
+
+		w := &recorder{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		if w.Status() >= http.StatusInternalServerError {
+			return
+		}
+		rec.StatusCode = w.Status()
+		rec.ContentType = w.Header().Get("Content-Type")
+		rec.Body = w.body.Bytes()
+		if err := repo.CompleteIdempotentRequest(context.WithoutCancel(ctx), rec); err != nil {
+			log.Printf("Failed to store response for Idempotency-Key of user %s: %v", userID, err)
+			return
+		}
+		stored = true
+	}
+}
+
+// replay answers a retry of the first request made with a key.
+func replay(c *gin.Context, retry, first models.IdempotencyRecord) {
+	switch {
+	case first.Fingerprint != retry.Fingerprint:
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, models.ErrorResponse{Error: "Idempotency-Key was already used for a different request"})
+	case first.StatusCode == 0:
+		c.AbortWithStatusJSON(http.StatusConflict, models.ErrorResponse{Error: "A request with this Idempotency-Key is still in progress"})
+	default:
+		c.Header(ReplayedHeader, "true")
+		c.Data(first.StatusCode, first.ContentType, first.Body)
+		c.Abort()
+	}
+}
+
+// fingerprint hashes what identifies a request: its method, path and body.
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recorder keeps a copy of the response body as it is written.
+type recorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,164 @@
+package idempotency
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+)
+
+// testServer counts the requests that reach its handlers.
+type testServer struct {
+	router *gin.Engine
+	calls  atomic.Int32
+	// status is the code the handler responds with
+	status atomic.Int32
+	// block, if set, is waited on by the handler after it signals started
+	block   chan struct{}
+	started chan struct{}
+}
+
+func newTestServer(t *testing.T, ttl time.Duration) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	s := &testServer{router: gin.New()}
+	s.status.Store(http.StatusCreated)
+	auth := func(c *gin.Context) {
+		if id := c.GetHeader("X-User-ID"); id != "" {
+			c.Set("user_id", id)
+		}
+	}
+	handler := func(c *gin.Context) {
+		n := s.calls.Add(1)
+		if s.block != nil {
+			s.started <- struct{}{}
+			<-s.block
+		}
+		c.JSON(int(s.status.Load()), gin.H{"call": n})
+	}
+	idempotent := Middleware(repository.NewMemoryStore().Idempotency, ttl)
+	s.router.POST("/payments", auth, idempotent, handler)
+	s.router.POST("/refunds", auth, idempotent, handler)
+	return s
+}
+
+// do sends a request by user with an Idempotency-Key of key, leaving out
+// whichever is empty.
+func (s *testServer) do(user, key, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if user != "" {
+		req.Header.Set("X-User-ID", user)
+	}
+	if key != "" {
+		req.Header.Set(Header, key)
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func check(t *testing.T, w *httptest.ResponseRecorder, wantCode int, wantBody string, wantReplayed bool) {
+	t.Helper()
+	if w.Code != wantCode {
+		t.Errorf("status = %d %s, want %d", w.Code, w.Body, wantCode)
+	}
+	if wantBody != "" && w.Body.String() != wantBody {
+		t.Errorf("body = %s, want %s", w.Body, wantBody)
+	}
+	if got := w.Header().Get(ReplayedHeader) == "true"; got != wantReplayed {
+		t.Errorf("%s = %q, want replayed %v", ReplayedHeader, w.Header().Get(ReplayedHeader), wantReplayed)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	s := newTestServer(t, time.Hour)
+
+	first := s.do("alice", "k1", "/payments", `{"course_id":"1"}`)
+	check(t, first, http.StatusCreated, `{"call":1}`, false)
+	for range 3 {
+		retry := s.do("alice", "k1", "/payments", `{"course_id":"1"}`)
+		check(t, retry, http.StatusCreated, `{"call":1}`, true)
+		if got, want := retry.Header().Get("Content-Type"), first.Header().Get("Content-Type"); got != want {
+			t.Errorf("replayed Content-Type = %q, want %q", got, want)
+		}
+	}
+	if n := s.calls.Load(); n != 1 {
+		t.Errorf("handler ran %d times, want once", n)
+	}
+
+	// Client errors are replayed as well
+	s.status.Store(http.StatusBadRequest)
+	check(t, s.do("alice", "k2", "/payments", `{}`), http.StatusBadRequest, `{"call":2}`, false)
+	s.status.Store(http.StatusCreated)
+	check(t, s.do("alice", "k2", "/payments", `{}`), http.StatusBadRequest, `{"call":2}`, true)
+}
+
+func TestInProgress(t *testing.T) {
+	s := newTestServer(t, time.Hour)
+	s.block, s.started = make(chan struct{}), make(chan struct{})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- s.do("alice", "k1", "/payments", `{}`) }()
+	<-s.started
+
+	check(t, s.do("alice", "k1", "/payments", `{}`), http.StatusConflict, "", false)
+	close(s.block)
+	check(t, <-done, http.StatusCreated, `{"call":1}`, false)
+	check(t, s.do("alice", "k1", "/payments", `{}`), http.StatusCreated, `{"call":1}`, true)
+}
+
+func TestKeyReusedForAnotherRequest(t *testing.T) {
+	s := newTestServer(t, time.Hour)
+
+	check(t, s.do("alice", "k1", "/payments", `{"course_id":"1"}`), http.StatusCreated, "", false)
+	check(t, s.do("alice", "k1", "/payments", `{"course_id":"2"}`), http.StatusUnprocessableEntity, "", false)
+	check(t, s.do("alice", "k1", "/refunds", `{"course_id":"1"}`), http.StatusUnprocessableEntity, "", false)
+	if n := s.calls.Load(); n != 1 {
+		t.Errorf("handler ran %d times, want once", n)
+	}
+}
+
+func TestKeysPerUser(t *testing.T) {
+	s := newTestServer(t, time.Hour)
+
+	check(t, s.do("alice", "k1", "/payments", `{}`), http.StatusCreated, `{"call":1}`, false)
+	// Another user choosing the same key gets their own response
+	check(t, s.do("bob", "k1", "/payments", `{}`), http.StatusCreated, `{"call":2}`, false)
+	check(t, s.do("bob", "k1", "/payments", `{}`), http.StatusCreated, `{"call":2}`, true)
+	check(t, s.do("alice", "k1", "/payments", `{}`), http.StatusCreated, `{"call":1}`, true)
+}
+
+func TestNotStored(t *testing.T) {
+	s := newTestServer(t, time.Hour)
+
+	// Without a key or a user every request runs
+	for i := range 2 {
+		want := `{"call":` + strconv.Itoa(2*i+1) + `}`
+		check(t, s.do("alice", "", "/payments", `{}`), http.StatusCreated, want, false)
+		check(t, s.do("", "k1", "/payments", `{}`), http.StatusCreated, "", false)
+	}
+
+	// Server errors can be retried
+	s.status.Store(http.StatusInternalServerError)
+	check(t, s.do("alice", "k1", "/payments", `{}`), http.StatusInternalServerError, `{"call":5}`, false)
+	s.status.Store(http.StatusCreated)
+	check(t, s.do("alice", "k1", "/payments", `{}`), http.StatusCreated, `{"call":6}`, false)
+
+	check(t, s.do("alice", strings.Repeat("k", 256), "/payments", `{}`), http.StatusBadRequest, "", false)
+}
+
+func TestExpiry(t *testing.T) {
+	const ttl = 20 * time.Millisecond
+	s := newTestServer(t, ttl)
+
+	check(t, s.do("alice", "k1", "/payments", `{}`), http.StatusCreated, `{"call":1}`, false)
+	time.Sleep(2 * ttl)
+	check(t, s.do("alice", "k1", "/payments", `{}`), http.StatusCreated, `{"call":2}`, false)
+}
@@ -0,0 +1,77 @@
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Generate creates a new private key for alg, "RS256" or "EdDSA", and
+// writes it to dir as <kid>.pem. The kid is the UTC creation time, so the
+// new key becomes the default signing key. It returns the kid.
+func Generate(dir, alg string) (string, error) {
+	var key any
+	switch alg {
+	case "RS256":
+		k, err := rsa.GenerateKey(rand.Reader, minRSABits)
+		if err != nil {
+			return "", err
+		}
+		key = k
+	case "EdDSA":
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		key = k
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q, want RS256 or EdDSA", alg)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	kid := time.Now().UTC().Format("20060102T150405Z")
+	path := filepath.Join(dir, kid+".pem")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		return "", err
+	}
+	return kid, f.Close()
+}
+
+// Retire replaces the private key kid in dir with its public key, so that it
+// keeps verifying the tokens it signed but can no longer sign.
+func Retire(dir, kid string) error {
+	path := filepath.Join(dir, kid+".pem")
+	key, err := loadKey(kid, path)
+	if err != nil {
+		return err
+	}
+	if key.sign == nil {
+		return fmt.Errorf("key %s is already retired", kid)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.verify)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,219 @@
+// Package jwtkeys holds the keys used to sign and verify JWTs. Several keys
+// can be active at once, selected by the token's "kid" header, so that the
+// signing key can be rotated while tokens signed with the previous one stay
+// valid.
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minRSABits is the smallest RSA modulus accepted for signing keys.
+const minRSABits = 2048
+
+// Key is a single signing or verification key.
+type Key struct {
+	ID     string
+	method jwt.SigningMethod
+	sign   any // private key or HMAC secret; nil for verify-only keys
+	verify any // public key or HMAC secret
+}
+
+// Algorithm returns the JWS algorithm of the key, such as "RS256".
+func (k *Key) Algorithm() string {
+	return k.method.Alg()
+}
+
+// KeySet signs tokens with one key and verifies them with any of its keys.
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+	// legacy verifies tokens without a kid, which were signed with the
+	// shared HS256 secret before asymmetric keys were configured.
+	legacy *Key
+}
+
+// NewHMAC returns a KeySet that signs and verifies with a single HS256
+// secret. Tokens carry no kid and the JWKS is empty.
+func NewHMAC(secret []byte) *KeySet {
+	key := &Key{method: jwt.SigningMethodHS256, sign: secret, verify: secret}
+	return &KeySet{signing: key, keys: map[string]*Key{}, legacy: key}
+}
+
+// LoadDir loads every *.pem file in dir as a key whose ID is the file name
+// without the extension. Private keys (PKCS#8, or PKCS#1 for RSA) can sign;
+// public keys (PKIX) only verify, which is how a retired key is kept until
+// the tokens it signed expire. RSA keys use RS256 and Ed25519 keys EdDSA.
+//
+// The signing key is signingID, or if that is empty the private key with
+// the greatest ID; IDs made by Generate sort by creation time. If
+// legacySecret is not empty, tokens without a kid are verified against it
+// with HS256.
+func LoadDir(dir, signingID string, legacySecret []byte) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	set := &KeySet{keys: make(map[string]*Key)}
+	var signable []string
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := loadKey(id, path)
+		if err != nil {
+			return nil, err
+		}
+		set.keys[id] = key
+		if key.sign != nil {
+			signable = append(signable, id)
+		}
+	}
+	if len(signable) == 0 {
+		return nil, fmt.Errorf("no private keys in %s", dir)
+	}
+
+	if signingID == "" {
+		sort.Strings(signable)
+		signingID = signable[len(signable)-1]
+	}
+	set.signing = set.keys[signingID]
+	if set.signing == nil || set.signing.sign == nil {
+		return nil, fmt.Errorf("signing key %q not found in %s", signingID, dir)
+	}
+
+	if len(legacySecret) > 0 {
+		set.legacy = &Key{method: jwt.SigningMethodHS256, verify: legacySecret}
+	}
+	return set, nil
+}
+
+func loadKey(id, path string) (*Key, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("%s: RSA keys must have at least %d bits", path, minRSABits)
+		}
+		return &Key{ID: id, method: jwt.SigningMethodRS256, sign: k, verify: &k.PublicKey}, nil
+	case *rsa.PublicKey:
+		return &Key{ID: id, method: jwt.SigningMethodRS256, verify: k}, nil
+	case ed25519.PrivateKey:
+		return &Key{ID: id, method: jwt.SigningMethodEdDSA, sign: k, verify: k.Public()}, nil
+	case ed25519.PublicKey:
+		return &Key{ID: id, method: jwt.SigningMethodEdDSA, verify: k}, nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, parsed)
+	}
+}
+
+// SigningKey returns the key new tokens are signed with.
+func (s *KeySet) SigningKey() *Key {
+	return s.signing
+}
+
+// Sign returns a token with the given claims, signed with the signing key
+// and carrying its kid.
+func (s *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.signing.method, claims)
+	if s.signing.ID != "" {
+		token.Header["kid"] = s.signing.ID
+	}
+	return token.SignedString(s.signing.sign)
+}
+
+// Parse verifies a token with the key named by its kid header and returns
+// it with jwt.MapClaims. The token's algorithm must match the key's.
+func (s *KeySet) Parse(tokenString string, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		key := s.legacy
+		if kid, ok := token.Header["kid"].(string); ok {
+			key = s.keys[kid]
+		}
+		if key == nil {
+			return nil, errors.New("unknown signing key")
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return key.verify, nil
+	}, opts...)
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public halves of the asymmetric keys, sorted by ID. HMAC
+// secrets are never published.
+func (s *KeySet) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for id, key := range s.keys {
+		jwk := JWK{KeyID: id, Use: "sig", Algorithm: key.Algorithm()}
+		switch pub := key.verify.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+	return set
+}
@@ -0,0 +1,217 @@
+package jwtkeys
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func claims() jwt.MapClaims {
+	return jwt.MapClaims{"sub": "user", "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func load(t *testing.T, dir, signingID string, legacySecret []byte) *KeySet {
+	t.Helper()
+	set, err := LoadDir(dir, signingID, legacySecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func sign(t *testing.T, set *KeySet) string {
+	t.Helper()
+	token, err := set.Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// generateOld generates a key for alg and renames it to kid, as if it had
+// been generated earlier. Generate names keys by the second, so two keys
+// generated in a row would otherwise collide.
+func generateOld(t *testing.T, dir, alg, kid string) {
+	t.Helper()
+	generated, err := Generate(dir, alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, generated+".pem"), filepath.Join(dir, kid+".pem")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func kids(set JWKS) []string {
+	var ids []string
+	for _, k := range set.Keys {
+		ids = append(ids, k.KeyID)
+	}
+	return ids
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	const old = "20000101T000000Z"
+	generateOld(t, dir, "EdDSA", old)
+	oldToken := sign(t, load(t, dir, "", nil))
+
+	// A newly generated key takes over signing
+	current, err := Generate(dir, "RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := load(t, dir, "", nil)
+	if got := set.SigningKey().ID; got != current {
+		t.Fatalf("signing key = %s, want the newest key %s", got, current)
+	}
+	newToken := sign(t, set)
+	parsed, err := set.Parse(newToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["kid"] != current || parsed.Method.Alg() != "RS256" {
+		t.Errorf("new token has kid %v and alg %s, want %s and RS256", parsed.Header["kid"], parsed.Method.Alg(), current)
+	}
+	if _, err := set.Parse(oldToken); err != nil {
+		t.Errorf("token signed with the previous key: %v", err)
+	}
+
+	// The signing key can be pinned to an older key
+	if got := load(t, dir, old, nil).SigningKey().ID; got != old {
+		t.Errorf("pinned signing key = %s, want %s", got, old)
+	}
+	if _, err := LoadDir(dir, "missing", nil); err == nil {
+		t.Error("LoadDir with an unknown signing key succeeded")
+	}
+}
+
+func TestRetire(t *testing.T) {
+	dir := t.TempDir()
+	const old = "20000101T000000Z"
+	generateOld(t, dir, "RS256", old)
+	oldToken := sign(t, load(t, dir, "", nil))
+	current, err := Generate(dir, "EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Retire(dir, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := Retire(dir, old); err == nil {
+		t.Error("retiring a key twice succeeded")
+	}
+	if _, err := LoadDir(dir, old, nil); err == nil {
+		t.Error("LoadDir accepted a retired key for signing")
+	}
+
+	// A retired key is still published and verifies what it signed
+	set := load(t, dir, "", nil)
+	if got := kids(set.JWKS()); len(got) != 2 || got[0] != old || got[1] != current {
+		t.Errorf("JWKS kids = %v, want [%s %s]", got, old, current)
+	}
+	if _, err := set.Parse(oldToken); err != nil {
+		t.Errorf("token signed with the retired key: %v", err)
+	}
+
+	// Once its file is removed the key is no longer published and its
+	// tokens stop verifying
+	if err := os.Remove(filepath.Join(dir, old+".pem")); err != nil {
+		t.Fatal(err)
+	}
+	set = load(t, dir, "", nil)
+	if got := kids(set.JWKS()); len(got) != 1 || got[0] != current {
+		t.Errorf("JWKS kids = %v, want [%s]", got, current)
+	}
+	if _, err := set.Parse(oldToken); err == nil {
+		t.Error("token signed with a key no longer published verified")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	dir := t.TempDir()
+	generateOld(t, dir, "EdDSA", "a")
+	generateOld(t, dir, "RS256", "b")
+	set := load(t, dir, "", []byte("legacy"))
+
+	keys := set.JWKS().Keys
+	if len(keys) != 2 {
+		t.Fatalf("JWKS = %+v, want the 2 asymmetric keys", keys)
+	}
+	ed, rsa := keys[0], keys[1]
+	if ed.KeyType != "OKP" || ed.Curve != "Ed25519" || ed.Algorithm != "EdDSA" || ed.Use != "sig" || ed.N != "" {
+		t.Errorf("Ed25519 JWK = %+v", ed)
+	}
+	if x, err := base64.RawURLEncoding.DecodeString(ed.X); err != nil || len(x) != 32 {
+		t.Errorf("Ed25519 JWK x = %q, want 32 base64url bytes", ed.X)
+	}
+	if rsa.KeyType != "RSA" || rsa.Algorithm != "RS256" || rsa.Use != "sig" || rsa.E != "AQAB" || rsa.X != "" {
+		t.Errorf("RSA JWK = %+v", rsa)
+	}
+	if n, err := base64.RawURLEncoding.DecodeString(rsa.N); err != nil || len(n)*8 != minRSABits {
+		t.Errorf("RSA JWK n is %d bytes, %v, want %d bits", len(n), err, minRSABits)
+	}
+
+	// HMAC secrets are never published
+	if keys := NewHMAC([]byte("secret")).JWKS().Keys; len(keys) != 0 {
+		t.Errorf("HMAC JWKS = %+v, want no keys", keys)
+	}
+}
+
+func TestLegacyHMAC(t *testing.T) {
+	secret := []byte("legacy-secret")
+	legacy := NewHMAC(secret)
+	legacyToken := sign(t, legacy)
+	if _, err := legacy.Parse(legacyToken); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.SigningKey().ID != "" {
+		t.Errorf("HMAC signing key ID = %q, want none", legacy.SigningKey().ID)
+	}
+
+	dir := t.TempDir()
+	if _, err := Generate(dir, "EdDSA"); err != nil {
+		t.Fatal(err)
+	}
+	// Tokens without a kid verify against the legacy secret only
+	if _, err := load(t, dir, "", secret).Parse(legacyToken); err != nil {
+		t.Errorf("legacy token with its secret configured: %v", err)
+	}
+	if _, err := load(t, dir, "", []byte("other-secret")).Parse(legacyToken); err == nil {
+		t.Error("legacy token verified with another secret")
+	}
+	if _, err := load(t, dir, "", nil).Parse(legacyToken); err == nil {
+		t.Error("legacy token verified without a legacy secret")
+	}
+}
+
+func TestParseRejectsAlgorithmMismatch(t *testing.T) {
+	dir := t.TempDir()
+	kid, err := Generate(dir, "RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := load(t, dir, "", nil)
+
+	// An HS256 token naming the RSA key must not be checked as HMAC
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	token.Header["kid"] = kid
+	forged, err := token.SignedString([]byte("guess"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := set.Parse(forged); err == nil {
+		t.Error("HS256 token naming an RSA key verified")
+	}
+}
+
+func TestGenerateRejectsUnknownAlgorithm(t *testing.T) {
+	if _, err := Generate(t.TempDir(), "HS256"); err == nil {
+		t.Error("Generate(HS256) succeeded")
+	}
+}
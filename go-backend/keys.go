@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cuanin/emergent-backend/jwtkeys"
+)
+
+// defaultJWTSecret is the development fallback for JWT_SECRET. It is public,
+// so it is refused when APP_ENV=production.
+const defaultJWTSecret = "your-secret-key-2024"
+
+// newKeySet returns the JWT keys configured by the environment. With
+// JWT_KEYS_DIR set, tokens are signed with the asymmetric keys in that
+// directory and JWT_SECRET, if set, only verifies tokens issued before the
+// switch. Otherwise tokens are signed with the HS256 secret JWT_SECRET.
+func newKeySet() (*jwtkeys.KeySet, error) {
+	secret := os.Getenv("JWT_SECRET")
+	dir := os.Getenv("JWT_KEYS_DIR")
+
+	if os.Getenv("APP_ENV") == "production" {
+		if secret == defaultJWTSecret || (secret == "" && dir == "") {
+			return nil, errors.New("refusing to start in production with the default JWT secret; set JWT_KEYS_DIR or JWT_SECRET")
+		}
+	}
+
+	if dir == "" {
+		if secret == "" {
+			log.Printf("JWT_SECRET is not set; using the insecure development default")
+			secret = defaultJWTSecret
+		}
+		return jwtkeys.NewHMAC([]byte(secret)), nil
+	}
+	keys, err := jwtkeys.LoadDir(dir, os.Getenv("JWT_SIGNING_KEY_ID"), []byte(secret))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Signing tokens with %s key %s", keys.SigningKey().Algorithm(), keys.SigningKey().ID)
+	return keys, nil
+}
+
+// runKeys implements the "keys" subcommand:
+//
+//	emergent-backend keys generate [RS256|EdDSA]
+//	emergent-backend keys retire <kid>
+//
+// It manages the key files in JWT_KEYS_DIR.
+func runKeys(args []string) error {
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if dir == "" {
+		return errors.New("JWT_KEYS_DIR is not set")
+	}
+	if len(args) == 0 {
+		return errors.New("usage: keys generate [RS256|EdDSA] | retire <kid>")
+	}
+
+	switch args[0] {
+	case "generate":
+		alg := "RS256"
+		if len(args) > 1 {
+			alg = args[1]
+		}
+		kid, err := jwtkeys.Generate(dir, alg)
+		if err != nil {
+			return err
+		}
+		fmt.Println(kid)
+		return nil
+	case "retire":
+		if len(args) < 2 {
+			return errors.New("usage: keys retire <kid>")
+		}
+		return jwtkeys.Retire(dir, args[1])
+	default:
+		return fmt.Errorf("unknown keys command %q", args[0])
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cuanin/emergent-backend/mailer"
+)
+
+// newMailer returns the mailer selected by the MAILER environment variable:
+// "smtp" for real delivery, or "log" (the default) to log messages, or write
+// them to MAIL_DIR, for local testing.
+func newMailer() (mailer.Mailer, error) {
+	from := getEnv("MAIL_FROM", "Emergent <no-reply@localhost>")
+	switch kind := os.Getenv("MAILER"); kind {
+	case "", "log":
+		return &mailer.LogMailer{Dir: os.Getenv("MAIL_DIR"), From: from}, nil
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required for MAILER=smtp")
+		}
+		return &mailer.SMTPMailer{
+			Host:     host,
+			Port:     getEnv("SMTP_PORT", "587"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", kind)
+	}
+}
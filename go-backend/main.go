@@ -1,38 +1,149 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/cuanin/emergent-backend/data"
+	"github.com/cuanin/emergent-backend/export"
 	"github.com/cuanin/emergent-backend/handlers"
+	"github.com/cuanin/emergent-backend/idempotency"
+	"github.com/cuanin/emergent-backend/jwtkeys"
+	"github.com/cuanin/emergent-backend/media"
 	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/rbac"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/cuanin/emergent-backend/search"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 )
 
 func main() {
-	// Set JWT secret key
-	if os.Getenv("JWT_SECRET") == "" {
-		os.Setenv("JWT_SECRET", "your-secret-key-2024")
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		if err := runKeys(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// JWT signing keys
+	keys, err := newKeySet()
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+
+	// Outgoing email
+	mail, err := newMailer()
+	if err != nil {
+		log.Fatalf("Failed to configure mailer: %v", err)
+	}
+
+	// Social login providers
+	oidcProviders, err := newOIDCProviders()
+	if err != nil {
+		log.Fatalf("Failed to configure OIDC providers: %v", err)
+	}
+
+	// Links to paid course media
+	mediaSigner, err := newMediaSigner()
+	if err != nil {
+		log.Fatalf("Failed to configure media links: %v", err)
+	}
+
+	// Payment gateway for course purchases
+	paymentProvider, err := newPaymentProvider()
+	if err != nil {
+		log.Fatalf("Failed to configure payments: %v", err)
 	}
 
 	r := gin.Default()
 
+	// Only proxies listed in TRUSTED_PROXIES may set the client IP used for
+	// login rate limiting; by default the socket address is used.
+	var trustedProxies []string
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		trustedProxies = strings.Split(v, ",")
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// CORS configuration
 	config := cors.Config{
 		AllowOrigins:     []string{"http://localhost:3000"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", idempotency.Header},
+		ExposeHeaders:    []string{"Link", "X-Total-Count", idempotency.ReplayedHeader},
 		AllowCredentials: true,
 	}
 	r.Use(cors.New(config))
 
+	// Storage
+	store, err := newStore()
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+	defer store.Close(context.Background())
+
+	// Role permissions
+	policy := rbac.DefaultPolicy()
+	if path := os.Getenv("RBAC_POLICY_FILE"); path != "" {
+		if policy, err = rbac.LoadPolicy(path); err != nil {
+			log.Fatalf("Failed to load RBAC policy: %v", err)
+		}
+	}
+
+	apiURL := strings.TrimSuffix(getEnv("API_URL", "http://localhost:8080"), "/")
+
+	// Personal data exports are built in the background
+	exports := export.NewWorker(store, export.Config{
+		Mailer:      mail,
+		DownloadURL: apiURL + "/api/exports/download",
+		TTL:         envDuration("EXPORT_TTL", export.DefaultTTL),
+	})
+	go exports.Run(context.Background())
+
+	// Course search runs on an in-memory index of the catalog
+	searchIndex := search.New()
+	if err := indexCourses(context.Background(), store.Courses, searchIndex); err != nil {
+		log.Fatalf("Failed to build search index: %v", err)
+	}
+	go refreshSearchIndex(context.Background(), store.Courses, searchIndex, envDuration("SEARCH_REFRESH_INTERVAL", 5*time.Minute))
+
 	// Routes
-	setupRoutes(r)
+	setupRoutes(r, store, keys, policy, handlers.Config{
+		Keys:      keys,
+		Mailer:    mail,
+		AppURL:    os.Getenv("APP_URL"),
+		MFAIssuer: os.Getenv("MFA_ISSUER"),
+
+		AccessTokenTTL:  envDuration("ACCESS_TOKEN_TTL", handlers.DefaultAccessTokenTTL),
+		RefreshTokenTTL: envDuration("REFRESH_TOKEN_TTL", handlers.DefaultRefreshTokenTTL),
+
+		OIDCProviders: oidcProviders,
+		Exports:       exports,
+		Search:        searchIndex,
+		Policy:        policy,
+
+		Media:      mediaSigner,
+		MediaURL:   apiURL + "/api/media",
+		MediaTTL:   envDuration("MEDIA_URL_TTL", media.DefaultTTL),
+		MediaProxy: os.Getenv("MEDIA_PROXY") == "true",
+
+		PaymentProvider: paymentProvider,
+		PaymentExpiry:   envDuration("PAYMENT_EXPIRY", 24*time.Hour),
+	})
 
 	// Start server
 	port := ":8080"
@@ -40,51 +151,136 @@ func main() {
 	log.Fatal(r.Run(port))
 }
 
-func setupRoutes(r *gin.Engine) {
+func setupRoutes(r *gin.Engine, store repository.Store, keys *jwtkeys.KeySet, policy rbac.Policy, cfg handlers.Config) {
+	h := handlers.New(store, cfg)
+	requireAuth := authMiddleware(store, keys)
+	optionalAuth := optionalAuthMiddleware(requireAuth)
+	// Mutating endpoints that clients may retry replay their first response
+	idempotent := idempotency.Middleware(store.Idempotency, envDuration("IDEMPOTENCY_TTL", idempotency.DefaultTTL))
+
 	// Health check
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
 
+	// Public keys for verifying our tokens
+	r.GET("/.well-known/jwks.json", h.JWKS)
+
 	// API v1 routes
 	v1 := r.Group("/api")
 	{
 		// Auth routes
 		auth := v1.Group("/auth")
 		{
-			auth.POST("/register", handlers.Register)
-			auth.POST("/login", handlers.Login)
+			auth.POST("/register", h.Register)
+			auth.POST("/login", h.Login)
+			auth.POST("/login/2fa", h.LoginMFA)
+			auth.POST("/refresh", h.RefreshToken)
+			auth.POST("/logout", requireAuth, h.Logout)
+			auth.POST("/forgot-password", h.ForgotPassword)
+			auth.POST("/reset-password", h.ResetPassword)
+			auth.GET("/verify-email", h.VerifyEmail)
+			auth.GET("/confirm-email-change", h.ConfirmEmailChange)
+			auth.GET("/oidc/:provider/start", h.OIDCStart)
+			auth.GET("/oidc/:provider/callback", h.OIDCCallback)
 		}
 
 		// Courses routes
 		courses := v1.Group("/courses")
 		{
-			courses.GET("", handlers.GetCourses)
-			courses.GET("/:id", handlers.GetCourse)
-			courses.POST("", handlers.CreateCourse)
+			courses.GET("", optionalAuth, h.GetCourses)
+			courses.GET("/search", h.SearchCourses)
+			courses.GET("/:id", optionalAuth, h.GetCourse)
+			courses.GET("/:id/media", requireAuth, h.GetCourseMedia)
+			courses.POST("", requireAuth, requirePermission(policy, rbac.CreateCourse), h.CreateCourse)
+			courses.PUT("/:id", requireAuth, requirePermission(policy, rbac.EditCourse), h.ReplaceCourse)
+			courses.PATCH("/:id", requireAuth, requirePermission(policy, rbac.EditCourse), h.UpdateCourse)
+			courses.DELETE("/:id", requireAuth, requirePermission(policy, rbac.DeleteCourse), h.DeleteCourse)
+			courses.POST("/:id/status", requireAuth, requirePermission(policy, rbac.SubmitCourse), h.SetCourseStatus)
+			courses.GET("/:id/status/history", requireAuth, requirePermission(policy, rbac.SubmitCourse), h.GetCourseStatusHistory)
+
+			// Curriculum
+			editCurriculum := requirePermission(policy, rbac.EditCurriculum)
+			courses.POST("/:id/modules", requireAuth, editCurriculum, h.CreateModule)
+			courses.PATCH("/:id/modules/:module_id", requireAuth, editCurriculum, h.UpdateModule)
+			courses.DELETE("/:id/modules/:module_id", requireAuth, editCurriculum, h.DeleteModule)
+			courses.POST("/:id/modules/:module_id/lessons", requireAuth, editCurriculum, h.CreateLesson)
+			courses.GET("/:id/lessons/:lesson_id", requireAuth, h.GetLesson)
+			courses.PATCH("/:id/lessons/:lesson_id", requireAuth, editCurriculum, h.UpdateLesson)
+			courses.DELETE("/:id/lessons/:lesson_id", requireAuth, editCurriculum, h.DeleteLesson)
 		}
 
-		// Payment routes
+		// Payment routes. Webhooks are signed by the provider instead of
+		// carrying a token.
 		payment := v1.Group("/payment")
-		payment.Use(authMiddleware())
 		{
-			payment.POST("", handlers.PurchaseCourse)
+			payment.POST("", requireAuth, idempotent, h.PurchaseCourse)
+			payment.POST("/quote", requireAuth, h.QuotePayment)
+			payment.POST("/webhook/:provider", h.PaymentWebhook)
+			payment.GET("/:id", requireAuth, h.GetPayment)
+			payment.POST("/:id/simulate", requireAuth, idempotent, h.SimulatePayment)
 		}
 
 		// User dashboard
 		user := v1.Group("/user")
-		user.Use(authMiddleware())
+		user.Use(requireAuth)
 		{
-			user.GET("/dashboard", handlers.GetUserDashboard)
+			user.GET("/dashboard", h.GetUserDashboard)
+			user.GET("/me", h.GetProfile)
+			user.PATCH("/me", h.UpdateProfile)
+			user.DELETE("/me", h.DeleteAccount)
+			user.POST("/me/password", h.ChangePassword)
+			user.POST("/2fa/setup", h.SetupTOTP)
+			user.POST("/2fa/confirm", h.ConfirmTOTP)
+			user.POST("/2fa/recovery-codes", h.RegenerateRecoveryCodes)
+			user.POST("/2fa/disable", h.DisableTOTP)
+			user.POST("/exports", h.RequestExport)
+			user.GET("/exports", h.ListExports)
+			user.GET("/exports/:id", h.GetExport)
+			user.GET("/exports/:id/download", h.DownloadExport)
+		}
+
+		// Download links sent by email carry their own token
+		v1.GET("/exports/download", h.DownloadExportByToken)
+
+		// Media links are signed for the user they were issued to
+		v1.GET("/media", h.ServeMedia)
+
+		// Admin settings and audit log
+		admin := v1.Group("/admin")
+		admin.Use(requireAuth)
+		{
+			admin.GET("/settings/2fa", requirePermission(policy, rbac.ManageSettings), h.GetMFASettings)
+			admin.PUT("/settings/2fa", requirePermission(policy, rbac.ManageSettings), h.UpdateMFASettings)
+			admin.GET("/audit", requirePermission(policy, rbac.ReadAuditLog), h.GetAuditLog)
+
+			users := admin.Group("/users", requirePermission(policy, rbac.ManageUsers))
+			{
+				users.GET("", h.ListUsers)
+				users.GET("/:id", h.GetUser)
+				users.PUT("/:id/role", h.UpdateUserRole)
+				users.POST("/:id/suspend", h.SuspendUser)
+				users.POST("/:id/reactivate", h.ReactivateUser)
+				users.POST("/:id/reset-password", h.ResetUserPassword)
+			}
+
+			coupons := admin.Group("/coupons", requirePermission(policy, rbac.ManageCoupons))
+			{
+				coupons.GET("", h.ListCoupons)
+				coupons.POST("", h.CreateCoupon)
+				coupons.GET("/:id", h.GetCoupon)
+				coupons.PUT("/:id", h.UpdateCoupon)
+				coupons.DELETE("/:id", h.DeleteCoupon)
+			}
 		}
 
 		// Categories
-		v1.GET("/categories", handlers.GetCategories)
+		v1.GET("/categories", h.GetCategories)
 	}
 }
 
 // Auth middleware to validate JWT token
-func authMiddleware() gin.HandlerFunc {
+func authMiddleware(store repository.Store, keys *jwtkeys.KeySet) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -106,13 +302,7 @@ func authMiddleware() gin.HandlerFunc {
 		}
 
 		// Parse and validate token
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			// Validate the alg is what you expect:
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			return []byte(os.Getenv("JWT_SECRET")), nil
-		})
+		token, err := keys.Parse(tokenString)
 
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Invalid token"})
@@ -129,33 +319,79 @@ func authMiddleware() gin.HandlerFunc {
 				return
 			}
 
-			// Add user ID to context
+			// Add user ID to context. Other tokens signed with the same
+			// key, such as login challenges, are not access tokens.
 			userID, ok := claims["user_id"].(string)
-			if !ok {
+			jti, hasJTI := claims["jti"].(string)
+			if !ok || !hasJTI || claims["typ"] != "access" {
 				c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Invalid token claims"})
 				c.Abort()
 				return
 			}
 
-			// Check if user exists
-			userExists := false
-			for _, user := range data.Users {
-				if user.ID == userID {
-					userExists = true
-					break
+			// Check the revocation list
+			revoked, err := store.Tokens.IsAccessTokenRevoked(c.Request.Context(), jti)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to check token"})
+				c.Abort()
+				return
+			}
+			if revoked {
+				c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Token has been revoked"})
+				c.Abort()
+				return
+			}
+
+			// Check if user exists; deleted accounts are kept anonymised
+			user, err := store.Users.GetByID(c.Request.Context(), userID)
+			if err == nil && user.DeletedAt != nil {
+				err = repository.ErrNotFound
+			}
+			if err != nil {
+				if errors.Is(err, repository.ErrNotFound) {
+					c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "User not found"})
+				} else {
+					c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load user"})
 				}
+				c.Abort()
+				return
+			}
+			if user.SuspendedAt != nil {
+				c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Account suspended"})
+				c.Abort()
+				return
 			}
 
-			if !userExists {
-				c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "User not found"})
+			// Refuse tokens issued before the user was signed out
+			// everywhere, as by a password reset. iat has whole seconds,
+			// so tokens issued in the same second are still accepted.
+			iat, _ := claims["iat"].(float64)
+			if user.SessionsEndedAt != nil && int64(iat) < user.SessionsEndedAt.Unix() {
+				c.JSON(http.StatusUnauthorized, models.ErrorResponse{Error: "Token has been revoked"})
 				c.Abort()
 				return
 			}
 
-			// Set user ID and is_admin flag in context
+			// Set user ID, role and is_admin flag in context. The role is
+			// read from the stored user so changes apply without a new token.
+			role := user.EffectiveRole()
 			c.Set("user_id", userID)
-			isAdmin, _ := claims["is_admin"].(bool)
-			c.Set("is_admin", isAdmin)
+			c.Set("role", role)
+			c.Set("is_admin", role == models.RoleAdmin)
+			c.Set("jti", jti)
+			c.Set("token_expires_at", time.Unix(int64(exp), 0))
+
+			// Members of roles that require two-factor authentication
+			// cannot use role-restricted endpoints until they enable it.
+			if !user.TOTPEnabled {
+				required, err := rbac.MFARequiredRoles(c.Request.Context(), store.Settings)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: "Failed to load settings"})
+					c.Abort()
+					return
+				}
+				c.Set("mfa_setup_required", rbac.RequiresMFA(required, role))
+			}
 
 			c.Next()
 		} else {
@@ -165,3 +401,43 @@ func authMiddleware() gin.HandlerFunc {
 		}
 	}
 }
+
+// optionalAuthMiddleware authenticates requests that carry an
+// Authorization header like requireAuth, and lets the others through
+// anonymously, for public endpoints that show staff more.
+func optionalAuthMiddleware(requireAuth gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			c.Next()
+			return
+		}
+		requireAuth(c)
+	}
+}
+
+// requirePermission allows the request only if the policy grants permission
+// to the authenticated user's role. It must run after authMiddleware.
+func requirePermission(policy rbac.Policy, permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if mfaSetupRequired(c) {
+			return
+		}
+		if !policy.Allows(c.GetString("role"), permission) {
+			c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Insufficient permissions"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// mfaSetupRequired rejects the request if the user's role requires
+// two-factor authentication and they have not enabled it.
+func mfaSetupRequired(c *gin.Context) bool {
+	if !c.GetBool("mfa_setup_required") {
+		return false
+	}
+	c.JSON(http.StatusForbidden, models.ErrorResponse{Error: "Two-factor authentication must be enabled for your role"})
+	c.Abort()
+	return true
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/handlers"
+	"github.com/cuanin/emergent-backend/jwtkeys"
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+	"github.com/cuanin/emergent-backend/rbac"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPassword is the password of the accounts made by newUser.
+const testPassword = "correct horse battery staple"
+
+// testServer serves the API as main sets it up, on an in-memory store.
+type testServer struct {
+	store  repository.Store
+	keys   *jwtkeys.KeySet
+	router *gin.Engine
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	store := repository.NewMemoryStore()
+	keys := jwtkeys.NewHMAC([]byte("test-secret"))
+	r := gin.New()
+	setupRoutes(r, store, keys, rbac.DefaultPolicy(), handlers.Config{Keys: keys})
+	return &testServer{store, keys, r}
+}
+
+// do sends a request with body as JSON, authenticated with token if it is
+// not empty, and fails the test unless it gets wantCode.
+func (s *testServer) do(t *testing.T, method, path, token string, body any, wantCode int) *httptest.ResponseRecorder {
+	t.Helper()
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	if w.Code != wantCode {
+		t.Fatalf("%s %s = %d %s, want %d", method, path, w.Code, w.Body, wantCode)
+	}
+	return w
+}
+
+// newUser creates a verified account with role and testPassword, and
+// returns it.
+func (s *testServer) newUser(t *testing.T, role string) models.User {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := models.User{
+		ID:              uuid.New().String(),
+		Email:           uuid.New().String() + "@example.com",
+		Password:        string(hash),
+		FullName:        "Test User",
+		Role:            role,
+		EmailVerified:   true,
+		CreatedAt:       time.Now(),
+		EnrolledCourses: []string{},
+		Badges:          []string{},
+		Progress:        map[string]int{},
+	}
+	if err := s.store.Users.Create(t.Context(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// login signs in as user and returns the access token.
+func (s *testServer) login(t *testing.T, user models.User) string {
+	t.Helper()
+	token, _ := s.loginTokens(t, user)
+	return token
+}
+
+// loginTokens signs in as user and returns the access and refresh token.
+func (s *testServer) loginTokens(t *testing.T, user models.User) (string, string) {
+	t.Helper()
+	w := s.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: user.Email, Password: testPassword}, http.StatusOK)
+	var resp struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Token == "" {
+		t.Fatalf("login response %s has no token", w.Body)
+	}
+	return resp.Token, resp.RefreshToken
+}
+
+// tokenIssuedAt returns an access token for user issued at iat. Tokens
+// carry iat in whole seconds, so the tests backdate them rather than wait
+// for the clock to tick.
+func (s *testServer) tokenIssuedAt(t *testing.T, user models.User, iat time.Time) string {
+	t.Helper()
+	token, err := s.keys.Sign(jwt.MapClaims{
+		"jti":     uuid.New().String(),
+		"typ":     "access",
+		"user_id": user.ID,
+		"email":   user.Email,
+		"role":    user.EffectiveRole(),
+		"iat":     iat.Unix(),
+		"exp":     iat.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestResetUserPasswordEndsSessions(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.login(t, s.newUser(t, models.RoleAdmin))
+	student := s.newUser(t, models.RoleStudent)
+	_, refreshToken := s.loginTokens(t, student)
+	earlier := s.tokenIssuedAt(t, student, time.Now().Add(-time.Minute))
+	s.do(t, http.MethodGet, "/api/user/me", earlier, nil, http.StatusOK)
+
+	s.do(t, http.MethodPost, "/api/admin/users/"+student.ID+"/reset-password", admin, nil, http.StatusOK)
+
+	// Access tokens issued before the reset stop working along with the
+	// refresh tokens and the password
+	s.do(t, http.MethodGet, "/api/user/me", earlier, nil, http.StatusUnauthorized)
+	s.do(t, http.MethodPost, "/api/auth/refresh", "", models.RefreshRequest{RefreshToken: refreshToken}, http.StatusUnauthorized)
+	s.do(t, http.MethodPost, "/api/auth/login", "", models.LoginRequest{Email: student.Email, Password: testPassword}, http.StatusUnauthorized)
+	s.do(t, http.MethodGet, "/api/user/me", s.tokenIssuedAt(t, student, time.Now()), nil, http.StatusOK)
+}
+
+func TestSuspensionEndsSessions(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.login(t, s.newUser(t, models.RoleAdmin))
+	student := s.newUser(t, models.RoleStudent)
+	earlier := s.tokenIssuedAt(t, student, time.Now().Add(-time.Minute))
+
+	s.do(t, http.MethodPost, "/api/admin/users/"+student.ID+"/suspend", admin, models.SuspendUserRequest{Reason: "spam"}, http.StatusOK)
+	s.do(t, http.MethodGet, "/api/user/me", earlier, nil, http.StatusForbidden)
+
+	// Reactivating the account does not bring its old sessions back
+	s.do(t, http.MethodPost, "/api/admin/users/"+student.ID+"/reactivate", admin, nil, http.StatusOK)
+	s.do(t, http.MethodGet, "/api/user/me", earlier, nil, http.StatusUnauthorized)
+	s.do(t, http.MethodGet, "/api/user/me", s.login(t, student), nil, http.StatusOK)
+}
+
+func TestCreateCourseRequiresPermission(t *testing.T) {
+	s := newTestServer(t)
+	price := money.New(299000, money.IDR)
+	req := models.CourseCreateRequest{
+		Title:       "Investing 101",
+		Description: "Stocks, bonds and funds",
+		Price:       &price,
+		Category:    "Investing",
+		Level:       "Beginner",
+		MentorName:  "Mentor",
+		Duration:    "2h",
+		Topics:      []string{"stocks"},
+	}
+
+	s.do(t, http.MethodPost, "/api/courses", "", req, http.StatusUnauthorized)
+	s.do(t, http.MethodPost, "/api/courses", s.login(t, s.newUser(t, models.RoleStudent)), req, http.StatusForbidden)
+
+	w := s.do(t, http.MethodPost, "/api/courses", s.login(t, s.newUser(t, models.RoleAdmin)), req, http.StatusCreated)
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	course, err := s.store.Courses.GetByID(t.Context(), created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if course.Title != req.Title || course.Price != price {
+		t.Errorf("stored course = %+v, want %q for %v", course, req.Title, price)
+	}
+}
+
+func TestEditCourseRequiresPermission(t *testing.T) {
+	s := newTestServer(t)
+	path := "/api/courses/1"
+	title := "Renamed Course"
+	patch := models.CourseUpdateRequest{Title: &title}
+
+	s.do(t, http.MethodPatch, path, "", patch, http.StatusUnauthorized)
+	s.do(t, http.MethodDelete, path, "", nil, http.StatusUnauthorized)
+	for _, role := range []string{models.RoleStudent, models.RoleMentor} {
+		token := s.login(t, s.newUser(t, role))
+		s.do(t, http.MethodPatch, path, token, patch, http.StatusForbidden)
+		s.do(t, http.MethodPut, path, token, patch, http.StatusForbidden)
+		s.do(t, http.MethodDelete, path, token, nil, http.StatusForbidden)
+	}
+	if course, err := s.store.Courses.GetByID(t.Context(), "1"); err != nil || course.Title == title {
+		t.Fatalf("course after refused edits = %+v, %v", course, err)
+	}
+
+	admin := s.login(t, s.newUser(t, models.RoleAdmin))
+	s.do(t, http.MethodPatch, path, admin, patch, http.StatusOK)
+	s.do(t, http.MethodDelete, path, admin, nil, http.StatusOK)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/cuanin/emergent-backend/media"
+)
+
+// newMediaSigner returns the signer for links to paid course media, keyed by
+// MEDIA_URL_SECRET. Without it a random key is used, which is fine for a
+// single development server but invalidates links on every restart, so it
+// is refused when APP_ENV=production.
+func newMediaSigner() (*media.Signer, error) {
+	secret := os.Getenv("MEDIA_URL_SECRET")
+	if secret != "" {
+		return media.NewSigner([]byte(secret)), nil
+	}
+	if os.Getenv("APP_ENV") == "production" {
+		return nil, errors.New("MEDIA_URL_SECRET is required in production")
+	}
+	log.Printf("MEDIA_URL_SECRET is not set; media links will stop working when the server restarts")
+	return media.NewRandomSigner(), nil
+}
@@ -0,0 +1,79 @@
+package media
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	s := NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+	now := time.Unix(1700000000, 0)
+	link := Link{CourseID: "course", LessonID: "lesson", UserID: "user", ExpiresAt: now.Add(time.Hour)}
+	q := s.Sign(link)
+
+	got, err := s.Verify(q, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != link {
+		t.Errorf("Verify = %+v, want %+v", got, link)
+	}
+
+	// A link for the course's own video has no lesson
+	video := Link{CourseID: "course", UserID: "user", ExpiresAt: now.Add(time.Hour)}
+	if got, err := s.Verify(s.Sign(video), now); err != nil || got != video {
+		t.Errorf("Verify of a course video link = %+v, %v, want %+v", got, err, video)
+	}
+}
+
+func TestVerifyExpiry(t *testing.T) {
+	s := NewRandomSigner()
+	expires := time.Unix(1700000000, 0)
+	q := s.Sign(Link{CourseID: "course", UserID: "user", ExpiresAt: expires})
+
+	if _, err := s.Verify(q, expires.Add(-time.Second)); err != nil {
+		t.Errorf("Verify a second before expiry: %v", err)
+	}
+	for _, now := range []time.Time{expires, expires.Add(time.Second), expires.Add(24 * time.Hour)} {
+		if _, err := s.Verify(q, now); !errors.Is(err, ErrLinkExpired) {
+			t.Errorf("Verify %v after expiry: got %v, want ErrLinkExpired", now.Sub(expires), err)
+		}
+	}
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	s := NewRandomSigner()
+	now := time.Unix(1700000000, 0)
+	signed := s.Sign(Link{CourseID: "course", LessonID: "lesson", UserID: "user", ExpiresAt: now.Add(time.Hour)})
+
+	for _, tt := range []struct {
+		name string
+		edit func(url.Values)
+	}{
+		{"other course", func(q url.Values) { q.Set("course", "other") }},
+		{"other lesson", func(q url.Values) { q.Set("lesson", "other") }},
+		{"no lesson", func(q url.Values) { q.Del("lesson") }},
+		{"other user", func(q url.Values) { q.Set("user", "other") }},
+		{"later expiry", func(q url.Values) { q.Set("expires", "9999999999") }},
+		{"no signature", func(q url.Values) { q.Del("sig") }},
+		{"malformed signature", func(q url.Values) { q.Set("sig", "not base64!") }},
+		{"no course", func(q url.Values) { q.Del("course") }},
+		{"no user", func(q url.Values) { q.Del("user") }},
+	} {
+		q := url.Values{}
+		for k, v := range signed {
+			q[k] = append([]string{}, v...)
+		}
+		tt.edit(q)
+		if _, err := s.Verify(q, now); !errors.Is(err, ErrInvalidLink) {
+			t.Errorf("%s: got %v, want ErrInvalidLink", tt.name, err)
+		}
+	}
+
+	// Nor does another key accept it
+	if _, err := NewRandomSigner().Verify(signed, now); !errors.Is(err, ErrInvalidLink) {
+		t.Errorf("Verify with another key: got %v, want ErrInvalidLink", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// runMigrate implements the "migrate" subcommand:
+//
+//	emergent-backend migrate up
+//	emergent-backend migrate down [steps]
+//	emergent-backend migrate version
+//
+// It operates on the SQL database selected by DB_DRIVER and DATABASE_URL.
+func runMigrate(args []string) error {
+	driver := os.Getenv("DB_DRIVER")
+	if driver != "sqlite" && driver != "postgres" {
+		return fmt.Errorf("migrations require DB_DRIVER=sqlite or DB_DRIVER=postgres")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up | down [steps] | version")
+	}
+
+	db, err := openSQLDatabase(driver)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(ctx)
+		for _, version := range applied {
+			fmt.Printf("applied %04d\n", version)
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		reverted, err := db.MigrateDown(ctx, steps)
+		for _, version := range reverted {
+			fmt.Printf("reverted %04d\n", version)
+		}
+		return err
+	case "version":
+		version, err := db.SchemaVersion(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%04d\n", version)
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
@@ -1,49 +1,527 @@
 package models
 
 import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/cuanin/emergent-backend/money"
 )
 
 // User represents a user in the system
 type User struct {
-	ID             string         `json:"id" bson:"_id"`
-	Email          string         `json:"email" bson:"email"`
-	Password       string         `json:"-" bson:"password"`
-	FullName       string         `json:"full_name" bson:"full_name"`
-	IsAdmin        bool           `json:"is_admin" bson:"is_admin"`
-	CreatedAt      time.Time      `json:"created_at" bson:"created_at"`
-	LastLogin      *time.Time     `json:"last_login,omitempty" bson:"last_login,omitempty"`
+	ID              string         `json:"id" bson:"_id"`
+	Email           string         `json:"email" bson:"email"`
+	Password        string         `json:"-" bson:"password"`
+	FullName        string         `json:"full_name" bson:"full_name"`
+	AvatarURL       string         `json:"avatar_url,omitempty" bson:"avatar_url,omitempty"`
+	IsAdmin         bool           `json:"is_admin" bson:"is_admin"`
+	Role            string         `json:"role" bson:"role"`
+	EmailVerified   bool           `json:"email_verified" bson:"email_verified"`
+	TOTPSecret      string         `json:"-" bson:"totp_secret,omitempty"`
+	TOTPEnabled     bool           `json:"totp_enabled" bson:"totp_enabled"`
+	TOTPLastStep    int64          `json:"-" bson:"totp_last_step"` // last accepted time step, to prevent code replay
+	CreatedAt       time.Time      `json:"created_at" bson:"created_at"`
+	LastLogin       *time.Time     `json:"last_login,omitempty" bson:"last_login,omitempty"`
+	DeletedAt       *time.Time     `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`     // set when the account was deleted and anonymised
+	SuspendedAt     *time.Time     `json:"suspended_at,omitempty" bson:"suspended_at,omitempty"` // set while an admin has disabled the account
+	SuspendedReason string         `json:"suspended_reason,omitempty" bson:"suspended_reason,omitempty"`
+	SessionsEndedAt *time.Time     `json:"-" bson:"sessions_ended_at,omitempty"` // access tokens issued before this are refused
 	EnrolledCourses []string       `json:"enrolled_courses" bson:"enrolled_courses"`
-	Badges         []string       `json:"badges" bson:"badges"`
-	Progress       map[string]int `json:"progress" bson:"progress"`
+	Badges          []string       `json:"badges" bson:"badges"`
+	Progress        map[string]int `json:"progress" bson:"progress"`
+}
+
+// User roles
+const (
+	RoleAdmin   = "admin"
+	RoleMentor  = "mentor"
+	RoleStudent = "student"
+)
+
+// User statuses, as derived by User.Status
+const (
+	UserActive    = "active"
+	UserSuspended = "suspended"
+	UserDeleted   = "deleted"
+)
+
+// Status reports whether the account is active, suspended or deleted.
+func (u User) Status() string {
+	switch {
+	case u.DeletedAt != nil:
+		return UserDeleted
+	case u.SuspendedAt != nil:
+		return UserSuspended
+	default:
+		return UserActive
+	}
+}
+
+// EffectiveRole returns the user's role, falling back to the IsAdmin flag
+// for records created before roles existed.
+func (u User) EffectiveRole() string {
+	if u.Role != "" {
+		return u.Role
+	}
+	if u.IsAdmin {
+		return RoleAdmin
+	}
+	return RoleStudent
 }
 
 // Course represents a course in the platform
 type Course struct {
+	ID              string      `json:"id" bson:"_id"`
+	Title           string      `json:"title" bson:"title"`
+	Description     string      `json:"description" bson:"description"`
+	Price           money.Money `json:"price" bson:"price"`
+	Category        string      `json:"category" bson:"category"`
+	Level           string      `json:"level" bson:"level"`
+	MentorName      string      `json:"mentor_name" bson:"mentor_name"`
+	MentorID        string      `json:"mentor_id,omitempty" bson:"mentor_id,omitempty"` // the mentor's account, which may author the course
+	VideoURL        string      `json:"-" bson:"video_url,omitempty"`                   // paid content, only handed out as a signed MediaLink
+	PreviewVideoURL string      `json:"preview_video_url,omitempty" bson:"preview_video_url,omitempty"`
+	Duration        string      `json:"duration" bson:"duration"`                 // computed from the lessons once there are any
+	DurationSeconds int         `json:"duration_seconds" bson:"duration_seconds"` // total of the lessons
+	LessonCount     int         `json:"lesson_count" bson:"lesson_count"`
+	Topics          []string    `json:"topics" bson:"topics"`
+	CreatedAt       time.Time   `json:"created_at" bson:"created_at"`
+	EnrolledCount   int         `json:"enrolled_count" bson:"enrolled_count"`
+	Rating          float64     `json:"rating" bson:"rating"`                               // average review score out of 5
+	RatingCount     int         `json:"rating_count" bson:"rating_count"`                   // number of reviews in Rating
+	Status          string      `json:"status" bson:"status"`                               // one of the Course statuses
+	ArchivedAt      *time.Time  `json:"archived_at,omitempty" bson:"archived_at,omitempty"` // set while the status is archived
+}
+
+// course has the fields of Course without its MarshalJSON.
+type course Course
+
+// courseJSON is how a Course is written in responses.
+type courseJSON struct {
+	course
+	Price      json.Number `json:"price"`
+	PriceMoney money.Money `json:"price_money"`
+}
+
+// MarshalJSON writes the price both as price_money, with its currency, and
+// as price, a plain number of whole units that clients written before
+// prices had a currency still read.
+func (c Course) MarshalJSON() ([]byte, error) {
+	return json.Marshal(courseJSON{course(c), c.Price.Number(), c.Price})
+}
+
+// Course statuses. A course is written as a draft, reviewed and published.
+// Unlisted courses are published but left out of listings, so only people
+// with a link find them; archived courses are kept for their buyers only.
+// A released course goes back to review to have its curriculum changed.
+const (
+	CourseDraft     = "draft"
+	CourseInReview  = "in_review"
+	CoursePublished = "published"
+	CourseUnlisted  = "unlisted"
+	CourseArchived  = "archived"
+)
+
+// courseTransitions lists the statuses a course can move to from each status.
+var courseTransitions = map[string][]string{
+	CourseDraft:     {CourseInReview},
+	CourseInReview:  {CourseDraft, CoursePublished, CourseUnlisted},
+	CoursePublished: {CourseUnlisted, CourseArchived, CourseInReview},
+	CourseUnlisted:  {CoursePublished, CourseArchived, CourseInReview},
+	CourseArchived:  {CoursePublished, CourseUnlisted},
+}
+
+// IsCourseStatus reports whether s is one of the Course statuses.
+func IsCourseStatus(s string) bool {
+	_, ok := courseTransitions[s]
+	return ok
+}
+
+// CanTransition reports whether a course may move from one status to
+// another.
+func CanTransition(from, to string) bool {
+	return slices.Contains(courseTransitions[from], to)
+}
+
+// Listed reports whether the course appears in the catalog, search results
+// and category counts.
+func (c Course) Listed() bool {
+	return c.Status == CoursePublished
+}
+
+// Released reports whether the course has left review, so that anyone can
+// open it by its ID. Drafts and courses in review are only shown to staff.
+func (c Course) Released() bool {
+	return c.Status != CourseDraft && c.Status != CourseInReview
+}
+
+// CourseStatusChange records a course moving from one status to another,
+// who moved it and when.
+type CourseStatusChange struct {
+	ID        string    `json:"id" bson:"_id"`
+	CourseID  string    `json:"course_id" bson:"course_id"`
+	From      string    `json:"from" bson:"from"`
+	To        string    `json:"to" bson:"to"`
+	ChangedBy string    `json:"changed_by" bson:"changed_by"` // user ID
+	Note      string    `json:"note,omitempty" bson:"note,omitempty"`
+	ChangedAt time.Time `json:"changed_at" bson:"changed_at"`
+}
+
+// Lesson content types
+const (
+	LessonVideo      = "video"
+	LessonText       = "text"
+	LessonAttachment = "attachment"
+)
+
+// Module is a section of a course's curriculum, holding lessons in order.
+// Positions start at 1 and have no gaps.
+type Module struct {
 	ID              string    `json:"id" bson:"_id"`
+	CourseID        string    `json:"course_id" bson:"course_id"`
 	Title           string    `json:"title" bson:"title"`
-	Description     string    `json:"description" bson:"description"`
-	Price           float64   `json:"price" bson:"price"`
-	Category        string    `json:"category" bson:"category"`
-	Level           string    `json:"level" bson:"level"`
-	MentorName      string    `json:"mentor_name" bson:"mentor_name"`
+	Position        int       `json:"position" bson:"position"`
+	DurationSeconds int       `json:"duration_seconds" bson:"-"` // total of the lessons
+	Lessons         []Lesson  `json:"lessons" bson:"lessons"`
+	CreatedAt       time.Time `json:"created_at" bson:"created_at"`
+}
+
+// Lesson is one item of a module. Depending on its type, its content is a
+// video, a text in Markdown or a downloadable attachment.
+type Lesson struct {
+	ID              string    `json:"id" bson:"_id"`
+	CourseID        string    `json:"course_id" bson:"course_id"`
+	ModuleID        string    `json:"module_id" bson:"module_id"`
+	Title           string    `json:"title" bson:"title"`
+	Position        int       `json:"position" bson:"position"`
+	Type            string    `json:"type" bson:"type"`
 	VideoURL        string    `json:"video_url,omitempty" bson:"video_url,omitempty"`
-	PreviewVideoURL string    `json:"preview_video_url,omitempty" bson:"preview_video_url,omitempty"`
-	Duration        string    `json:"duration" bson:"duration"`
-	Topics          []string  `json:"topics" bson:"topics"`
+	Content         string    `json:"content,omitempty" bson:"content,omitempty"`
+	AttachmentURL   string    `json:"attachment_url,omitempty" bson:"attachment_url,omitempty"`
+	DurationSeconds int       `json:"duration_seconds" bson:"duration_seconds"`
 	CreatedAt       time.Time `json:"created_at" bson:"created_at"`
-	EnrolledCount   int       `json:"enrolled_count" bson:"enrolled_count"`
 }
 
-// Payment represents a payment transaction
+// Summary returns the lesson without its content, as listed in the public
+// course outline.
+func (l Lesson) Summary() Lesson {
+	l.VideoURL = ""
+	l.Content = ""
+	l.AttachmentURL = ""
+	return l
+}
+
+// FormatDuration describes a length of time in hours and minutes, rounding
+// up to the minute, as in "2 hours 5 minutes".
+func FormatDuration(seconds int) string {
+	minutes := (seconds + 59) / 60
+	hours, minutes := minutes/60, minutes%60
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return strconv.Itoa(n) + " " + unit + "s"
+	}
+	switch {
+	case hours == 0:
+		return plural(minutes, "minute")
+	case minutes == 0:
+		return plural(hours, "hour")
+	default:
+		return plural(hours, "hour") + " " + plural(minutes, "minute")
+	}
+}
+
+// Payment represents a payment transaction. It is created pending with the
+// provider's instructions for the payer, and settled once the provider
+// reports the outcome.
 type Payment struct {
-	ID            string    `json:"id" bson:"_id"`
-	UserID        string    `json:"user_id" bson:"user_id"`
-	CourseID      string    `json:"course_id" bson:"course_id"`
-	Amount        float64   `json:"amount" bson:"amount"`
-	PaymentMethod string    `json:"payment_method" bson:"payment_method"`
-	Status        string    `json:"status" bson:"status"`
-	CreatedAt     time.Time `json:"created_at" bson:"created_at"`
+	ID            string      `json:"id" bson:"_id"`
+	UserID        string      `json:"user_id" bson:"user_id"`
+	CourseID      string      `json:"course_id" bson:"course_id"`
+	Amount        money.Money `json:"amount" bson:"amount"`
+	PaymentMethod string      `json:"payment_method" bson:"payment_method"`
+	Status        string      `json:"status" bson:"status"` // one of the Payment statuses
+	// CouponCode is the coupon the buyer used, if any, and Discount what it
+	// took off the course's price to give Amount.
+	CouponCode string       `json:"coupon_code,omitempty" bson:"coupon_code,omitempty"`
+	Discount   *money.Money `json:"discount,omitempty" bson:"discount,omitempty"`
+	// Provider names the payment gateway, and Reference is its ID for the
+	// charge.
+	Provider  string         `json:"provider,omitempty" bson:"provider,omitempty"`
+	Reference string         `json:"provider_reference,omitempty" bson:"reference,omitempty"`
+	Action    *PaymentAction `json:"action,omitempty" bson:"action,omitempty"`
+	ExpiresAt *time.Time     `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	SettledAt *time.Time     `json:"settled_at,omitempty" bson:"settled_at,omitempty"` // when it stopped being pending
+	CreatedAt time.Time      `json:"created_at" bson:"created_at"`
+}
+
+// MarshalJSON writes the amount both as amount_money, with its currency,
+// and as amount, a plain number of whole units, as Course does the price.
+func (p Payment) MarshalJSON() ([]byte, error) {
+	type payment Payment
+	return json.Marshal(struct {
+		payment
+		Amount      json.Number `json:"amount"`
+		AmountMoney money.Money `json:"amount_money"`
+	}{payment(p), p.Amount.Number(), p.Amount})
+}
+
+// Payment statuses. Only a paid payment enrolls the payer, and refunding it
+// takes the enrollment away again.
+const (
+	PaymentPending  = "pending"
+	PaymentPaid     = "paid"
+	PaymentFailed   = "failed"
+	PaymentExpired  = "expired"
+	PaymentRefunded = "refunded"
+)
+
+// paymentTransitions lists the statuses a payment can move to from each
+// status. Failed, expired and refunded payments are final.
+var paymentTransitions = map[string][]string{
+	PaymentPending: {PaymentPaid, PaymentFailed, PaymentExpired},
+	PaymentPaid:    {PaymentRefunded},
+}
+
+// CanTransitionPayment reports whether a payment may move from one status
+// to another.
+func CanTransitionPayment(from, to string) bool {
+	return slices.Contains(paymentTransitions[from], to)
+}
+
+// PaymentAction tells the payer how to complete a pending payment: open a
+// URL, transfer to a virtual account, or scan a QR code.
+type PaymentAction struct {
+	Type     string `json:"type" bson:"type"` // one of the PaymentAction types
+	URL      string `json:"url,omitempty" bson:"url,omitempty"`
+	Bank     string `json:"bank,omitempty" bson:"bank,omitempty"`
+	VANumber string `json:"va_number,omitempty" bson:"va_number,omitempty"`
+	QRString string `json:"qr_string,omitempty" bson:"qr_string,omitempty"`
+}
+
+// PaymentAction types. A QR code action may also have a URL of the code as
+// an image.
+const (
+	ActionRedirect       = "redirect"
+	ActionVirtualAccount = "virtual_account"
+	ActionQRCode         = "qr_code"
+)
+
+// Coupon is a discount code that buyers enter when purchasing a course. It
+// takes either PercentOff or AmountOff off the price. Limits and
+// restrictions left at their zero value do not apply.
+type Coupon struct {
+	ID         string       `json:"id" bson:"_id"`
+	Code       string       `json:"code" bson:"code"` // upper case; entered codes match ignoring case
+	PercentOff int          `json:"percent_off,omitempty" bson:"percent_off,omitempty"`
+	AmountOff  *money.Money `json:"amount_off,omitempty" bson:"amount_off,omitempty"` // only for prices in its currency
+	// MinSpend is the lowest price the coupon applies to, and only prices in
+	// its currency qualify.
+	MinSpend *money.Money `json:"min_spend,omitempty" bson:"min_spend,omitempty"`
+	// CourseIDs and Categories restrict the coupon to courses that are
+	// listed or in one of the categories.
+	CourseIDs  []string   `json:"course_ids" bson:"course_ids"`
+	Categories []string   `json:"categories" bson:"categories"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	// MaxRedemptions limits the purchases made with the coupon in total, and
+	// PerUserLimit those made by each buyer. Redemptions counts pending and
+	// paid purchases; failed and expired ones give their redemption back.
+	MaxRedemptions int       `json:"max_redemptions" bson:"max_redemptions"`
+	PerUserLimit   int       `json:"per_user_limit" bson:"per_user_limit"`
+	Redemptions    int       `json:"redemptions" bson:"redemptions"`
+	CreatedAt      time.Time `json:"created_at" bson:"created_at"`
+}
+
+// AppliesTo reports whether the coupon's course and category restrictions
+// allow it to be used for course.
+func (cp Coupon) AppliesTo(course Course) bool {
+	if len(cp.CourseIDs) == 0 && len(cp.Categories) == 0 {
+		return true
+	}
+	if slices.Contains(cp.CourseIDs, course.ID) {
+		return true
+	}
+	return slices.ContainsFunc(cp.Categories, func(category string) bool {
+		return strings.EqualFold(category, course.Category)
+	})
+}
+
+// Discount returns how much the coupon takes off price, which is never more
+// than the price itself. Percentages are rounded down to a whole unit of
+// the currency.
+func (cp Coupon) Discount(price money.Money) money.Money {
+	off := price.Amount * int64(cp.PercentOff) / 100
+	if cp.AmountOff != nil {
+		off = cp.AmountOff.Amount
+	}
+	return money.New(min(off, price.Amount), price.Currency)
+}
+
+// RefreshToken is the server-side record of an issued refresh token. Only
+// the SHA-256 hash of the token value is stored. Tokens obtained by rotating
+// one another share a FamilyID, which starts at login.
+type RefreshToken struct {
+	ID        string     `json:"-" bson:"_id"`
+	UserID    string     `json:"user_id" bson:"user_id"`
+	FamilyID  string     `json:"family_id" bson:"family_id"`
+	CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at" bson:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty" bson:"used_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+// Purposes of an ActionToken
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenResetPassword = "reset_password"
+	TokenChangeEmail   = "change_email" // Email holds the new address
+)
+
+// ActionToken is a single-use, expiring token sent by email to verify an
+// address or reset a password. Only the SHA-256 hash of the token is stored.
+type ActionToken struct {
+	ID        string     `json:"-" bson:"_id"`
+	UserID    string     `json:"user_id" bson:"user_id"`
+	Purpose   string     `json:"purpose" bson:"purpose"`
+	Email     string     `json:"email" bson:"email"` // address the token was sent to
+	CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at" bson:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty" bson:"used_at,omitempty"`
+}
+
+// OIDCState is a pending OpenID Connect login, started by redirecting the
+// browser to the provider. Only the SHA-256 hash of the state parameter is
+// stored; the PKCE verifier and nonce are checked on the callback.
+type OIDCState struct {
+	ID           string    `json:"-" bson:"_id"`
+	Provider     string    `json:"provider" bson:"provider"`
+	CodeVerifier string    `json:"-" bson:"code_verifier"`
+	Nonce        string    `json:"-" bson:"nonce"`
+	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+// Identity links a user to their account at an OpenID Connect provider,
+// identified by the provider's subject claim.
+type Identity struct {
+	Provider  string    `json:"provider" bson:"provider"`
+	Subject   string    `json:"subject" bson:"subject"`
+	UserID    string    `json:"user_id" bson:"user_id"`
+	Email     string    `json:"email" bson:"email"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// LoginThrottle counts failed logins for one key, either a client IP
+// address or an account email.
+type LoginThrottle struct {
+	Key           string     `json:"key" bson:"_id"`
+	Failures      int        `json:"failures" bson:"failures"`
+	Lockouts      int        `json:"lockouts" bson:"lockouts"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty" bson:"locked_until,omitempty"`
+	LastFailureAt time.Time  `json:"last_failure_at" bson:"last_failure_at"`
+}
+
+// IdempotencyRecord is the first request a user made with an
+// Idempotency-Key and, once it has completed, its response, which is
+// replayed when the request is retried with the same key.
+type IdempotencyRecord struct {
+	UserID string `json:"user_id" bson:"user_id"`
+	Key    string `json:"key" bson:"key"`
+	// Fingerprint is a hash of the method, path and body of the request.
+	Fingerprint string `json:"fingerprint" bson:"fingerprint"`
+	// StatusCode is 0 while the request is in progress.
+	StatusCode  int       `json:"status_code" bson:"status_code"`
+	ContentType string    `json:"content_type" bson:"content_type"`
+	Body        []byte    `json:"body" bson:"body"`
+	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+// LockoutEvent records that logins were temporarily blocked for an IP
+// address or an account.
+type LockoutEvent struct {
+	ID          string    `json:"id" bson:"_id"`
+	Scope       string    `json:"scope" bson:"scope"` // "ip" or "account"
+	IP          string    `json:"ip" bson:"ip"`
+	Email       string    `json:"email" bson:"email"`
+	Failures    int       `json:"failures" bson:"failures"`
+	LockedUntil time.Time `json:"locked_until" bson:"locked_until"`
+	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+}
+
+// Login methods recorded in a LoginEvent. Social logins are recorded as
+// "oidc:" followed by the provider name.
+const (
+	LoginPassword = "password"
+	LoginTOTP     = "2fa"
+)
+
+// LoginEvent records an attempt to sign in to an account, for the user's
+// login history.
+type LoginEvent struct {
+	ID        string    `json:"id" bson:"_id"`
+	UserID    string    `json:"user_id" bson:"user_id"`
+	Method    string    `json:"method" bson:"method"`
+	Success   bool      `json:"success" bson:"success"`
+	IP        string    `json:"ip" bson:"ip"`
+	UserAgent string    `json:"user_agent" bson:"user_agent"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// Actions recorded in the audit log
+const (
+	AuditAccountDeleted   = "account.deleted"
+	AuditExportRequested  = "export.requested"
+	AuditExportCompleted  = "export.completed"
+	AuditExportFailed     = "export.failed"
+	AuditExportDownloaded = "export.downloaded"
+	AuditRoleChanged      = "user.role_changed"
+	AuditUserSuspended    = "user.suspended"
+	AuditUserReactivated  = "user.reactivated"
+	AuditPasswordReset    = "user.password_reset"
+)
+
+// AuditEvent records an action taken on a user's account or data. ActorID
+// is the user who took it, or empty for the server itself.
+type AuditEvent struct {
+	ID        string    `json:"id" bson:"_id"`
+	Action    string    `json:"action" bson:"action"`
+	UserID    string    `json:"user_id" bson:"user_id"` // account acted on
+	ActorID   string    `json:"actor_id,omitempty" bson:"actor_id,omitempty"`
+	TargetID  string    `json:"target_id,omitempty" bson:"target_id,omitempty"` // e.g. the export ID
+	Detail    string    `json:"detail,omitempty" bson:"detail,omitempty"`       // e.g. the new role
+	IP        string    `json:"ip,omitempty" bson:"ip,omitempty"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// Statuses of a DataExport
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+	ExportExpired = "expired"
+)
+
+// DataExport is a request by a user for a copy of their personal data. The
+// archive is built in the background and can be downloaded until
+// ExpiresAt, after which it is deleted. Only the SHA-256 hash of the
+// emailed download token is stored.
+type DataExport struct {
+	ID          string     `json:"id" bson:"_id"`
+	UserID      string     `json:"user_id" bson:"user_id"`
+	Status      string     `json:"status" bson:"status"`
+	Error       string     `json:"error,omitempty" bson:"error,omitempty"`
+	Size        int        `json:"size,omitempty" bson:"size,omitempty"` // archive size in bytes
+	TokenHash   string     `json:"-" bson:"token_hash,omitempty"`
+	RequestedAt time.Time  `json:"requested_at" bson:"requested_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty" bson:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty" bson:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
 }
 
 // Request and response models
@@ -58,6 +536,89 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+// MFALoginRequest completes a login for an account with two-factor
+// authentication, using either an authenticator code or a recovery code.
+type MFALoginRequest struct {
+	MFAToken     string `json:"mfa_token" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type TOTPDisableRequest struct {
+	Password     string `json:"password" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// MFASettings lists the roles whose members must enable two-factor
+// authentication before they can use role-restricted endpoints.
+type MFASettings struct {
+	RequiredRoles []string `json:"required_roles"`
+}
+
+// UpdateProfileRequest changes the fields that are present. A new email
+// takes effect once confirmed through the link sent to it.
+type UpdateProfileRequest struct {
+	FullName  *string `json:"full_name" binding:"omitempty,min=1,max=100"`
+	Email     *string `json:"email" binding:"omitempty,email"`
+	AvatarURL *string `json:"avatar_url" binding:"omitempty,max=2048"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// UpdateUserRoleRequest sets a user's role, either directly or by toggling
+// the admin flag. Exactly one of the fields must be set.
+type UpdateUserRoleRequest struct {
+	Role    *string `json:"role" binding:"omitempty,oneof=admin mentor student"`
+	IsAdmin *bool   `json:"is_admin"`
+}
+
+type SuspendUserRequest struct {
+	Reason string `json:"reason" binding:"max=500"`
+}
+
+type UserListResponse struct {
+	Users   []User `json:"users"`
+	Total   int    `json:"total"`
+	Page    int    `json:"page"`
+	PerPage int    `json:"per_page"`
+}
+
+// UserDetailResponse is what admins see of a single user.
+type UserDetailResponse struct {
+	User        User             `json:"user"`
+	Enrollments []EnrolledCourse `json:"enrollments"`
+	Payments    []Payment        `json:"payments"`
+}
+
 type LoginResponse struct {
 	AccessToken string `json:"access_token"`
 	TokenType   string `json:"token_type"`
@@ -65,22 +626,84 @@ type LoginResponse struct {
 }
 
 type CourseCreateRequest struct {
-	Title           string   `json:"title" binding:"required"`
-	Description     string   `json:"description" binding:"required"`
-	Price           float64  `json:"price" binding:"required"`
-	Category        string   `json:"category" binding:"required"`
-	Level           string   `json:"level" binding:"required"`
-	MentorName      string   `json:"mentor_name" binding:"required"`
-	VideoURL        string   `json:"video_url,omitempty"`
-	PreviewVideoURL string   `json:"preview_video_url,omitempty"`
-	Duration        string   `json:"duration" binding:"required"`
-	Topics          []string `json:"topics"`
+	Title           string       `json:"title" binding:"required"`
+	Description     string       `json:"description" binding:"required"`
+	Price           *money.Money `json:"price" binding:"required"`
+	Category        string       `json:"category" binding:"required"`
+	Level           string       `json:"level" binding:"required"`
+	MentorName      string       `json:"mentor_name" binding:"required"`
+	MentorID        string       `json:"mentor_id"`
+	VideoURL        *string      `json:"video_url,omitempty"` // responses omit it, so a PUT without it keeps the video
+	PreviewVideoURL string       `json:"preview_video_url,omitempty"`
+	Duration        string       `json:"duration"`
+	Topics          []string     `json:"topics"`
 }
 
+// CourseUpdateRequest changes some fields of a course. Fields left out are
+// kept.
+type CourseUpdateRequest struct {
+	Title           *string      `json:"title" binding:"omitempty,min=1"`
+	Description     *string      `json:"description" binding:"omitempty,min=1"`
+	Price           *money.Money `json:"price"`
+	Category        *string      `json:"category" binding:"omitempty,min=1"`
+	Level           *string      `json:"level" binding:"omitempty,min=1"`
+	MentorName      *string      `json:"mentor_name" binding:"omitempty,min=1"`
+	MentorID        *string      `json:"mentor_id"` // "" leaves the course without one
+	VideoURL        *string      `json:"video_url"`
+	PreviewVideoURL *string      `json:"preview_video_url"`
+	Duration        *string      `json:"duration" binding:"omitempty,min=1"`
+	Topics          *[]string    `json:"topics"`
+}
+
+// CourseStatusRequest moves a course to another status. The note, such as
+// the reason for sending a course back to draft, is kept in its history.
+type CourseStatusRequest struct {
+	Status string `json:"status" binding:"required,oneof=draft in_review published unlisted archived"`
+	Note   string `json:"note" binding:"max=1000"`
+}
+
+// PaymentRequest starts the purchase of a course. The amount charged is
+// always the course's price, less the discount of the coupon named by
+// CouponCode, so Amount is optional and ignored.
 type PaymentRequest struct {
-	CourseID      string  `json:"course_id" binding:"required"`
-	PaymentMethod string  `json:"payment_method" binding:"required"`
-	Amount        float64 `json:"amount" binding:"required"`
+	CourseID      string       `json:"course_id" binding:"required"`
+	PaymentMethod string       `json:"payment_method" binding:"required"`
+	Amount        *money.Money `json:"amount"`
+	CouponCode    string       `json:"coupon_code"`
+}
+
+// QuoteRequest asks what a course would cost with an optional coupon.
+type QuoteRequest struct {
+	CourseID   string `json:"course_id" binding:"required"`
+	CouponCode string `json:"coupon_code"`
+}
+
+// Quote is the price a buyer would pay for a course.
+type Quote struct {
+	CourseID   string      `json:"course_id"`
+	Price      money.Money `json:"price"`
+	Discount   money.Money `json:"discount"`
+	Total      money.Money `json:"total"`
+	CouponCode string      `json:"coupon_code,omitempty"`
+}
+
+// CouponRequest creates or replaces a coupon. Exactly one of PercentOff and
+// AmountOff is required.
+type CouponRequest struct {
+	Code           string       `json:"code" binding:"required"`
+	PercentOff     int          `json:"percent_off" binding:"min=0,max=100"`
+	AmountOff      *money.Money `json:"amount_off"`
+	MinSpend       *money.Money `json:"min_spend"`
+	CourseIDs      []string     `json:"course_ids"`
+	Categories     []string     `json:"categories"`
+	ExpiresAt      *time.Time   `json:"expires_at"`
+	MaxRedemptions int          `json:"max_redemptions" binding:"min=0"`
+	PerUserLimit   int          `json:"per_user_limit" binding:"min=0"`
+}
+
+// SimulatePaymentRequest settles a payment made with the payment simulator.
+type SimulatePaymentRequest struct {
+	Status string `json:"status" binding:"required,oneof=paid failed expired refunded"`
 }
 
 // EnrolledCourse represents a course that a user is enrolled in, including progress
@@ -92,9 +715,93 @@ type EnrolledCourse struct {
 // DashboardResponse represents the data returned for a user's dashboard
 type DashboardResponse struct {
 	EnrolledCourses []EnrolledCourse `json:"enrolled_courses"`
-	TotalSpent     float64          `json:"total_spent"`
-	Badges         []string         `json:"badges"`
-	RecentPayments []Payment        `json:"recent_payments"`
+	TotalSpent      json.Number      `json:"total_spent"`       // the total paid in rupiah, for older clients
+	TotalSpentMoney []money.Money    `json:"total_spent_money"` // one total per currency paid in
+	Badges          []string         `json:"badges"`
+	RecentPayments  []Payment        `json:"recent_payments"`
+}
+
+// CourseDetailResponse is a course with its curriculum outline.
+type CourseDetailResponse struct {
+	Course
+	Modules []Module `json:"modules"`
+}
+
+// MarshalJSON writes the course as Course does, which the method promoted
+// from Course would do without the modules.
+func (r CourseDetailResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		courseJSON
+		Modules []Module `json:"modules"`
+	}{courseJSON{course(r.Course), r.Course.Price.Number(), r.Course.Price}, r.Modules})
+}
+
+// MediaLink is a signed link that opens a course video or lesson file for
+// one user until it expires.
+type MediaLink struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LessonResponse is a lesson as shown to a student: instead of its video or
+// attachment URL, it has a MediaLink to open it.
+type LessonResponse struct {
+	Lesson
+	Media *MediaLink `json:"media,omitempty"`
+}
+
+// ModuleRequest creates a module. A position of 0 adds it at the end.
+type ModuleRequest struct {
+	Title    string `json:"title" binding:"required"`
+	Position int    `json:"position" binding:"min=0"`
+}
+
+// ModuleUpdateRequest renames or moves a module.
+type ModuleUpdateRequest struct {
+	Title    *string `json:"title" binding:"omitempty,min=1"`
+	Position *int    `json:"position" binding:"omitempty,min=1"`
+}
+
+// LessonRequest creates a lesson. A video lesson needs video_url, a text
+// lesson content and an attachment lesson attachment_url. A position of 0
+// adds it at the end of the module.
+type LessonRequest struct {
+	Title           string `json:"title" binding:"required"`
+	Type            string `json:"type" binding:"required,oneof=video text attachment"`
+	VideoURL        string `json:"video_url"`
+	Content         string `json:"content"`
+	AttachmentURL   string `json:"attachment_url"`
+	DurationSeconds int    `json:"duration_seconds" binding:"min=0"`
+	Position        int    `json:"position" binding:"min=0"`
+}
+
+// LessonUpdateRequest changes some fields of a lesson. Setting module_id
+// moves it to another module of the same course.
+type LessonUpdateRequest struct {
+	ModuleID        *string `json:"module_id" binding:"omitempty,min=1"`
+	Title           *string `json:"title" binding:"omitempty,min=1"`
+	Type            *string `json:"type" binding:"omitempty,oneof=video text attachment"`
+	VideoURL        *string `json:"video_url"`
+	Content         *string `json:"content"`
+	AttachmentURL   *string `json:"attachment_url"`
+	DurationSeconds *int    `json:"duration_seconds" binding:"omitempty,min=0"`
+	Position        *int    `json:"position" binding:"omitempty,min=1"`
+}
+
+// CourseSearchResult is a course matching a search, with its relevance
+// score and the matching fields as HTML with the matched words in <mark>.
+type CourseSearchResult struct {
+	Course     Course            `json:"course"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights"`
+}
+
+type CourseSearchResponse struct {
+	Query   string               `json:"query"`
+	Results []CourseSearchResult `json:"results"`
+	Total   int                  `json:"total"`
+	Page    int                  `json:"page"`
+	PerPage int                  `json:"per_page"`
 }
 
 type CategoryResponse struct {
@@ -0,0 +1,117 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cuanin/emergent-backend/money"
+)
+
+func TestCanTransition(t *testing.T) {
+	statuses := []string{CourseDraft, CourseInReview, CoursePublished, CourseUnlisted, CourseArchived}
+	// allowed[from] lists the statuses a course may move to, in the order
+	// of statuses
+	allowed := map[string]string{
+		CourseDraft:     ".R...",
+		CourseInReview:  "D.PU.",
+		CoursePublished: ".R.UA",
+		CourseUnlisted:  ".RP.A",
+		CourseArchived:  "..PU.",
+	}
+	for _, from := range statuses {
+		for i, to := range statuses {
+			want := allowed[from][i] != '.'
+			if got := CanTransition(from, to); got != want {
+				t.Errorf("CanTransition(%s, %s) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+
+	for _, tt := range [][2]string{{"", CourseDraft}, {CourseDraft, ""}, {"deleted", CourseDraft}, {CourseInReview, "deleted"}} {
+		if CanTransition(tt[0], tt[1]) {
+			t.Errorf("CanTransition(%q, %q) = true, want false", tt[0], tt[1])
+		}
+	}
+}
+
+func TestIsCourseStatus(t *testing.T) {
+	for _, s := range []string{CourseDraft, CourseInReview, CoursePublished, CourseUnlisted, CourseArchived} {
+		if !IsCourseStatus(s) {
+			t.Errorf("IsCourseStatus(%q) = false", s)
+		}
+	}
+	for _, s := range []string{"", "Published", "deleted"} {
+		if IsCourseStatus(s) {
+			t.Errorf("IsCourseStatus(%q) = true", s)
+		}
+	}
+}
+
+// decodeJSON marshals v and decodes it into a map, so tests can check the
+// type of each field as clients read it.
+func decodeJSON(t *testing.T, v any) map[string]any {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+// checkAmount checks that fields[name] is the plain number want and that
+// fields[moneyName] is the amount with its currency.
+func checkAmount(t *testing.T, fields map[string]any, name string, want float64, moneyName string, wantMoney money.Money) {
+	t.Helper()
+	if got, ok := fields[name].(float64); !ok || got != want {
+		t.Errorf("%s = %#v, want the number %v", name, fields[name], want)
+	}
+	m, _ := fields[moneyName].(map[string]any)
+	if m["amount"] != float64(wantMoney.Amount) || m["currency"] != wantMoney.Currency || m["formatted"] != wantMoney.String() {
+		t.Errorf("%s = %#v, want %v", moneyName, fields[moneyName], wantMoney)
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	rupiah := Course{ID: "1", Title: "Budgeting", Price: money.New(499000, money.IDR), Topics: []string{}}
+	checkAmount(t, decodeJSON(t, rupiah), "price", 499000, "price_money", rupiah.Price)
+	dollars := Course{ID: "2", Title: "Investing", Price: money.New(129999, money.USD), Topics: []string{}}
+	checkAmount(t, decodeJSON(t, dollars), "price", 1299.99, "price_money", dollars.Price)
+
+	detail := decodeJSON(t, CourseDetailResponse{Course: rupiah, Modules: []Module{}})
+	checkAmount(t, detail, "price", 499000, "price_money", rupiah.Price)
+	if detail["title"] != "Budgeting" || detail["modules"] == nil {
+		t.Errorf("course detail = %v, want the course and its modules", detail)
+	}
+
+	payment := Payment{ID: "p", Amount: money.New(199000, money.IDR), Status: PaymentPaid}
+	checkAmount(t, decodeJSON(t, payment), "amount", 199000, "amount_money", payment.Amount)
+
+	dashboard := decodeJSON(t, DashboardResponse{
+		TotalSpent:      money.New(698000, money.IDR).Number(),
+		TotalSpentMoney: []money.Money{money.New(698000, money.IDR)},
+	})
+	if got, ok := dashboard["total_spent"].(float64); !ok || got != 698000 {
+		t.Errorf("total_spent = %#v, want the number 698000", dashboard["total_spent"])
+	}
+
+	// A course sent back as a request keeps its price, whether the client
+	// reads price_money or the plain price, which is rupiah
+	var req struct {
+		Price      money.Money `json:"price"`
+		PriceMoney money.Money `json:"price_money"`
+	}
+	b, err := json.Marshal(rupiah)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Price != rupiah.Price || req.PriceMoney != rupiah.Price {
+		t.Errorf("price read back = %v and %v, want %v", req.Price, req.PriceMoney, rupiah.Price)
+	}
+}
@@ -0,0 +1,239 @@
+// Package money represents amounts of money exactly, as a whole number of
+// the smallest unit a currency is priced in, and formats them the way
+// buyers in each currency expect to read them.
+package money
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Supported currencies, by ISO 4217 code.
+const (
+	IDR = "IDR"
+	USD = "USD"
+)
+
+// DefaultCurrency is the currency of amounts given without one, such as a
+// bare number in JSON from clients written before Money existed.
+const DefaultCurrency = IDR
+
+// ErrUnknownCurrency is returned for a currency that is not supported.
+var ErrUnknownCurrency = errors.New("currency must be " + strings.Join(Currencies(), " or "))
+
+// unit describes how a currency is priced and written.
+type unit struct {
+	// digits is the number of decimal digits amounts are priced in. Rupiah
+	// are priced in whole units, although ISO 4217 allows sen.
+	digits    int
+	symbol    string
+	space     bool // between the symbol and the number
+	thousands string
+	decimal   string
+}
+
+var units = map[string]unit{
+	IDR: {digits: 0, symbol: "Rp", space: true, thousands: ".", decimal: ","},
+	USD: {digits: 2, symbol: "$", thousands: ",", decimal: "."},
+}
+
+// Money is an amount in a currency. Amount counts the smallest unit the
+// currency is priced in: rupiah for IDR and cents for USD.
+type Money struct {
+	Amount   int64  `json:"amount" bson:"amount"`
+	Currency string `json:"currency" bson:"currency"`
+}
+
+// New returns amount units of currency.
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// Currencies returns the codes of the supported currencies in order.
+func Currencies() []string {
+	codes := make([]string, 0, len(units))
+	for code := range units {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	return codes
+}
+
+// Supported reports whether currency is one of the supported currencies.
+func Supported(currency string) bool {
+	_, ok := units[currency]
+	return ok
+}
+
+// Parse reads a decimal number of whole units of currency, such as "49.99"
+// dollars or "499000" rupiah. Digits after the decimal point beyond what
+// the currency is priced in must be zeros, so "499000.00" rupiah is
+// accepted but not "49.99".
+func Parse(s, currency string) (Money, error) {
+	u, ok := units[currency]
+	if !ok {
+		return Money{}, ErrUnknownCurrency
+	}
+	digits, neg := strings.CutPrefix(s, "-")
+	whole, frac, _ := strings.Cut(digits, ".")
+	if whole == "" || !isDigits(whole) || !isDigits(frac) {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	if len(frac) > u.digits {
+		if strings.Trim(frac[u.digits:], "0") != "" {
+			return Money{}, fmt.Errorf("amount %s has more decimals than %s is priced in", s, currency)
+		}
+		frac = frac[:u.digits]
+	}
+	amount, err := strconv.ParseInt(whole+frac+strings.Repeat("0", u.digits-len(frac)), 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	if neg {
+		amount = -amount
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Decimal returns m as a plain decimal number of whole units, such as
+// "49.99" or "499000", for providers and files that take numbers.
+func (m Money) Decimal() string {
+	return m.format(units[m.Currency].digits, "", ".")
+}
+
+// Number returns m as a JSON number of whole units, for responses read by
+// clients written before amounts had a currency.
+func (m Money) Number() json.Number {
+	return json.Number(m.Decimal())
+}
+
+// String formats m for people, such as "Rp 499.000" or "$1,299.99".
+// Amounts in an unsupported currency are written as "123 XYZ".
+func (m Money) String() string {
+	u, ok := units[m.Currency]
+	if !ok {
+		return strconv.FormatInt(m.Amount, 10) + " " + m.Currency
+	}
+	s := m.format(u.digits, u.thousands, u.decimal)
+	sign := ""
+	if m.Amount < 0 {
+		sign, s = "-", s[1:]
+	}
+	if u.space {
+		return sign + u.symbol + " " + s
+	}
+	return sign + u.symbol + s
+}
+
+// format writes the amount with digits decimals, grouping thousands with
+// the given separator.
+func (m Money) format(digits int, thousands, decimal string) string {
+	abs := strconv.FormatUint(absolute(m.Amount), 10)
+	if len(abs) <= digits {
+		abs = strings.Repeat("0", digits-len(abs)+1) + abs
+	}
+	whole, frac := abs[:len(abs)-digits], abs[len(abs)-digits:]
+
+	var b strings.Builder
+	if m.Amount < 0 {
+		b.WriteByte('-')
+	}
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(thousands)
+		}
+		b.WriteRune(r)
+	}
+	if digits > 0 {
+		b.WriteString(decimal)
+		b.WriteString(frac)
+	}
+	return b.String()
+}
+
+func absolute(n int64) uint64 {
+	if n < 0 {
+		return uint64(-(n + 1)) + 1
+	}
+	return uint64(n)
+}
+
+// Sum adds up amounts exactly, giving one total per currency, ordered by
+// currency code. It returns an empty slice when there is nothing to add.
+func Sum(amounts ...Money) []Money {
+	totals := []Money{}
+	for _, m := range amounts {
+		i := slices.IndexFunc(totals, func(t Money) bool { return t.Currency == m.Currency })
+		if i < 0 {
+			totals = append(totals, Money{Currency: m.Currency})
+			i = len(totals) - 1
+		}
+		totals[i].Amount += m.Amount
+	}
+	slices.SortFunc(totals, func(a, b Money) int { return strings.Compare(a.Currency, b.Currency) })
+	return totals
+}
+
+// MarshalJSON writes m as an object with its amount, currency and, for
+// display, its formatted form:
+//
+//	{"amount": 499000, "currency": "IDR", "formatted": "Rp 499.000"}
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount    int64  `json:"amount"`
+		Currency  string `json:"currency"`
+		Formatted string `json:"formatted"`
+	}{m.Amount, m.Currency, m.String()})
+}
+
+// UnmarshalJSON reads an object with an amount and a currency; formatted
+// is ignored. A bare number, which clients sent before amounts had a
+// currency, is read as whole units of DefaultCurrency.
+func (m *Money) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if string(b) == "null" {
+		return nil
+	}
+	if len(b) > 0 && b[0] != '{' {
+		var n json.Number
+		if err := json.Unmarshal(b, &n); err != nil {
+			return errors.New("an amount of money must be an object with amount and currency")
+		}
+		v, err := Parse(n.String(), DefaultCurrency)
+		if err != nil {
+			return err
+		}
+		*m = v
+		return nil
+	}
+
+	var v struct {
+		Amount   *int64 `json:"amount"`
+		Currency string `json:"currency"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return errors.New("an amount of money must have a whole number amount in the currency's smallest unit")
+	}
+	if v.Amount == nil {
+		return errors.New("an amount of money must have an amount")
+	}
+	if !Supported(v.Currency) {
+		return ErrUnknownCurrency
+	}
+	*m = Money{Amount: *v.Amount, Currency: v.Currency}
+	return nil
+}
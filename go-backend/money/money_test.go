@@ -0,0 +1,163 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	for _, tt := range []struct {
+		m    Money
+		want string
+	}{
+		{New(499000, IDR), "Rp 499.000"},
+		{New(1299000, IDR), "Rp 1.299.000"},
+		{New(500, IDR), "Rp 500"},
+		{New(0, IDR), "Rp 0"},
+		{New(-25000, IDR), "-Rp 25.000"},
+		{New(129999, USD), "$1,299.99"},
+		{New(4999, USD), "$49.99"},
+		{New(100, USD), "$1.00"},
+		{New(5, USD), "$0.05"},
+		{New(0, USD), "$0.00"},
+		{New(-129999, USD), "-$1,299.99"},
+		{New(123, "XYZ"), "123 XYZ"},
+	} {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("%#v.String() = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	for _, tt := range []struct {
+		m    Money
+		want string
+	}{
+		{New(499000, IDR), "499000"},
+		{New(129999, USD), "1299.99"},
+		{New(5, USD), "0.05"},
+		{New(-5, USD), "-0.05"},
+		{New(-25000, IDR), "-25000"},
+	} {
+		if got := tt.m.Decimal(); got != tt.want {
+			t.Errorf("%#v.Decimal() = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		s, currency string
+		want        Money
+	}{
+		{"499000", IDR, New(499000, IDR)},
+		{"499000.00", IDR, New(499000, IDR)},
+		{"0", IDR, New(0, IDR)},
+		{"49.99", USD, New(4999, USD)},
+		{"49.9", USD, New(4990, USD)},
+		{"49", USD, New(4900, USD)},
+		{"49.", USD, New(4900, USD)},
+		{"49.990", USD, New(4999, USD)},
+		{"-1.50", USD, New(-150, USD)},
+	} {
+		got, err := Parse(tt.s, tt.currency)
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q, %s) = %v, %v, want %v", tt.s, tt.currency, got, err, tt.want)
+		}
+	}
+
+	// Amounts are never rounded: a fraction of the smallest unit is an
+	// error rather than a rupiah or a cent gained or lost
+	for _, tt := range []struct{ s, currency string }{
+		{"499000.5", IDR},
+		{"0.01", IDR},
+		{"49.999", USD},
+		{"49.991", USD},
+		{"", USD},
+		{".5", USD},
+		{"-", USD},
+		{"1e3", USD},
+		{"1,000", IDR},
+		{"1.000.000", IDR},
+		{" 5", IDR},
+		{"+5", IDR},
+		{"99999999999999999999", IDR},
+	} {
+		if got, err := Parse(tt.s, tt.currency); err == nil {
+			t.Errorf("Parse(%q, %s) = %v, want an error", tt.s, tt.currency, got)
+		}
+	}
+	if _, err := Parse("5", "EUR"); !errors.Is(err, ErrUnknownCurrency) {
+		t.Errorf("Parse in EUR: got %v, want ErrUnknownCurrency", err)
+	}
+}
+
+func TestSum(t *testing.T) {
+	got := Sum(New(499000, IDR), New(4999, USD), New(199000, IDR), New(1, USD), New(-99000, IDR))
+	want := []Money{New(599000, IDR), New(5000, USD)}
+	if !slices.Equal(got, want) {
+		t.Errorf("Sum = %v, want %v", got, want)
+	}
+	if got := Sum(); got == nil || len(got) != 0 {
+		t.Errorf("Sum() = %#v, want an empty slice", got)
+	}
+	if got := Sum(New(5, USD)); !slices.Equal(got, []Money{New(5, USD)}) {
+		t.Errorf("Sum of one amount = %v", got)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	b, err := json.Marshal(New(129999, USD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"amount":129999,"currency":"USD","formatted":"$1,299.99"}`; string(b) != want {
+		t.Errorf("Marshal = %s, want %s", b, want)
+	}
+	var back Money
+	if err := json.Unmarshal(b, &back); err != nil || back != New(129999, USD) {
+		t.Errorf("Unmarshal of %s = %v, %v", b, back, err)
+	}
+
+	for _, tt := range []struct {
+		in   string
+		want Money
+	}{
+		{`{"amount":499000,"currency":"IDR"}`, New(499000, IDR)},
+		{`{"amount":499000,"currency":"IDR","formatted":"ignored"}`, New(499000, IDR)},
+		{`{"amount":0,"currency":"USD"}`, New(0, USD)},
+		// A bare number is rupiah, as clients sent before amounts had a
+		// currency
+		{`499000`, New(499000, IDR)},
+		{` 499000.00 `, New(499000, IDR)},
+	} {
+		var got Money
+		if err := json.Unmarshal([]byte(tt.in), &got); err != nil || got != tt.want {
+			t.Errorf("Unmarshal(%s) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{
+		`{"currency":"IDR"}`,
+		`{"amount":499000}`,
+		`{"amount":499000,"currency":"EUR"}`,
+		`{"amount":49.99,"currency":"USD"}`,
+		`{"amount":"499000","currency":"IDR"}`,
+		`49.99`,
+		`true`,
+	} {
+		var got Money
+		if err := json.Unmarshal([]byte(in), &got); err == nil {
+			t.Errorf("Unmarshal(%s) = %v, want an error", in, got)
+		}
+	}
+
+	// null leaves the amount alone, as for other types
+	m := New(5, USD)
+	if err := json.Unmarshal([]byte(`null`), &m); err != nil || m != New(5, USD) {
+		t.Errorf("Unmarshal(null) = %v, %v, want it unchanged", m, err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cuanin/emergent-backend/oidcauth"
+)
+
+// wellKnownIssuers are the issuer URLs used when OIDC_<NAME>_ISSUER is unset.
+var wellKnownIssuers = map[string]string{
+	"google": "https://accounts.google.com",
+}
+
+// newOIDCProviders returns the social login providers listed in
+// OIDC_PROVIDERS, e.g. "google". Each is configured by OIDC_<NAME>_CLIENT_ID,
+// OIDC_<NAME>_CLIENT_SECRET, OIDC_<NAME>_ISSUER and optionally
+// OIDC_<NAME>_SCOPES. The callback URL registered with the provider must be
+// API_URL/api/auth/oidc/<name>/callback.
+func newOIDCProviders() (map[string]*oidcauth.Provider, error) {
+	apiURL := strings.TrimSuffix(getEnv("API_URL", "http://localhost:8080"), "/")
+	providers := make(map[string]*oidcauth.Provider)
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+
+		cfg := oidcauth.Config{
+			Name:         name,
+			Issuer:       getEnv(prefix+"ISSUER", wellKnownIssuers[name]),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  apiURL + "/api/auth/oidc/" + name + "/callback",
+		}
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			cfg.Scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+		}
+		if cfg.Issuer == "" || cfg.ClientID == "" {
+			return nil, fmt.Errorf("OIDC provider %q needs %sISSUER and %sCLIENT_ID", name, prefix, prefix)
+		}
+		providers[name] = oidcauth.NewProvider(cfg)
+	}
+	return providers, nil
+}
@@ -0,0 +1,134 @@
+// Package oidcauth signs users in with external OpenID Connect providers,
+// such as Google, using the authorization code flow with PKCE.
+package oidcauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Config describes an OpenID Connect provider registered with this app.
+type Config struct {
+	// Name identifies the provider in URLs, e.g. "google".
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is our callback URL, as registered with the provider.
+	RedirectURL string
+	// Scopes are requested in addition to "openid". Defaults to email and
+	// profile.
+	Scopes []string
+}
+
+// Claims are the facts about the user taken from a verified ID token.
+type Claims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Provider runs logins against one issuer. The issuer's discovery document
+// is fetched on first use, and again after a failure, so that an
+// unreachable provider does not keep the server from starting.
+type Provider struct {
+	cfg Config
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewProvider returns a Provider for cfg.
+func NewProvider(cfg Config) *Provider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"email", "profile"}
+	}
+	return &Provider{cfg: cfg}
+}
+
+// Name returns the provider's name.
+func (p *Provider) Name() string {
+	return p.cfg.Name
+}
+
+func (p *Provider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.oauth == nil {
+		provider, err := oidc.NewProvider(ctx, p.cfg.Issuer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("discover %s: %w", p.cfg.Issuer, err)
+		}
+		p.oauth = &oauth2.Config{
+			ClientID:     p.cfg.ClientID,
+			ClientSecret: p.cfg.ClientSecret,
+			RedirectURL:  p.cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, p.cfg.Scopes...),
+		}
+		p.verifier = provider.Verifier(&oidc.Config{ClientID: p.cfg.ClientID})
+	}
+	return p.oauth, p.verifier, nil
+}
+
+// NewVerifier returns a random PKCE code verifier.
+func NewVerifier() string {
+	return oauth2.GenerateVerifier()
+}
+
+// AuthCodeURL returns the provider URL that starts a login. The state,
+// PKCE verifier and nonce must be kept until the callback.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, verifier, nonce string) (string, error) {
+	conf, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return conf.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce)), nil
+}
+
+// Exchange redeems the authorization code from the callback and returns the
+// claims of the verified ID token. The token must carry nonce.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (Claims, error) {
+	conf, idVerifier, err := p.discover(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+	token, err := conf.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return Claims{}, fmt.Errorf("exchange code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return Claims{}, errors.New("token response has no id_token")
+	}
+	idToken, err := idVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return Claims{}, fmt.Errorf("verify id_token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return Claims{}, errors.New("id_token nonce mismatch")
+	}
+
+	var raw struct {
+		Email         string `json:"email"`
+		EmailVerified any    `json:"email_verified"` // some providers send a string
+		Name          string `json:"name"`
+	}
+	if err := idToken.Claims(&raw); err != nil {
+		return Claims{}, err
+	}
+	return Claims{
+		Subject:       idToken.Subject,
+		Email:         raw.Email,
+		EmailVerified: raw.EmailVerified == true || raw.EmailVerified == "true",
+		Name:          raw.Name,
+	}, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cuanin/emergent-backend/gateway"
+)
+
+// newPaymentProvider returns the payment gateway selected by the
+// PAYMENT_PROVIDER environment variable: "midtrans", or "simulator" (the
+// default), which settles payments only when asked to and so is refused
+// when APP_ENV=production.
+func newPaymentProvider() (gateway.Provider, error) {
+	switch kind := os.Getenv("PAYMENT_PROVIDER"); kind {
+	case "", "simulator":
+		if os.Getenv("APP_ENV") == "production" {
+			return nil, errors.New("PAYMENT_PROVIDER=simulator cannot be used in production")
+		}
+		sim := gateway.NewSimulator()
+		sim.WebhookSecret = os.Getenv("SIMULATOR_WEBHOOK_SECRET")
+		return sim, nil
+	case "midtrans":
+		key := os.Getenv("MIDTRANS_SERVER_KEY")
+		if key == "" {
+			return nil, errors.New("MIDTRANS_SERVER_KEY is required for PAYMENT_PROVIDER=midtrans")
+		}
+		return &gateway.Midtrans{
+			ServerKey: key,
+			BaseURL:   getEnv("MIDTRANS_API_URL", gateway.MidtransSandbox),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", kind)
+	}
+}
@@ -0,0 +1,27 @@
+// Package randtoken creates the opaque random tokens handed out in links and
+// sessions, such as refresh tokens and password reset links, and hashes them
+// for storage, so that the stored value cannot be used as the token.
+package randtoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// New returns a URL-safe random string with 256 bits of entropy.
+func New() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hash returns the hex SHA-256 of a token, which is what the server stores
+// instead of the token itself.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
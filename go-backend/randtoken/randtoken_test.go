@@ -0,0 +1,31 @@
+package randtoken
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	seen := map[string]bool{}
+	for range 100 {
+		token, err := New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil || len(b) != 32 {
+			t.Fatalf("token %q decodes to %d bytes, %v, want 32", token, len(b), err)
+		}
+		if seen[token] {
+			t.Fatalf("token %q repeated", token)
+		}
+		seen[token] = true
+	}
+}
+
+func TestHash(t *testing.T) {
+	// The SHA-256 of "abc" from FIPS 180-2
+	if got, want := Hash("abc"), "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; got != want {
+		t.Errorf("Hash(abc) = %s, want %s", got, want)
+	}
+}
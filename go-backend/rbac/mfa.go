@@ -0,0 +1,40 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/cuanin/emergent-backend/repository"
+)
+
+// MFARequiredRolesSetting is the settings key holding the JSON array of roles
+// whose members must enable two-factor authentication.
+const MFARequiredRolesSetting = "mfa_required_roles"
+
+// MFARequiredRoles returns the roles that must use two-factor
+// authentication. None are required until an admin configures them.
+func MFARequiredRoles(ctx context.Context, settings repository.SettingsRepository) ([]string, error) {
+	raw, err := settings.GetSetting(ctx, MFARequiredRolesSetting)
+	if errors.Is(err, repository.ErrNotFound) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	roles := []string{}
+	if err := json.Unmarshal([]byte(raw), &roles); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// RequiresMFA reports whether role is one of the required roles.
+func RequiresMFA(required []string, role string) bool {
+	for _, r := range required {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+// Package rbac maps user roles to the permissions they are granted.
+package rbac
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+// Permissions checked by the API routes
+const (
+	CreateCourse    = "courses:create"
+	EditCourse      = "courses:edit"
+	DeleteCourse    = "courses:delete"
+	SubmitCourse    = "courses:submit"
+	PublishCourse   = "courses:publish"
+	EditCurriculum  = "curriculum:edit"
+	ManageAnyCourse = "courses:manage_any"
+	ManageSettings  = "settings:manage"
+	ReadAuditLog    = "audit:read"
+	ManageUsers     = "users:manage"
+	ManageCoupons   = "coupons:manage"
+)
+
+// Policy maps each permission to the roles that are granted it.
+type Policy map[string][]string
+
+// DefaultPolicy returns the permissions used when no policy file is configured.
+func DefaultPolicy() Policy {
+	return Policy{
+		CreateCourse:    {models.RoleAdmin},
+		EditCourse:      {models.RoleAdmin},
+		DeleteCourse:    {models.RoleAdmin},
+		SubmitCourse:    {models.RoleAdmin, models.RoleMentor},
+		PublishCourse:   {models.RoleAdmin},
+		EditCurriculum:  {models.RoleAdmin, models.RoleMentor},
+		ManageAnyCourse: {models.RoleAdmin},
+		ManageSettings:  {models.RoleAdmin},
+		ReadAuditLog:    {models.RoleAdmin},
+		ManageUsers:     {models.RoleAdmin},
+		ManageCoupons:   {models.RoleAdmin},
+	}
+}
+
+// LoadPolicy reads a policy from a JSON file of the form
+//
+//	{"courses:create": ["admin", "mentor"]}
+//
+// Permissions missing from the file keep their default roles.
+func LoadPolicy(path string) (Policy, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var overrides Policy
+	if err := json.Unmarshal(raw, &overrides); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	policy := DefaultPolicy()
+	for permission, roles := range overrides {
+		policy[permission] = roles
+	}
+	return policy, nil
+}
+
+// Allows reports whether role has been granted permission.
+func (p Policy) Allows(role, permission string) bool {
+	for _, r := range p[permission] {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
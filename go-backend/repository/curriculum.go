@@ -0,0 +1,179 @@
+package repository
+
+import (
+	"slices"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/google/uuid"
+)
+
+// outline is the curriculum of one course. Every backend loads it whole,
+// edits it in Go and stores the result, so that positions are handled the
+// same way everywhere; a course has few enough lessons for that to be
+// cheap.
+type outline []models.Module
+
+// cloneModule returns a copy of m that shares no lessons with it.
+func cloneModule(m models.Module) models.Module {
+	m.Lessons = append([]models.Lesson{}, m.Lessons...)
+	return m
+}
+
+func (o outline) clone() outline {
+	c := make(outline, len(o))
+	for i, m := range o {
+		c[i] = cloneModule(m)
+	}
+	return c
+}
+
+// findModule returns the index of the module with the given ID, or -1.
+func (o outline) findModule(id string) int {
+	return slices.IndexFunc(o, func(m models.Module) bool { return m.ID == id })
+}
+
+// findLesson returns the indexes of the module holding the lesson with the
+// given ID and of the lesson in it, or -1, -1.
+func (o outline) findLesson(id string) (int, int) {
+	for i, m := range o {
+		if j := slices.IndexFunc(m.Lessons, func(l models.Lesson) bool { return l.ID == id }); j >= 0 {
+			return i, j
+		}
+	}
+	return -1, -1
+}
+
+// normalize numbers the modules and the lessons of each module from 1 in
+// their current order, points each lesson at its module and adds up the
+// module durations.
+func (o outline) normalize() {
+	for i := range o {
+		m := &o[i]
+		m.Position = i + 1
+		m.DurationSeconds = 0
+		if m.Lessons == nil {
+			m.Lessons = []models.Lesson{}
+		}
+		for j := range m.Lessons {
+			l := &m.Lessons[j]
+			l.Position = j + 1
+			l.ModuleID = m.ID
+			l.CourseID = m.CourseID
+			m.DurationSeconds += l.DurationSeconds
+		}
+	}
+}
+
+// totals returns the number of lessons in the outline and their total
+// duration.
+func (o outline) totals() (lessons, seconds int) {
+	for _, m := range o {
+		lessons += len(m.Lessons)
+		seconds += m.DurationSeconds
+	}
+	return lessons, seconds
+}
+
+// courseDuration returns the Duration of a course whose outline was edited
+// from before to after, or false if the edit leaves it alone. A course
+// without lessons keeps the duration it was given; once it has lessons, its
+// duration is theirs.
+func courseDuration(before, after outline) (string, bool) {
+	lessons, seconds := after.totals()
+	if had, _ := before.totals(); lessons == 0 && had == 0 {
+		return "", false
+	}
+	return models.FormatDuration(seconds), true
+}
+
+// insertAt inserts item at a 1-based position, or at the end if position
+// is zero or past it.
+func insertAt[T any](items []T, item T, position int) []T {
+	i := position - 1
+	if i < 0 || i > len(items) {
+		i = len(items)
+	}
+	return slices.Insert(items, i, item)
+}
+
+// The edits below leave o unchanged and return the edited copy. The module
+// or lesson passed in is updated to how it was stored.
+
+func (o outline) addModule(module *models.Module) outline {
+	if module.ID == "" {
+		module.ID = uuid.New().String()
+	}
+	module.Lessons = nil
+	o = insertAt(o.clone(), *module, module.Position)
+	o.normalize()
+	*module = cloneModule(o[o.findModule(module.ID)])
+	return o
+}
+
+func (o outline) updateModule(module *models.Module) (outline, error) {
+	i := o.findModule(module.ID)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	o = o.clone()
+	m := o[i]
+	m.Title = module.Title
+	o = insertAt(slices.Delete(o, i, i+1), m, module.Position)
+	o.normalize()
+	*module = cloneModule(o[o.findModule(m.ID)])
+	return o, nil
+}
+
+func (o outline) deleteModule(id string) (outline, error) {
+	i := o.findModule(id)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	o = slices.Delete(o.clone(), i, i+1)
+	o.normalize()
+	return o, nil
+}
+
+func (o outline) addLesson(lesson *models.Lesson) (outline, error) {
+	i := o.findModule(lesson.ModuleID)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	if lesson.ID == "" {
+		lesson.ID = uuid.New().String()
+	}
+	o = o.clone()
+	o[i].Lessons = insertAt(o[i].Lessons, *lesson, lesson.Position)
+	o.normalize()
+	_, j := o.findLesson(lesson.ID)
+	*lesson = o[i].Lessons[j]
+	return o, nil
+}
+
+func (o outline) updateLesson(lesson *models.Lesson) (outline, error) {
+	from, j := o.findLesson(lesson.ID)
+	to := o.findModule(lesson.ModuleID)
+	if from < 0 || to < 0 {
+		return nil, ErrNotFound
+	}
+	o = o.clone()
+	updated := *lesson
+	updated.CreatedAt = o[from].Lessons[j].CreatedAt
+	o[from].Lessons = slices.Delete(o[from].Lessons, j, j+1)
+	o[to].Lessons = insertAt(o[to].Lessons, updated, lesson.Position)
+	o.normalize()
+	_, j = o.findLesson(lesson.ID)
+	*lesson = o[to].Lessons[j]
+	return o, nil
+}
+
+func (o outline) deleteLesson(id string) (outline, error) {
+	i, j := o.findLesson(id)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	o = o.clone()
+	o[i].Lessons = slices.Delete(o[i].Lessons, j, j+1)
+	o.normalize()
+	return o, nil
+}
@@ -0,0 +1,573 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cuanin/emergent-backend/data"
+	"github.com/cuanin/emergent-backend/models"
+)
+
+// memoryDB holds the records of the in-memory backend. A single lock guards
+// all collections so that changes spanning several of them are atomic.
+type memoryDB struct {
+	mu       sync.RWMutex
+	users    []models.User
+	courses  []models.Course
+	payments []models.Payment
+
+	curricula     map[string]outline // course ID -> modules
+	statusChanges []models.CourseStatusChange
+
+	refreshTokens map[string]models.RefreshToken
+	revokedTokens map[string]time.Time // jti -> access token expiry
+	actionTokens  map[string]models.ActionToken
+
+	throttles map[string]models.LoginThrottle
+	lockouts  []models.LockoutEvent
+
+	recoveryCodes map[string][]string // user ID -> code hashes
+	settings      map[string]string
+
+	identities []models.Identity
+	oidcStates map[string]models.OIDCState
+
+	logins         []models.LoginEvent
+	audit          []models.AuditEvent
+	exports        []models.DataExport
+	exportArchives map[string][]byte // export ID -> archive
+
+	idempotency map[string]models.IdempotencyRecord // by idempotencyID
+
+	coupons     []models.Coupon
+	redemptions []couponRedemption
+}
+
+// NewMemoryStore returns a Store that keeps everything in process memory,
+// seeded with a copy of the dummy data from the data package. It is safe for
+// concurrent use.
+func NewMemoryStore() Store {
+	db := &memoryDB{
+		refreshTokens: make(map[string]models.RefreshToken),
+		revokedTokens: make(map[string]time.Time),
+		actionTokens:  make(map[string]models.ActionToken),
+		throttles:     make(map[string]models.LoginThrottle),
+		recoveryCodes: make(map[string][]string),
+		settings:      make(map[string]string),
+		oidcStates:    make(map[string]models.OIDCState),
+		curricula:     make(map[string]outline),
+
+		exportArchives: make(map[string][]byte),
+		idempotency:    make(map[string]models.IdempotencyRecord),
+	}
+	for _, u := range data.Users {
+		db.users = append(db.users, cloneUser(u))
+	}
+	for _, c := range data.Courses {
+		db.courses = append(db.courses, cloneCourse(c))
+	}
+	db.payments = append(db.payments, data.Payments...)
+
+	return Store{
+		Users:       &memoryUsers{db},
+		Courses:     &memoryCourses{db},
+		Curriculum:  &memoryCurriculum{db},
+		Payments:    &memoryPayments{db},
+		Tokens:      &memoryTokens{db},
+		Throttles:   &memoryThrottles{db},
+		Settings:    &memorySettings{db},
+		Activity:    &memoryActivity{db},
+		Exports:     &memoryExports{db},
+		Idempotency: &memoryIdempotency{db},
+		Coupons:     &memoryCoupons{db},
+	}
+}
+
+// cloneUser returns a deep copy of u so callers cannot mutate stored state.
+func cloneUser(u models.User) models.User {
+	u.EnrolledCourses = append([]string{}, u.EnrolledCourses...)
+	u.Badges = append([]string{}, u.Badges...)
+	progress := make(map[string]int, len(u.Progress))
+	for k, v := range u.Progress {
+		progress[k] = v
+	}
+	u.Progress = progress
+	if u.LastLogin != nil {
+		t := *u.LastLogin
+		u.LastLogin = &t
+	}
+	if u.SuspendedAt != nil {
+		t := *u.SuspendedAt
+		u.SuspendedAt = &t
+	}
+	if u.DeletedAt != nil {
+		t := *u.DeletedAt
+		u.DeletedAt = &t
+	}
+	if u.SessionsEndedAt != nil {
+		t := *u.SessionsEndedAt
+		u.SessionsEndedAt = &t
+	}
+	return u
+}
+
+// cloneCourse returns a deep copy of c so callers cannot mutate stored state.
+func cloneCourse(c models.Course) models.Course {
+	c.Topics = append([]string{}, c.Topics...)
+	if c.ArchivedAt != nil {
+		t := *c.ArchivedAt
+		c.ArchivedAt = &t
+	}
+	return c
+}
+
+// findUser returns the index of the user with the given ID, or -1. The
+// caller must hold db.mu.
+func (db *memoryDB) findUser(id string) int {
+	for i := range db.users {
+		if db.users[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// findCourse returns the index of the course with the given ID, or -1. The
+// caller must hold db.mu.
+func (db *memoryDB) findCourse(id string) int {
+	for i := range db.courses {
+		if db.courses[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// enroll adds courseID to the user's enrolled courses. The caller must hold
+// db.mu for writing.
+func (db *memoryDB) enroll(userID, courseID string) error {
+	i := db.findUser(userID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	user := &db.users[i]
+	for _, id := range user.EnrolledCourses {
+		if id == courseID {
+			return ErrAlreadyEnrolled
+		}
+	}
+	user.EnrolledCourses = append(user.EnrolledCourses, courseID)
+	if user.Progress == nil {
+		user.Progress = make(map[string]int)
+	}
+	user.Progress[courseID] = 0
+	return nil
+}
+
+// unenroll reverts enroll, reporting whether the user was enrolled. The
+// caller must hold db.mu.
+func (db *memoryDB) unenroll(userID, courseID string) bool {
+	i := db.findUser(userID)
+	if i < 0 {
+		return false
+	}
+	user := &db.users[i]
+	n := len(user.EnrolledCourses)
+	user.EnrolledCourses = slices.DeleteFunc(user.EnrolledCourses, func(id string) bool { return id == courseID })
+	delete(user.Progress, courseID)
+	return len(user.EnrolledCourses) < n
+}
+
+type memoryUsers struct{ db *memoryDB }
+
+func (r *memoryUsers) GetByID(_ context.Context, id string) (models.User, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	i := r.db.findUser(id)
+	if i < 0 {
+		return models.User{}, ErrNotFound
+	}
+	return cloneUser(r.db.users[i]), nil
+}
+
+func (r *memoryUsers) GetByEmail(_ context.Context, email string) (models.User, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	for _, u := range r.db.users {
+		if u.Email == email {
+			return cloneUser(u), nil
+		}
+	}
+	return models.User{}, ErrNotFound
+}
+
+func (r *memoryUsers) Create(_ context.Context, user models.User) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	for _, u := range r.db.users {
+		if u.Email == user.Email {
+			return ErrDuplicateEmail
+		}
+	}
+	r.db.users = append(r.db.users, cloneUser(user))
+	return nil
+}
+
+func (r *memoryUsers) Update(_ context.Context, user models.User) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findUser(user.ID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	for _, u := range r.db.users {
+		if u.Email == user.Email && u.ID != user.ID {
+			return ErrDuplicateEmail
+		}
+	}
+	stored := &r.db.users[i]
+	updated := cloneUser(user)
+	updated.EnrolledCourses = stored.EnrolledCourses
+	updated.Progress = stored.Progress
+	updated.TOTPLastStep = stored.TOTPLastStep
+	updated.DeletedAt = stored.DeletedAt
+	updated.SuspendedAt = stored.SuspendedAt
+	updated.SuspendedReason = stored.SuspendedReason
+	updated.SessionsEndedAt = stored.SessionsEndedAt
+	*stored = updated
+	return nil
+}
+
+func (r *memoryUsers) Search(_ context.Context, filter UserFilter) ([]models.User, int, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	var matches []models.User
+	for _, u := range r.db.users {
+		if filter.matches(u) {
+			matches = append(matches, u)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if !matches[i].CreatedAt.Equal(matches[j].CreatedAt) {
+			return matches[i].CreatedAt.After(matches[j].CreatedAt)
+		}
+		return matches[i].ID < matches[j].ID
+	})
+
+	users := []models.User{}
+	for i := max(filter.Offset, 0); i < len(matches) && len(users) < filter.Limit; i++ {
+		users = append(users, cloneUser(matches[i]))
+	}
+	return users, len(matches), nil
+}
+
+func (r *memoryUsers) SetSuspension(_ context.Context, id string, at *time.Time, reason string) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findUser(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	if at != nil {
+		t := *at
+		at = &t
+	}
+	r.db.users[i].SuspendedAt = at
+	r.db.users[i].SuspendedReason = reason
+	return nil
+}
+
+func (r *memoryUsers) UpdateLastLogin(_ context.Context, id string, at time.Time) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findUser(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	r.db.users[i].LastLogin = &at
+	return nil
+}
+
+func (r *memoryUsers) EndSessions(_ context.Context, id string, at time.Time) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findUser(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	r.db.users[i].SessionsEndedAt = &at
+	return nil
+}
+
+func (r *memoryUsers) Anonymize(_ context.Context, id string, at time.Time) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findUser(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	r.db.users[i] = anonymized(r.db.users[i], at)
+	delete(r.db.recoveryCodes, id)
+	identities := r.db.identities[:0]
+	for _, identity := range r.db.identities {
+		if identity.UserID != id {
+			identities = append(identities, identity)
+		}
+	}
+	r.db.identities = identities
+	logins := r.db.logins[:0]
+	for _, event := range r.db.logins {
+		if event.UserID != id {
+			logins = append(logins, event)
+		}
+	}
+	r.db.logins = logins
+	exports := r.db.exports[:0]
+	for _, export := range r.db.exports {
+		if export.UserID == id {
+			delete(r.db.exportArchives, export.ID)
+		} else {
+			exports = append(exports, export)
+		}
+	}
+	r.db.exports = exports
+	for tokenID, token := range r.db.actionTokens {
+		if token.UserID == id {
+			delete(r.db.actionTokens, tokenID)
+		}
+	}
+	return nil
+}
+
+func (r *memoryUsers) Enroll(_ context.Context, userID, courseID string) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	return r.db.enroll(userID, courseID)
+}
+
+type memoryCourses struct{ db *memoryDB }
+
+func (r *memoryCourses) List(_ context.Context) ([]models.Course, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	courses := make([]models.Course, 0, len(r.db.courses))
+	for _, c := range r.db.courses {
+		courses = append(courses, cloneCourse(c))
+	}
+	return courses, nil
+}
+
+func (r *memoryCourses) Search(_ context.Context, filter CourseFilter) ([]models.Course, int, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	var matches []models.Course
+	for _, c := range r.db.courses {
+		if filter.matches(c) {
+			matches = append(matches, c)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return filter.less(matches[i], matches[j]) })
+
+	courses := []models.Course{}
+	for i := max(filter.Offset, 0); i < len(matches) && len(courses) < filter.Limit; i++ {
+		courses = append(courses, cloneCourse(matches[i]))
+	}
+	return courses, len(matches), nil
+}
+
+func (r *memoryCourses) GetByID(_ context.Context, id string) (models.Course, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	i := r.db.findCourse(id)
+	if i < 0 {
+		return models.Course{}, ErrNotFound
+	}
+	return cloneCourse(r.db.courses[i]), nil
+}
+
+func (r *memoryCourses) Create(_ context.Context, course *models.Course) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	if course.ID == "" {
+		// Deleted courses leave gaps, so the next free number is used
+		n := len(r.db.courses) + 1
+		for r.db.findCourse(strconv.Itoa(n)) >= 0 {
+			n++
+		}
+		course.ID = strconv.Itoa(n)
+	}
+	r.db.courses = append(r.db.courses, cloneCourse(*course))
+	return nil
+}
+
+func (r *memoryCourses) Update(_ context.Context, course models.Course) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findCourse(course.ID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	stored := r.db.courses[i]
+	course.CreatedAt = stored.CreatedAt
+	course.EnrolledCount = stored.EnrolledCount
+	course.Rating = stored.Rating
+	course.RatingCount = stored.RatingCount
+	course.Status = stored.Status
+	course.ArchivedAt = stored.ArchivedAt
+	course.LessonCount = stored.LessonCount
+	course.DurationSeconds = stored.DurationSeconds
+	if stored.LessonCount > 0 {
+		course.Duration = stored.Duration
+	}
+	r.db.courses[i] = cloneCourse(course)
+	return nil
+}
+
+func (r *memoryCourses) Delete(_ context.Context, id, userID string, at time.Time) (bool, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findCourse(id)
+	if i < 0 {
+		return false, ErrNotFound
+	}
+	if !r.db.courseSold(id) {
+		r.db.courses = append(r.db.courses[:i], r.db.courses[i+1:]...)
+		delete(r.db.curricula, id)
+		r.db.statusChanges = slices.DeleteFunc(r.db.statusChanges, func(c models.CourseStatusChange) bool { return c.CourseID == id })
+		return false, nil
+	}
+	if from := r.db.courses[i].Status; from != models.CourseArchived {
+		r.db.setStatus(i, models.CourseStatusChange{CourseID: id, From: from, To: models.CourseArchived, ChangedBy: userID, ChangedAt: at})
+	}
+	return true, nil
+}
+
+// courseSold reports whether anyone has enrolled in or paid for the course.
+// The caller must hold db.mu.
+func (db *memoryDB) courseSold(id string) bool {
+	for _, u := range db.users {
+		for _, c := range u.EnrolledCourses {
+			if c == id {
+				return true
+			}
+		}
+	}
+	for _, p := range db.payments {
+		if p.CourseID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *memoryCourses) IncrementEnrolled(_ context.Context, id string) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findCourse(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	r.db.courses[i].EnrolledCount++
+	return nil
+}
+
+type memoryPayments struct{ db *memoryDB }
+
+func (r *memoryPayments) Create(_ context.Context, payment models.Payment) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	if payment.Status == models.PaymentPending && slices.ContainsFunc(r.db.payments, func(p models.Payment) bool {
+		return p.UserID == payment.UserID && p.CourseID == payment.CourseID && p.Status == models.PaymentPending
+	}) {
+		return ErrPaymentPending
+	}
+	r.db.payments = append(r.db.payments, payment)
+	return nil
+}
+
+func (r *memoryPayments) GetByID(_ context.Context, id string) (models.Payment, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	for _, p := range r.db.payments {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return models.Payment{}, ErrNotFound
+}
+
+func (r *memoryPayments) SetStatus(_ context.Context, id, from, to string, at time.Time) (models.Payment, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := slices.IndexFunc(r.db.payments, func(p models.Payment) bool { return p.ID == id })
+	if i < 0 {
+		return models.Payment{}, ErrNotFound
+	}
+	payment := &r.db.payments[i]
+	if payment.Status != from {
+		return *payment, ErrStatusConflict
+	}
+	switch to {
+	case models.PaymentPaid:
+		err := r.db.enroll(payment.UserID, payment.CourseID)
+		if err == nil {
+			if j := r.db.findCourse(payment.CourseID); j >= 0 {
+				r.db.courses[j].EnrolledCount++
+			}
+		} else if !errors.Is(err, ErrAlreadyEnrolled) {
+			return models.Payment{}, err
+		}
+	case models.PaymentRefunded:
+		paidAgain := slices.ContainsFunc(r.db.payments, func(p models.Payment) bool {
+			return p.ID != id && p.UserID == payment.UserID && p.CourseID == payment.CourseID && p.Status == models.PaymentPaid
+		})
+		if !paidAgain && r.db.unenroll(payment.UserID, payment.CourseID) {
+			if j := r.db.findCourse(payment.CourseID); j >= 0 && r.db.courses[j].EnrolledCount > 0 {
+				r.db.courses[j].EnrolledCount--
+			}
+		}
+	}
+	payment.Status = to
+	if payment.SettledAt == nil {
+		payment.SettledAt = &at
+	}
+	return *payment, nil
+}
+
+func (r *memoryPayments) ListByUser(_ context.Context, userID string) ([]models.Payment, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	payments := []models.Payment{}
+	for _, p := range r.db.payments {
+		if p.UserID == userID {
+			payments = append(payments, p)
+		}
+	}
+	return payments, nil
+}
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+type memoryActivity struct{ db *memoryDB }
+
+func (r *memoryActivity) RecordLogin(_ context.Context, event models.LoginEvent) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	r.db.logins = append(r.db.logins, event)
+	return nil
+}
+
+func (r *memoryActivity) ListLogins(_ context.Context, userID string) ([]models.LoginEvent, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	events := []models.LoginEvent{}
+	for i := len(r.db.logins) - 1; i >= 0; i-- {
+		if r.db.logins[i].UserID == userID {
+			events = append(events, r.db.logins[i])
+		}
+	}
+	return events, nil
+}
+
+func (r *memoryActivity) RecordAudit(_ context.Context, event models.AuditEvent) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	r.db.audit = append(r.db.audit, event)
+	return nil
+}
+
+func (r *memoryActivity) ListAudit(_ context.Context, userID string, limit int) ([]models.AuditEvent, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	events := []models.AuditEvent{}
+	for i := len(r.db.audit) - 1; i >= 0 && len(events) < limit; i-- {
+		if userID == "" || r.db.audit[i].UserID == userID {
+			events = append(events, r.db.audit[i])
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,174 @@
+package repository
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+// couponRedemption is a purchase made with a coupon.
+type couponRedemption struct {
+	paymentID string
+	couponID  string
+	userID    string
+}
+
+type memoryCoupons struct{ db *memoryDB }
+
+// cloneCoupon returns a deep copy of cp so callers cannot mutate stored
+// state.
+func cloneCoupon(cp models.Coupon) models.Coupon {
+	cp.CourseIDs = append([]string{}, cp.CourseIDs...)
+	cp.Categories = append([]string{}, cp.Categories...)
+	if cp.AmountOff != nil {
+		m := *cp.AmountOff
+		cp.AmountOff = &m
+	}
+	if cp.MinSpend != nil {
+		m := *cp.MinSpend
+		cp.MinSpend = &m
+	}
+	if cp.ExpiresAt != nil {
+		t := *cp.ExpiresAt
+		cp.ExpiresAt = &t
+	}
+	return cp
+}
+
+// findCoupon returns the index of the coupon with the given ID, or -1. The
+// caller must hold db.mu.
+func (db *memoryDB) findCoupon(id string) int {
+	return slices.IndexFunc(db.coupons, func(cp models.Coupon) bool { return cp.ID == id })
+}
+
+func (r *memoryCoupons) Create(_ context.Context, coupon models.Coupon) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	if slices.ContainsFunc(r.db.coupons, func(cp models.Coupon) bool { return strings.EqualFold(cp.Code, coupon.Code) }) {
+		return ErrDuplicateCouponCode
+	}
+	r.db.coupons = append(r.db.coupons, cloneCoupon(coupon))
+	return nil
+}
+
+func (r *memoryCoupons) GetByID(_ context.Context, id string) (models.Coupon, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	i := r.db.findCoupon(id)
+	if i < 0 {
+		return models.Coupon{}, ErrNotFound
+	}
+	return cloneCoupon(r.db.coupons[i]), nil
+}
+
+func (r *memoryCoupons) GetByCode(_ context.Context, code string) (models.Coupon, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	i := slices.IndexFunc(r.db.coupons, func(cp models.Coupon) bool { return strings.EqualFold(cp.Code, code) })
+	if i < 0 {
+		return models.Coupon{}, ErrNotFound
+	}
+	return cloneCoupon(r.db.coupons[i]), nil
+}
+
+func (r *memoryCoupons) List(_ context.Context) ([]models.Coupon, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	coupons := make([]models.Coupon, 0, len(r.db.coupons))
+	for i := len(r.db.coupons) - 1; i >= 0; i-- {
+		coupons = append(coupons, cloneCoupon(r.db.coupons[i]))
+	}
+	return coupons, nil
+}
+
+func (r *memoryCoupons) Update(_ context.Context, coupon models.Coupon) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findCoupon(coupon.ID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	if slices.ContainsFunc(r.db.coupons, func(cp models.Coupon) bool { return cp.ID != coupon.ID && strings.EqualFold(cp.Code, coupon.Code) }) {
+		return ErrDuplicateCouponCode
+	}
+	coupon = cloneCoupon(coupon)
+	coupon.Redemptions = r.db.coupons[i].Redemptions
+	coupon.CreatedAt = r.db.coupons[i].CreatedAt
+	r.db.coupons[i] = coupon
+	return nil
+}
+
+func (r *memoryCoupons) Delete(_ context.Context, id string) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findCoupon(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	r.db.coupons = slices.Delete(r.db.coupons, i, i+1)
+	r.db.redemptions = slices.DeleteFunc(r.db.redemptions, func(rd couponRedemption) bool { return rd.couponID == id })
+	return nil
+}
+
+func (r *memoryCoupons) CountRedemptions(_ context.Context, couponID, userID string) (int, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	return r.db.countRedemptions(couponID, userID), nil
+}
+
+// countRedemptions counts the user's redemptions of a coupon. The caller
+// must hold db.mu.
+func (db *memoryDB) countRedemptions(couponID, userID string) int {
+	n := 0
+	for _, rd := range db.redemptions {
+		if rd.couponID == couponID && rd.userID == userID {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *memoryCoupons) Redeem(_ context.Context, couponID, userID, paymentID string, _ time.Time) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findCoupon(couponID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	coupon := &r.db.coupons[i]
+	if coupon.MaxRedemptions > 0 && coupon.Redemptions >= coupon.MaxRedemptions {
+		return ErrCouponExhausted
+	}
+	if coupon.PerUserLimit > 0 && r.db.countRedemptions(couponID, userID) >= coupon.PerUserLimit {
+		return ErrCouponUserLimit
+	}
+	coupon.Redemptions++
+	r.db.redemptions = append(r.db.redemptions, couponRedemption{paymentID: paymentID, couponID: couponID, userID: userID})
+	return nil
+}
+
+func (r *memoryCoupons) Release(_ context.Context, paymentID string) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	j := slices.IndexFunc(r.db.redemptions, func(rd couponRedemption) bool { return rd.paymentID == paymentID })
+	if j < 0 {
+		return nil
+	}
+	if i := r.db.findCoupon(r.db.redemptions[j].couponID); i >= 0 {
+		r.db.coupons[i].Redemptions--
+	}
+	r.db.redemptions = slices.Delete(r.db.redemptions, j, j+1)
+	return nil
+}
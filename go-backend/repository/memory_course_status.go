@@ -0,0 +1,55 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/google/uuid"
+)
+
+// setStatus moves the course at index i to change.To and records the change.
+// The caller must hold db.mu.
+func (db *memoryDB) setStatus(i int, change models.CourseStatusChange) {
+	if change.ID == "" {
+		change.ID = uuid.New().String()
+	}
+	course := &db.courses[i]
+	course.Status = change.To
+	course.ArchivedAt = nil
+	if change.To == models.CourseArchived {
+		at := change.ChangedAt
+		course.ArchivedAt = &at
+	}
+	db.statusChanges = append(db.statusChanges, change)
+}
+
+func (r *memoryCourses) SetStatus(_ context.Context, change models.CourseStatusChange) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findCourse(change.CourseID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	if r.db.courses[i].Status != change.From {
+		return ErrStatusConflict
+	}
+	r.db.setStatus(i, change)
+	return nil
+}
+
+func (r *memoryCourses) ListStatusChanges(_ context.Context, courseID string) ([]models.CourseStatusChange, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	if r.db.findCourse(courseID) < 0 {
+		return nil, ErrNotFound
+	}
+	changes := []models.CourseStatusChange{}
+	for _, c := range r.db.statusChanges {
+		if c.CourseID == courseID {
+			changes = append(changes, c)
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+type memoryCurriculum struct{ db *memoryDB }
+
+// edit applies fn to the outline of the course and stores the result,
+// updating the course's lesson totals.
+func (r *memoryCurriculum) edit(courseID string, fn func(outline) (outline, error)) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findCourse(courseID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	before := r.db.curricula[courseID]
+	after, err := fn(before)
+	if err != nil {
+		return err
+	}
+	r.db.curricula[courseID] = after
+
+	course := &r.db.courses[i]
+	course.LessonCount, course.DurationSeconds = after.totals()
+	if duration, ok := courseDuration(before, after); ok {
+		course.Duration = duration
+	}
+	return nil
+}
+
+func (r *memoryCurriculum) Outline(_ context.Context, courseID string) ([]models.Module, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	if r.db.findCourse(courseID) < 0 {
+		return nil, ErrNotFound
+	}
+	return r.db.curricula[courseID].clone(), nil
+}
+
+func (r *memoryCurriculum) CreateModule(_ context.Context, module *models.Module) error {
+	return r.edit(module.CourseID, func(o outline) (outline, error) {
+		return o.addModule(module), nil
+	})
+}
+
+func (r *memoryCurriculum) UpdateModule(_ context.Context, module *models.Module) error {
+	return r.edit(module.CourseID, func(o outline) (outline, error) {
+		return o.updateModule(module)
+	})
+}
+
+func (r *memoryCurriculum) DeleteModule(_ context.Context, courseID, id string) error {
+	return r.edit(courseID, func(o outline) (outline, error) {
+		return o.deleteModule(id)
+	})
+}
+
+func (r *memoryCurriculum) CreateLesson(_ context.Context, lesson *models.Lesson) error {
+	return r.edit(lesson.CourseID, func(o outline) (outline, error) {
+		return o.addLesson(lesson)
+	})
+}
+
+func (r *memoryCurriculum) UpdateLesson(_ context.Context, lesson *models.Lesson) error {
+	return r.edit(lesson.CourseID, func(o outline) (outline, error) {
+		return o.updateLesson(lesson)
+	})
+}
+
+func (r *memoryCurriculum) DeleteLesson(_ context.Context, courseID, id string) error {
+	return r.edit(courseID, func(o outline) (outline, error) {
+		return o.deleteLesson(id)
+	})
+}
@@ -0,0 +1,150 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+type memoryExports struct{ db *memoryDB }
+
+// findExport returns the index of the export with the given ID, or -1. The
+// caller must hold the lock.
+func (db *memoryDB) findExport(id string) int {
+	for i, e := range db.exports {
+		if e.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// cloneExport returns a copy of e that shares no pointers with it.
+func cloneExport(e models.DataExport) models.DataExport {
+	for _, t := range []**time.Time{&e.StartedAt, &e.CompletedAt, &e.ExpiresAt} {
+		if *t != nil {
+			copied := **t
+			*t = &copied
+		}
+	}
+	return e
+}
+
+func (r *memoryExports) CreateExport(_ context.Context, export models.DataExport) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	r.db.exports = append(r.db.exports, cloneExport(export))
+	return nil
+}
+
+func (r *memoryExports) GetExport(_ context.Context, id string) (models.DataExport, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	i := r.db.findExport(id)
+	if i < 0 {
+		return models.DataExport{}, ErrNotFound
+	}
+	return cloneExport(r.db.exports[i]), nil
+}
+
+func (r *memoryExports) GetExportByToken(_ context.Context, tokenHash string) (models.DataExport, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	for _, e := range r.db.exports {
+		if e.TokenHash != "" && e.TokenHash == tokenHash {
+			return cloneExport(e), nil
+		}
+	}
+	return models.DataExport{}, ErrNotFound
+}
+
+func (r *memoryExports) ListExports(_ context.Context, userID string) ([]models.DataExport, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	exports := []models.DataExport{}
+	for i := len(r.db.exports) - 1; i >= 0; i-- {
+		if r.db.exports[i].UserID == userID {
+			exports = append(exports, cloneExport(r.db.exports[i]))
+		}
+	}
+	return exports, nil
+}
+
+func (r *memoryExports) ClaimExport(_ context.Context, at, staleBefore time.Time) (models.DataExport, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	for i, e := range r.db.exports {
+		stale := e.Status == models.ExportRunning && e.StartedAt != nil && e.StartedAt.Before(staleBefore)
+		if e.Status == models.ExportPending || stale {
+			e.Status = models.ExportRunning
+			e.StartedAt = &at
+			r.db.exports[i] = e
+			return cloneExport(e), nil
+		}
+	}
+	return models.DataExport{}, ErrNotFound
+}
+
+func (r *memoryExports) CompleteExport(_ context.Context, id string, archive []byte, tokenHash string, at, expiresAt time.Time) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findExport(id)
+	if i < 0 || r.db.exports[i].Status != models.ExportRunning {
+		return ErrNotFound
+	}
+	e := &r.db.exports[i]
+	e.Status = models.ExportReady
+	e.Size = len(archive)
+	e.TokenHash = tokenHash
+	e.CompletedAt = &at
+	e.ExpiresAt = &expiresAt
+	r.db.exportArchives[id] = append([]byte{}, archive...)
+	return nil
+}
+
+func (r *memoryExports) FailExport(_ context.Context, id, reason string, at time.Time) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findExport(id)
+	if i < 0 || r.db.exports[i].Status != models.ExportRunning {
+		return ErrNotFound
+	}
+	e := &r.db.exports[i]
+	e.Status = models.ExportFailed
+	e.Error = reason
+	e.CompletedAt = &at
+	return nil
+}
+
+func (r *memoryExports) GetExportArchive(_ context.Context, id string) ([]byte, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	archive, ok := r.db.exportArchives[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, archive...), nil
+}
+
+func (r *memoryExports) ExpireExports(_ context.Context, at time.Time) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	for i, e := range r.db.exports {
+		if e.Status == models.ExportReady && e.ExpiresAt != nil && e.ExpiresAt.Before(at) {
+			r.db.exports[i].Status = models.ExportExpired
+			r.db.exports[i].TokenHash = ""
+			delete(r.db.exportArchives, e.ID)
+		}
+	}
+	return nil
+}
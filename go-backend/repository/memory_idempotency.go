@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+type memoryIdempotency struct{ db *memoryDB }
+
+// idempotencyID identifies the record of a user's key.
+func idempotencyID(userID, key string) string {
+	return userID + "\x00" + key
+}
+
+func (r *memoryIdempotency) BeginIdempotentRequest(_ context.Context, rec models.IdempotencyRecord) (models.IdempotencyRecord, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	for id, old := range r.db.idempotency {
+		if !old.ExpiresAt.After(rec.CreatedAt) {
+			delete(r.db.idempotency, id)
+		}
+	}
+	id := idempotencyID(rec.UserID, rec.Key)
+	if old, ok := r.db.idempotency[id]; ok {
+		return old, ErrIdempotencyKeyUsed
+	}
+	r.db.idempotency[id] = rec
+	return rec, nil
+}
+
+func (r *memoryIdempotency) CompleteIdempotentRequest(_ context.Context, rec models.IdempotencyRecord) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	id := idempotencyID(rec.UserID, rec.Key)
+	if _, ok := r.db.idempotency[id]; !ok {
+		return ErrNotFound
+	}
+	r.db.idempotency[id] = rec
+	return nil
+}
+
+func (r *memoryIdempotency) ReleaseIdempotentRequest(_ context.Context, userID, key string) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	id := idempotencyID(userID, key)
+	if rec, ok := r.db.idempotency[id]; ok && rec.StatusCode == 0 {
+		delete(r.db.idempotency, id)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+func (r *memoryUsers) UseTOTPStep(_ context.Context, userID string, step int64) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	i := r.db.findUser(userID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	if r.db.users[i].TOTPLastStep >= step {
+		return ErrTokenUsed
+	}
+	r.db.users[i].TOTPLastStep = step
+	return nil
+}
+
+func (r *memoryUsers) ReplaceRecoveryCodes(_ context.Context, userID string, hashes []string) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	if r.db.findUser(userID) < 0 {
+		return ErrNotFound
+	}
+	if len(hashes) == 0 {
+		delete(r.db.recoveryCodes, userID)
+		return nil
+	}
+	r.db.recoveryCodes[userID] = append([]string{}, hashes...)
+	return nil
+}
+
+func (r *memoryUsers) UseRecoveryCode(_ context.Context, userID, hash string) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	codes := r.db.recoveryCodes[userID]
+	for i, h := range codes {
+		if h == hash {
+			r.db.recoveryCodes[userID] = append(codes[:i:i], codes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+type memorySettings struct{ db *memoryDB }
+
+func (r *memorySettings) GetSetting(_ context.Context, key string) (string, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	value, ok := r.db.settings[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (r *memorySettings) PutSetting(_ context.Context, key, value string, _ time.Time) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	r.db.settings[key] = value
+	return nil
+}
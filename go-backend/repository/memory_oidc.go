@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+func (r *memoryUsers) GetByIdentity(_ context.Context, provider, subject string) (models.User, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	for _, identity := range r.db.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			i := r.db.findUser(identity.UserID)
+			if i < 0 {
+				return models.User{}, ErrNotFound
+			}
+			return cloneUser(r.db.users[i]), nil
+		}
+	}
+	return models.User{}, ErrNotFound
+}
+
+func (r *memoryUsers) LinkIdentity(_ context.Context, identity models.Identity) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	if r.db.findUser(identity.UserID) < 0 {
+		return ErrNotFound
+	}
+	for _, existing := range r.db.identities {
+		if existing.Provider == identity.Provider && existing.Subject == identity.Subject {
+			return ErrDuplicateIdentity
+		}
+	}
+	r.db.identities = append(r.db.identities, identity)
+	return nil
+}
+
+func (r *memoryUsers) ListIdentities(_ context.Context, userID string) ([]models.Identity, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	identities := []models.Identity{}
+	for _, identity := range r.db.identities {
+		if identity.UserID == userID {
+			identities = append(identities, identity)
+		}
+	}
+	return identities, nil
+}
+
+func (r *memoryTokens) CreateOIDCState(_ context.Context, state models.OIDCState) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	// Drop logins that were abandoned.
+	now := time.Now()
+	for id, s := range r.db.oidcStates {
+		if s.ExpiresAt.Before(now) {
+			delete(r.db.oidcStates, id)
+		}
+	}
+	r.db.oidcStates[state.ID] = state
+	return nil
+}
+
+func (r *memoryTokens) ConsumeOIDCState(_ context.Context, id string) (models.OIDCState, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	state, ok := r.db.oidcStates[id]
+	if !ok {
+		return models.OIDCState{}, ErrNotFound
+	}
+	delete(r.db.oidcStates, id)
+	return state, nil
+}
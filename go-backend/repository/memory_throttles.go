@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+type memoryThrottles struct{ db *memoryDB }
+
+func (r *memoryThrottles) GetLoginThrottle(_ context.Context, key string) (models.LoginThrottle, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	t, ok := r.db.throttles[key]
+	if !ok {
+		return models.LoginThrottle{}, ErrNotFound
+	}
+	return t, nil
+}
+
+func (r *memoryThrottles) RecordLoginFailure(_ context.Context, key string, at time.Time, window, decay time.Duration) (models.LoginThrottle, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	// Drop counters that have decayed completely.
+	for k, t := range r.db.throttles {
+		if t.LastFailureAt.Before(at.Add(-decay)) && (t.LockedUntil == nil || t.LockedUntil.Before(at)) {
+			delete(r.db.throttles, k)
+		}
+	}
+
+	t, ok := r.db.throttles[key]
+	if !ok {
+		t = models.LoginThrottle{Key: key}
+	}
+	if t.LastFailureAt.Before(at.Add(-window)) {
+		t.Failures = 0
+	}
+	t.Failures++
+	t.LastFailureAt = at
+	r.db.throttles[key] = t
+	return t, nil
+}
+
+func (r *memoryThrottles) LockLogin(_ context.Context, key string, until time.Time) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	t := r.db.throttles[key]
+	t.Key = key
+	t.Failures = 0
+	t.Lockouts++
+	t.LockedUntil = &until
+	r.db.throttles[key] = t
+	return nil
+}
+
+func (r *memoryThrottles) ResetLogin(_ context.Context, key string) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	delete(r.db.throttles, key)
+	return nil
+}
+
+func (r *memoryThrottles) RecordLockout(_ context.Context, event models.LockoutEvent) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	r.db.lockouts = append(r.db.lockouts, event)
+	return nil
+}
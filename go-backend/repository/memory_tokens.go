@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+type memoryTokens struct{ db *memoryDB }
+
+func (r *memoryTokens) CreateRefreshToken(_ context.Context, token models.RefreshToken) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	r.db.refreshTokens[token.ID] = token
+	return nil
+}
+
+func (r *memoryTokens) GetRefreshToken(_ context.Context, id string) (models.RefreshToken, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	token, ok := r.db.refreshTokens[id]
+	if !ok {
+		return models.RefreshToken{}, ErrNotFound
+	}
+	return token, nil
+}
+
+func (r *memoryTokens) MarkRefreshTokenUsed(_ context.Context, id string, at time.Time) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	token, ok := r.db.refreshTokens[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if token.UsedAt != nil {
+		return ErrTokenUsed
+	}
+	token.UsedAt = &at
+	r.db.refreshTokens[id] = token
+	return nil
+}
+
+func (r *memoryTokens) RevokeRefreshFamily(_ context.Context, familyID string, at time.Time) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	for id, token := range r.db.refreshTokens {
+		if token.FamilyID == familyID && token.RevokedAt == nil {
+			token.RevokedAt = &at
+			r.db.refreshTokens[id] = token
+		}
+	}
+	return nil
+}
+
+func (r *memoryTokens) RevokeAccessToken(_ context.Context, jti string, expiresAt time.Time) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	// Drop entries for tokens that have expired on their own.
+	now := time.Now()
+	for id, exp := range r.db.revokedTokens {
+		if exp.Before(now) {
+			delete(r.db.revokedTokens, id)
+		}
+	}
+	r.db.revokedTokens[jti] = expiresAt
+	return nil
+}
+
+func (r *memoryTokens) IsAccessTokenRevoked(_ context.Context, jti string) (bool, error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+
+	_, ok := r.db.revokedTokens[jti]
+	return ok, nil
+}
+
+func (r *memoryTokens) RevokeUserRefreshTokens(_ context.Context, userID string, at time.Time) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	for id, token := range r.db.refreshTokens {
+		if token.UserID == userID && token.RevokedAt == nil {
+			token.RevokedAt = &at
+			r.db.refreshTokens[id] = token
+		}
+	}
+	return nil
+}
+
+func (r *memoryTokens) CreateActionToken(_ context.Context, token models.ActionToken) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	r.db.actionTokens[token.ID] = token
+	return nil
+}
+
+func (r *memoryTokens) ConsumeActionToken(_ context.Context, id, purpose string, at time.Time) (models.ActionToken, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	token, ok := r.db.actionTokens[id]
+	if !ok || token.Purpose != purpose {
+		return models.ActionToken{}, ErrNotFound
+	}
+	if token.UsedAt != nil {
+		return models.ActionToken{}, ErrTokenUsed
+	}
+	token.UsedAt = &at
+	r.db.actionTokens[id] = token
+	return token, nil
+}
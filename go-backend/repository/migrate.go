@@ -0,0 +1,155 @@
+package repository
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is one versioned schema change, loaded from a pair of
+// NNNN_name.up.sql / NNNN_name.down.sql files.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		file := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(file, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s: expected NNNN_name.up.sql or NNNN_name.down.sql", file)
+		}
+		prefix, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version: %w", file, err)
+		}
+
+		body, err := migrationFiles.ReadFile(path.Join("migrations", file))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %04d_%s: missing up or down file", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+func (d *SQLDatabase) ensureMigrationTable(ctx context.Context) error {
+	_, err := d.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version    INTEGER PRIMARY KEY,
+    applied_at TIMESTAMP NOT NULL
+)`)
+	return err
+}
+
+// SchemaVersion returns the version of the most recently applied migration,
+// or 0 if none has been applied.
+func (d *SQLDatabase) SchemaVersion(ctx context.Context) (int, error) {
+	if err := d.ensureMigrationTable(ctx); err != nil {
+		return 0, err
+	}
+	var version int
+	err := d.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// MigrateUp applies every pending migration in order and returns the
+// versions that were applied.
+func (d *SQLDatabase) MigrateUp(ctx context.Context) ([]int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	current, err := d.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []int
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err := d.withTx(ctx, func(tx sqlQuerier) error {
+			if _, err := tx.ExecContext(ctx, m.up); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, d.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`),
+				m.version, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return applied, fmt.Errorf("migration %04d_%s up: %w", m.version, m.name, err)
+		}
+		applied = append(applied, m.version)
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first, and
+// returns the versions that were reverted.
+func (d *SQLDatabase) MigrateDown(ctx context.Context, steps int) ([]int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	current, err := d.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted []int
+	for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		m := migrations[i]
+		if m.version > current {
+			continue
+		}
+		err := d.withTx(ctx, func(tx sqlQuerier) error {
+			if _, err := tx.ExecContext(ctx, m.down); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, d.rebind(`DELETE FROM schema_migrations WHERE version = ?`), m.version)
+			return err
+		})
+		if err != nil {
+			return reverted, fmt.Errorf("migration %04d_%s down: %w", m.version, m.name, err)
+		}
+		reverted = append(reverted, m.version)
+	}
+	return reverted, nil
+}
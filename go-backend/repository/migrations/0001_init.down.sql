@@ -0,0 +1,6 @@
+DROP TABLE payments;
+DROP TABLE enrollments;
+DROP TABLE course_topics;
+DROP TABLE courses;
+DROP TABLE user_badges;
+DROP TABLE users;
@@ -0,0 +1,63 @@
+CREATE TABLE users (
+    id         TEXT PRIMARY KEY,
+    email      TEXT NOT NULL UNIQUE,
+    password   TEXT NOT NULL,
+    full_name  TEXT NOT NULL,
+    is_admin   BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL,
+    last_login TIMESTAMP
+);
+
+CREATE TABLE user_badges (
+    user_id  TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    badge    TEXT NOT NULL,
+    PRIMARY KEY (user_id, position)
+);
+
+CREATE TABLE courses (
+    id                TEXT PRIMARY KEY,
+    title             TEXT NOT NULL,
+    description       TEXT NOT NULL,
+    price             DOUBLE PRECISION NOT NULL,
+    category          TEXT NOT NULL,
+    level             TEXT NOT NULL,
+    mentor_name       TEXT NOT NULL,
+    video_url         TEXT NOT NULL DEFAULT '',
+    preview_video_url TEXT NOT NULL DEFAULT '',
+    duration          TEXT NOT NULL,
+    created_at        TIMESTAMP NOT NULL,
+    enrolled_count    INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX courses_category_idx ON courses (category);
+
+CREATE TABLE course_topics (
+    course_id TEXT NOT NULL REFERENCES courses (id) ON DELETE CASCADE,
+    position  INTEGER NOT NULL,
+    topic     TEXT NOT NULL,
+    PRIMARY KEY (course_id, position)
+);
+
+CREATE TABLE enrollments (
+    user_id     TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    course_id   TEXT NOT NULL REFERENCES courses (id),
+    progress    INTEGER NOT NULL DEFAULT 0 CHECK (progress BETWEEN 0 AND 100),
+    enrolled_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, course_id)
+);
+
+CREATE INDEX enrollments_course_idx ON enrollments (course_id);
+
+CREATE TABLE payments (
+    id             TEXT PRIMARY KEY,
+    user_id        TEXT NOT NULL REFERENCES users (id),
+    course_id      TEXT NOT NULL REFERENCES courses (id),
+    amount         DOUBLE PRECISION NOT NULL,
+    payment_method TEXT NOT NULL,
+    status         TEXT NOT NULL,
+    created_at     TIMESTAMP NOT NULL
+);
+
+CREATE INDEX payments_user_idx ON payments (user_id, created_at);
+CREATE INDEX payments_course_idx ON payments (course_id);
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'student';
+
+UPDATE users SET role = 'admin' WHERE is_admin = TRUE;
@@ -0,0 +1,5 @@
+DROP TABLE action_tokens;
+
+DROP INDEX refresh_tokens_user_idx;
+
+ALTER TABLE users DROP COLUMN email_verified;
@@ -0,0 +1,21 @@
+CREATE TABLE login_throttles (
+    throttle_key    TEXT PRIMARY KEY,
+    failures        INTEGER NOT NULL DEFAULT 0,
+    lockouts        INTEGER NOT NULL DEFAULT 0,
+    locked_until    TIMESTAMP,
+    last_failure_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX login_throttles_last_failure_idx ON login_throttles (last_failure_at);
+
+CREATE TABLE login_lockouts (
+    id           TEXT PRIMARY KEY,
+    scope        TEXT NOT NULL,
+    ip           TEXT NOT NULL,
+    email        TEXT NOT NULL,
+    failures     INTEGER NOT NULL,
+    locked_until TIMESTAMP NOT NULL,
+    created_at   TIMESTAMP NOT NULL
+);
+
+CREATE INDEX login_lockouts_created_idx ON login_lockouts (created_at);
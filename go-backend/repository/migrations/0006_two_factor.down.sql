@@ -0,0 +1,6 @@
+DROP TABLE settings;
+DROP TABLE user_recovery_codes;
+
+ALTER TABLE users DROP COLUMN totp_last_step;
+ALTER TABLE users DROP COLUMN totp_enabled;
+ALTER TABLE users DROP COLUMN totp_secret;
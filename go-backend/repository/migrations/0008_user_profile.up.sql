@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP;
@@ -0,0 +1,3 @@
+DROP TABLE data_exports;
+DROP TABLE audit_events;
+DROP TABLE login_events;
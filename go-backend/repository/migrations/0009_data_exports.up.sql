@@ -0,0 +1,42 @@
+CREATE TABLE login_events (
+    id         TEXT PRIMARY KEY,
+    user_id    TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    method     TEXT NOT NULL,
+    success    BOOLEAN NOT NULL,
+    ip         TEXT NOT NULL,
+    user_agent TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX login_events_user_idx ON login_events (user_id, created_at);
+
+CREATE TABLE audit_events (
+    id         TEXT PRIMARY KEY,
+    action     TEXT NOT NULL,
+    user_id    TEXT NOT NULL,
+    actor_id   TEXT NOT NULL DEFAULT '',
+    target_id  TEXT NOT NULL DEFAULT '',
+    ip         TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX audit_events_user_idx ON audit_events (user_id, created_at);
+CREATE INDEX audit_events_created_idx ON audit_events (created_at);
+
+CREATE TABLE data_exports (
+    id           TEXT PRIMARY KEY,
+    user_id      TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    status       TEXT NOT NULL,
+    error        TEXT NOT NULL DEFAULT '',
+    size         INTEGER NOT NULL DEFAULT 0,
+    token_hash   TEXT,
+    archive      BYTEA,
+    requested_at TIMESTAMP NOT NULL,
+    started_at   TIMESTAMP,
+    completed_at TIMESTAMP,
+    expires_at   TIMESTAMP
+);
+
+CREATE INDEX data_exports_user_idx ON data_exports (user_id, requested_at);
+CREATE INDEX data_exports_status_idx ON data_exports (status, requested_at);
+CREATE UNIQUE INDEX data_exports_token_idx ON data_exports (token_hash);
@@ -0,0 +1,3 @@
+ALTER TABLE audit_events DROP COLUMN detail;
+ALTER TABLE users DROP COLUMN suspended_reason;
+ALTER TABLE users DROP COLUMN suspended_at;
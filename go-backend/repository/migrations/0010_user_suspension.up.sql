@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN suspended_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN suspended_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE audit_events ADD COLUMN detail TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE courses ADD COLUMN archived_at TIMESTAMP;
@@ -0,0 +1,5 @@
+DROP INDEX courses_created_at_idx;
+DROP INDEX courses_price_idx;
+
+ALTER TABLE courses DROP COLUMN rating_count;
+ALTER TABLE courses DROP COLUMN rating;
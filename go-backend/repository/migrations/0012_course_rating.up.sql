@@ -0,0 +1,5 @@
+ALTER TABLE courses ADD COLUMN rating DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE courses ADD COLUMN rating_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX courses_price_idx ON courses (price);
+CREATE INDEX courses_created_at_idx ON courses (created_at);
@@ -0,0 +1,5 @@
+DROP TABLE course_lessons;
+DROP TABLE course_modules;
+
+ALTER TABLE courses DROP COLUMN duration_seconds;
+ALTER TABLE courses DROP COLUMN lesson_count;
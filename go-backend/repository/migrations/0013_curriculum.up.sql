@@ -0,0 +1,28 @@
+ALTER TABLE courses ADD COLUMN lesson_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE courses ADD COLUMN duration_seconds INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE course_modules (
+    id         TEXT PRIMARY KEY,
+    course_id  TEXT NOT NULL REFERENCES courses (id) ON DELETE CASCADE,
+    position   INTEGER NOT NULL,
+    title      TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX course_modules_course_idx ON course_modules (course_id, position);
+
+CREATE TABLE course_lessons (
+    id               TEXT PRIMARY KEY,
+    course_id        TEXT NOT NULL REFERENCES courses (id) ON DELETE CASCADE,
+    module_id        TEXT NOT NULL REFERENCES course_modules (id) ON DELETE CASCADE,
+    position         INTEGER NOT NULL,
+    title            TEXT NOT NULL,
+    type             TEXT NOT NULL,
+    video_url        TEXT NOT NULL DEFAULT '',
+    content          TEXT NOT NULL DEFAULT '',
+    attachment_url   TEXT NOT NULL DEFAULT '',
+    duration_seconds INTEGER NOT NULL DEFAULT 0,
+    created_at       TIMESTAMP NOT NULL
+);
+
+CREATE INDEX course_lessons_course_idx ON course_lessons (course_id, module_id, position);
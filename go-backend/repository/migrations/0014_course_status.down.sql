@@ -0,0 +1,5 @@
+DROP TABLE course_status_changes;
+
+DROP INDEX courses_status_idx;
+
+ALTER TABLE courses DROP COLUMN status;
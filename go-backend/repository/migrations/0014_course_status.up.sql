@@ -0,0 +1,17 @@
+ALTER TABLE courses ADD COLUMN status TEXT NOT NULL DEFAULT 'published';
+
+UPDATE courses SET status = 'archived' WHERE archived_at IS NOT NULL;
+
+CREATE INDEX courses_status_idx ON courses (status);
+
+CREATE TABLE course_status_changes (
+    id          TEXT PRIMARY KEY,
+    course_id   TEXT NOT NULL REFERENCES courses (id) ON DELETE CASCADE,
+    from_status TEXT NOT NULL,
+    to_status   TEXT NOT NULL,
+    changed_by  TEXT NOT NULL,
+    note        TEXT NOT NULL DEFAULT '',
+    changed_at  TIMESTAMP NOT NULL
+);
+
+CREATE INDEX course_status_changes_course_idx ON course_status_changes (course_id, changed_at);
@@ -0,0 +1,7 @@
+UPDATE payments SET status = 'completed' WHERE status = 'paid';
+
+ALTER TABLE payments DROP COLUMN settled_at;
+ALTER TABLE payments DROP COLUMN expires_at;
+ALTER TABLE payments DROP COLUMN action;
+ALTER TABLE payments DROP COLUMN reference;
+ALTER TABLE payments DROP COLUMN provider;
@@ -0,0 +1,7 @@
+ALTER TABLE payments ADD COLUMN provider TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN reference TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN action TEXT;
+ALTER TABLE payments ADD COLUMN expires_at TIMESTAMP;
+ALTER TABLE payments ADD COLUMN settled_at TIMESTAMP;
+
+UPDATE payments SET status = 'paid', settled_at = created_at WHERE status = 'completed';
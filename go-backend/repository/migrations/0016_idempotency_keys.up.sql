@@ -0,0 +1,13 @@
+CREATE TABLE idempotency_keys (
+    user_id      TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    idem_key     TEXT NOT NULL,
+    fingerprint  TEXT NOT NULL,
+    status_code  INTEGER NOT NULL DEFAULT 0,
+    content_type TEXT NOT NULL DEFAULT '',
+    body         TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMP NOT NULL,
+    expires_at   TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, idem_key)
+);
+
+CREATE INDEX idempotency_keys_expires_idx ON idempotency_keys (expires_at);
@@ -0,0 +1,13 @@
+ALTER TABLE payments ADD COLUMN amount_major DOUBLE PRECISION NOT NULL DEFAULT 0;
+UPDATE payments SET amount_major = CASE currency WHEN 'USD' THEN amount / 100.0 ELSE amount END;
+ALTER TABLE payments DROP COLUMN amount;
+ALTER TABLE payments DROP COLUMN currency;
+ALTER TABLE payments RENAME COLUMN amount_major TO amount;
+
+DROP INDEX courses_price_idx;
+ALTER TABLE courses ADD COLUMN price_major DOUBLE PRECISION NOT NULL DEFAULT 0;
+UPDATE courses SET price_major = CASE currency WHEN 'USD' THEN price / 100.0 ELSE price END;
+ALTER TABLE courses DROP COLUMN price;
+ALTER TABLE courses DROP COLUMN currency;
+ALTER TABLE courses RENAME COLUMN price_major TO price;
+CREATE INDEX courses_price_idx ON courses (price);
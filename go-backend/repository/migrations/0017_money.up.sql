@@ -0,0 +1,16 @@
+ALTER TABLE courses ADD COLUMN price_minor BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE courses ADD COLUMN currency TEXT NOT NULL DEFAULT 'IDR';
+-- Whole numbers were rupiah; a price with cents can only have been dollars
+UPDATE courses SET price_minor = CAST(ROUND(price) AS BIGINT), currency = 'IDR' WHERE price = ROUND(price);
+UPDATE courses SET price_minor = CAST(ROUND(price * 100) AS BIGINT), currency = 'USD' WHERE price <> ROUND(price);
+DROP INDEX courses_price_idx;
+ALTER TABLE courses DROP COLUMN price;
+ALTER TABLE courses RENAME COLUMN price_minor TO price;
+CREATE INDEX courses_price_idx ON courses (currency, price);
+
+ALTER TABLE payments ADD COLUMN amount_minor BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE payments ADD COLUMN currency TEXT NOT NULL DEFAULT 'IDR';
+UPDATE payments SET amount_minor = CAST(ROUND(amount) AS BIGINT), currency = 'IDR' WHERE amount = ROUND(amount);
+UPDATE payments SET amount_minor = CAST(ROUND(amount * 100) AS BIGINT), currency = 'USD' WHERE amount <> ROUND(amount);
+ALTER TABLE payments DROP COLUMN amount;
+ALTER TABLE payments RENAME COLUMN amount_minor TO amount;
@@ -0,0 +1,5 @@
+ALTER TABLE payments DROP COLUMN discount;
+ALTER TABLE payments DROP COLUMN coupon_code;
+
+DROP TABLE coupon_redemptions;
+DROP TABLE coupons;
@@ -0,0 +1,28 @@
+CREATE TABLE coupons (
+    id                  TEXT PRIMARY KEY,
+    code                TEXT NOT NULL UNIQUE,
+    percent_off         INTEGER NOT NULL DEFAULT 0,
+    amount_off          BIGINT,
+    amount_off_currency TEXT,
+    min_spend           BIGINT,
+    min_spend_currency  TEXT,
+    course_ids          TEXT NOT NULL DEFAULT '[]',
+    categories          TEXT NOT NULL DEFAULT '[]',
+    expires_at          TIMESTAMP,
+    max_redemptions     INTEGER NOT NULL DEFAULT 0,
+    per_user_limit      INTEGER NOT NULL DEFAULT 0,
+    redemptions         INTEGER NOT NULL DEFAULT 0,
+    created_at          TIMESTAMP NOT NULL
+);
+
+CREATE TABLE coupon_redemptions (
+    payment_id  TEXT PRIMARY KEY,
+    coupon_id   TEXT NOT NULL REFERENCES coupons (id) ON DELETE CASCADE,
+    user_id     TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    redeemed_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX coupon_redemptions_coupon_user_idx ON coupon_redemptions (coupon_id, user_id);
+
+ALTER TABLE payments ADD COLUMN coupon_code TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN discount BIGINT;
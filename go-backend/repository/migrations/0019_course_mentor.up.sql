@@ -0,0 +1 @@
+ALTER TABLE courses ADD COLUMN mentor_id TEXT NOT NULL DEFAULT '';
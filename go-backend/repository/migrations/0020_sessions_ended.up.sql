@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN sessions_ended_at TIMESTAMP;
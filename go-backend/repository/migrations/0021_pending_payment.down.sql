@@ -0,0 +1 @@
+DROP INDEX payments_pending_idx;
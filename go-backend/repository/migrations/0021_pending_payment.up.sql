@@ -0,0 +1,21 @@
+-- A user has at most one pending payment for a course. Older duplicates
+-- from before this was enforced are expired and give back their coupons.
+UPDATE coupons SET redemptions = redemptions - (
+    SELECT COUNT(*) FROM coupon_redemptions r JOIN payments p ON p.id = r.payment_id
+    WHERE r.coupon_id = coupons.id AND p.status = 'pending' AND EXISTS (
+        SELECT 1 FROM payments newer
+        WHERE newer.user_id = p.user_id AND newer.course_id = p.course_id AND newer.status = 'pending'
+            AND (newer.created_at > p.created_at OR (newer.created_at = p.created_at AND newer.id > p.id))));
+DELETE FROM coupon_redemptions WHERE payment_id IN (
+    SELECT p.id FROM payments p
+    WHERE p.status = 'pending' AND EXISTS (
+        SELECT 1 FROM payments newer
+        WHERE newer.user_id = p.user_id AND newer.course_id = p.course_id AND newer.status = 'pending'
+            AND (newer.created_at > p.created_at OR (newer.created_at = p.created_at AND newer.id > p.id))));
+UPDATE payments SET status = 'expired', settled_at = created_at
+WHERE status = 'pending' AND EXISTS (
+    SELECT 1 FROM payments newer
+    WHERE newer.user_id = payments.user_id AND newer.course_id = payments.course_id AND newer.status = 'pending'
+        AND (newer.created_at > payments.created_at OR (newer.created_at = payments.created_at AND newer.id > payments.id)));
+
+CREATE UNIQUE INDEX payments_pending_idx ON payments (user_id, course_id) WHERE status = 'pending';
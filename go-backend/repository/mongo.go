@@ -0,0 +1,726 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// NewMongoStore connects to the MongoDB deployment at uri and returns a Store
+// backed by the users, courses and payments collections of database dbName.
+// The required indexes are created if they do not exist yet.
+func NewMongoStore(ctx context.Context, uri, dbName string) (Store, error) {
+	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		return Store{}, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return Store{}, err
+	}
+
+	db := client.Database(dbName)
+	if err := ensureMongoIndexes(ctx, db); err != nil {
+		client.Disconnect(ctx)
+		return Store{}, err
+	}
+	if err := migrateMongo(ctx, db); err != nil {
+		client.Disconnect(ctx)
+		return Store{}, err
+	}
+
+	users := &mongoUsers{db.Collection("users"), db.Collection("user_identities")}
+	courses := &mongoCourses{db.Collection("courses"), db.Collection("course_status_changes")}
+	return Store{
+		Users:       users,
+		Courses:     courses,
+		Curriculum:  &mongoCurriculum{db.Collection("course_curricula"), courses},
+		Payments:    &mongoPayments{db.Collection("payments"), users, courses},
+		Tokens:      &mongoTokens{db.Collection("refresh_tokens"), db.Collection("revoked_tokens"), db.Collection("action_tokens"), db.Collection("oidc_states")},
+		Throttles:   &mongoThrottles{db.Collection("login_throttles"), db.Collection("login_lockouts")},
+		Settings:    &mongoSettings{db.Collection("settings")},
+		Activity:    &mongoActivity{db.Collection("login_events"), db.Collection("audit_events")},
+		Exports:     &mongoExports{db.Collection("data_exports")},
+		Idempotency: &mongoIdempotency{db.Collection("idempotency_keys")},
+		Coupons:     &mongoCoupons{db.Collection("coupons"), db.Collection("coupon_redemptions")},
+		closer:      client.Disconnect,
+	}, nil
+}
+
+func ensureMongoIndexes(ctx context.Context, db *mongo.Database) error {
+	if _, err := db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return err
+	}
+	if _, err := db.Collection("payments").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "course_id", Value: 1}}},
+	}); err != nil {
+		return err
+	}
+	if err := ensureMongoTokenIndexes(ctx, db); err != nil {
+		return err
+	}
+	if err := ensureMongoThrottleIndexes(ctx, db); err != nil {
+		return err
+	}
+	if err := ensureMongoOIDCIndexes(ctx, db); err != nil {
+		return err
+	}
+	if err := ensureMongoActivityIndexes(ctx, db); err != nil {
+		return err
+	}
+	if err := ensureMongoCourseStatusIndexes(ctx, db); err != nil {
+		return err
+	}
+	if err := ensureMongoIdempotencyIndexes(ctx, db); err != nil {
+		return err
+	}
+	if err := ensureMongoCouponIndexes(ctx, db); err != nil {
+		return err
+	}
+	return ensureMongoExportIndexes(ctx, db)
+}
+
+// migrateMongo backfills fields added after documents were first written.
+func migrateMongo(ctx context.Context, db *mongo.Database) error {
+	// Accounts created before email verification existed count as verified.
+	_, err := db.Collection("users").UpdateMany(ctx,
+		bson.D{{Key: "email_verified", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "email_verified", Value: true}}}},
+	)
+	if err != nil {
+		return err
+	}
+	// Courses from before the publishing workflow were all live.
+	for _, status := range []string{models.CourseArchived, models.CoursePublished} {
+		filter := bson.D{{Key: "status", Value: bson.D{{Key: "$in", Value: bson.A{nil, ""}}}}}
+		if status == models.CourseArchived {
+			filter = append(filter, bson.E{Key: "archived_at", Value: bson.D{{Key: "$ne", Value: nil}}})
+		}
+		if _, err := db.Collection("courses").UpdateMany(ctx, filter, bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: status}}}}); err != nil {
+			return err
+		}
+	}
+	// Purchases used to be completed at once; they are now settled as paid.
+	_, err = db.Collection("payments").UpdateMany(ctx,
+		bson.D{{Key: "status", Value: "completed"}},
+		bson.A{bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: models.PaymentPaid}, {Key: "settled_at", Value: "$created_at"}}}}},
+	)
+	if err != nil {
+		return err
+	}
+	// Prices and amounts were stored as a plain number, and are now in the
+	// smallest unit with their currency. Whole numbers were rupiah; a number
+	// with cents can only have been dollars.
+	for coll, field := range map[string]string{"courses": "price", "payments": "amount"} {
+		whole := bson.D{{Key: "$eq", Value: bson.A{"$" + field, bson.D{{Key: "$round", Value: bson.A{"$" + field, 0}}}}}}
+		cents := bson.D{{Key: "$round", Value: bson.A{bson.D{{Key: "$multiply", Value: bson.A{"$" + field, 100}}}, 0}}}
+		_, err := db.Collection(coll).UpdateMany(ctx,
+			bson.D{{Key: field, Value: bson.D{{Key: "$type", Value: "number"}}}},
+			bson.A{bson.D{{Key: "$set", Value: bson.D{{Key: field, Value: bson.D{{Key: "$cond", Value: bson.A{
+				whole,
+				bson.D{{Key: "amount", Value: bson.D{{Key: "$toLong", Value: "$" + field}}}, {Key: "currency", Value: money.IDR}},
+				bson.D{{Key: "amount", Value: bson.D{{Key: "$toLong", Value: cents}}}, {Key: "currency", Value: money.USD}},
+			}}}}}}}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if err := migrateMongoPendingPayments(ctx, db); err != nil {
+		return err
+	}
+	// Search filters on role, which accounts from before roles lack.
+	for _, admin := range []bool{true, false} {
+		role := models.RoleStudent
+		if admin {
+			role = models.RoleAdmin
+		}
+		_, err := db.Collection("users").UpdateMany(ctx,
+			bson.D{
+				{Key: "role", Value: bson.D{{Key: "$in", Value: bson.A{nil, ""}}}},
+				{Key: "is_admin", Value: admin},
+			},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "role", Value: role}}}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateMongoPendingPayments expires all but the newest of the pending
+// payments a user has for the same course, from before a user could only
+// have one, giving back their coupons, and then enforces it with an index.
+func migrateMongoPendingPayments(ctx context.Context, db *mongo.Database) error {
+	payments := db.Collection("payments")
+	cur, err := payments.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "status", Value: models.PaymentPending}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "user_id", Value: "$user_id"}, {Key: "course_id", Value: "$course_id"}}},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "ids.1", Value: bson.D{{Key: "$exists", Value: true}}}}}},
+	})
+	if err != nil {
+		return err
+	}
+	var groups []struct {
+		IDs []string `bson:"ids"`
+	}
+	if err := cur.All(ctx, &groups); err != nil {
+		return err
+	}
+	coupons := &mongoCoupons{db.Collection("coupons"), db.Collection("coupon_redemptions")}
+	for _, group := range groups {
+		for _, id := range group.IDs[1:] {
+			_, err := payments.UpdateOne(ctx,
+				bson.D{{Key: "_id", Value: id}, {Key: "status", Value: models.PaymentPending}},
+				bson.A{bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: models.PaymentExpired}, {Key: "settled_at", Value: "$created_at"}}}}},
+			)
+			if err != nil {
+				return err
+			}
+			if err := coupons.Release(ctx, id); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = payments.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "course_id", Value: 1}},
+		Options: options.Index().SetName("pending_payment").SetUnique(true).
+			SetPartialFilterExpression(bson.D{{Key: "status", Value: models.PaymentPending}}),
+	})
+	return err
+}
+
+type mongoUsers struct {
+	coll       *mongo.Collection
+	identities *mongo.Collection
+}
+
+func (r *mongoUsers) findOne(ctx context.Context, filter bson.D) (models.User, error) {
+	var user models.User
+	err := r.coll.FindOne(ctx, filter).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.User{}, ErrNotFound
+	}
+	return user, err
+}
+
+func (r *mongoUsers) GetByID(ctx context.Context, id string) (models.User, error) {
+	return r.findOne(ctx, bson.D{{Key: "_id", Value: id}})
+}
+
+func (r *mongoUsers) GetByEmail(ctx context.Context, email string) (models.User, error) {
+	return r.findOne(ctx, bson.D{{Key: "email", Value: email}})
+}
+
+func (r *mongoUsers) Create(ctx context.Context, user models.User) error {
+	_, err := r.coll.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateEmail
+	}
+	return err
+}
+
+func (r *mongoUsers) Update(ctx context.Context, user models.User) error {
+	set := bson.D{
+		{Key: "email", Value: user.Email},
+		{Key: "password", Value: user.Password},
+		{Key: "full_name", Value: user.FullName},
+		{Key: "avatar_url", Value: user.AvatarURL},
+		{Key: "is_admin", Value: user.IsAdmin},
+		{Key: "role", Value: user.EffectiveRole()},
+		{Key: "email_verified", Value: user.EmailVerified},
+		{Key: "totp_secret", Value: user.TOTPSecret},
+		{Key: "totp_enabled", Value: user.TOTPEnabled},
+		{Key: "badges", Value: user.Badges},
+	}
+	if user.LastLogin != nil {
+		set = append(set, bson.E{Key: "last_login", Value: *user.LastLogin})
+	}
+	res, err := r.coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: user.ID}}, bson.D{{Key: "$set", Value: set}})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateEmail
+	}
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoUsers) Search(ctx context.Context, filter UserFilter) ([]models.User, int, error) {
+	query := bson.D{}
+	switch filter.Status {
+	case "":
+		query = append(query, bson.E{Key: "deleted_at", Value: nil})
+	case models.UserActive:
+		query = append(query, bson.E{Key: "deleted_at", Value: nil}, bson.E{Key: "suspended_at", Value: nil})
+	case models.UserSuspended:
+		query = append(query, bson.E{Key: "deleted_at", Value: nil}, bson.E{Key: "suspended_at", Value: bson.D{{Key: "$ne", Value: nil}}})
+	case models.UserDeleted:
+		query = append(query, bson.E{Key: "deleted_at", Value: bson.D{{Key: "$ne", Value: nil}}})
+	default:
+		return []models.User{}, 0, nil
+	}
+	if filter.Role != "" {
+		query = append(query, bson.E{Key: "role", Value: filter.Role})
+	}
+	if filter.Query != "" {
+		pattern := bson.Regex{Pattern: regexp.QuoteMeta(filter.Query), Options: "i"}
+		query = append(query, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "email", Value: pattern}},
+			bson.D{{Key: "full_name", Value: pattern}},
+		}})
+	}
+
+	total, err := r.coll.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: 1}}).
+		SetSkip(int64(filter.Offset)).
+		SetLimit(int64(filter.Limit))
+	cur, err := r.coll.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	users := []models.User{}
+	if err := cur.All(ctx, &users); err != nil {
+		return nil, 0, err
+	}
+	return users, int(total), nil
+}
+
+func (r *mongoUsers) SetSuspension(ctx context.Context, id string, at *time.Time, reason string) error {
+	update := bson.D{{Key: "$unset", Value: bson.D{{Key: "suspended_at", Value: ""}, {Key: "suspended_reason", Value: ""}}}}
+	if at != nil {
+		update = bson.D{{Key: "$set", Value: bson.D{{Key: "suspended_at", Value: *at}, {Key: "suspended_reason", Value: reason}}}}
+	}
+	res, err := r.coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoUsers) EndSessions(ctx context.Context, id string, at time.Time) error {
+	res, err := r.coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, bson.D{{Key: "$set", Value: bson.D{{Key: "sessions_ended_at", Value: at}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoUsers) UpdateLastLogin(ctx context.Context, id string, at time.Time) error {
+	res, err := r.coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: id}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "last_login", Value: at}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Anonymize updates the user document first, so that a failure while
+// deleting the related records leaves no personal data behind in the account.
+func (r *mongoUsers) Anonymize(ctx context.Context, id string, at time.Time) error {
+	user := anonymized(models.User{ID: id}, at)
+	res, err := r.coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: id}},
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "email", Value: user.Email},
+				{Key: "password", Value: user.Password},
+				{Key: "full_name", Value: user.FullName},
+				{Key: "email_verified", Value: user.EmailVerified},
+				{Key: "totp_enabled", Value: user.TOTPEnabled},
+				{Key: "badges", Value: user.Badges},
+				{Key: "deleted_at", Value: at},
+			}},
+			{Key: "$unset", Value: bson.D{
+				{Key: "avatar_url", Value: ""},
+				{Key: "totp_secret", Value: ""},
+				{Key: "recovery_codes", Value: ""},
+				{Key: "last_login", Value: ""},
+				{Key: "suspended_at", Value: ""},
+				{Key: "suspended_reason", Value: ""},
+			}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	db := r.coll.Database()
+	for _, coll := range []*mongo.Collection{r.identities, db.Collection("login_events"), db.Collection("data_exports"), db.Collection("action_tokens")} {
+		if _, err := coll.DeleteMany(ctx, bson.D{{Key: "user_id", Value: id}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *mongoUsers) Enroll(ctx context.Context, userID, courseID string) error {
+	// The $ne guard makes the check and the push a single atomic update.
+	res, err := r.coll.UpdateOne(ctx,
+		bson.D{
+			{Key: "_id", Value: userID},
+			{Key: "enrolled_courses", Value: bson.D{{Key: "$ne", Value: courseID}}},
+		},
+		bson.D{
+			{Key: "$push", Value: bson.D{{Key: "enrolled_courses", Value: courseID}}},
+			{Key: "$set", Value: bson.D{{Key: "progress." + courseID, Value: 0}}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		if _, err := r.GetByID(ctx, userID); err != nil {
+			return err
+		}
+		return ErrAlreadyEnrolled
+	}
+	return nil
+}
+
+type mongoCourses struct {
+	coll          *mongo.Collection
+	statusChanges *mongo.Collection
+}
+
+func (r *mongoCourses) List(ctx context.Context) ([]models.Course, error) {
+	cur, err := r.coll.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	courses := []models.Course{}
+	if err := cur.All(ctx, &courses); err != nil {
+		return nil, err
+	}
+	return courses, nil
+}
+
+func (r *mongoCourses) Search(ctx context.Context, filter CourseFilter) ([]models.Course, int, error) {
+	query := bson.D{}
+	in := func(field string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		patterns := bson.A{}
+		for _, v := range values {
+			patterns = append(patterns, bson.Regex{Pattern: "^" + regexp.QuoteMeta(v) + "$", Options: "i"})
+		}
+		query = append(query, bson.E{Key: field, Value: bson.D{{Key: "$in", Value: patterns}}})
+	}
+	if len(filter.Statuses) == 0 {
+		query = append(query, bson.E{Key: "status", Value: models.CoursePublished})
+	}
+	in("status", filter.Statuses)
+	in("category", filter.Categories)
+	in("level", filter.Levels)
+	in("mentor_name", filter.Mentors)
+	in("topics", filter.Topics)
+	price := bson.D{}
+	if filter.MinPrice != nil {
+		price = append(price, bson.E{Key: "$gte", Value: filter.MinPrice.Amount})
+		query = append(query, bson.E{Key: "price.currency", Value: filter.MinPrice.Currency})
+	}
+	if filter.MaxPrice != nil {
+		price = append(price, bson.E{Key: "$lte", Value: filter.MaxPrice.Amount})
+		if filter.MinPrice == nil {
+			query = append(query, bson.E{Key: "price.currency", Value: filter.MaxPrice.Currency})
+		}
+	}
+	if len(price) > 0 {
+		query = append(query, bson.E{Key: "price.amount", Value: price})
+	}
+
+	direction := 1
+	if filter.Desc {
+		direction = -1
+	}
+	var sort bson.D
+	switch filter.Sort {
+	case "":
+		sort = bson.D{{Key: CourseSortCreatedAt, Value: direction}}
+	case CourseSortPrice:
+		sort = bson.D{{Key: "price.currency", Value: direction}, {Key: "price.amount", Value: direction}}
+	default:
+		sort = bson.D{{Key: filter.Sort, Value: direction}}
+	}
+
+	total, err := r.coll.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := options.Find().
+		SetSort(append(sort, bson.E{Key: "_id", Value: 1})).
+		SetSkip(int64(filter.Offset)).
+		SetLimit(int64(filter.Limit))
+	cur, err := r.coll.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	courses := []models.Course{}
+	if err := cur.All(ctx, &courses); err != nil {
+		return nil, 0, err
+	}
+	return courses, int(total), nil
+}
+
+func (r *mongoCourses) GetByID(ctx context.Context, id string) (models.Course, error) {
+	var course models.Course
+	err := r.coll.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&course)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.Course{}, ErrNotFound
+	}
+	return course, err
+}
+
+func (r *mongoCourses) Create(ctx context.Context, course *models.Course) error {
+	if course.ID == "" {
+		course.ID = uuid.New().String()
+	}
+	_, err := r.coll.InsertOne(ctx, course)
+	return err
+}
+
+func (r *mongoCourses) Update(ctx context.Context, course models.Course) error {
+	res, err := r.coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: course.ID}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "title", Value: course.Title},
+			{Key: "description", Value: course.Description},
+			{Key: "price", Value: course.Price},
+			{Key: "category", Value: course.Category},
+			{Key: "level", Value: course.Level},
+			{Key: "mentor_name", Value: course.MentorName},
+			{Key: "mentor_id", Value: course.MentorID},
+			{Key: "video_url", Value: course.VideoURL},
+			{Key: "preview_video_url", Value: course.PreviewVideoURL},
+			{Key: "topics", Value: course.Topics},
+		}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	// Once the course has lessons its duration is theirs
+	_, err = r.coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: course.ID}, {Key: "lesson_count", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gt", Value: 0}}}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "duration", Value: course.Duration}}}},
+	)
+	return err
+}
+
+// Delete keeps every course with payments, pending ones included, so that
+// settling a payment finds its course. A purchase started while the course
+// is being deleted fails to increment enrolled_count and stays pending.
+func (r *mongoCourses) Delete(ctx context.Context, id, userID string, at time.Time) (bool, error) {
+	paid, err := r.coll.Database().Collection("payments").CountDocuments(ctx, bson.D{{Key: "course_id", Value: id}}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	if paid == 0 {
+		res, err := r.coll.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}, {Key: "enrolled_count", Value: 0}})
+		if err != nil {
+			return false, err
+		}
+		if res.DeletedCount > 0 {
+			if _, err := r.statusChanges.DeleteMany(ctx, bson.D{{Key: "course_id", Value: id}}); err != nil {
+				return false, err
+			}
+			_, err := r.coll.Database().Collection("course_curricula").DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+			return false, err
+		}
+	}
+	var before models.Course
+	err = r.coll.FindOneAndUpdate(ctx,
+		bson.D{{Key: "_id", Value: id}, {Key: "status", Value: bson.D{{Key: "$ne", Value: models.CourseArchived}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: models.CourseArchived}, {Key: "archived_at", Value: at}}}},
+	).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Already archived, or missing
+		_, err := r.GetByID(ctx, id)
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	err = r.recordStatusChange(ctx, models.CourseStatusChange{CourseID: id, From: before.Status, To: models.CourseArchived, ChangedBy: userID, ChangedAt: at})
+	return true, err
+}
+
+func (r *mongoCourses) IncrementEnrolled(ctx context.Context, id string) error {
+	res, err := r.coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: id}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "enrolled_count", Value: 1}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoPayments struct {
+	coll    *mongo.Collection
+	users   *mongoUsers
+	courses *mongoCourses
+}
+
+func (r *mongoPayments) Create(ctx context.Context, payment models.Payment) error {
+	_, err := r.coll.InsertOne(ctx, payment)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrPaymentPending
+	}
+	return err
+}
+
+func (r *mongoPayments) GetByID(ctx context.Context, id string) (models.Payment, error) {
+	var payment models.Payment
+	err := r.coll.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&payment)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.Payment{}, ErrNotFound
+	}
+	return payment, err
+}
+
+// SetStatus claims the payment with a conditional update on its status, so
+// only one change from that status can succeed, and then changes the
+// enrollment. The enrollment updates are idempotent rather than part of a
+// transaction, so a standalone MongoDB server will do; if they fail, the
+// payment is put back in status from for the change to be retried.
+func (r *mongoPayments) SetStatus(ctx context.Context, id, from, to string, at time.Time) (models.Payment, error) {
+	var before models.Payment
+	err := r.coll.FindOneAndUpdate(ctx,
+		bson.D{{Key: "_id", Value: id}, {Key: "status", Value: from}},
+		bson.A{bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: to},
+			{Key: "settled_at", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$settled_at", at}}}},
+		}}}},
+	).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		payment, err := r.GetByID(ctx, id)
+		if err != nil {
+			return models.Payment{}, err
+		}
+		return payment, ErrStatusConflict
+	}
+	if err != nil {
+		return models.Payment{}, err
+	}
+	payment := before
+	payment.Status = to
+	if payment.SettledAt == nil {
+		payment.SettledAt = &at
+	}
+
+	switch to {
+	case models.PaymentPaid:
+		// Enroll adds the course only if it is missing, and the count is
+		// incremented only when it was added
+		err = r.users.Enroll(ctx, payment.UserID, payment.CourseID)
+		if errors.Is(err, ErrAlreadyEnrolled) {
+			err = nil
+		} else if err == nil {
+			err = r.courses.IncrementEnrolled(ctx, payment.CourseID)
+		}
+	case models.PaymentRefunded:
+		err = r.unenrollRefunded(ctx, payment)
+	}
+	if err != nil {
+		return models.Payment{}, errors.Join(err, r.unclaim(context.WithoutCancel(ctx), before, to))
+	}
+	return payment, nil
+}
+
+// unclaim puts a payment that SetStatus moved to status to back as it was
+// before, after the enrollment change that goes with it failed.
+func (r *mongoPayments) unclaim(ctx context.Context, before models.Payment, to string) error {
+	restore := bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: before.Status}}}}
+	if before.SettledAt == nil {
+		restore = append(restore, bson.E{Key: "$unset", Value: bson.D{{Key: "settled_at", Value: ""}}})
+	}
+	_, err := r.coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: before.ID}, {Key: "status", Value: to}}, restore)
+	return err
+}
+
+// unenrollRefunded takes away the enrollment paid for by a refunded
+// payment, unless the payer has another paid payment for the course.
+func (r *mongoPayments) unenrollRefunded(ctx context.Context, payment models.Payment) error {
+	paid, err := r.coll.CountDocuments(ctx, bson.D{
+		{Key: "user_id", Value: payment.UserID},
+		{Key: "course_id", Value: payment.CourseID},
+		{Key: "status", Value: models.PaymentPaid},
+	}, options.Count().SetLimit(1))
+	if err != nil || paid > 0 {
+		return err
+	}
+	res, err := r.users.coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: payment.UserID}, {Key: "enrolled_courses", Value: payment.CourseID}},
+		bson.D{
+			{Key: "$pull", Value: bson.D{{Key: "enrolled_courses", Value: payment.CourseID}}},
+			{Key: "$unset", Value: bson.D{{Key: "progress." + payment.CourseID, Value: ""}}},
+		},
+	)
+	if err != nil || res.ModifiedCount == 0 {
+		return err
+	}
+	_, err = r.courses.coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: payment.CourseID}, {Key: "enrolled_count", Value: bson.D{{Key: "$gt", Value: 0}}}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "enrolled_count", Value: -1}}}},
+	)
+	return err
+}
+
+func (r *mongoPayments) ListByUser(ctx context.Context, userID string) ([]models.Payment, error) {
+	cur, err := r.coll.Find(ctx,
+		bson.D{{Key: "user_id", Value: userID}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	payments := []models.Payment{}
+	if err := cur.All(ctx, &payments); err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
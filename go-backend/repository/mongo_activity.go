@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/cuanin/emergent-backend/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func ensureMongoActivityIndexes(ctx context.Context, db *mongo.Database) error {
+	if _, err := db.Collection("login_events").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}},
+	}); err != nil {
+		return err
+	}
+	_, err := db.Collection("audit_events").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "created_at", Value: -1}}},
+	})
+	return err
+}
+
+type mongoActivity struct {
+	logins *mongo.Collection
+	audit  *mongo.Collection
+}
+
+func (r *mongoActivity) RecordLogin(ctx context.Context, event models.LoginEvent) error {
+	_, err := r.logins.InsertOne(ctx, event)
+	return err
+}
+
+func (r *mongoActivity) ListLogins(ctx context.Context, userID string) ([]models.LoginEvent, error) {
+	cur, err := r.logins.Find(ctx,
+		bson.D{{Key: "user_id", Value: userID}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	events := []models.LoginEvent{}
+	if err := cur.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (r *mongoActivity) RecordAudit(ctx context.Context, event models.AuditEvent) error {
+	_, err := r.audit.InsertOne(ctx, event)
+	return err
+}
+
+func (r *mongoActivity) ListAudit(ctx context.Context, userID string, limit int) ([]models.AuditEvent, error) {
+	filter := bson.D{}
+	if userID != "" {
+		filter = bson.D{{Key: "user_id", Value: userID}}
+	}
+	cur, err := r.audit.Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	events := []models.AuditEvent{}
+	if err := cur.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,196 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func ensureMongoCouponIndexes(ctx context.Context, db *mongo.Database) error {
+	if _, err := db.Collection("coupons").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "code", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return err
+	}
+	_, err := db.Collection("coupon_redemptions").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "coupon_id", Value: 1}, {Key: "user_id", Value: 1}},
+	})
+	return err
+}
+
+// mongoRedemption is a purchase made with a coupon, stored by payment ID.
+type mongoRedemption struct {
+	PaymentID  string    `bson:"_id"`
+	CouponID   string    `bson:"coupon_id"`
+	UserID     string    `bson:"user_id"`
+	RedeemedAt time.Time `bson:"redeemed_at"`
+}
+
+// mongoCoupons keeps, besides the fields of models.Coupon, a "users"
+// document on each coupon counting the redemptions of each user, so that
+// both limits are checked by a single update of the coupon.
+type mongoCoupons struct {
+	coll        *mongo.Collection
+	redemptions *mongo.Collection
+}
+
+func (r *mongoCoupons) findOne(ctx context.Context, filter bson.D) (models.Coupon, error) {
+	var coupon models.Coupon
+	err := r.coll.FindOne(ctx, filter, options.FindOne().SetProjection(bson.D{{Key: "users", Value: 0}})).Decode(&coupon)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.Coupon{}, ErrNotFound
+	}
+	return coupon, err
+}
+
+func (r *mongoCoupons) Create(ctx context.Context, coupon models.Coupon) error {
+	_, err := r.coll.InsertOne(ctx, coupon)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateCouponCode
+	}
+	return err
+}
+
+func (r *mongoCoupons) GetByID(ctx context.Context, id string) (models.Coupon, error) {
+	return r.findOne(ctx, bson.D{{Key: "_id", Value: id}})
+}
+
+func (r *mongoCoupons) GetByCode(ctx context.Context, code string) (models.Coupon, error) {
+	return r.findOne(ctx, bson.D{{Key: "code", Value: strings.ToUpper(code)}})
+}
+
+func (r *mongoCoupons) List(ctx context.Context) ([]models.Coupon, error) {
+	cur, err := r.coll.Find(ctx, bson.D{}, options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: 1}}).
+		SetProjection(bson.D{{Key: "users", Value: 0}}))
+	if err != nil {
+		return nil, err
+	}
+	coupons := []models.Coupon{}
+	if err := cur.All(ctx, &coupons); err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+func (r *mongoCoupons) Update(ctx context.Context, coupon models.Coupon) error {
+	set := bson.D{
+		{Key: "code", Value: coupon.Code},
+		{Key: "percent_off", Value: coupon.PercentOff},
+		{Key: "course_ids", Value: coupon.CourseIDs},
+		{Key: "categories", Value: coupon.Categories},
+		{Key: "max_redemptions", Value: coupon.MaxRedemptions},
+		{Key: "per_user_limit", Value: coupon.PerUserLimit},
+	}
+	unset := bson.D{}
+	optional := func(field string, value any, ok bool) {
+		if ok {
+			set = append(set, bson.E{Key: field, Value: value})
+		} else {
+			unset = append(unset, bson.E{Key: field, Value: ""})
+		}
+	}
+	optional("amount_off", coupon.AmountOff, coupon.AmountOff != nil)
+	optional("min_spend", coupon.MinSpend, coupon.MinSpend != nil)
+	optional("expires_at", coupon.ExpiresAt, coupon.ExpiresAt != nil)
+	update := bson.D{{Key: "$set", Value: set}}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+	res, err := r.coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: coupon.ID}}, update)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateCouponCode
+	}
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoCoupons) Delete(ctx context.Context, id string) error {
+	res, err := r.coll.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	_, err = r.redemptions.DeleteMany(ctx, bson.D{{Key: "coupon_id", Value: id}})
+	return err
+}
+
+func (r *mongoCoupons) CountRedemptions(ctx context.Context, couponID, userID string) (int, error) {
+	n, err := r.redemptions.CountDocuments(ctx, bson.D{{Key: "coupon_id", Value: couponID}, {Key: "user_id", Value: userID}})
+	return int(n), err
+}
+
+// Redeem counts the redemption on the coupon only if neither limit has
+// been reached, then records it, taking the count back if that fails.
+func (r *mongoCoupons) Redeem(ctx context.Context, couponID, userID, paymentID string, at time.Time) error {
+	used := "$users." + userID
+	res, err := r.coll.UpdateOne(ctx,
+		bson.D{
+			{Key: "_id", Value: couponID},
+			{Key: "$expr", Value: bson.D{{Key: "$and", Value: bson.A{
+				bson.D{{Key: "$or", Value: bson.A{
+					bson.D{{Key: "$eq", Value: bson.A{"$max_redemptions", 0}}},
+					bson.D{{Key: "$lt", Value: bson.A{"$redemptions", "$max_redemptions"}}},
+				}}},
+				bson.D{{Key: "$or", Value: bson.A{
+					bson.D{{Key: "$eq", Value: bson.A{"$per_user_limit", 0}}},
+					bson.D{{Key: "$lt", Value: bson.A{bson.D{{Key: "$ifNull", Value: bson.A{used, 0}}}, "$per_user_limit"}}},
+				}}},
+			}}}},
+		},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "redemptions", Value: 1}, {Key: "users." + userID, Value: 1}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		coupon, err := r.GetByID(ctx, couponID)
+		if err != nil {
+			return err
+		}
+		if coupon.MaxRedemptions > 0 && coupon.Redemptions >= coupon.MaxRedemptions {
+			return ErrCouponExhausted
+		}
+		return ErrCouponUserLimit
+	}
+
+	_, err = r.redemptions.InsertOne(ctx, mongoRedemption{PaymentID: paymentID, CouponID: couponID, UserID: userID, RedeemedAt: at})
+	if err != nil {
+		r.uncount(ctx, couponID, userID)
+		return err
+	}
+	return nil
+}
+
+func (r *mongoCoupons) Release(ctx context.Context, paymentID string) error {
+	var rd mongoRedemption
+	err := r.redemptions.FindOneAndDelete(ctx, bson.D{{Key: "_id", Value: paymentID}}).Decode(&rd)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return r.uncount(ctx, rd.CouponID, rd.UserID)
+}
+
+// uncount takes a user's redemption off the coupon's counts.
+func (r *mongoCoupons) uncount(ctx context.Context, couponID, userID string) error {
+	_, err := r.coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: couponID}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "redemptions", Value: -1}, {Key: "users." + userID, Value: -1}}}})
+	return err
+}
@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func ensureMongoCourseStatusIndexes(ctx context.Context, db *mongo.Database) error {
+	if _, err := db.Collection("courses").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}},
+	}); err != nil {
+		return err
+	}
+	_, err := db.Collection("course_status_changes").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "course_id", Value: 1}, {Key: "changed_at", Value: 1}},
+	})
+	return err
+}
+
+func (r *mongoCourses) recordStatusChange(ctx context.Context, change models.CourseStatusChange) error {
+	if change.ID == "" {
+		change.ID = uuid.New().String()
+	}
+	_, err := r.statusChanges.InsertOne(ctx, change)
+	return err
+}
+
+// SetStatus changes the status with a conditional update, so that of two
+// concurrent changes from the same status only one succeeds. The history
+// entry is written afterwards, without a transaction.
+func (r *mongoCourses) SetStatus(ctx context.Context, change models.CourseStatusChange) error {
+	var update bson.D
+	if change.To == models.CourseArchived {
+		update = bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: change.To}, {Key: "archived_at", Value: change.ChangedAt}}}}
+	} else {
+		update = bson.D{
+			{Key: "$set", Value: bson.D{{Key: "status", Value: change.To}}},
+			{Key: "$unset", Value: bson.D{{Key: "archived_at", Value: ""}}},
+		}
+	}
+	res, err := r.coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: change.CourseID}, {Key: "status", Value: change.From}}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		if _, err := r.GetByID(ctx, change.CourseID); err != nil {
+			return err
+		}
+		return ErrStatusConflict
+	}
+	return r.recordStatusChange(ctx, change)
+}
+
+func (r *mongoCourses) ListStatusChanges(ctx context.Context, courseID string) ([]models.CourseStatusChange, error) {
+	if _, err := r.GetByID(ctx, courseID); err != nil {
+		return nil, err
+	}
+	cur, err := r.statusChanges.Find(ctx,
+		bson.D{{Key: "course_id", Value: courseID}},
+		options.Find().SetSort(bson.D{{Key: "changed_at", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	changes := []models.CourseStatusChange{}
+	if err := cur.All(ctx, &changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
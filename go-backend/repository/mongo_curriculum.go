@@ -0,0 +1,159 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/cuanin/emergent-backend/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// mongoCurriculum keeps the outline of each course in one document of the
+// course_curricula collection, so that every edit is a single-document
+// write. Concurrent edits are detected with a version number and retried.
+type mongoCurriculum struct {
+	coll    *mongo.Collection
+	courses *mongoCourses
+}
+
+type mongoOutline struct {
+	CourseID string  `bson:"_id"`
+	Version  int     `bson:"version"`
+	Modules  outline `bson:"modules"`
+}
+
+// maxCurriculumRetries bounds how often an edit is retried after losing a
+// race with another edit of the same curriculum.
+const maxCurriculumRetries = 10
+
+func (r *mongoCurriculum) load(ctx context.Context, courseID string) (mongoOutline, error) {
+	var doc mongoOutline
+	err := r.coll.FindOne(ctx, bson.D{{Key: "_id", Value: courseID}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return mongoOutline{CourseID: courseID, Modules: outline{}}, nil
+	}
+	if err != nil {
+		return mongoOutline{}, err
+	}
+	doc.Modules.normalize()
+	return doc, nil
+}
+
+// edit applies fn to the outline of the course and stores the result,
+// then updates the course's lesson totals. fn is called again when the
+// outline changed in the meantime, so the callers reset the module or lesson
+// it edits to what was passed in.
+func (r *mongoCurriculum) edit(ctx context.Context, courseID string, fn func(outline) (outline, error)) error {
+	if _, err := r.courses.GetByID(ctx, courseID); err != nil {
+		return err
+	}
+	for range maxCurriculumRetries {
+		doc, err := r.load(ctx, courseID)
+		if err != nil {
+			return err
+		}
+		edited, err := fn(doc.Modules)
+		if err != nil {
+			return err
+		}
+
+		next := mongoOutline{CourseID: courseID, Version: doc.Version + 1, Modules: edited}
+		if doc.Version == 0 {
+			_, err = r.coll.InsertOne(ctx, next)
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		} else {
+			res, err := r.coll.ReplaceOne(ctx, bson.D{{Key: "_id", Value: courseID}, {Key: "version", Value: doc.Version}}, next)
+			if err != nil {
+				return err
+			}
+			if res.MatchedCount == 0 {
+				continue
+			}
+		}
+		return r.updateTotals(ctx, courseID, next.Version, doc.Modules, edited)
+	}
+	return errors.New("curriculum edit kept conflicting with concurrent edits")
+}
+
+// updateTotals stores the lesson totals of a version of the outline on its
+// course, unless a later version got there first.
+func (r *mongoCurriculum) updateTotals(ctx context.Context, courseID string, version int, before, after outline) error {
+	lessons, seconds := after.totals()
+	set := bson.D{
+		{Key: "lesson_count", Value: lessons},
+		{Key: "duration_seconds", Value: seconds},
+		{Key: "curriculum_version", Value: version},
+	}
+	if duration, ok := courseDuration(before, after); ok {
+		set = append(set, bson.E{Key: "duration", Value: duration})
+	}
+	_, err := r.courses.coll.UpdateOne(ctx,
+		bson.D{
+			{Key: "_id", Value: courseID},
+			{Key: "curriculum_version", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: version}}}}},
+		},
+		bson.D{{Key: "$set", Value: set}},
+	)
+	return err
+}
+
+func (r *mongoCurriculum) Outline(ctx context.Context, courseID string) ([]models.Module, error) {
+	if _, err := r.courses.GetByID(ctx, courseID); err != nil {
+		return nil, err
+	}
+	doc, err := r.load(ctx, courseID)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Modules, nil
+}
+
+func (r *mongoCurriculum) CreateModule(ctx context.Context, module *models.Module) error {
+	req := *module
+	return r.edit(ctx, module.CourseID, func(o outline) (outline, error) {
+		*module = req
+		return o.addModule(module), nil
+	})
+}
+
+func (r *mongoCurriculum) UpdateModule(ctx context.Context, module *models.Module) error {
+	req := *module
+	return r.edit(ctx, module.CourseID, func(o outline) (outline, error) {
+		*module = req
+		return o.updateModule(module)
+	})
+}
+
+func (r *mongoCurriculum) DeleteModule(ctx context.Context, courseID, id string) error {
+	return r.edit(ctx, courseID, func(o outline) (outline, error) {
+		return o.deleteModule(id)
+	})
+}
+
+func (r *mongoCurriculum) CreateLesson(ctx context.Context, lesson *models.Lesson) error {
+	req := *lesson
+	return r.edit(ctx, lesson.CourseID, func(o outline) (outline, error) {
+		*lesson = req
+		return o.addLesson(lesson)
+	})
+}
+
+func (r *mongoCurriculum) UpdateLesson(ctx context.Context, lesson *models.Lesson) error {
+	req := *lesson
+	return r.edit(ctx, lesson.CourseID, func(o outline) (outline, error) {
+		*lesson = req
+		return o.updateLesson(lesson)
+	})
+}
+
+func (r *mongoCurriculum) DeleteLesson(ctx context.Context, courseID, id string) error {
+	return r.edit(ctx, courseID, func(o outline) (outline, error) {
+		return o.deleteLesson(id)
+	})
+}
@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func ensureMongoExportIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("data_exports").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "requested_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "requested_at", Value: 1}}},
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+	})
+	return err
+}
+
+// mongoExports keeps each archive in its export's document, in a field that
+// is left out of every query except GetExportArchive.
+type mongoExports struct{ coll *mongo.Collection }
+
+var withoutArchive = bson.D{{Key: "archive", Value: 0}}
+
+func (r *mongoExports) findOne(ctx context.Context, filter bson.D) (models.DataExport, error) {
+	var e models.DataExport
+	err := r.coll.FindOne(ctx, filter, options.FindOne().SetProjection(withoutArchive)).Decode(&e)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.DataExport{}, ErrNotFound
+	}
+	return e, err
+}
+
+func (r *mongoExports) CreateExport(ctx context.Context, export models.DataExport) error {
+	_, err := r.coll.InsertOne(ctx, export)
+	return err
+}
+
+func (r *mongoExports) GetExport(ctx context.Context, id string) (models.DataExport, error) {
+	return r.findOne(ctx, bson.D{{Key: "_id", Value: id}})
+}
+
+func (r *mongoExports) GetExportByToken(ctx context.Context, tokenHash string) (models.DataExport, error) {
+	return r.findOne(ctx, bson.D{{Key: "token_hash", Value: tokenHash}})
+}
+
+func (r *mongoExports) ListExports(ctx context.Context, userID string) ([]models.DataExport, error) {
+	cur, err := r.coll.Find(ctx,
+		bson.D{{Key: "user_id", Value: userID}},
+		options.Find().SetSort(bson.D{{Key: "requested_at", Value: -1}}).SetProjection(withoutArchive),
+	)
+	if err != nil {
+		return nil, err
+	}
+	exports := []models.DataExport{}
+	if err := cur.All(ctx, &exports); err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (r *mongoExports) ClaimExport(ctx context.Context, at, staleBefore time.Time) (models.DataExport, error) {
+	var e models.DataExport
+	err := r.coll.FindOneAndUpdate(ctx,
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "status", Value: models.ExportPending}},
+			bson.D{{Key: "status", Value: models.ExportRunning}, {Key: "started_at", Value: bson.D{{Key: "$lt", Value: staleBefore}}}},
+		}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: models.ExportRunning}, {Key: "started_at", Value: at}}}},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "requested_at", Value: 1}}).
+			SetProjection(withoutArchive).
+			SetReturnDocument(options.After),
+	).Decode(&e)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.DataExport{}, ErrNotFound
+	}
+	return e, err
+}
+
+func (r *mongoExports) CompleteExport(ctx context.Context, id string, archive []byte, tokenHash string, at, expiresAt time.Time) error {
+	res, err := r.coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: id}, {Key: "status", Value: models.ExportRunning}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: models.ExportReady},
+			{Key: "size", Value: len(archive)},
+			{Key: "token_hash", Value: tokenHash},
+			{Key: "archive", Value: archive},
+			{Key: "completed_at", Value: at},
+			{Key: "expires_at", Value: expiresAt},
+		}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoExports) FailExport(ctx context.Context, id, reason string, at time.Time) error {
+	res, err := r.coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: id}, {Key: "status", Value: models.ExportRunning}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: models.ExportFailed},
+			{Key: "error", Value: reason},
+			{Key: "completed_at", Value: at},
+		}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoExports) GetExportArchive(ctx context.Context, id string) ([]byte, error) {
+	var doc struct {
+		Archive []byte `bson:"archive"`
+	}
+	err := r.coll.FindOne(ctx,
+		bson.D{{Key: "_id", Value: id}, {Key: "status", Value: models.ExportReady}},
+		options.FindOne().SetProjection(bson.D{{Key: "archive", Value: 1}}),
+	).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && doc.Archive == nil) {
+		return nil, ErrNotFound
+	}
+	return doc.Archive, err
+}
+
+func (r *mongoExports) ExpireExports(ctx context.Context, at time.Time) error {
+	_, err := r.coll.UpdateMany(ctx,
+		bson.D{{Key: "status", Value: models.ExportReady}, {Key: "expires_at", Value: bson.D{{Key: "$lt", Value: at}}}},
+		bson.D{
+			{Key: "$set", Value: bson.D{{Key: "status", Value: models.ExportExpired}}},
+			{Key: "$unset", Value: bson.D{{Key: "archive", Value: ""}, {Key: "token_hash", Value: ""}}},
+		},
+	)
+	return err
+}
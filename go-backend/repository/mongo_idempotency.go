@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/cuanin/emergent-backend/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func ensureMongoIdempotencyIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("idempotency_keys").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+type mongoIdempotency struct{ coll *mongo.Collection }
+
+// BeginIdempotentRequest relies on the unique index to let only one of
+// several concurrent requests with the same key insert its record. MongoDB
+// removes expired records about once a minute, so one that has expired but
+// is still there is replaced.
+func (r *mongoIdempotency) BeginIdempotentRequest(ctx context.Context, rec models.IdempotencyRecord) (models.IdempotencyRecord, error) {
+	filter := bson.D{{Key: "user_id", Value: rec.UserID}, {Key: "key", Value: rec.Key}}
+	for {
+		_, err := r.coll.InsertOne(ctx, rec)
+		if !mongo.IsDuplicateKeyError(err) {
+			return rec, err
+		}
+		res, err := r.coll.ReplaceOne(ctx, append(filter, bson.E{Key: "expires_at", Value: bson.D{{Key: "$lte", Value: rec.CreatedAt}}}), rec)
+		if err != nil {
+			return models.IdempotencyRecord{}, err
+		}
+		if res.MatchedCount > 0 {
+			return rec, nil
+		}
+		var existing models.IdempotencyRecord
+		err = r.coll.FindOne(ctx, filter).Decode(&existing)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// Released in the meantime
+			continue
+		}
+		if err != nil {
+			return models.IdempotencyRecord{}, err
+		}
+		return existing, ErrIdempotencyKeyUsed
+	}
+}
+
+func (r *mongoIdempotency) CompleteIdempotentRequest(ctx context.Context, rec models.IdempotencyRecord) error {
+	res, err := r.coll.UpdateOne(ctx,
+		bson.D{{Key: "user_id", Value: rec.UserID}, {Key: "key", Value: rec.Key}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status_code", Value: rec.StatusCode},
+			{Key: "content_type", Value: rec.ContentType},
+			{Key: "body", Value: rec.Body},
+		}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoIdempotency) ReleaseIdempotentRequest(ctx context.Context, userID, key string) error {
+	_, err := r.coll.DeleteOne(ctx, bson.D{{Key: "user_id", Value: userID}, {Key: "key", Value: key}, {Key: "status_code", Value: 0}})
+	return err
+}
@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func (r *mongoUsers) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	// $not also matches users written before totp_last_step existed.
+	res, err := r.coll.UpdateOne(ctx,
+		bson.D{
+			{Key: "_id", Value: userID},
+			{Key: "totp_last_step", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: step}}}}},
+		},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "totp_last_step", Value: step}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		if _, err := r.GetByID(ctx, userID); err != nil {
+			return err
+		}
+		return ErrTokenUsed
+	}
+	return nil
+}
+
+// Recovery code hashes are kept in the user document but outside
+// models.User, so that they are never loaded with the account.
+func (r *mongoUsers) ReplaceRecoveryCodes(ctx context.Context, userID string, hashes []string) error {
+	update := bson.D{{Key: "$unset", Value: bson.D{{Key: "recovery_codes", Value: ""}}}}
+	if len(hashes) > 0 {
+		update = bson.D{{Key: "$set", Value: bson.D{{Key: "recovery_codes", Value: hashes}}}}
+	}
+	res, err := r.coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: userID}}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoUsers) UseRecoveryCode(ctx context.Context, userID, hash string) error {
+	res, err := r.coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: userID}, {Key: "recovery_codes", Value: hash}},
+		bson.D{{Key: "$pull", Value: bson.D{{Key: "recovery_codes", Value: hash}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoSettings struct{ coll *mongo.Collection }
+
+func (r *mongoSettings) GetSetting(ctx context.Context, key string) (string, error) {
+	var doc struct {
+		Value string `bson:"value"`
+	}
+	err := r.coll.FindOne(ctx, bson.D{{Key: "_id", Value: key}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", ErrNotFound
+	}
+	return doc.Value, err
+}
+
+func (r *mongoSettings) PutSetting(ctx context.Context, key, value string, at time.Time) error {
+	_, err := r.coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: key}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "value", Value: value}, {Key: "updated_at", Value: at}}}},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/cuanin/emergent-backend/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func ensureMongoOIDCIndexes(ctx context.Context, db *mongo.Database) error {
+	if _, err := db.Collection("user_identities").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "provider", Value: 1}, {Key: "subject", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	}); err != nil {
+		return err
+	}
+	_, err := db.Collection("oidc_states").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+func (r *mongoUsers) GetByIdentity(ctx context.Context, provider, subject string) (models.User, error) {
+	var identity models.Identity
+	err := r.identities.FindOne(ctx, bson.D{{Key: "provider", Value: provider}, {Key: "subject", Value: subject}}).Decode(&identity)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.User{}, ErrNotFound
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+	return r.GetByID(ctx, identity.UserID)
+}
+
+func (r *mongoUsers) LinkIdentity(ctx context.Context, identity models.Identity) error {
+	if _, err := r.GetByID(ctx, identity.UserID); err != nil {
+		return err
+	}
+	_, err := r.identities.InsertOne(ctx, identity)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateIdentity
+	}
+	return err
+}
+
+func (r *mongoUsers) ListIdentities(ctx context.Context, userID string) ([]models.Identity, error) {
+	cur, err := r.identities.Find(ctx,
+		bson.D{{Key: "user_id", Value: userID}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	identities := []models.Identity{}
+	if err := cur.All(ctx, &identities); err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+func (r *mongoTokens) CreateOIDCState(ctx context.Context, state models.OIDCState) error {
+	_, err := r.oidcStates.InsertOne(ctx, state)
+	return err
+}
+
+func (r *mongoTokens) ConsumeOIDCState(ctx context.Context, id string) (models.OIDCState, error) {
+	var state models.OIDCState
+	err := r.oidcStates.FindOneAndDelete(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&state)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.OIDCState{}, ErrNotFound
+	}
+	return state, err
+}
@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// newMongoTestDB connects to the MongoDB deployment at MONGODB_URI, skipping
+// the test if it is not set, and returns a database of its own that is
+// dropped when the test ends.
+func newMongoTestDB(t *testing.T) (uri string, db *mongo.Database) {
+	t.Helper()
+	uri = os.Getenv("MONGODB_URI")
+	if uri == "" {
+		t.Skip("MONGODB_URI is not set")
+	}
+	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = client.Database("emergent_test_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:12])
+	t.Cleanup(func() {
+		ctx := context.Background()
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+	return uri, db
+}
+
+// newMongoTestStore returns a Store on a database of its own, as
+// newMongoTestDB does.
+func newMongoTestStore(t *testing.T) Store {
+	t.Helper()
+	uri, db := newMongoTestDB(t)
+	store, err := NewMongoStore(context.Background(), uri, db.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close(context.Background()) })
+	return store
+}
+
+func TestMongoStore(t *testing.T) {
+	testStore(t, newMongoTestStore(t))
+}
+
+func TestMongoStoreConcurrent(t *testing.T) {
+	testStoreConcurrent(t, newMongoTestStore(t))
+}
+
+func TestMigrateMongo(t *testing.T) {
+	uri, db := newMongoTestDB(t)
+	ctx := context.Background()
+	created := time.Now().UTC().Truncate(time.Millisecond)
+
+	// Documents as they were written before the fields migrateMongo
+	// backfills existed
+	if _, err := db.Collection("users").InsertMany(ctx, []any{
+		bson.D{{Key: "_id", Value: "admin"}, {Key: "email", Value: "admin@example.com"}, {Key: "is_admin", Value: true}},
+		bson.D{{Key: "_id", Value: "student"}, {Key: "email", Value: "student@example.com"}, {Key: "is_admin", Value: false}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Collection("courses").InsertMany(ctx, []any{
+		bson.D{{Key: "_id", Value: "live"}, {Key: "title", Value: "Live"}, {Key: "price", Value: 499000.4}},
+		bson.D{{Key: "_id", Value: "gone"}, {Key: "title", Value: "Gone"}, {Key: "price", Value: 799000}, {Key: "archived_at", Value: created}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Collection("payments").InsertOne(ctx, bson.D{
+		{Key: "_id", Value: "old"}, {Key: "user_id", Value: "student"}, {Key: "course_id", Value: "live"},
+		{Key: "amount", Value: 499000.0}, {Key: "status", Value: "completed"}, {Key: "created_at", Value: created},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// NewMongoStore migrates on every start, which must leave migrated
+	// documents as they are
+	var store Store
+	for range 2 {
+		s, err := NewMongoStore(ctx, uri, db.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close(ctx) })
+		store = s
+	}
+
+	for id, want := range map[string]string{"admin": models.RoleAdmin, "student": models.RoleStudent} {
+		user, err := store.Users.GetByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Role != want || !user.EmailVerified {
+			t.Errorf("user %s: role %q, verified %v, want %q and verified", id, user.Role, user.EmailVerified, want)
+		}
+	}
+
+	for id, want := range map[string]models.Course{
+		"live": {Status: models.CoursePublished, Price: money.New(499000, money.IDR)},
+		"gone": {Status: models.CourseArchived, Price: money.New(799000, money.IDR)},
+	} {
+		course, err := store.Courses.GetByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if course.Status != want.Status || course.Price != want.Price {
+			t.Errorf("course %s: status %q, price %v, want %q and %v", id, course.Status, course.Price, want.Status, want.Price)
+		}
+	}
+
+	payment, err := store.Payments.GetByID(ctx, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Status != models.PaymentPaid || payment.SettledAt == nil || !payment.SettledAt.Equal(created) {
+		t.Errorf("payment: status %q, settled at %v, want paid at %v", payment.Status, payment.SettledAt, created)
+	}
+	if want := money.New(499000, money.IDR); payment.Amount != want {
+		t.Errorf("payment amount = %v, want %v", payment.Amount, want)
+	}
+}
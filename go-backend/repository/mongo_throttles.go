@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// throttleRetention is how long MongoDB keeps a login counter after its last
+// failure. It must be longer than the lockout decay of the login policy.
+const throttleRetention = 7 * 24 * time.Hour
+
+func ensureMongoThrottleIndexes(ctx context.Context, db *mongo.Database) error {
+	if _, err := db.Collection("login_throttles").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "last_failure_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(throttleRetention.Seconds())),
+	}); err != nil {
+		return err
+	}
+	_, err := db.Collection("login_lockouts").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "created_at", Value: -1}},
+	})
+	return err
+}
+
+type mongoThrottles struct {
+	throttles *mongo.Collection
+	lockouts  *mongo.Collection
+}
+
+func (r *mongoThrottles) GetLoginThrottle(ctx context.Context, key string) (models.LoginThrottle, error) {
+	var t models.LoginThrottle
+	err := r.throttles.FindOne(ctx, bson.D{{Key: "_id", Value: key}}).Decode(&t)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.LoginThrottle{}, ErrNotFound
+	}
+	return t, err
+}
+
+func (r *mongoThrottles) RecordLoginFailure(ctx context.Context, key string, at time.Time, window, decay time.Duration) (models.LoginThrottle, error) {
+	// An update pipeline lets the new counter depend on the stored one in a
+	// single atomic upsert. Expressions in one $set stage all see the old
+	// document.
+	lastFailure := bson.D{{Key: "$ifNull", Value: bson.A{"$last_failure_at", time.Time{}}}}
+	stale := func(age time.Duration) bson.D {
+		return bson.D{{Key: "$lt", Value: bson.A{lastFailure, at.Add(-age)}}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "failures", Value: bson.D{{Key: "$cond", Value: bson.A{
+				stale(window), 1, bson.D{{Key: "$add", Value: bson.A{"$failures", 1}}},
+			}}}},
+			{Key: "lockouts", Value: bson.D{{Key: "$cond", Value: bson.A{
+				stale(decay), 0, bson.D{{Key: "$ifNull", Value: bson.A{"$lockouts", 0}}},
+			}}}},
+			{Key: "last_failure_at", Value: at},
+		}}},
+	}
+
+	var t models.LoginThrottle
+	err := r.throttles.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: key}}, pipeline,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&t)
+	return t, err
+}
+
+func (r *mongoThrottles) LockLogin(ctx context.Context, key string, until time.Time) error {
+	_, err := r.throttles.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: key}},
+		bson.D{
+			{Key: "$set", Value: bson.D{{Key: "failures", Value: 0}, {Key: "locked_until", Value: until}}},
+			{Key: "$inc", Value: bson.D{{Key: "lockouts", Value: 1}}},
+			{Key: "$setOnInsert", Value: bson.D{{Key: "last_failure_at", Value: time.Now()}}},
+		},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
+
+func (r *mongoThrottles) ResetLogin(ctx context.Context, key string) error {
+	_, err := r.throttles.DeleteOne(ctx, bson.D{{Key: "_id", Value: key}})
+	return err
+}
+
+func (r *mongoThrottles) RecordLockout(ctx context.Context, event models.LockoutEvent) error {
+	_, err := r.lockouts.InsertOne(ctx, event)
+	return err
+}
@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func ensureMongoTokenIndexes(ctx context.Context, db *mongo.Database) error {
+	// MongoDB deletes documents once their expires_at has passed.
+	expire := options.Index().SetExpireAfterSeconds(0)
+	if _, err := db.Collection("refresh_tokens").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "family_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: expire},
+	}); err != nil {
+		return err
+	}
+	if _, err := db.Collection("revoked_tokens").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: expire,
+	}); err != nil {
+		return err
+	}
+	_, err := db.Collection("action_tokens").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: expire,
+	})
+	return err
+}
+
+type mongoTokens struct {
+	refresh    *mongo.Collection
+	revoked    *mongo.Collection
+	actions    *mongo.Collection
+	oidcStates *mongo.Collection
+}
+
+func (r *mongoTokens) CreateRefreshToken(ctx context.Context, token models.RefreshToken) error {
+	_, err := r.refresh.InsertOne(ctx, token)
+	return err
+}
+
+func (r *mongoTokens) GetRefreshToken(ctx context.Context, id string) (models.RefreshToken, error) {
+	var token models.RefreshToken
+	err := r.refresh.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&token)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.RefreshToken{}, ErrNotFound
+	}
+	return token, err
+}
+
+func (r *mongoTokens) MarkRefreshTokenUsed(ctx context.Context, id string, at time.Time) error {
+	res, err := r.refresh.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: id}, {Key: "used_at", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "used_at", Value: at}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		if _, err := r.GetRefreshToken(ctx, id); err != nil {
+			return err
+		}
+		return ErrTokenUsed
+	}
+	return nil
+}
+
+func (r *mongoTokens) RevokeRefreshFamily(ctx context.Context, familyID string, at time.Time) error {
+	_, err := r.refresh.UpdateMany(ctx,
+		bson.D{{Key: "family_id", Value: familyID}, {Key: "revoked_at", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "revoked_at", Value: at}}}},
+	)
+	return err
+}
+
+func (r *mongoTokens) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := r.revoked.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: jti}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "expires_at", Value: expiresAt}}}},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
+
+func (r *mongoTokens) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	n, err := r.revoked.CountDocuments(ctx, bson.D{{Key: "_id", Value: jti}})
+	return n > 0, err
+}
+
+func (r *mongoTokens) RevokeUserRefreshTokens(ctx context.Context, userID string, at time.Time) error {
+	_, err := r.refresh.UpdateMany(ctx,
+		bson.D{{Key: "user_id", Value: userID}, {Key: "revoked_at", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "revoked_at", Value: at}}}},
+	)
+	return err
+}
+
+func (r *mongoTokens) CreateActionToken(ctx context.Context, token models.ActionToken) error {
+	_, err := r.actions.InsertOne(ctx, token)
+	return err
+}
+
+func (r *mongoTokens) ConsumeActionToken(ctx context.Context, id, purpose string, at time.Time) (models.ActionToken, error) {
+	var token models.ActionToken
+	err := r.actions.FindOneAndUpdate(ctx,
+		bson.D{
+			{Key: "_id", Value: id},
+			{Key: "purpose", Value: purpose},
+			{Key: "used_at", Value: bson.D{{Key: "$exists", Value: false}}},
+		},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "used_at", Value: at}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&token)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		n, countErr := r.actions.CountDocuments(ctx, bson.D{{Key: "_id", Value: id}, {Key: "purpose", Value: purpose}})
+		if countErr != nil {
+			return models.ActionToken{}, countErr
+		}
+		if n > 0 {
+			return models.ActionToken{}, ErrTokenUsed
+		}
+		return models.ActionToken{}, ErrNotFound
+	}
+	return token, err
+}
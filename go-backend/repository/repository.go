@@ -0,0 +1,476 @@
+// Package repository defines the storage interfaces used by the HTTP
+// handlers, together with the backends that implement them.
+package repository
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+)
+
+var (
+	// ErrNotFound is returned when the requested record does not exist.
+	ErrNotFound = errors.New("record not found")
+	// ErrDuplicateEmail is returned when a user with the same email already exists.
+	ErrDuplicateEmail = errors.New("email already registered")
+	// ErrAlreadyEnrolled is returned when a user is already enrolled in a course.
+	ErrAlreadyEnrolled = errors.New("user already enrolled in this course")
+	// ErrTokenUsed is returned when a single-use token has already been used.
+	ErrTokenUsed = errors.New("token already used")
+	// ErrDuplicateIdentity is returned when a provider identity is already
+	// linked to a user.
+	ErrDuplicateIdentity = errors.New("identity already linked")
+	// ErrIdempotencyKeyUsed is returned when a request with the same
+	// Idempotency-Key was already made.
+	ErrIdempotencyKeyUsed = errors.New("idempotency key already used")
+	// ErrStatusConflict is returned when a course or payment is no longer
+	// in the status a change was made from.
+	ErrStatusConflict = errors.New("status has changed")
+	// ErrDuplicateCouponCode is returned when a coupon with the same code
+	// already exists.
+	ErrDuplicateCouponCode = errors.New("coupon code already exists")
+	// ErrCouponExhausted is returned when a coupon has been redeemed as many
+	// times as it may be.
+	ErrCouponExhausted = errors.New("coupon fully redeemed")
+	// ErrCouponUserLimit is returned when a user has redeemed a coupon as
+	// many times as each user may.
+	ErrCouponUserLimit = errors.New("coupon redemption limit reached for user")
+	// ErrPaymentPending is returned when a user already has a pending
+	// payment for the course they are buying.
+	ErrPaymentPending = errors.New("payment already pending")
+)
+
+// UserRepository stores user accounts and their course enrollments.
+type UserRepository interface {
+	GetByID(ctx context.Context, id string) (models.User, error)
+	GetByEmail(ctx context.Context, email string) (models.User, error)
+	Create(ctx context.Context, user models.User) error
+	// Update saves the account fields of user (everything except
+	// enrollments, progress, TOTPLastStep, DeletedAt, suspension and
+	// SessionsEndedAt).
+	Update(ctx context.Context, user models.User) error
+	// Search returns a page of the users matching filter, newest first,
+	// and the total number of matches.
+	Search(ctx context.Context, filter UserFilter) ([]models.User, int, error)
+	// SetSuspension suspends the account with the given reason, or
+	// reactivates it if at is nil.
+	SetSuspension(ctx context.Context, id string, at *time.Time, reason string) error
+	UpdateLastLogin(ctx context.Context, id string, at time.Time) error
+	// EndSessions records that access tokens issued to the user before
+	// at must be refused.
+	EndSessions(ctx context.Context, id string, at time.Time) error
+	// Enroll adds courseID to the user's enrolled courses with zero progress.
+	Enroll(ctx context.Context, userID, courseID string) error
+
+	// UseTOTPStep records that the TOTP code for step was accepted. It
+	// returns ErrTokenUsed if that or a later step was already used, so a
+	// code cannot be replayed.
+	UseTOTPStep(ctx context.Context, userID string, step int64) error
+	// ReplaceRecoveryCodes replaces the user's two-factor recovery codes
+	// with the given hashes; nil removes them all.
+	ReplaceRecoveryCodes(ctx context.Context, userID string, hashes []string) error
+	// UseRecoveryCode removes the recovery code with the given hash. It
+	// returns ErrNotFound if the user has no such code.
+	UseRecoveryCode(ctx context.Context, userID, hash string) error
+
+	// GetByIdentity returns the user linked to the provider account.
+	GetByIdentity(ctx context.Context, provider, subject string) (models.User, error)
+	// LinkIdentity links a provider account to a user. It returns
+	// ErrDuplicateIdentity if the account is already linked.
+	LinkIdentity(ctx context.Context, identity models.Identity) error
+	// ListIdentities returns the provider accounts linked to the user.
+	ListIdentities(ctx context.Context, userID string) ([]models.Identity, error)
+
+	// Anonymize deletes the user's account by replacing their personal data
+	// with placeholders and removing their badges, linked identities,
+	// recovery codes, login history, data exports and the action tokens
+	// sent by email, such as password reset links. The record itself, with
+	// its enrollments and payments, is kept for accounting.
+	Anonymize(ctx context.Context, id string, at time.Time) error
+}
+
+// UserFilter selects users for UserRepository.Search.
+type UserFilter struct {
+	// Query matches part of the email address or full name, ignoring case.
+	Query string
+	// Role matches the effective role when not empty.
+	Role string
+	// Status is models.UserActive, UserSuspended or UserDeleted. When
+	// empty, every user except deleted ones matches.
+	Status string
+	Offset int
+	Limit  int
+}
+
+// matches reports whether user is selected by f, for backends that filter
+// in Go.
+func (f UserFilter) matches(user models.User) bool {
+	if f.Status == "" {
+		if user.DeletedAt != nil {
+			return false
+		}
+	} else if user.Status() != f.Status {
+		return false
+	}
+	if f.Role != "" && user.EffectiveRole() != f.Role {
+		return false
+	}
+	q := strings.ToLower(f.Query)
+	return strings.Contains(strings.ToLower(user.Email), q) || strings.Contains(strings.ToLower(user.FullName), q)
+}
+
+// Sort orders for CourseFilter.Sort
+const (
+	CourseSortCreatedAt     = "created_at"
+	CourseSortPrice         = "price"
+	CourseSortEnrolledCount = "enrolled_count"
+	CourseSortRating        = "rating"
+)
+
+// CourseFilter selects courses for CourseRepository.Search. Each list
+// matches courses with any of its values, ignoring case; empty lists match
+// every course, except for Statuses.
+type CourseFilter struct {
+	// Statuses matches courses in any of the given statuses, and only
+	// published courses when empty.
+	Statuses   []string
+	Categories []string
+	Levels     []string
+	Mentors    []string
+	// Topics matches courses that have at least one of the topics.
+	Topics []string
+	// MinPrice and MaxPrice bound the price, which must then be in their
+	// currency; both bounds are in the same currency.
+	MinPrice *money.Money
+	MaxPrice *money.Money
+	// Sort is one of the CourseSort constants, CourseSortCreatedAt when
+	// empty. Courses that sort equal are ordered by ID.
+	Sort   string
+	Desc   bool
+	Offset int
+	Limit  int
+}
+
+// matches reports whether course is selected by f, for backends that
+// filter in Go.
+func (f CourseFilter) matches(course models.Course) bool {
+	if len(f.Statuses) == 0 {
+		if !course.Listed() {
+			return false
+		}
+	} else if !matchesAny(f.Statuses, course.Status) {
+		return false
+	}
+	if f.MinPrice != nil && (course.Price.Currency != f.MinPrice.Currency || course.Price.Amount < f.MinPrice.Amount) {
+		return false
+	}
+	if f.MaxPrice != nil && (course.Price.Currency != f.MaxPrice.Currency || course.Price.Amount > f.MaxPrice.Amount) {
+		return false
+	}
+	if !matchesAny(f.Categories, course.Category) || !matchesAny(f.Levels, course.Level) || !matchesAny(f.Mentors, course.MentorName) {
+		return false
+	}
+	if len(f.Topics) == 0 {
+		return true
+	}
+	for _, topic := range course.Topics {
+		if matchesAny(f.Topics, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// less reports whether a sorts before b in the order asked for by f.
+func (f CourseFilter) less(a, b models.Course) bool {
+	var order int
+	switch f.Sort {
+	case CourseSortPrice:
+		// Prices only compare within a currency, so courses are grouped
+		// by currency first
+		order = cmp.Or(cmp.Compare(a.Price.Currency, b.Price.Currency), cmp.Compare(a.Price.Amount, b.Price.Amount))
+	case CourseSortEnrolledCount:
+		order = cmp.Compare(a.EnrolledCount, b.EnrolledCount)
+	case CourseSortRating:
+		order = cmp.Compare(a.Rating, b.Rating)
+	default:
+		order = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if f.Desc {
+		order = -order
+	}
+	if order != 0 {
+		return order < 0
+	}
+	return a.ID < b.ID
+}
+
+// matchesAny reports whether values is empty or holds s, ignoring case.
+func matchesAny(values []string, s string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// CourseRepository stores the course catalog.
+type CourseRepository interface {
+	List(ctx context.Context) ([]models.Course, error)
+	// Search returns one page of the courses selected by filter, and how
+	// many courses it selects in total.
+	Search(ctx context.Context, filter CourseFilter) ([]models.Course, int, error)
+	GetByID(ctx context.Context, id string) (models.Course, error)
+	// Create stores a new course, assigning an ID if course.ID is empty.
+	Create(ctx context.Context, course *models.Course) error
+	// Update replaces the editable fields of the course. The ID, creation
+	// time, enrolled count, rating, status and archive time are kept, and so
+	// is the duration once the course has lessons. Payments already made
+	// keep the amount that was paid.
+	Update(ctx context.Context, course models.Course) error
+	// Delete removes the course, with its curriculum, if nobody has
+	// enrolled in or paid for it.
+	// Otherwise the course is archived by userID at the given time, so that
+	// buyers keep access but it can no longer be purchased, and archived is
+	// true.
+	Delete(ctx context.Context, id, userID string, at time.Time) (archived bool, err error)
+	IncrementEnrolled(ctx context.Context, id string) error
+
+	// SetStatus moves the course from change.From to change.To, setting
+	// ArchivedAt while it is archived, and records the change in its
+	// history, assigning change.ID if empty. It returns ErrStatusConflict
+	// if the course is no longer in change.From.
+	SetStatus(ctx context.Context, change models.CourseStatusChange) error
+	// ListStatusChanges returns the status history of the course, oldest
+	// first.
+	ListStatusChanges(ctx context.Context, courseID string) ([]models.CourseStatusChange, error)
+}
+
+// CurriculumRepository stores the modules and lessons of courses. Modules
+// and lessons are inserted or moved to a 1-based position, shifting their
+// siblings to make room; a position of zero or past the end puts them last.
+// Every change to the lessons of a course updates its LessonCount,
+// DurationSeconds and, while it has lessons, Duration.
+type CurriculumRepository interface {
+	// Outline returns the modules of the course in order, each with its
+	// lessons in order.
+	Outline(ctx context.Context, courseID string) ([]models.Module, error)
+	// CreateModule adds a module to its course, assigning its ID and
+	// final position. It returns ErrNotFound if the course does not exist.
+	CreateModule(ctx context.Context, module *models.Module) error
+	// UpdateModule renames the module and moves it to module.Position.
+	UpdateModule(ctx context.Context, module *models.Module) error
+	// DeleteModule removes a module of the course with all its lessons.
+	DeleteModule(ctx context.Context, courseID, id string) error
+	// CreateLesson adds a lesson to lesson.ModuleID, assigning its ID and
+	// final position. It returns ErrNotFound if the module is not part of
+	// lesson.CourseID.
+	CreateLesson(ctx context.Context, lesson *models.Lesson) error
+	// UpdateLesson saves the lesson and moves it to lesson.Position in
+	// lesson.ModuleID, which may be another module of the same course.
+	UpdateLesson(ctx context.Context, lesson *models.Lesson) error
+	// DeleteLesson removes a lesson of the course.
+	DeleteLesson(ctx context.Context, courseID, id string) error
+}
+
+// PaymentRepository stores payment transactions.
+type PaymentRepository interface {
+	// Create stores a new payment. A user has at most one pending payment
+	// for a course; Create returns ErrPaymentPending for a second one.
+	Create(ctx context.Context, payment models.Payment) error
+	GetByID(ctx context.Context, id string) (models.Payment, error)
+	// SetStatus moves a payment from status from to status to as of at, and
+	// returns it. Paying also enrolls the payer in the course, even if the
+	// course has since been archived, and increments the course's enrolled
+	// count; a payer who is already enrolled is left as is. Refunding takes
+	// the enrollment away and decrements the count, unless the payer has
+	// another paid payment for the course. Only one change from status from
+	// succeeds, and if the enrollment cannot be changed the payment is left
+	// in status from. It returns the payment with ErrStatusConflict if it
+	// is no longer in status from.
+	SetStatus(ctx context.Context, id, from, to string, at time.Time) (models.Payment, error)
+	// ListByUser returns the user's payments in insertion order.
+	ListByUser(ctx context.Context, userID string) ([]models.Payment, error)
+}
+
+// CouponRepository stores discount coupons and counts their redemptions,
+// one per payment made with a coupon.
+type CouponRepository interface {
+	Create(ctx context.Context, coupon models.Coupon) error
+	GetByID(ctx context.Context, id string) (models.Coupon, error)
+	// GetByCode returns the coupon with code, ignoring case.
+	GetByCode(ctx context.Context, code string) (models.Coupon, error)
+	// List returns every coupon, newest first.
+	List(ctx context.Context) ([]models.Coupon, error)
+	// Update saves every field of coupon except Redemptions and CreatedAt.
+	Update(ctx context.Context, coupon models.Coupon) error
+	Delete(ctx context.Context, id string) error
+	// CountRedemptions returns how many redemptions of the coupon the user
+	// holds.
+	CountRedemptions(ctx context.Context, couponID, userID string) (int, error)
+	// Redeem records a redemption of the coupon by the user for a payment.
+	// The coupon's limits are checked as part of the same atomic change, so
+	// concurrent purchases cannot redeem it more often than allowed: it
+	// returns ErrCouponExhausted or ErrCouponUserLimit once a limit is
+	// reached.
+	Redeem(ctx context.Context, couponID, userID, paymentID string, at time.Time) error
+	// Release gives back the redemption made for a payment. It does nothing
+	// if there is none, so it is safe to repeat.
+	Release(ctx context.Context, paymentID string) error
+}
+
+// IdempotencyRepository stores the responses to requests made with an
+// Idempotency-Key, per user and key, until they expire.
+type IdempotencyRepository interface {
+	// BeginIdempotentRequest stores rec, which has no response yet, and
+	// returns it. If the user already used the key and the record has not
+	// expired, it returns that record with ErrIdempotencyKeyUsed instead.
+	BeginIdempotentRequest(ctx context.Context, rec models.IdempotencyRecord) (models.IdempotencyRecord, error)
+	// CompleteIdempotentRequest saves the response in rec to the record of
+	// its user and key.
+	CompleteIdempotentRequest(ctx context.Context, rec models.IdempotencyRecord) error
+	// ReleaseIdempotentRequest removes the record of a request that has no
+	// response, so that it can be retried.
+	ReleaseIdempotentRequest(ctx context.Context, userID, key string) error
+}
+
+// TokenRepository stores refresh tokens and the access token revocation list.
+type TokenRepository interface {
+	CreateRefreshToken(ctx context.Context, token models.RefreshToken) error
+	GetRefreshToken(ctx context.Context, id string) (models.RefreshToken, error)
+	// MarkRefreshTokenUsed records that the token was rotated. It returns
+	// ErrTokenUsed if the token was already used, so that only one of several
+	// concurrent refreshes succeeds.
+	MarkRefreshTokenUsed(ctx context.Context, id string, at time.Time) error
+	// RevokeRefreshFamily revokes every refresh token in the family.
+	RevokeRefreshFamily(ctx context.Context, familyID string, at time.Time) error
+	// RevokeAccessToken adds jti to the revocation list until expiresAt.
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error)
+	// RevokeUserRefreshTokens revokes every refresh token issued to the user.
+	RevokeUserRefreshTokens(ctx context.Context, userID string, at time.Time) error
+
+	CreateActionToken(ctx context.Context, token models.ActionToken) error
+	// ConsumeActionToken marks the token used and returns it. It returns
+	// ErrNotFound if no token with that ID and purpose exists, and
+	// ErrTokenUsed if it was already consumed.
+	ConsumeActionToken(ctx context.Context, id, purpose string, at time.Time) (models.ActionToken, error)
+
+	CreateOIDCState(ctx context.Context, state models.OIDCState) error
+	// ConsumeOIDCState deletes the pending login and returns it, or
+	// ErrNotFound if there is none, so that each state is used once.
+	ConsumeOIDCState(ctx context.Context, id string) (models.OIDCState, error)
+}
+
+// LoginThrottleRepository stores failed login counters and lockout events.
+// Keeping them in the shared store applies the limits across instances.
+type LoginThrottleRepository interface {
+	GetLoginThrottle(ctx context.Context, key string) (models.LoginThrottle, error)
+	// RecordLoginFailure atomically counts a failed login for key and returns
+	// the updated counter. Failures older than window are forgotten, and so
+	// are past lockouts once the last failure is older than decay.
+	RecordLoginFailure(ctx context.Context, key string, at time.Time, window, decay time.Duration) (models.LoginThrottle, error)
+	// LockLogin blocks key until the given time, increments its lockout
+	// count and clears its failures.
+	LockLogin(ctx context.Context, key string, until time.Time) error
+	// ResetLogin forgets every failure and lockout for key.
+	ResetLogin(ctx context.Context, key string) error
+	RecordLockout(ctx context.Context, event models.LockoutEvent) error
+}
+
+// SettingsRepository stores runtime settings that admins can change
+// through the API, as string values by key.
+type SettingsRepository interface {
+	// GetSetting returns ErrNotFound if key has never been set.
+	GetSetting(ctx context.Context, key string) (string, error)
+	PutSetting(ctx context.Context, key, value string, at time.Time) error
+}
+
+// ActivityRepository stores the login history of accounts and the audit log.
+type ActivityRepository interface {
+	RecordLogin(ctx context.Context, event models.LoginEvent) error
+	// ListLogins returns the user's login history, newest first.
+	ListLogins(ctx context.Context, userID string) ([]models.LoginEvent, error)
+	RecordAudit(ctx context.Context, event models.AuditEvent) error
+	// ListAudit returns up to limit audit events, newest first, about the
+	// given user or about everyone if userID is empty.
+	ListAudit(ctx context.Context, userID string, limit int) ([]models.AuditEvent, error)
+}
+
+// ExportRepository stores personal data exports and their archives.
+type ExportRepository interface {
+	CreateExport(ctx context.Context, export models.DataExport) error
+	GetExport(ctx context.Context, id string) (models.DataExport, error)
+	// GetExportByToken returns the export whose download token has the
+	// given hash.
+	GetExportByToken(ctx context.Context, tokenHash string) (models.DataExport, error)
+	// ListExports returns the user's exports, newest first.
+	ListExports(ctx context.Context, userID string) ([]models.DataExport, error)
+	// ClaimExport marks the oldest pending export running and returns it,
+	// or returns ErrNotFound if there is none. Exports that have been
+	// running since before staleBefore are claimed again, so that a job is
+	// not lost when the server running it stops.
+	ClaimExport(ctx context.Context, at, staleBefore time.Time) (models.DataExport, error)
+	// CompleteExport stores the archive of a running export and marks it
+	// ready. It returns ErrNotFound if the export is not running.
+	CompleteExport(ctx context.Context, id string, archive []byte, tokenHash string, at, expiresAt time.Time) error
+	// FailExport marks a running export failed.
+	FailExport(ctx context.Context, id, reason string, at time.Time) error
+	// GetExportArchive returns the archive of a ready export.
+	GetExportArchive(ctx context.Context, id string) ([]byte, error)
+	// ExpireExports deletes the archives of ready exports that expired
+	// before at and marks them expired.
+	ExpireExports(ctx context.Context, at time.Time) error
+}
+
+// Store groups the repositories of a single storage backend.
+type Store struct {
+	Users       UserRepository
+	Courses     CourseRepository
+	Curriculum  CurriculumRepository
+	Payments    PaymentRepository
+	Tokens      TokenRepository
+	Throttles   LoginThrottleRepository
+	Settings    SettingsRepository
+	Activity    ActivityRepository
+	Exports     ExportRepository
+	Idempotency IdempotencyRepository
+	Coupons     CouponRepository
+
+	closer func(context.Context) error
+}
+
+// Close releases the resources held by the backend, if any.
+func (s Store) Close(ctx context.Context) error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer(ctx)
+}
+
+// anonymized returns user with their personal data replaced by the
+// placeholders Anonymize stores.
+func anonymized(user models.User, at time.Time) models.User {
+	user.Email = "deleted-" + user.ID + "@deleted.invalid"
+	user.Password = ""
+	user.FullName = "Deleted User"
+	user.AvatarURL = ""
+	user.EmailVerified = false
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	user.Badges = []string{}
+	user.LastLogin = nil
+	user.SuspendedAt = nil
+	user.SuspendedReason = ""
+	user.DeletedAt = &at
+	return user
+}
@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/cuanin/emergent-backend/data"
+)
+
+// Seed loads the dummy data from the data package into an empty store. It is
+// a no-op when the store already holds courses.
+func Seed(ctx context.Context, store Store) error {
+	courses, err := store.Courses.List(ctx)
+	if err != nil {
+		return err
+	}
+	if len(courses) > 0 {
+		return nil
+	}
+
+	for _, course := range data.Courses {
+		course := cloneCourse(course)
+		if err := store.Courses.Create(ctx, &course); err != nil {
+			return err
+		}
+	}
+	for _, user := range data.Users {
+		if err := store.Users.Create(ctx, cloneUser(user)); err != nil && !errors.Is(err, ErrDuplicateEmail) {
+			return err
+		}
+	}
+	for _, payment := range data.Payments {
+		if err := store.Payments.Create(ctx, payment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,851 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLDatabase is a SQLite or PostgreSQL database holding the relational
+// schema from the migrations directory.
+type SQLDatabase struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// OpenSQL opens a database for the given driver, "sqlite" or "postgres".
+// For SQLite, dsn is a file name such as "emergent.db"; for PostgreSQL it is
+// a connection URL.
+func OpenSQL(driver, dsn string) (*SQLDatabase, error) {
+	switch driver {
+	case "sqlite":
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		db, err := sql.Open("sqlite", dsn+sep+"_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+		if err != nil {
+			return nil, err
+		}
+		// SQLite allows a single writer; serialising on one connection
+		// avoids SQLITE_BUSY and keeps ":memory:" databases shared.
+		db.SetMaxOpenConns(1)
+		return &SQLDatabase{db: db}, nil
+	case "postgres":
+		db, err := sql.Open("pgx", dsn)
+		if err != nil {
+			return nil, err
+		}
+		return &SQLDatabase{db: db, postgres: true}, nil
+	default:
+		return nil, fmt.Errorf("unsupported SQL driver %q", driver)
+	}
+}
+
+// Close closes the underlying database handle.
+func (d *SQLDatabase) Close() error {
+	return d.db.Close()
+}
+
+// Store returns the repositories backed by this database. The schema must
+// already be migrated.
+func (d *SQLDatabase) Store() Store {
+	return Store{
+		Users:       &sqlUsers{d},
+		Courses:     &sqlCourses{d},
+		Curriculum:  &sqlCurriculum{d},
+		Payments:    &sqlPayments{d},
+		Tokens:      &sqlTokens{d},
+		Throttles:   &sqlThrottles{d},
+		Settings:    &sqlSettings{d},
+		Activity:    &sqlActivity{d},
+		Exports:     &sqlExports{d},
+		Idempotency: &sqlIdempotency{d},
+		Coupons:     &sqlCoupons{d},
+		closer:      func(context.Context) error { return d.Close() },
+	}
+}
+
+// sqlQuerier is satisfied by both *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// rebind rewrites the ? placeholders in query to $1, $2, ... for PostgreSQL.
+func (d *SQLDatabase) rebind(query string) string {
+	if !d.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// withTx runs fn inside a transaction, committing if it returns nil.
+func (d *SQLDatabase) withTx(ctx context.Context, fn func(tx sqlQuerier) error) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// isUniqueViolation reports whether err is a unique or primary key constraint
+// failure from either driver.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505"
+	}
+	var liteErr *sqlite.Error
+	if errors.As(err, &liteErr) {
+		return liteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE ||
+			liteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	return false
+}
+
+type sqlUsers struct{ d *SQLDatabase }
+
+const userColumns = `id, email, password, full_name, avatar_url, is_admin, role, email_verified, totp_secret, totp_enabled, totp_last_step, created_at, last_login, deleted_at, suspended_at, suspended_reason, sessions_ended_at`
+
+func scanUser(row interface{ Scan(...any) error }) (models.User, error) {
+	var (
+		user                                             models.User
+		lastLogin, deletedAt, suspendedAt, sessionsEnded sql.NullTime
+	)
+	if err := row.Scan(&user.ID, &user.Email, &user.Password, &user.FullName, &user.AvatarURL, &user.IsAdmin, &user.Role, &user.EmailVerified,
+		&user.TOTPSecret, &user.TOTPEnabled, &user.TOTPLastStep, &user.CreatedAt, &lastLogin, &deletedAt, &suspendedAt, &user.SuspendedReason, &sessionsEnded); err != nil {
+		return models.User{}, err
+	}
+	if lastLogin.Valid {
+		user.LastLogin = &lastLogin.Time
+	}
+	if deletedAt.Valid {
+		user.DeletedAt = &deletedAt.Time
+	}
+	if suspendedAt.Valid {
+		user.SuspendedAt = &suspendedAt.Time
+	}
+	if sessionsEnded.Valid {
+		user.SessionsEndedAt = &sessionsEnded.Time
+	}
+	return user, nil
+}
+
+func (r *sqlUsers) getOne(ctx context.Context, where string, arg any) (models.User, error) {
+	user, err := scanUser(r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT `+userColumns+` FROM users WHERE `+where), arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.User{}, ErrNotFound
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+	if err := r.loadRelations(ctx, &user); err != nil {
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+// loadRelations fills in the user's badges and enrollments.
+func (r *sqlUsers) loadRelations(ctx context.Context, user *models.User) error {
+	user.Badges = []string{}
+	rows, err := r.d.db.QueryContext(ctx, r.d.rebind(`SELECT badge FROM user_badges WHERE user_id = ? ORDER BY position`), user.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var badge string
+		if err := rows.Scan(&badge); err != nil {
+			return err
+		}
+		user.Badges = append(user.Badges, badge)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	user.EnrolledCourses = []string{}
+	user.Progress = make(map[string]int)
+	rows, err = r.d.db.QueryContext(ctx, r.d.rebind(`SELECT course_id, progress FROM enrollments WHERE user_id = ? ORDER BY enrolled_at, course_id`), user.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			courseID string
+			progress int
+		)
+		if err := rows.Scan(&courseID, &progress); err != nil {
+			return err
+		}
+		user.EnrolledCourses = append(user.EnrolledCourses, courseID)
+		user.Progress[courseID] = progress
+	}
+	return rows.Err()
+}
+
+func (r *sqlUsers) GetByID(ctx context.Context, id string) (models.User, error) {
+	return r.getOne(ctx, `id = ?`, id)
+}
+
+func (r *sqlUsers) GetByEmail(ctx context.Context, email string) (models.User, error) {
+	return r.getOne(ctx, `email = ?`, email)
+}
+
+func (r *sqlUsers) Create(ctx context.Context, user models.User) error {
+	err := r.d.withTx(ctx, func(tx sqlQuerier) error {
+		if _, err := tx.ExecContext(ctx, r.d.rebind(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			user.ID, user.Email, user.Password, user.FullName, user.AvatarURL, user.IsAdmin, user.EffectiveRole(), user.EmailVerified,
+			user.TOTPSecret, user.TOTPEnabled, user.TOTPLastStep, user.CreatedAt.UTC(),
+			nullTime(user.LastLogin), nullTime(user.DeletedAt), nullTime(user.SuspendedAt), user.SuspendedReason, nullTime(user.SessionsEndedAt)); err != nil {
+			return err
+		}
+		for i, badge := range user.Badges {
+			if _, err := tx.ExecContext(ctx, r.d.rebind(`INSERT INTO user_badges (user_id, position, badge) VALUES (?, ?, ?)`),
+				user.ID, i, badge); err != nil {
+				return err
+			}
+		}
+		for _, courseID := range user.EnrolledCourses {
+			if _, err := tx.ExecContext(ctx, r.d.rebind(`INSERT INTO enrollments (user_id, course_id, progress, enrolled_at) VALUES (?, ?, ?, ?)`),
+				user.ID, courseID, user.Progress[courseID], user.CreatedAt.UTC()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if isUniqueViolation(err) {
+		return ErrDuplicateEmail
+	}
+	return err
+}
+
+func (r *sqlUsers) Update(ctx context.Context, user models.User) error {
+	err := r.d.withTx(ctx, func(tx sqlQuerier) error {
+		var lastLogin sql.NullTime
+		if user.LastLogin != nil {
+			lastLogin = sql.NullTime{Time: user.LastLogin.UTC(), Valid: true}
+		}
+		res, err := tx.ExecContext(ctx, r.d.rebind(`UPDATE users SET email = ?, password = ?, full_name = ?, avatar_url = ?, is_admin = ?, role = ?, email_verified = ?, totp_secret = ?, totp_enabled = ?, last_login = ? WHERE id = ?`),
+			user.Email, user.Password, user.FullName, user.AvatarURL, user.IsAdmin, user.EffectiveRole(), user.EmailVerified, user.TOTPSecret, user.TOTPEnabled, lastLogin, user.ID)
+		if err != nil {
+			return err
+		}
+		if err := requireRowAffected(res); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, r.d.rebind(`DELETE FROM user_badges WHERE user_id = ?`), user.ID); err != nil {
+			return err
+		}
+		for i, badge := range user.Badges {
+			if _, err := tx.ExecContext(ctx, r.d.rebind(`INSERT INTO user_badges (user_id, position, badge) VALUES (?, ?, ?)`),
+				user.ID, i, badge); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if isUniqueViolation(err) {
+		return ErrDuplicateEmail
+	}
+	return err
+}
+
+func (r *sqlUsers) Search(ctx context.Context, filter UserFilter) ([]models.User, int, error) {
+	var (
+		where []string
+		args  []any
+	)
+	switch filter.Status {
+	case "":
+		where = append(where, `deleted_at IS NULL`)
+	case models.UserActive:
+		where = append(where, `deleted_at IS NULL AND suspended_at IS NULL`)
+	case models.UserSuspended:
+		where = append(where, `deleted_at IS NULL AND suspended_at IS NOT NULL`)
+	case models.UserDeleted:
+		where = append(where, `deleted_at IS NOT NULL`)
+	default:
+		return []models.User{}, 0, nil
+	}
+	if filter.Role != "" {
+		where = append(where, `role = ?`)
+		args = append(args, filter.Role)
+	}
+	if filter.Query != "" {
+		pattern := "%" + escapeLike(strings.ToLower(filter.Query)) + "%"
+		where = append(where, `(LOWER(email) LIKE ? ESCAPE '\' OR LOWER(full_name) LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+	cond := strings.Join(where, ` AND `)
+
+	var total int
+	if err := r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT COUNT(*) FROM users WHERE `+cond), args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := r.d.db.QueryContext(ctx, r.d.rebind(`SELECT `+userColumns+` FROM users WHERE `+cond+` ORDER BY created_at DESC, id LIMIT ? OFFSET ?`),
+		append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	users := []models.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	for i := range users {
+		if err := r.loadRelations(ctx, &users[i]); err != nil {
+			return nil, 0, err
+		}
+	}
+	return users, total, nil
+}
+
+func (r *sqlUsers) SetSuspension(ctx context.Context, id string, at *time.Time, reason string) error {
+	res, err := r.d.db.ExecContext(ctx, r.d.rebind(`UPDATE users SET suspended_at = ?, suspended_reason = ? WHERE id = ?`), nullTime(at), reason, id)
+	if err != nil {
+		return err
+	}
+	return requireRowAffected(res)
+}
+
+func (r *sqlUsers) UpdateLastLogin(ctx context.Context, id string, at time.Time) error {
+	res, err := r.d.db.ExecContext(ctx, r.d.rebind(`UPDATE users SET last_login = ? WHERE id = ?`), at.UTC(), id)
+	if err != nil {
+		return err
+	}
+	return requireRowAffected(res)
+}
+
+func (r *sqlUsers) EndSessions(ctx context.Context, id string, at time.Time) error {
+	res, err := r.d.db.ExecContext(ctx, r.d.rebind(`UPDATE users SET sessions_ended_at = ? WHERE id = ?`), at.UTC(), id)
+	if err != nil {
+		return err
+	}
+	return requireRowAffected(res)
+}
+
+func (r *sqlUsers) Anonymize(ctx context.Context, id string, at time.Time) error {
+	user := anonymized(models.User{ID: id}, at)
+	return r.d.withTx(ctx, func(tx sqlQuerier) error {
+		res, err := tx.ExecContext(ctx, r.d.rebind(`UPDATE users SET email = ?, password = ?, full_name = ?, avatar_url = ?, email_verified = ?,
+    totp_secret = ?, totp_enabled = ?, last_login = NULL, deleted_at = ?, suspended_at = NULL, suspended_reason = '' WHERE id = ?`),
+			user.Email, user.Password, user.FullName, user.AvatarURL, user.EmailVerified, user.TOTPSecret, user.TOTPEnabled, at.UTC(), id)
+		if err != nil {
+			return err
+		}
+		if err := requireRowAffected(res); err != nil {
+			return err
+		}
+		for _, table := range []string{"user_badges", "user_recovery_codes", "user_identities", "login_events", "data_exports", "action_tokens"} {
+			if _, err := tx.ExecContext(ctx, r.d.rebind(`DELETE FROM `+table+` WHERE user_id = ?`), id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *sqlUsers) Enroll(ctx context.Context, userID, courseID string) error {
+	if _, err := r.GetByID(ctx, userID); err != nil {
+		return err
+	}
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`INSERT INTO enrollments (user_id, course_id, progress, enrolled_at) VALUES (?, ?, 0, ?)`),
+		userID, courseID, time.Now().UTC())
+	if isUniqueViolation(err) {
+		return ErrAlreadyEnrolled
+	}
+	return err
+}
+
+// placeholders returns n comma-separated ? placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// nullTime converts an optional time to a nullable UTC column value.
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+// escapeLike escapes the LIKE wildcards in s, for use with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// requireRowAffected returns ErrNotFound if res reports no affected rows.
+func requireRowAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type sqlCourses struct{ d *SQLDatabase }
+
+const courseColumns = `id, title, description, price, currency, category, level, mentor_name, video_url, preview_video_url, duration, duration_seconds, lesson_count, created_at, enrolled_count, rating, rating_count, status, archived_at, mentor_id`
+
+func scanCourse(row interface{ Scan(...any) error }) (models.Course, error) {
+	var (
+		course     models.Course
+		archivedAt sql.NullTime
+	)
+	err := row.Scan(&course.ID, &course.Title, &course.Description, &course.Price.Amount, &course.Price.Currency, &course.Category, &course.Level,
+		&course.MentorName, &course.VideoURL, &course.PreviewVideoURL, &course.Duration, &course.DurationSeconds, &course.LessonCount, &course.CreatedAt, &course.EnrolledCount,
+		&course.Rating, &course.RatingCount, &course.Status, &archivedAt, &course.MentorID)
+	if archivedAt.Valid {
+		course.ArchivedAt = &archivedAt.Time
+	}
+	course.Topics = []string{}
+	return course, err
+}
+
+// topics returns the topics of the courses with the given IDs, or of every
+// course if none are given, keyed by course ID.
+func (r *sqlCourses) topics(ctx context.Context, ids ...string) (map[string][]string, error) {
+	query, args := `SELECT course_id, topic FROM course_topics ORDER BY course_id, position`, []any{}
+	if len(ids) > 0 {
+		query = `SELECT course_id, topic FROM course_topics WHERE course_id IN (` + placeholders(len(ids)) + `) ORDER BY course_id, position`
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	rows, err := r.d.db.QueryContext(ctx, r.d.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	topics := make(map[string][]string)
+	for rows.Next() {
+		var id, topic string
+		if err := rows.Scan(&id, &topic); err != nil {
+			return nil, err
+		}
+		topics[id] = append(topics[id], topic)
+	}
+	return topics, rows.Err()
+}
+
+func (r *sqlCourses) List(ctx context.Context) ([]models.Course, error) {
+	rows, err := r.d.db.QueryContext(ctx, `SELECT `+courseColumns+` FROM courses ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	courses := []models.Course{}
+	for rows.Next() {
+		course, err := scanCourse(rows)
+		if err != nil {
+			return nil, err
+		}
+		courses = append(courses, course)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	topics, err := r.topics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range courses {
+		if t, ok := topics[courses[i].ID]; ok {
+			courses[i].Topics = t
+		}
+	}
+	return courses, nil
+}
+
+// courseSortColumns maps CourseFilter.Sort to a column of courses.
+var courseSortColumns = map[string]string{
+	"":                      "created_at",
+	CourseSortCreatedAt:     "created_at",
+	CourseSortPrice:         "price",
+	CourseSortEnrolledCount: "enrolled_count",
+	CourseSortRating:        "rating",
+}
+
+func (r *sqlCourses) Search(ctx context.Context, filter CourseFilter) ([]models.Course, int, error) {
+	var (
+		where []string
+		args  []any
+	)
+	in := func(column string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		where = append(where, `LOWER(`+column+`) IN (`+placeholders(len(values))+`)`)
+		for _, v := range values {
+			args = append(args, strings.ToLower(v))
+		}
+	}
+	if len(filter.Statuses) == 0 {
+		where = append(where, `status = ?`)
+		args = append(args, models.CoursePublished)
+	}
+	in("status", filter.Statuses)
+	in("category", filter.Categories)
+	in("level", filter.Levels)
+	in("mentor_name", filter.Mentors)
+	if len(filter.Topics) > 0 {
+		where = append(where, `EXISTS (SELECT 1 FROM course_topics t WHERE t.course_id = courses.id AND LOWER(t.topic) IN (`+placeholders(len(filter.Topics))+`))`)
+		for _, v := range filter.Topics {
+			args = append(args, strings.ToLower(v))
+		}
+	}
+	if filter.MinPrice != nil {
+		where = append(where, `currency = ? AND price >= ?`)
+		args = append(args, filter.MinPrice.Currency, filter.MinPrice.Amount)
+	}
+	if filter.MaxPrice != nil {
+		where = append(where, `currency = ? AND price <= ?`)
+		args = append(args, filter.MaxPrice.Currency, filter.MaxPrice.Amount)
+	}
+	cond := strings.Join(where, ` AND `)
+
+	column, ok := courseSortColumns[filter.Sort]
+	if !ok {
+		return nil, 0, errors.New("unknown course sort " + filter.Sort)
+	}
+	direction := ` ASC`
+	if filter.Desc {
+		direction = ` DESC`
+	}
+	order := column + direction + `, id ASC`
+	if filter.Sort == CourseSortPrice {
+		order = `currency` + direction + `, ` + order
+	}
+
+	var total int
+	if err := r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT COUNT(*) FROM courses WHERE `+cond), args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := r.d.db.QueryContext(ctx, r.d.rebind(`SELECT `+courseColumns+` FROM courses WHERE `+cond+` ORDER BY `+order+` LIMIT ? OFFSET ?`),
+		append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	courses := []models.Course{}
+	var ids []string
+	for rows.Next() {
+		course, err := scanCourse(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		courses = append(courses, course)
+		ids = append(ids, course.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return courses, total, nil
+	}
+
+	topics, err := r.topics(ctx, ids...)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range courses {
+		if t, ok := topics[courses[i].ID]; ok {
+			courses[i].Topics = t
+		}
+	}
+	return courses, total, nil
+}
+
+func (r *sqlCourses) GetByID(ctx context.Context, id string) (models.Course, error) {
+	course, err := scanCourse(r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT `+courseColumns+` FROM courses WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Course{}, ErrNotFound
+	}
+	if err != nil {
+		return models.Course{}, err
+	}
+	topics, err := r.topics(ctx, id)
+	if err != nil {
+		return models.Course{}, err
+	}
+	if t, ok := topics[id]; ok {
+		course.Topics = t
+	}
+	return course, nil
+}
+
+func (r *sqlCourses) Create(ctx context.Context, course *models.Course) error {
+	if course.ID == "" {
+		course.ID = uuid.New().String()
+	}
+	return r.d.withTx(ctx, func(tx sqlQuerier) error {
+		if _, err := tx.ExecContext(ctx, r.d.rebind(`INSERT INTO courses (`+courseColumns+`) VALUES (`+placeholders(20)+`)`),
+			course.ID, course.Title, course.Description, course.Price.Amount, course.Price.Currency, course.Category, course.Level, course.MentorName,
+			course.VideoURL, course.PreviewVideoURL, course.Duration, course.DurationSeconds, course.LessonCount, course.CreatedAt.UTC(), course.EnrolledCount,
+			course.Rating, course.RatingCount, course.Status, nullTime(course.ArchivedAt), course.MentorID); err != nil {
+			return err
+		}
+		return r.insertTopics(ctx, tx, course.ID, course.Topics)
+	})
+}
+
+func (r *sqlCourses) insertTopics(ctx context.Context, tx sqlQuerier, courseID string, topics []string) error {
+	for i, topic := range topics {
+		if _, err := tx.ExecContext(ctx, r.d.rebind(`INSERT INTO course_topics (course_id, position, topic) VALUES (?, ?, ?)`),
+			courseID, i, topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sqlCourses) Update(ctx context.Context, course models.Course) error {
+	return r.d.withTx(ctx, func(tx sqlQuerier) error {
+		res, err := tx.ExecContext(ctx, r.d.rebind(`UPDATE courses SET title = ?, description = ?, price = ?, currency = ?, category = ?, level = ?,
+    mentor_name = ?, mentor_id = ?, video_url = ?, preview_video_url = ?, duration = CASE WHEN lesson_count > 0 THEN duration ELSE ? END WHERE id = ?`),
+			course.Title, course.Description, course.Price.Amount, course.Price.Currency, course.Category, course.Level,
+			course.MentorName, course.MentorID, course.VideoURL, course.PreviewVideoURL, course.Duration, course.ID)
+		if err != nil {
+			return err
+		}
+		if err := requireRowAffected(res); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, r.d.rebind(`DELETE FROM course_topics WHERE course_id = ?`), course.ID); err != nil {
+			return err
+		}
+		return r.insertTopics(ctx, tx, course.ID, course.Topics)
+	})
+}
+
+func (r *sqlCourses) Delete(ctx context.Context, id, userID string, at time.Time) (bool, error) {
+	archived := false
+	err := r.d.withTx(ctx, func(tx sqlQuerier) error {
+		// Payments and enrollments reference the course, so a sold course
+		// is never removed even if a purchase commits concurrently.
+		res, err := tx.ExecContext(ctx, r.d.rebind(`DELETE FROM courses WHERE id = ?
+    AND NOT EXISTS (SELECT 1 FROM enrollments WHERE course_id = ?)
+    AND NOT EXISTS (SELECT 1 FROM payments WHERE course_id = ?)`), id, id, id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return nil
+		}
+		var from string
+		err = tx.QueryRowContext(ctx, r.d.rebind(`SELECT status FROM courses WHERE id = ?`), id).Scan(&from)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		archived = true
+		if from == models.CourseArchived {
+			return nil
+		}
+		return r.setStatus(ctx, tx, models.CourseStatusChange{CourseID: id, From: from, To: models.CourseArchived, ChangedBy: userID, ChangedAt: at})
+	})
+	return archived, err
+}
+
+func (r *sqlCourses) IncrementEnrolled(ctx context.Context, id string) error {
+	res, err := r.d.db.ExecContext(ctx, r.d.rebind(`UPDATE courses SET enrolled_count = enrolled_count + 1 WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	return requireRowAffected(res)
+}
+
+type sqlPayments struct{ d *SQLDatabase }
+
+const paymentColumns = `id, user_id, course_id, amount, currency, payment_method, status, coupon_code, discount, provider, reference, action, expires_at, settled_at, created_at`
+
+func scanPayment(row interface{ Scan(...any) error }) (models.Payment, error) {
+	var (
+		p                    models.Payment
+		discount             sql.NullInt64
+		action               sql.NullString
+		expiresAt, settledAt sql.NullTime
+	)
+	if err := row.Scan(&p.ID, &p.UserID, &p.CourseID, &p.Amount.Amount, &p.Amount.Currency, &p.PaymentMethod, &p.Status, &p.CouponCode, &discount,
+		&p.Provider, &p.Reference, &action, &expiresAt, &settledAt, &p.CreatedAt); err != nil {
+		return models.Payment{}, err
+	}
+	if discount.Valid {
+		d := money.New(discount.Int64, p.Amount.Currency)
+		p.Discount = &d
+	}
+	if action.Valid {
+		p.Action = new(models.PaymentAction)
+		if err := json.Unmarshal([]byte(action.String), p.Action); err != nil {
+			return models.Payment{}, err
+		}
+	}
+	if expiresAt.Valid {
+		p.ExpiresAt = &expiresAt.Time
+	}
+	if settledAt.Valid {
+		p.SettledAt = &settledAt.Time
+	}
+	return p, nil
+}
+
+func (r *sqlPayments) Create(ctx context.Context, payment models.Payment) error {
+	var action sql.NullString
+	if payment.Action != nil {
+		b, err := json.Marshal(payment.Action)
+		if err != nil {
+			return err
+		}
+		action = sql.NullString{String: string(b), Valid: true}
+	}
+	var discount sql.NullInt64
+	if payment.Discount != nil {
+		discount = sql.NullInt64{Int64: payment.Discount.Amount, Valid: true}
+	}
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`INSERT INTO payments (`+paymentColumns+`) VALUES (`+placeholders(15)+`)`),
+		payment.ID, payment.UserID, payment.CourseID, payment.Amount.Amount, payment.Amount.Currency, payment.PaymentMethod, payment.Status,
+		payment.CouponCode, discount, payment.Provider, payment.Reference, action, nullTime(payment.ExpiresAt), nullTime(payment.SettledAt), payment.CreatedAt.UTC())
+	if isUniqueViolation(err) {
+		return ErrPaymentPending
+	}
+	return err
+}
+
+func (r *sqlPayments) GetByID(ctx context.Context, id string) (models.Payment, error) {
+	payment, err := scanPayment(r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT `+paymentColumns+` FROM payments WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Payment{}, ErrNotFound
+	}
+	return payment, err
+}
+
+func (r *sqlPayments) SetStatus(ctx context.Context, id, from, to string, at time.Time) (models.Payment, error) {
+	var payment models.Payment
+	err := r.d.withTx(ctx, func(tx sqlQuerier) error {
+		res, err := tx.ExecContext(ctx, r.d.rebind(`UPDATE payments SET status = ?, settled_at = COALESCE(settled_at, ?) WHERE id = ? AND status = ?`),
+			to, at.UTC(), id, from)
+		if err != nil {
+			return err
+		}
+		changed, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		payment, err = scanPayment(tx.QueryRowContext(ctx, r.d.rebind(`SELECT `+paymentColumns+` FROM payments WHERE id = ?`), id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if changed == 0 {
+			return ErrStatusConflict
+		}
+
+		var delta int
+		switch to {
+		case models.PaymentPaid:
+			// ON CONFLICT DO NOTHING keeps a payer who is already enrolled
+			// without aborting the transaction, as a failed insert would on
+			// PostgreSQL.
+			res, err = tx.ExecContext(ctx, r.d.rebind(`INSERT INTO enrollments (user_id, course_id, progress, enrolled_at) VALUES (?, ?, 0, ?) ON CONFLICT DO NOTHING`),
+				payment.UserID, payment.CourseID, at.UTC())
+			delta = 1
+		case models.PaymentRefunded:
+			res, err = tx.ExecContext(ctx, r.d.rebind(`DELETE FROM enrollments WHERE user_id = ? AND course_id = ?
+				AND NOT EXISTS (SELECT 1 FROM payments WHERE user_id = ? AND course_id = ? AND status = ?)`),
+				payment.UserID, payment.CourseID, payment.UserID, payment.CourseID, models.PaymentPaid)
+			delta = -1
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, r.d.rebind(`UPDATE courses SET enrolled_count = enrolled_count + ? WHERE id = ? AND enrolled_count + ? >= 0`),
+			delta, payment.CourseID, delta)
+		return err
+	})
+	if err != nil && !errors.Is(err, ErrStatusConflict) {
+		return models.Payment{}, err
+	}
+	return payment, err
+}
+
+func (r *sqlPayments) ListByUser(ctx context.Context, userID string) ([]models.Payment, error) {
+	rows, err := r.d.db.QueryContext(ctx, r.d.rebind(`SELECT `+paymentColumns+` FROM payments WHERE user_id = ? ORDER BY created_at`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []models.Payment{}
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+type sqlActivity struct{ d *SQLDatabase }
+
+func (r *sqlActivity) RecordLogin(ctx context.Context, event models.LoginEvent) error {
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`INSERT INTO login_events (id, user_id, method, success, ip, user_agent, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		event.ID, event.UserID, event.Method, event.Success, event.IP, event.UserAgent, event.CreatedAt.UTC())
+	return err
+}
+
+func (r *sqlActivity) ListLogins(ctx context.Context, userID string) ([]models.LoginEvent, error) {
+	rows, err := r.d.db.QueryContext(ctx, r.d.rebind(`SELECT id, user_id, method, success, ip, user_agent, created_at FROM login_events WHERE user_id = ? ORDER BY created_at DESC`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.LoginEvent{}
+	for rows.Next() {
+		var e models.LoginEvent
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Method, &e.Success, &e.IP, &e.UserAgent, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (r *sqlActivity) RecordAudit(ctx context.Context, event models.AuditEvent) error {
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`INSERT INTO audit_events (id, action, user_id, actor_id, target_id, detail, ip, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		event.ID, event.Action, event.UserID, event.ActorID, event.TargetID, event.Detail, event.IP, event.CreatedAt.UTC())
+	return err
+}
+
+func (r *sqlActivity) ListAudit(ctx context.Context, userID string, limit int) ([]models.AuditEvent, error) {
+	query := `SELECT id, action, user_id, actor_id, target_id, detail, ip, created_at FROM audit_events`
+	args := []any{}
+	if userID != "" {
+		query += ` WHERE user_id = ?`
+		args = append(args, userID)
+	}
+	query += ` ORDER BY created_at DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := r.d.db.QueryContext(ctx, r.d.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var e models.AuditEvent
+		if err := rows.Scan(&e.ID, &e.Action, &e.UserID, &e.ActorID, &e.TargetID, &e.Detail, &e.IP, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
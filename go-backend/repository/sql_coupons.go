@@ -0,0 +1,213 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+)
+
+type sqlCoupons struct{ d *SQLDatabase }
+
+const couponColumns = `id, code, percent_off, amount_off, amount_off_currency, min_spend, min_spend_currency, course_ids, categories, expires_at, max_redemptions, per_user_limit, redemptions, created_at`
+
+func scanCoupon(row interface{ Scan(...any) error }) (models.Coupon, error) {
+	var (
+		cp                    models.Coupon
+		amountOff, minSpend   sql.NullInt64
+		offCurrency, currency sql.NullString
+		courseIDs, categories string
+		expiresAt             sql.NullTime
+	)
+	if err := row.Scan(&cp.ID, &cp.Code, &cp.PercentOff, &amountOff, &offCurrency, &minSpend, &currency, &courseIDs, &categories,
+		&expiresAt, &cp.MaxRedemptions, &cp.PerUserLimit, &cp.Redemptions, &cp.CreatedAt); err != nil {
+		return models.Coupon{}, err
+	}
+	if amountOff.Valid {
+		m := money.New(amountOff.Int64, offCurrency.String)
+		cp.AmountOff = &m
+	}
+	if minSpend.Valid {
+		m := money.New(minSpend.Int64, currency.String)
+		cp.MinSpend = &m
+	}
+	if err := json.Unmarshal([]byte(courseIDs), &cp.CourseIDs); err != nil {
+		return models.Coupon{}, err
+	}
+	if err := json.Unmarshal([]byte(categories), &cp.Categories); err != nil {
+		return models.Coupon{}, err
+	}
+	if expiresAt.Valid {
+		cp.ExpiresAt = &expiresAt.Time
+	}
+	return cp, nil
+}
+
+// couponArgs returns the values of couponColumns for coupon, from code on.
+func couponArgs(coupon models.Coupon) ([]any, error) {
+	var amountOff, minSpend sql.NullInt64
+	var offCurrency, currency sql.NullString
+	if coupon.AmountOff != nil {
+		amountOff = sql.NullInt64{Int64: coupon.AmountOff.Amount, Valid: true}
+		offCurrency = sql.NullString{String: coupon.AmountOff.Currency, Valid: true}
+	}
+	if coupon.MinSpend != nil {
+		minSpend = sql.NullInt64{Int64: coupon.MinSpend.Amount, Valid: true}
+		currency = sql.NullString{String: coupon.MinSpend.Currency, Valid: true}
+	}
+	courseIDs, err := json.Marshal(append([]string{}, coupon.CourseIDs...))
+	if err != nil {
+		return nil, err
+	}
+	categories, err := json.Marshal(append([]string{}, coupon.Categories...))
+	if err != nil {
+		return nil, err
+	}
+	return []any{coupon.Code, coupon.PercentOff, amountOff, offCurrency, minSpend, currency, string(courseIDs), string(categories),
+		nullTime(coupon.ExpiresAt), coupon.MaxRedemptions, coupon.PerUserLimit}, nil
+}
+
+func (r *sqlCoupons) Create(ctx context.Context, coupon models.Coupon) error {
+	args, err := couponArgs(coupon)
+	if err != nil {
+		return err
+	}
+	args = append([]any{coupon.ID}, append(args, coupon.Redemptions, coupon.CreatedAt.UTC())...)
+	_, err = r.d.db.ExecContext(ctx, r.d.rebind(`INSERT INTO coupons (`+couponColumns+`) VALUES (`+placeholders(14)+`)`), args...)
+	if isUniqueViolation(err) {
+		return ErrDuplicateCouponCode
+	}
+	return err
+}
+
+func (r *sqlCoupons) GetByID(ctx context.Context, id string) (models.Coupon, error) {
+	coupon, err := scanCoupon(r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT `+couponColumns+` FROM coupons WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Coupon{}, ErrNotFound
+	}
+	return coupon, err
+}
+
+func (r *sqlCoupons) GetByCode(ctx context.Context, code string) (models.Coupon, error) {
+	coupon, err := scanCoupon(r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT `+couponColumns+` FROM coupons WHERE code = ?`), strings.ToUpper(code)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Coupon{}, ErrNotFound
+	}
+	return coupon, err
+}
+
+func (r *sqlCoupons) List(ctx context.Context) ([]models.Coupon, error) {
+	rows, err := r.d.db.QueryContext(ctx, `SELECT `+couponColumns+` FROM coupons ORDER BY created_at DESC, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	coupons := []models.Coupon{}
+	for rows.Next() {
+		coupon, err := scanCoupon(rows)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, coupon)
+	}
+	return coupons, rows.Err()
+}
+
+func (r *sqlCoupons) Update(ctx context.Context, coupon models.Coupon) error {
+	args, err := couponArgs(coupon)
+	if err != nil {
+		return err
+	}
+	res, err := r.d.db.ExecContext(ctx, r.d.rebind(`UPDATE coupons SET code = ?, percent_off = ?, amount_off = ?, amount_off_currency = ?, min_spend = ?, min_spend_currency = ?,
+    course_ids = ?, categories = ?, expires_at = ?, max_redemptions = ?, per_user_limit = ? WHERE id = ?`), append(args, coupon.ID)...)
+	if isUniqueViolation(err) {
+		return ErrDuplicateCouponCode
+	}
+	if err != nil {
+		return err
+	}
+	return requireRowAffected(res)
+}
+
+func (r *sqlCoupons) Delete(ctx context.Context, id string) error {
+	return r.d.withTx(ctx, func(tx sqlQuerier) error {
+		if _, err := tx.ExecContext(ctx, r.d.rebind(`DELETE FROM coupon_redemptions WHERE coupon_id = ?`), id); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, r.d.rebind(`DELETE FROM coupons WHERE id = ?`), id)
+		if err != nil {
+			return err
+		}
+		return requireRowAffected(res)
+	})
+}
+
+func (r *sqlCoupons) CountRedemptions(ctx context.Context, couponID, userID string) (int, error) {
+	var n int
+	err := r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT COUNT(*) FROM coupon_redemptions WHERE coupon_id = ? AND user_id = ?`), couponID, userID).Scan(&n)
+	return n, err
+}
+
+func (r *sqlCoupons) Redeem(ctx context.Context, couponID, userID, paymentID string, at time.Time) error {
+	return r.d.withTx(ctx, func(tx sqlQuerier) error {
+		// Counting the redemption first locks the coupon's row, so that
+		// concurrent redemptions of the coupon wait for this one and see
+		// its row below when counting the user's.
+		res, err := tx.ExecContext(ctx, r.d.rebind(`UPDATE coupons SET redemptions = redemptions + 1
+WHERE id = ? AND (max_redemptions = 0 OR redemptions < max_redemptions)`), couponID)
+		if err != nil {
+			return err
+		}
+		if err := requireRowAffected(res); err != nil {
+			var exists bool
+			if err := tx.QueryRowContext(ctx, r.d.rebind(`SELECT EXISTS (SELECT 1 FROM coupons WHERE id = ?)`), couponID).Scan(&exists); err != nil {
+				return err
+			}
+			if exists {
+				return ErrCouponExhausted
+			}
+			return ErrNotFound
+		}
+		var limit, used int
+		err = tx.QueryRowContext(ctx, r.d.rebind(`SELECT per_user_limit, (SELECT COUNT(*) FROM coupon_redemptions WHERE coupon_id = coupons.id AND user_id = ?)
+FROM coupons WHERE id = ?`), userID, couponID).Scan(&limit, &used)
+		if err != nil {
+			return err
+		}
+		if limit > 0 && used >= limit {
+			return ErrCouponUserLimit
+		}
+		_, err = tx.ExecContext(ctx, r.d.rebind(`INSERT INTO coupon_redemptions (payment_id, coupon_id, user_id, redeemed_at) VALUES (?, ?, ?, ?)`),
+			paymentID, couponID, userID, at.UTC())
+		return err
+	})
+}
+
+func (r *sqlCoupons) Release(ctx context.Context, paymentID string) error {
+	return r.d.withTx(ctx, func(tx sqlQuerier) error {
+		var couponID string
+		err := tx.QueryRowContext(ctx, r.d.rebind(`SELECT coupon_id FROM coupon_redemptions WHERE payment_id = ?`), paymentID).Scan(&couponID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Only the release that deletes the redemption gives it back
+		res, err := tx.ExecContext(ctx, r.d.rebind(`DELETE FROM coupon_redemptions WHERE payment_id = ?`), paymentID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, r.d.rebind(`UPDATE coupons SET redemptions = redemptions - 1 WHERE id = ?`), couponID)
+		return err
+	})
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/google/uuid"
+)
+
+// setStatus moves a course from change.From to change.To and records the
+// change, as part of the transaction tx.
+func (r *sqlCourses) setStatus(ctx context.Context, tx sqlQuerier, change models.CourseStatusChange) error {
+	if change.ID == "" {
+		change.ID = uuid.New().String()
+	}
+	archivedAt := sql.NullTime{}
+	if change.To == models.CourseArchived {
+		archivedAt = nullTime(&change.ChangedAt)
+	}
+	res, err := tx.ExecContext(ctx, r.d.rebind(`UPDATE courses SET status = ?, archived_at = ? WHERE id = ? AND status = ?`),
+		change.To, archivedAt, change.CourseID, change.From)
+	if err != nil {
+		return err
+	}
+	if err := requireRowAffected(res); err != nil {
+		var exists int
+		err = tx.QueryRowContext(ctx, r.d.rebind(`SELECT 1 FROM courses WHERE id = ?`), change.CourseID).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return ErrStatusConflict
+	}
+	_, err = tx.ExecContext(ctx, r.d.rebind(`INSERT INTO course_status_changes (id, course_id, from_status, to_status, changed_by, note, changed_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		change.ID, change.CourseID, change.From, change.To, change.ChangedBy, change.Note, change.ChangedAt.UTC())
+	return err
+}
+
+func (r *sqlCourses) SetStatus(ctx context.Context, change models.CourseStatusChange) error {
+	return r.d.withTx(ctx, func(tx sqlQuerier) error {
+		return r.setStatus(ctx, tx, change)
+	})
+}
+
+func (r *sqlCourses) ListStatusChanges(ctx context.Context, courseID string) ([]models.CourseStatusChange, error) {
+	var exists int
+	err := r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT 1 FROM courses WHERE id = ?`), courseID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.d.db.QueryContext(ctx, r.d.rebind(`SELECT id, course_id, from_status, to_status, changed_by, note, changed_at
+    FROM course_status_changes WHERE course_id = ? ORDER BY changed_at, id`), courseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []models.CourseStatusChange{}
+	for rows.Next() {
+		var c models.CourseStatusChange
+		if err := rows.Scan(&c.ID, &c.CourseID, &c.From, &c.To, &c.ChangedBy, &c.Note, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
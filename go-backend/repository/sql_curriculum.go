@@ -0,0 +1,205 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+type sqlCurriculum struct{ d *SQLDatabase }
+
+// load reads the outline of a course.
+func (r *sqlCurriculum) load(ctx context.Context, q sqlQuerier, courseID string) (outline, error) {
+	rows, err := q.QueryContext(ctx, r.d.rebind(`SELECT id, course_id, title, created_at FROM course_modules WHERE course_id = ? ORDER BY position`), courseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	o := outline{}
+	for rows.Next() {
+		var m models.Module
+		if err := rows.Scan(&m.ID, &m.CourseID, &m.Title, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		o = append(o, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = q.QueryContext(ctx, r.d.rebind(`SELECT id, module_id, title, type, video_url, content, attachment_url, duration_seconds, created_at
+    FROM course_lessons WHERE course_id = ? ORDER BY position`), courseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l models.Lesson
+		if err := rows.Scan(&l.ID, &l.ModuleID, &l.Title, &l.Type, &l.VideoURL, &l.Content, &l.AttachmentURL, &l.DurationSeconds, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		if i := o.findModule(l.ModuleID); i >= 0 {
+			o[i].Lessons = append(o[i].Lessons, l)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	o.normalize()
+	return o, nil
+}
+
+// edit applies fn to the outline of the course and writes the rows that
+// changed, updating the course's lesson totals.
+func (r *sqlCurriculum) edit(ctx context.Context, courseID string, fn func(outline) (outline, error)) error {
+	return r.d.withTx(ctx, func(tx sqlQuerier) error {
+		// Locks the course row, so that concurrent edits of the same
+		// curriculum are applied one after the other.
+		res, err := tx.ExecContext(ctx, r.d.rebind(`UPDATE courses SET lesson_count = lesson_count WHERE id = ?`), courseID)
+		if err != nil {
+			return err
+		}
+		if err := requireRowAffected(res); err != nil {
+			return err
+		}
+		before, err := r.load(ctx, tx, courseID)
+		if err != nil {
+			return err
+		}
+		after, err := fn(before)
+		if err != nil {
+			return err
+		}
+		if err := r.save(ctx, tx, before, after); err != nil {
+			return err
+		}
+
+		lessons, seconds := after.totals()
+		duration, ok := courseDuration(before, after)
+		if !ok {
+			_, err = tx.ExecContext(ctx, r.d.rebind(`UPDATE courses SET lesson_count = ?, duration_seconds = ? WHERE id = ?`), lessons, seconds, courseID)
+			return err
+		}
+		_, err = tx.ExecContext(ctx, r.d.rebind(`UPDATE courses SET lesson_count = ?, duration_seconds = ?, duration = ? WHERE id = ?`),
+			lessons, seconds, duration, courseID)
+		return err
+	})
+}
+
+// save writes the differences between two versions of an outline.
+func (r *sqlCurriculum) save(ctx context.Context, tx sqlQuerier, before, after outline) error {
+	oldLessons := make(map[string]models.Lesson)
+	for _, m := range before {
+		for _, l := range m.Lessons {
+			oldLessons[l.ID] = l
+		}
+	}
+	newLessons := make(map[string]bool)
+	for _, m := range after {
+		for _, l := range m.Lessons {
+			newLessons[l.ID] = true
+		}
+	}
+
+	for id := range oldLessons {
+		if !newLessons[id] {
+			if _, err := tx.ExecContext(ctx, r.d.rebind(`DELETE FROM course_lessons WHERE id = ?`), id); err != nil {
+				return err
+			}
+		}
+	}
+	for _, m := range before {
+		if after.findModule(m.ID) < 0 {
+			if _, err := tx.ExecContext(ctx, r.d.rebind(`DELETE FROM course_modules WHERE id = ?`), m.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, m := range after {
+		var err error
+		switch i := before.findModule(m.ID); {
+		case i < 0:
+			_, err = tx.ExecContext(ctx, r.d.rebind(`INSERT INTO course_modules (id, course_id, position, title, created_at) VALUES (?, ?, ?, ?, ?)`),
+				m.ID, m.CourseID, m.Position, m.Title, m.CreatedAt.UTC())
+		case before[i].Position != m.Position || before[i].Title != m.Title:
+			_, err = tx.ExecContext(ctx, r.d.rebind(`UPDATE course_modules SET position = ?, title = ? WHERE id = ?`), m.Position, m.Title, m.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, m := range after {
+		for _, l := range m.Lessons {
+			var err error
+			switch old, ok := oldLessons[l.ID]; {
+			case !ok:
+				_, err = tx.ExecContext(ctx, r.d.rebind(`INSERT INTO course_lessons
+    (id, course_id, module_id, position, title, type, video_url, content, attachment_url, duration_seconds, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+					l.ID, l.CourseID, l.ModuleID, l.Position, l.Title, l.Type, l.VideoURL, l.Content, l.AttachmentURL, l.DurationSeconds, l.CreatedAt.UTC())
+			case old != l:
+				_, err = tx.ExecContext(ctx, r.d.rebind(`UPDATE course_lessons SET module_id = ?, position = ?, title = ?, type = ?,
+    video_url = ?, content = ?, attachment_url = ?, duration_seconds = ? WHERE id = ?`),
+					l.ModuleID, l.Position, l.Title, l.Type, l.VideoURL, l.Content, l.AttachmentURL, l.DurationSeconds, l.ID)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *sqlCurriculum) Outline(ctx context.Context, courseID string) ([]models.Module, error) {
+	var exists int
+	err := r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT 1 FROM courses WHERE id = ?`), courseID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.load(ctx, r.d.db, courseID)
+}
+
+func (r *sqlCurriculum) CreateModule(ctx context.Context, module *models.Module) error {
+	return r.edit(ctx, module.CourseID, func(o outline) (outline, error) {
+		return o.addModule(module), nil
+	})
+}
+
+func (r *sqlCurriculum) UpdateModule(ctx context.Context, module *models.Module) error {
+	return r.edit(ctx, module.CourseID, func(o outline) (outline, error) {
+		return o.updateModule(module)
+	})
+}
+
+func (r *sqlCurriculum) DeleteModule(ctx context.Context, courseID, id string) error {
+	return r.edit(ctx, courseID, func(o outline) (outline, error) {
+		return o.deleteModule(id)
+	})
+}
+
+func (r *sqlCurriculum) CreateLesson(ctx context.Context, lesson *models.Lesson) error {
+	return r.edit(ctx, lesson.CourseID, func(o outline) (outline, error) {
+		return o.addLesson(lesson)
+	})
+}
+
+func (r *sqlCurriculum) UpdateLesson(ctx context.Context, lesson *models.Lesson) error {
+	return r.edit(ctx, lesson.CourseID, func(o outline) (outline, error) {
+		return o.updateLesson(lesson)
+	})
+}
+
+func (r *sqlCurriculum) DeleteLesson(ctx context.Context, courseID, id string) error {
+	return r.edit(ctx, courseID, func(o outline) (outline, error) {
+		return o.deleteLesson(id)
+	})
+}
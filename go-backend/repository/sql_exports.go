@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+type sqlExports struct{ d *SQLDatabase }
+
+// exportColumns leaves out the archive, which is only read for downloads.
+const exportColumns = `id, user_id, status, error, size, token_hash, requested_at, started_at, completed_at, expires_at`
+
+func scanExport(row interface{ Scan(...any) error }) (models.DataExport, error) {
+	var (
+		e                                 models.DataExport
+		tokenHash                         sql.NullString
+		startedAt, completedAt, expiresAt sql.NullTime
+	)
+	if err := row.Scan(&e.ID, &e.UserID, &e.Status, &e.Error, &e.Size, &tokenHash, &e.RequestedAt, &startedAt, &completedAt, &expiresAt); err != nil {
+		return models.DataExport{}, err
+	}
+	e.TokenHash = tokenHash.String
+	if startedAt.Valid {
+		e.StartedAt = &startedAt.Time
+	}
+	if completedAt.Valid {
+		e.CompletedAt = &completedAt.Time
+	}
+	if expiresAt.Valid {
+		e.ExpiresAt = &expiresAt.Time
+	}
+	return e, nil
+}
+
+func (r *sqlExports) getOne(ctx context.Context, where string, arg any) (models.DataExport, error) {
+	e, err := scanExport(r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT `+exportColumns+` FROM data_exports WHERE `+where), arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.DataExport{}, ErrNotFound
+	}
+	return e, err
+}
+
+func (r *sqlExports) CreateExport(ctx context.Context, export models.DataExport) error {
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`INSERT INTO data_exports (id, user_id, status, requested_at) VALUES (?, ?, ?, ?)`),
+		export.ID, export.UserID, export.Status, export.RequestedAt.UTC())
+	return err
+}
+
+func (r *sqlExports) GetExport(ctx context.Context, id string) (models.DataExport, error) {
+	return r.getOne(ctx, `id = ?`, id)
+}
+
+func (r *sqlExports) GetExportByToken(ctx context.Context, tokenHash string) (models.DataExport, error) {
+	return r.getOne(ctx, `token_hash = ?`, tokenHash)
+}
+
+func (r *sqlExports) ListExports(ctx context.Context, userID string) ([]models.DataExport, error) {
+	rows, err := r.d.db.QueryContext(ctx, r.d.rebind(`SELECT `+exportColumns+` FROM data_exports WHERE user_id = ? ORDER BY requested_at DESC`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exports := []models.DataExport{}
+	for rows.Next() {
+		e, err := scanExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, e)
+	}
+	return exports, rows.Err()
+}
+
+func (r *sqlExports) ClaimExport(ctx context.Context, at, staleBefore time.Time) (models.DataExport, error) {
+	// The condition is repeated in the outer WHERE so that of two servers
+	// picking the same export, only the first update matches.
+	const claimable = `(status = 'pending' OR (status = 'running' AND started_at < ?))`
+	staleBefore = staleBefore.UTC()
+	e, err := scanExport(r.d.db.QueryRowContext(ctx, r.d.rebind(`UPDATE data_exports SET status = 'running', started_at = ?
+WHERE id = (SELECT id FROM data_exports WHERE `+claimable+` ORDER BY requested_at LIMIT 1) AND `+claimable+`
+RETURNING `+exportColumns), at.UTC(), staleBefore, staleBefore))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.DataExport{}, ErrNotFound
+	}
+	return e, err
+}
+
+func (r *sqlExports) CompleteExport(ctx context.Context, id string, archive []byte, tokenHash string, at, expiresAt time.Time) error {
+	res, err := r.d.db.ExecContext(ctx, r.d.rebind(`UPDATE data_exports SET status = 'ready', size = ?, token_hash = ?, archive = ?, completed_at = ?, expires_at = ?
+WHERE id = ? AND status = 'running'`), len(archive), tokenHash, archive, at.UTC(), expiresAt.UTC(), id)
+	if err != nil {
+		return err
+	}
+	return requireRowAffected(res)
+}
+
+func (r *sqlExports) FailExport(ctx context.Context, id, reason string, at time.Time) error {
+	res, err := r.d.db.ExecContext(ctx, r.d.rebind(`UPDATE data_exports SET status = 'failed', error = ?, completed_at = ? WHERE id = ? AND status = 'running'`),
+		reason, at.UTC(), id)
+	if err != nil {
+		return err
+	}
+	return requireRowAffected(res)
+}
+
+func (r *sqlExports) GetExportArchive(ctx context.Context, id string) ([]byte, error) {
+	var archive []byte
+	err := r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT archive FROM data_exports WHERE id = ? AND status = 'ready' AND archive IS NOT NULL`), id).Scan(&archive)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return archive, err
+}
+
+func (r *sqlExports) ExpireExports(ctx context.Context, at time.Time) error {
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`UPDATE data_exports SET status = 'expired', archive = NULL, token_hash = NULL WHERE status = 'ready' AND expires_at < ?`), at.UTC())
+	return err
+}
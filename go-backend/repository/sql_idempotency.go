@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+type sqlIdempotency struct{ d *SQLDatabase }
+
+func (r *sqlIdempotency) BeginIdempotentRequest(ctx context.Context, rec models.IdempotencyRecord) (models.IdempotencyRecord, error) {
+	var existing models.IdempotencyRecord
+	err := r.d.withTx(ctx, func(tx sqlQuerier) error {
+		if _, err := tx.ExecContext(ctx, r.d.rebind(`DELETE FROM idempotency_keys WHERE expires_at <= ?`), rec.CreatedAt.UTC()); err != nil {
+			return err
+		}
+		// The primary key lets only one of several concurrent requests
+		// with the same key insert its record.
+		res, err := tx.ExecContext(ctx, r.d.rebind(`INSERT INTO idempotency_keys (user_id, idem_key, fingerprint, created_at, expires_at) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (user_id, idem_key) DO NOTHING`), rec.UserID, rec.Key, rec.Fingerprint, rec.CreatedAt.UTC(), rec.ExpiresAt.UTC())
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+		var body string
+		err = tx.QueryRowContext(ctx, r.d.rebind(`SELECT user_id, idem_key, fingerprint, status_code, content_type, body, created_at, expires_at FROM idempotency_keys WHERE user_id = ? AND idem_key = ?`),
+			rec.UserID, rec.Key).Scan(&existing.UserID, &existing.Key, &existing.Fingerprint, &existing.StatusCode, &existing.ContentType, &body, &existing.CreatedAt, &existing.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		existing.Body = []byte(body)
+		return ErrIdempotencyKeyUsed
+	})
+	if errors.Is(err, ErrIdempotencyKeyUsed) {
+		return existing, err
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		// The conflicting record was released in the meantime
+		return r.BeginIdempotentRequest(ctx, rec)
+	}
+	return rec, err
+}
+
+func (r *sqlIdempotency) CompleteIdempotentRequest(ctx context.Context, rec models.IdempotencyRecord) error {
+	res, err := r.d.db.ExecContext(ctx, r.d.rebind(`UPDATE idempotency_keys SET status_code = ?, content_type = ?, body = ? WHERE user_id = ? AND idem_key = ?`),
+		rec.StatusCode, rec.ContentType, string(rec.Body), rec.UserID, rec.Key)
+	if err != nil {
+		return err
+	}
+	return requireRowAffected(res)
+}
+
+func (r *sqlIdempotency) ReleaseIdempotentRequest(ctx context.Context, userID, key string) error {
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`DELETE FROM idempotency_keys WHERE user_id = ? AND idem_key = ? AND status_code = 0`), userID, key)
+	return err
+}
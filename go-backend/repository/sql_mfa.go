@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func (r *sqlUsers) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	res, err := r.d.db.ExecContext(ctx, r.d.rebind(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`),
+		step, userID, step)
+	if err != nil {
+		return err
+	}
+	if err := requireRowAffected(res); err != nil {
+		if _, err := r.GetByID(ctx, userID); err != nil {
+			return err
+		}
+		return ErrTokenUsed
+	}
+	return nil
+}
+
+func (r *sqlUsers) ReplaceRecoveryCodes(ctx context.Context, userID string, hashes []string) error {
+	return r.d.withTx(ctx, func(tx sqlQuerier) error {
+		var exists int
+		err := tx.QueryRowContext(ctx, r.d.rebind(`SELECT 1 FROM users WHERE id = ?`), userID).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, r.d.rebind(`DELETE FROM user_recovery_codes WHERE user_id = ?`), userID); err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			if _, err := tx.ExecContext(ctx, r.d.rebind(`INSERT INTO user_recovery_codes (user_id, code_hash) VALUES (?, ?)`),
+				userID, hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *sqlUsers) UseRecoveryCode(ctx context.Context, userID, hash string) error {
+	res, err := r.d.db.ExecContext(ctx, r.d.rebind(`DELETE FROM user_recovery_codes WHERE user_id = ? AND code_hash = ?`), userID, hash)
+	if err != nil {
+		return err
+	}
+	return requireRowAffected(res)
+}
+
+type sqlSettings struct{ d *SQLDatabase }
+
+func (r *sqlSettings) GetSetting(ctx context.Context, key string) (string, error) {
+	var value string
+	err := r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT value FROM settings WHERE setting_key = ?`), key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return value, err
+}
+
+func (r *sqlSettings) PutSetting(ctx context.Context, key, value string, at time.Time) error {
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`INSERT INTO settings (setting_key, value, updated_at) VALUES (?, ?, ?)
+ON CONFLICT (setting_key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`), key, value, at.UTC())
+	return err
+}
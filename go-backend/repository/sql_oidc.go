@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+func (r *sqlUsers) GetByIdentity(ctx context.Context, provider, subject string) (models.User, error) {
+	var userID string
+	err := r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?`), provider, subject).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.User{}, ErrNotFound
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+	return r.GetByID(ctx, userID)
+}
+
+func (r *sqlUsers) LinkIdentity(ctx context.Context, identity models.Identity) error {
+	if _, err := r.GetByID(ctx, identity.UserID); err != nil {
+		return err
+	}
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`INSERT INTO user_identities (provider, subject, user_id, email, created_at) VALUES (?, ?, ?, ?, ?)`),
+		identity.Provider, identity.Subject, identity.UserID, identity.Email, identity.CreatedAt.UTC())
+	if isUniqueViolation(err) {
+		return ErrDuplicateIdentity
+	}
+	return err
+}
+
+func (r *sqlUsers) ListIdentities(ctx context.Context, userID string) ([]models.Identity, error) {
+	rows, err := r.d.db.QueryContext(ctx, r.d.rebind(`SELECT provider, subject, user_id, email, created_at FROM user_identities WHERE user_id = ? ORDER BY created_at`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []models.Identity{}
+	for rows.Next() {
+		var identity models.Identity
+		if err := rows.Scan(&identity.Provider, &identity.Subject, &identity.UserID, &identity.Email, &identity.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+func (r *sqlTokens) CreateOIDCState(ctx context.Context, state models.OIDCState) error {
+	// Drop logins that were abandoned.
+	if _, err := r.d.db.ExecContext(ctx, r.d.rebind(`DELETE FROM oidc_states WHERE expires_at < ?`), time.Now().UTC()); err != nil {
+		return err
+	}
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`INSERT INTO oidc_states (id, provider, code_verifier, nonce, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`),
+		state.ID, state.Provider, state.CodeVerifier, state.Nonce, state.CreatedAt.UTC(), state.ExpiresAt.UTC())
+	return err
+}
+
+func (r *sqlTokens) ConsumeOIDCState(ctx context.Context, id string) (models.OIDCState, error) {
+	var state models.OIDCState
+	err := r.d.db.QueryRowContext(ctx, r.d.rebind(`DELETE FROM oidc_states WHERE id = ? RETURNING id, provider, code_verifier, nonce, created_at, expires_at`), id).
+		Scan(&state.ID, &state.Provider, &state.CodeVerifier, &state.Nonce, &state.CreatedAt, &state.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.OIDCState{}, ErrNotFound
+	}
+	return state, err
+}
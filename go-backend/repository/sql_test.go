@@ -0,0 +1,365 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+	"github.com/google/uuid"
+)
+
+// newSQLiteTestDB returns an unmigrated SQLite database in a temporary
+// directory.
+func newSQLiteTestDB(t *testing.T) *SQLDatabase {
+	t.Helper()
+	d, err := OpenSQL("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// newPostgresTestDB connects to the PostgreSQL server at POSTGRES_URL,
+// skipping the test if it is not set, and returns an unmigrated schema of
+// its own that is dropped when the test ends.
+func newPostgresTestDB(t *testing.T) *SQLDatabase {
+	t.Helper()
+	dsn := os.Getenv("POSTGRES_URL")
+	if dsn == "" {
+		t.Skip("POSTGRES_URL is not set")
+	}
+	ctx := context.Background()
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := "emergent_test_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:12]
+	if _, err := admin.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE") })
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	d, err := OpenSQL("postgres", u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// migratedStore migrates d and returns its Store.
+func migratedStore(t *testing.T, d *SQLDatabase) Store {
+	t.Helper()
+	if _, err := d.MigrateUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return d.Store()
+}
+
+func TestPostgresStore(t *testing.T) {
+	testStore(t, migratedStore(t, newPostgresTestDB(t)))
+}
+
+func TestPostgresStoreConcurrent(t *testing.T) {
+	testStoreConcurrent(t, migratedStore(t, newPostgresTestDB(t)))
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	testMigrate(t, newSQLiteTestDB(t))
+}
+
+func TestMigratePostgres(t *testing.T) {
+	testMigrate(t, newPostgresTestDB(t))
+}
+
+// testMigrate applies every migration, reverts them all and applies them
+// again, checking that each down migration undoes its up migration.
+func testMigrate(t *testing.T, d *SQLDatabase) {
+	ctx := context.Background()
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := migrations[len(migrations)-1].version
+	checkVersion := func(want int) {
+		t.Helper()
+		if got, err := d.SchemaVersion(ctx); err != nil || got != want {
+			t.Fatalf("schema version = %d, %v, want %d", got, err, want)
+		}
+	}
+
+	applied, err := d.MigrateUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("applied %v, want all %d migrations", applied, len(migrations))
+	}
+	checkVersion(latest)
+	if applied, err := d.MigrateUp(ctx); err != nil || len(applied) != 0 {
+		t.Errorf("second MigrateUp applied %v, %v, want nothing", applied, err)
+	}
+
+	// One step back and forth only touches the newest migration
+	reverted, err := d.MigrateDown(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != 1 || reverted[0] != latest {
+		t.Errorf("MigrateDown(1) reverted %v, want [%d]", reverted, latest)
+	}
+	checkVersion(migrations[len(migrations)-2].version)
+	if applied, err := d.MigrateUp(ctx); err != nil || len(applied) != 1 || applied[0] != latest {
+		t.Errorf("MigrateUp after one step down applied %v, %v, want [%d]", applied, err, latest)
+	}
+
+	// Reverting everything drops every table the migrations created, so
+	// applying them again from scratch succeeds
+	reverted, err = d.MigrateDown(ctx, len(migrations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(migrations) || reverted[0] != latest || reverted[len(reverted)-1] != migrations[0].version {
+		t.Errorf("MigrateDown reverted %v, want every migration newest first", reverted)
+	}
+	checkVersion(0)
+	if _, err := d.db.ExecContext(ctx, "SELECT 1 FROM users"); err == nil {
+		t.Error("the users table is left after reverting every migration")
+	}
+
+	if _, err := d.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(latest)
+	store := d.Store()
+	user := newTestUser("migrated@example.com")
+	if err := store.Users.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Users.GetByEmail(ctx, user.Email); err != nil || got.ID != user.ID {
+		t.Errorf("GetByEmail after migrating again = %+v, %v", got, err)
+	}
+}
+
+func TestMigrateMoneySQLite(t *testing.T) {
+	testMigrateMoney(t, newSQLiteTestDB(t))
+}
+
+func TestMigrateMoneyPostgres(t *testing.T) {
+	testMigrateMoney(t, newPostgresTestDB(t))
+}
+
+// moneyMigration is the version of the migration that stores prices and
+// payment amounts as whole numbers of a currency's smallest unit.
+const moneyMigration = 17
+
+// testMigrateMoney checks that prices and payments stored in rupiah as
+// floating point numbers before moneyMigration keep their value, and that
+// reverting it writes them back in whole units.
+func testMigrateMoney(t *testing.T, d *SQLDatabase) {
+	ctx := context.Background()
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Migrate to just before moneyMigration
+	if _, err := d.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	steps := 0
+	for _, m := range migrations {
+		if m.version >= moneyMigration {
+			steps++
+		}
+	}
+	if _, err := d.MigrateDown(ctx, steps); err != nil {
+		t.Fatal(err)
+	}
+
+	exec := func(query string, args ...any) {
+		t.Helper()
+		if _, err := d.db.ExecContext(ctx, d.rebind(query), args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	exec(`INSERT INTO users (id, email, password, full_name, created_at) VALUES (?, ?, ?, ?, ?)`,
+		"legacy-user", "legacy@example.com", "hash", "Legacy User", now)
+	course := `INSERT INTO courses (id, title, description, price, category, level, mentor_name, duration, created_at) VALUES (?, ?, ?, ?, 'Finance', 'Beginner', 'Mentor', '1h', ?)`
+	exec(course, "legacy", "Legacy Course", "Priced before currencies", 199000.0, now)
+	exec(course, "dollars", "Dollar Course", "Priced in dollars, as the old seed data was", 49.99, now)
+	payment := `INSERT INTO payments (id, user_id, course_id, amount, payment_method, status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	exec(payment, "legacy-payment", "legacy-user", "legacy", 199000.0, "qris", models.PaymentPaid, now)
+	exec(payment, "dollar-payment", "legacy-user", "dollars", 49.99, "qris", models.PaymentPaid, now)
+
+	if _, err := d.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	store := d.Store()
+	for id, want := range map[string]money.Money{
+		"legacy":  money.New(199000, money.IDR),
+		"dollars": money.New(4999, money.USD),
+	} {
+		got, err := store.Courses.GetByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Price != want {
+			t.Errorf("price of course %s after migrating = %v, want %v", id, got.Price, want)
+		}
+	}
+	for id, want := range map[string]money.Money{
+		"legacy-payment": money.New(199000, money.IDR),
+		"dollar-payment": money.New(4999, money.USD),
+	} {
+		got, err := store.Payments.GetByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Amount != want {
+			t.Errorf("amount of payment %s after migrating = %v, want %v", id, got.Amount, want)
+		}
+	}
+
+	// Reverting writes amounts back as whole units, dollars included
+	dollars := newTestCourse()
+	dollars.Price = money.New(129999, money.USD)
+	if err := store.Courses.Create(ctx, &dollars); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.MigrateDown(ctx, steps); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]float64{"legacy": 199000, "dollars": 49.99, dollars.ID: 1299.99} {
+		var price float64
+		if err := d.db.QueryRowContext(ctx, d.rebind(`SELECT price FROM courses WHERE id = ?`), id).Scan(&price); err != nil {
+			t.Fatal(err)
+		}
+		if price != want {
+			t.Errorf("price of course %s after reverting = %v, want %v", id, price, want)
+		}
+	}
+	for id, want := range map[string]float64{"legacy-payment": 199000, "dollar-payment": 49.99} {
+		var amount float64
+		if err := d.db.QueryRowContext(ctx, d.rebind(`SELECT amount FROM payments WHERE id = ?`), id).Scan(&amount); err != nil {
+			t.Fatal(err)
+		}
+		if amount != want {
+			t.Errorf("amount of payment %s after reverting = %v, want %v", id, amount, want)
+		}
+	}
+}
+
+func TestMigratePendingPaymentsSQLite(t *testing.T) {
+	testMigratePendingPayments(t, newSQLiteTestDB(t))
+}
+
+func TestMigratePendingPaymentsPostgres(t *testing.T) {
+	testMigratePendingPayments(t, newPostgresTestDB(t))
+}
+
+// pendingPaymentMigration is the version of the migration that allows a
+// user one pending payment per course.
+const pendingPaymentMigration = 21
+
+// testMigratePendingPayments checks that pendingPaymentMigration expires
+// all but the newest of a user's pending payments for a course, giving
+// back their coupon redemptions.
+func testMigratePendingPayments(t *testing.T, d *SQLDatabase) {
+	ctx := context.Background()
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	steps := 0
+	for _, m := range migrations {
+		if m.version >= pendingPaymentMigration {
+			steps++
+		}
+	}
+	if _, err := d.MigrateDown(ctx, steps); err != nil {
+		t.Fatal(err)
+	}
+
+	store := d.Store()
+	user := newTestUser("pending@example.com")
+	course := newTestCourse()
+	if err := store.Users.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Courses.Create(ctx, &course); err != nil {
+		t.Fatal(err)
+	}
+	coupon := models.Coupon{ID: uuid.New().String(), Code: "TWICE", PercentOff: 10, CourseIDs: []string{}, Categories: []string{}, CreatedAt: time.Now().UTC()}
+	if err := store.Coupons.Create(ctx, coupon); err != nil {
+		t.Fatal(err)
+	}
+	older, newer := newTestPayment(user.ID, course), newTestPayment(user.ID, course)
+	older.CreatedAt = newer.CreatedAt.Add(-time.Minute)
+	for _, p := range []models.Payment{older, newer} {
+		if err := store.Payments.Create(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Coupons.Redeem(ctx, coupon.ID, user.ID, p.ID, p.CreatedAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := d.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]string{older.ID: models.PaymentExpired, newer.ID: models.PaymentPending} {
+		got, err := store.Payments.GetByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != want {
+			t.Errorf("payment created at %v is %q after migrating, want %q", got.CreatedAt, got.Status, want)
+		}
+	}
+	if got, err := store.Coupons.GetByID(ctx, coupon.ID); err != nil || got.Redemptions != 1 {
+		t.Errorf("coupon redemptions after migrating = %d, %v, want 1", got.Redemptions, err)
+	}
+	if used, err := store.Coupons.CountRedemptions(ctx, coupon.ID, user.ID); err != nil || used != 1 {
+		t.Errorf("user's redemptions after migrating = %d, %v, want 1", used, err)
+	}
+	if err := store.Payments.Create(ctx, newTestPayment(user.ID, course)); !errors.Is(err, ErrPaymentPending) {
+		t.Errorf("another pending payment after migrating: got %v, want ErrPaymentPending", err)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	const query = `SELECT id FROM users WHERE email = ? AND role IN (?, ?)`
+	for _, tc := range []struct {
+		postgres bool
+		want     string
+	}{
+		{false, query},
+		{true, `SELECT id FROM users WHERE email = $1 AND role IN ($2, $3)`},
+	} {
+		d := &SQLDatabase{postgres: tc.postgres}
+		if got := d.rebind(query); got != tc.want {
+			t.Errorf("postgres %v: rebind = %q, want %q", tc.postgres, got, tc.want)
+		}
+	}
+}
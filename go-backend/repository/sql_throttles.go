@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+type sqlThrottles struct{ d *SQLDatabase }
+
+func scanThrottle(row interface{ Scan(...any) error }) (models.LoginThrottle, error) {
+	var (
+		t           models.LoginThrottle
+		lockedUntil sql.NullTime
+	)
+	if err := row.Scan(&t.Key, &t.Failures, &t.Lockouts, &lockedUntil, &t.LastFailureAt); err != nil {
+		return models.LoginThrottle{}, err
+	}
+	if lockedUntil.Valid {
+		t.LockedUntil = &lockedUntil.Time
+	}
+	return t, nil
+}
+
+func (r *sqlThrottles) GetLoginThrottle(ctx context.Context, key string) (models.LoginThrottle, error) {
+	t, err := scanThrottle(r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT throttle_key, failures, lockouts, locked_until, last_failure_at FROM login_throttles WHERE throttle_key = ?`), key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.LoginThrottle{}, ErrNotFound
+	}
+	return t, err
+}
+
+func (r *sqlThrottles) RecordLoginFailure(ctx context.Context, key string, at time.Time, window, decay time.Duration) (models.LoginThrottle, error) {
+	at = at.UTC()
+	var t models.LoginThrottle
+	err := r.d.withTx(ctx, func(tx sqlQuerier) error {
+		// Drop counters that have decayed completely.
+		if _, err := tx.ExecContext(ctx, r.d.rebind(`DELETE FROM login_throttles WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)`),
+			at.Add(-decay), at); err != nil {
+			return err
+		}
+		// A single upsert keeps concurrent failures from different instances
+		// from overwriting each other.
+		var err error
+		t, err = scanThrottle(tx.QueryRowContext(ctx, r.d.rebind(`INSERT INTO login_throttles (throttle_key, failures, lockouts, last_failure_at) VALUES (?, 1, 0, ?)
+ON CONFLICT (throttle_key) DO UPDATE SET
+    failures = CASE WHEN login_throttles.last_failure_at < ? THEN 1 ELSE login_throttles.failures + 1 END,
+    last_failure_at = excluded.last_failure_at
+RETURNING throttle_key, failures, lockouts, locked_until, last_failure_at`), key, at, at.Add(-window)))
+		return err
+	})
+	return t, err
+}
+
+func (r *sqlThrottles) LockLogin(ctx context.Context, key string, until time.Time) error {
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`INSERT INTO login_throttles (throttle_key, failures, lockouts, locked_until, last_failure_at) VALUES (?, 0, 1, ?, ?)
+ON CONFLICT (throttle_key) DO UPDATE SET
+    failures = 0,
+    lockouts = login_throttles.lockouts + 1,
+    locked_until = excluded.locked_until`), key, until.UTC(), time.Now().UTC())
+	return err
+}
+
+func (r *sqlThrottles) ResetLogin(ctx context.Context, key string) error {
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`DELETE FROM login_throttles WHERE throttle_key = ?`), key)
+	return err
+}
+
+func (r *sqlThrottles) RecordLockout(ctx context.Context, event models.LockoutEvent) error {
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`INSERT INTO login_lockouts (id, scope, ip, email, failures, locked_until, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		event.ID, event.Scope, event.IP, event.Email, event.Failures, event.LockedUntil.UTC(), event.CreatedAt.UTC())
+	return err
+}
@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+type sqlTokens struct{ d *SQLDatabase }
+
+func (r *sqlTokens) CreateRefreshToken(ctx context.Context, token models.RefreshToken) error {
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`INSERT INTO refresh_tokens (id, user_id, family_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`),
+		token.ID, token.UserID, token.FamilyID, token.CreatedAt.UTC(), token.ExpiresAt.UTC())
+	return err
+}
+
+func (r *sqlTokens) GetRefreshToken(ctx context.Context, id string) (models.RefreshToken, error) {
+	var (
+		token           models.RefreshToken
+		usedAt, revoked sql.NullTime
+	)
+	err := r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT id, user_id, family_id, created_at, expires_at, used_at, revoked_at FROM refresh_tokens WHERE id = ?`), id).
+		Scan(&token.ID, &token.UserID, &token.FamilyID, &token.CreatedAt, &token.ExpiresAt, &usedAt, &revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.RefreshToken{}, ErrNotFound
+	}
+	if err != nil {
+		return models.RefreshToken{}, err
+	}
+	if usedAt.Valid {
+		token.UsedAt = &usedAt.Time
+	}
+	if revoked.Valid {
+		token.RevokedAt = &revoked.Time
+	}
+	return token, nil
+}
+
+func (r *sqlTokens) MarkRefreshTokenUsed(ctx context.Context, id string, at time.Time) error {
+	res, err := r.d.db.ExecContext(ctx, r.d.rebind(`UPDATE refresh_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL`), at.UTC(), id)
+	if err != nil {
+		return err
+	}
+	if err := requireRowAffected(res); err != nil {
+		if _, getErr := r.GetRefreshToken(ctx, id); getErr != nil {
+			return getErr
+		}
+		return ErrTokenUsed
+	}
+	return nil
+}
+
+func (r *sqlTokens) RevokeRefreshFamily(ctx context.Context, familyID string, at time.Time) error {
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL`), at.UTC(), familyID)
+	return err
+}
+
+func (r *sqlTokens) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	return r.d.withTx(ctx, func(tx sqlQuerier) error {
+		// Drop entries for tokens that have expired on their own.
+		if _, err := tx.ExecContext(ctx, r.d.rebind(`DELETE FROM revoked_access_tokens WHERE expires_at < ?`), time.Now().UTC()); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, r.d.rebind(`INSERT INTO revoked_access_tokens (jti, expires_at) VALUES (?, ?)`), jti, expiresAt.UTC())
+		if isUniqueViolation(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (r *sqlTokens) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var n int
+	err := r.d.db.QueryRowContext(ctx, r.d.rebind(`SELECT COUNT(*) FROM revoked_access_tokens WHERE jti = ?`), jti).Scan(&n)
+	return n > 0, err
+}
+
+func (r *sqlTokens) RevokeUserRefreshTokens(ctx context.Context, userID string, at time.Time) error {
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`), at.UTC(), userID)
+	return err
+}
+
+func (r *sqlTokens) CreateActionToken(ctx context.Context, token models.ActionToken) error {
+	_, err := r.d.db.ExecContext(ctx, r.d.rebind(`INSERT INTO action_tokens (id, user_id, purpose, email, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`),
+		token.ID, token.UserID, token.Purpose, token.Email, token.CreatedAt.UTC(), token.ExpiresAt.UTC())
+	return err
+}
+
+func (r *sqlTokens) ConsumeActionToken(ctx context.Context, id, purpose string, at time.Time) (models.ActionToken, error) {
+	var token models.ActionToken
+	err := r.d.withTx(ctx, func(tx sqlQuerier) error {
+		var usedAt sql.NullTime
+		err := tx.QueryRowContext(ctx, r.d.rebind(`SELECT id, user_id, purpose, email, created_at, expires_at, used_at FROM action_tokens WHERE id = ? AND purpose = ?`), id, purpose).
+			Scan(&token.ID, &token.UserID, &token.Purpose, &token.Email, &token.CreatedAt, &token.ExpiresAt, &usedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		// The used_at guard keeps concurrent consumers from both succeeding.
+		res, err := tx.ExecContext(ctx, r.d.rebind(`UPDATE action_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL`), at.UTC(), id)
+		if err != nil {
+			return err
+		}
+		if err := requireRowAffected(res); err != nil {
+			return ErrTokenUsed
+		}
+		token.UsedAt = &at
+		return nil
+	})
+	if err != nil {
+		return models.ActionToken{}, err
+	}
+	return token, nil
+}
@@ -0,0 +1,598 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/money"
+	"github.com/google/uuid"
+)
+
+// newSQLiteTestStore returns a Store on a migrated SQLite database in a
+// temporary directory.
+func newSQLiteTestStore(t *testing.T) Store {
+	t.Helper()
+	return migratedStore(t, newSQLiteTestDB(t))
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, newSQLiteTestStore(t))
+}
+
+// The concurrency tests are most useful run with go test -race.
+
+func TestMemoryStoreConcurrent(t *testing.T) {
+	testStoreConcurrent(t, NewMemoryStore())
+}
+
+func TestSQLiteStoreConcurrent(t *testing.T) {
+	testStoreConcurrent(t, newSQLiteTestStore(t))
+}
+
+// newTestUser returns a student account as Register creates it.
+func newTestUser(email string) models.User {
+	return models.User{
+		ID:              uuid.New().String(),
+		Email:           email,
+		Password:        "hash",
+		FullName:        "Test User",
+		Role:            models.RoleStudent,
+		CreatedAt:       time.Now().UTC().Truncate(time.Millisecond),
+		EnrolledCourses: []string{},
+		Badges:          []string{},
+		Progress:        map[string]int{},
+	}
+}
+
+// newTestCourse returns a published course priced at Rp 499.000.
+func newTestCourse() models.Course {
+	return models.Course{
+		Title:       "Personal Finance",
+		Description: "Budgeting and saving",
+		Price:       money.New(499000, money.IDR),
+		Category:    "Finance",
+		Level:       "Beginner",
+		MentorName:  "Mentor",
+		Duration:    "1h",
+		Topics:      []string{"budgeting"},
+		CreatedAt:   time.Now().UTC().Truncate(time.Millisecond),
+		Status:      models.CoursePublished,
+	}
+}
+
+// newTestPayment returns a pending payment by the user for the course.
+func newTestPayment(userID string, course models.Course) models.Payment {
+	return models.Payment{
+		ID:            uuid.New().String(),
+		UserID:        userID,
+		CourseID:      course.ID,
+		Amount:        course.Price,
+		PaymentMethod: "qris",
+		Status:        models.PaymentPending,
+		CreatedAt:     time.Now().UTC().Truncate(time.Millisecond),
+	}
+}
+
+// testStore checks the behaviour every backend must share: storing and
+// changing users, courses and their curricula, enrolling, and settling
+// payments.
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	t.Run("users", func(t *testing.T) {
+		user := newTestUser("users@example.com")
+		if err := store.Users.Create(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Users.Create(ctx, newTestUser(user.Email)); !errors.Is(err, ErrDuplicateEmail) {
+			t.Fatalf("Create with a used email: got %v, want ErrDuplicateEmail", err)
+		}
+
+		got, err := store.Users.GetByEmail(ctx, user.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != user.ID || got.FullName != user.FullName || got.Role != user.Role {
+			t.Errorf("GetByEmail = %+v, want %+v", got, user)
+		}
+
+		user.FullName = "Renamed"
+		if err := store.Users.Update(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := store.Users.GetByID(ctx, user.ID); err != nil || got.FullName != "Renamed" {
+			t.Errorf("GetByID after Update = %q, %v, want %q", got.FullName, err, "Renamed")
+		}
+
+		// Ending sessions is kept by later updates
+		ended := time.Now().UTC().Truncate(time.Millisecond)
+		if err := store.Users.EndSessions(ctx, user.ID, ended); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Users.Update(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := store.Users.GetByID(ctx, user.ID); err != nil || got.SessionsEndedAt == nil || !got.SessionsEndedAt.Equal(ended) {
+			t.Errorf("SessionsEndedAt = %v, %v, want %v", got.SessionsEndedAt, err, ended)
+		}
+		if err := store.Users.EndSessions(ctx, uuid.New().String(), ended); !errors.Is(err, ErrNotFound) {
+			t.Errorf("EndSessions of a missing user: got %v, want ErrNotFound", err)
+		}
+
+		if _, err := store.Users.GetByID(ctx, uuid.New().String()); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetByID of a missing user: got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("courses", func(t *testing.T) {
+		course := newTestCourse()
+		if err := store.Courses.Create(ctx, &course); err != nil {
+			t.Fatal(err)
+		}
+		if course.ID == "" {
+			t.Fatal("Create did not assign an ID")
+		}
+
+		got, err := store.Courses.GetByID(ctx, course.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Title != course.Title || got.Price != course.Price || got.Status != course.Status {
+			t.Errorf("GetByID = %+v, want %+v", got, course)
+		}
+
+		course.Price = money.New(4999, money.USD)
+		if err := store.Courses.Update(ctx, course); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := store.Courses.GetByID(ctx, course.ID); err != nil || got.Price != course.Price {
+			t.Errorf("price after Update = %v, %v, want %v", got.Price, err, course.Price)
+		}
+
+		archived, err := store.Courses.Delete(ctx, course.ID, "admin", time.Now())
+		if err != nil || archived {
+			t.Fatalf("Delete of an unsold course = %v, %v, want it removed", archived, err)
+		}
+		if _, err := store.Courses.GetByID(ctx, course.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetByID after Delete: got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("curriculum", func(t *testing.T) {
+		course := newTestCourse()
+		if err := store.Courses.Create(ctx, &course); err != nil {
+			t.Fatal(err)
+		}
+		addModule := func(title string, position int) models.Module {
+			t.Helper()
+			m := models.Module{CourseID: course.ID, Title: title, Position: position, CreatedAt: time.Now()}
+			if err := store.Curriculum.CreateModule(ctx, &m); err != nil {
+				t.Fatal(err)
+			}
+			return m
+		}
+		addLesson := func(module models.Module, title string, position, seconds int) models.Lesson {
+			t.Helper()
+			l := models.Lesson{
+				CourseID:        course.ID,
+				ModuleID:        module.ID,
+				Title:           title,
+				Position:        position,
+				Type:            models.LessonText,
+				Content:         "Text",
+				DurationSeconds: seconds,
+				CreatedAt:       time.Now(),
+			}
+			if err := store.Curriculum.CreateLesson(ctx, &l); err != nil {
+				t.Fatal(err)
+			}
+			return l
+		}
+		// check compares the outline, written as module titles followed by
+		// their lessons' titles, and the positions in it.
+		check := func(want string) []models.Module {
+			t.Helper()
+			modules, err := store.Curriculum.Outline(ctx, course.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for i, m := range modules {
+				if m.Position != i+1 {
+					t.Errorf("module %q is at position %d, want %d", m.Title, m.Position, i+1)
+				}
+				s := m.Title + ":"
+				for j, l := range m.Lessons {
+					if l.Position != j+1 || l.ModuleID != m.ID {
+						t.Errorf("lesson %q is at %s position %d, want %s position %d", l.Title, l.ModuleID, l.Position, m.ID, j+1)
+					}
+					s += " " + l.Title
+				}
+				got = append(got, s)
+			}
+			if g := strings.Join(got, ", "); g != want {
+				t.Errorf("outline = %s, want %s", g, want)
+			}
+			return modules
+		}
+
+		// Position 0 adds at the end, a position past the end too
+		a := addModule("A", 0)
+		b := addModule("B", 0)
+		c := addModule("C", 1)
+		addModule("D", 9)
+		if a.Position != 1 || c.Position != 1 {
+			t.Errorf("CreateModule positions = %d, %d, want 1, 1", a.Position, c.Position)
+		}
+		l1 := addLesson(a, "l1", 0, 600)
+		l2 := addLesson(a, "l2", 0, 1200)
+		l3 := addLesson(a, "l3", 1, 300)
+		if l3.Position != 1 || l2.Position != 2 {
+			t.Errorf("CreateLesson positions = %d, %d, want 1, 2", l3.Position, l2.Position)
+		}
+		check("C:, A: l3 l1 l2, B:, D:")
+
+		// Moving a module or a lesson shifts the others
+		b.Position = 1
+		if err := store.Curriculum.UpdateModule(ctx, &b); err != nil {
+			t.Fatal(err)
+		}
+		l2.Position = 1
+		if err := store.Curriculum.UpdateLesson(ctx, &l2); err != nil {
+			t.Fatal(err)
+		}
+		check("B:, C:, A: l2 l3 l1, D:")
+
+		// A lesson moved to another module goes to the position asked for
+		l1.ModuleID, l1.Position = b.ID, 0
+		if err := store.Curriculum.UpdateLesson(ctx, &l1); err != nil {
+			t.Fatal(err)
+		}
+		if l1.ModuleID != b.ID || l1.Position != 1 {
+			t.Errorf("moved lesson is in %s at %d, want %s at 1", l1.ModuleID, l1.Position, b.ID)
+		}
+		modules := check("B: l1, C:, A: l2 l3, D:")
+		if modules[0].DurationSeconds != 600 || modules[2].DurationSeconds != 1500 {
+			t.Errorf("module durations = %d, %d, want 600, 1500", modules[0].DurationSeconds, modules[2].DurationSeconds)
+		}
+
+		// Deleting closes the gap
+		if err := store.Curriculum.DeleteModule(ctx, course.ID, c.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Curriculum.DeleteLesson(ctx, course.ID, l2.ID); err != nil {
+			t.Fatal(err)
+		}
+		check("B: l1, A: l3, D:")
+
+		// The course's totals follow its lessons
+		got, err := store.Courses.GetByID(ctx, course.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.LessonCount != 2 || got.DurationSeconds != 900 || got.Duration != "15 minutes" {
+			t.Errorf("course totals = %d lessons, %ds, %q, want 2, 900s, 15 minutes", got.LessonCount, got.DurationSeconds, got.Duration)
+		}
+
+		missing := uuid.New().String()
+		if err := store.Curriculum.DeleteModule(ctx, course.ID, missing); !errors.Is(err, ErrNotFound) {
+			t.Errorf("DeleteModule of a missing module: got %v, want ErrNotFound", err)
+		}
+		if err := store.Curriculum.DeleteLesson(ctx, course.ID, missing); !errors.Is(err, ErrNotFound) {
+			t.Errorf("DeleteLesson of a missing lesson: got %v, want ErrNotFound", err)
+		}
+		l3.ModuleID = missing
+		if err := store.Curriculum.UpdateLesson(ctx, &l3); !errors.Is(err, ErrNotFound) {
+			t.Errorf("UpdateLesson into a missing module: got %v, want ErrNotFound", err)
+		}
+		if _, err := store.Curriculum.Outline(ctx, missing); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Outline of a missing course: got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("enroll", func(t *testing.T) {
+		user := newTestUser("enroll@example.com")
+		course := newTestCourse()
+		if err := store.Users.Create(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Courses.Create(ctx, &course); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.Users.Enroll(ctx, user.ID, course.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Users.Enroll(ctx, user.ID, course.ID); !errors.Is(err, ErrAlreadyEnrolled) {
+			t.Errorf("second Enroll: got %v, want ErrAlreadyEnrolled", err)
+		}
+		got, err := store.Users.GetByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Contains(got.EnrolledCourses, course.ID) {
+			t.Errorf("enrolled courses = %v, want %s", got.EnrolledCourses, course.ID)
+		}
+		if progress, ok := got.Progress[course.ID]; !ok || progress != 0 {
+			t.Errorf("progress = %v, want 0", got.Progress)
+		}
+
+		archived, err := store.Courses.Delete(ctx, course.ID, "admin", time.Now())
+		if err != nil || !archived {
+			t.Errorf("Delete of an enrolled course = %v, %v, want it archived", archived, err)
+		}
+	})
+
+	t.Run("payments", func(t *testing.T) {
+		user := newTestUser("payments@example.com")
+		course := newTestCourse()
+		if err := store.Users.Create(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Courses.Create(ctx, &course); err != nil {
+			t.Fatal(err)
+		}
+		payment := newTestPayment(user.ID, course)
+		if err := store.Payments.Create(ctx, payment); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Payments.Create(ctx, newTestPayment(user.ID, course)); !errors.Is(err, ErrPaymentPending) {
+			t.Errorf("second pending payment: got %v, want ErrPaymentPending", err)
+		}
+
+		paid, err := store.Payments.SetStatus(ctx, payment.ID, models.PaymentPending, models.PaymentPaid, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paid.Status != models.PaymentPaid || paid.SettledAt == nil || paid.Amount != course.Price {
+			t.Errorf("paid payment = %+v", paid)
+		}
+		checkEnrollment(t, store, user.ID, course.ID, true, 1)
+
+		got, err := store.Payments.SetStatus(ctx, payment.ID, models.PaymentPending, models.PaymentPaid, time.Now())
+		if !errors.Is(err, ErrStatusConflict) || got.Status != models.PaymentPaid {
+			t.Errorf("paying twice = %q, %v, want paid with ErrStatusConflict", got.Status, err)
+		}
+		checkEnrollment(t, store, user.ID, course.ID, true, 1)
+
+		if _, err := store.Payments.SetStatus(ctx, payment.ID, models.PaymentPaid, models.PaymentRefunded, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		checkEnrollment(t, store, user.ID, course.ID, false, 0)
+
+		payments, err := store.Payments.ListByUser(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(payments) != 1 || payments[0].Status != models.PaymentRefunded {
+			t.Errorf("ListByUser = %+v, want the refunded payment", payments)
+		}
+	})
+}
+
+// checkEnrollment fails the test unless the user's enrollment in the course
+// and the course's enrolled count are as given.
+func checkEnrollment(t *testing.T, store Store, userID, courseID string, enrolled bool, count int) {
+	t.Helper()
+	ctx := context.Background()
+	user, err := store.Users.GetByID(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(user.EnrolledCourses, courseID) != enrolled {
+		t.Errorf("enrolled = %v, want %v", !enrolled, enrolled)
+	}
+	course, err := store.Courses.GetByID(ctx, courseID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if course.EnrolledCount != count {
+		t.Errorf("enrolled count = %d, want %d", course.EnrolledCount, count)
+	}
+}
+
+// concurrency is how many goroutines each concurrency test starts at once.
+const concurrency = 20
+
+// parallel calls f with 0 to n-1 in n goroutines released together, and
+// returns their errors in the same order.
+func parallel(n int, f func(i int) error) []error {
+	errs := make([]error, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			errs[i] = f(i)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return errs
+}
+
+// countErrors returns how many of errs are nil and how many match target,
+// failing the test on any other error.
+func countErrors(t *testing.T, errs []error, target error) (ok, matched int) {
+	t.Helper()
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			ok++
+		case errors.Is(err, target):
+			matched++
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	return ok, matched
+}
+
+// testStoreConcurrent checks that registering, enrolling and purchasing
+// from many goroutines at once neither loses nor repeats a change.
+func testStoreConcurrent(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	t.Run("register", func(t *testing.T) {
+		errs := parallel(concurrency, func(i int) error {
+			email := "same@example.com"
+			if i%2 == 0 {
+				email = "user" + strconv.Itoa(i) + "@example.com"
+			}
+			return store.Users.Create(ctx, newTestUser(email))
+		})
+		ok, duplicates := countErrors(t, errs, ErrDuplicateEmail)
+		if want := concurrency/2 + 1; ok != want || duplicates != concurrency-want {
+			t.Errorf("%d created and %d duplicates, want %d and %d", ok, duplicates, want, concurrency-want)
+		}
+	})
+
+	t.Run("enroll", func(t *testing.T) {
+		user := newTestUser("enroll-race@example.com")
+		course := newTestCourse()
+		if err := store.Users.Create(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Courses.Create(ctx, &course); err != nil {
+			t.Fatal(err)
+		}
+
+		errs := parallel(concurrency, func(int) error {
+			return store.Users.Enroll(ctx, user.ID, course.ID)
+		})
+		if ok, _ := countErrors(t, errs, ErrAlreadyEnrolled); ok != 1 {
+			t.Errorf("%d enrollments succeeded, want 1", ok)
+		}
+		got, err := store.Users.GetByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got.EnrolledCourses, []string{course.ID}) {
+			t.Errorf("enrolled courses = %v, want [%s]", got.EnrolledCourses, course.ID)
+		}
+	})
+
+	t.Run("purchase", func(t *testing.T) {
+		course := newTestCourse()
+		if err := store.Courses.Create(ctx, &course); err != nil {
+			t.Fatal(err)
+		}
+		// Every buyer starts the purchase twice at once, which leaves one
+		// pending payment, and every payment is settled by two webhooks at
+		// once
+		var buyers []string
+		var attempts []models.Payment
+		for i := range concurrency / 2 {
+			user := newTestUser("buyer" + strconv.Itoa(i) + "@example.com")
+			if err := store.Users.Create(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+			buyers = append(buyers, user.ID)
+			attempts = append(attempts, newTestPayment(user.ID, course), newTestPayment(user.ID, course))
+		}
+		errs := parallel(len(attempts), func(i int) error {
+			return store.Payments.Create(ctx, attempts[i])
+		})
+		if ok, pending := countErrors(t, errs, ErrPaymentPending); ok != len(buyers) || pending != len(buyers) {
+			t.Fatalf("%d payments stored and %d refused, want %d of each", ok, pending, len(buyers))
+		}
+		var payments []models.Payment
+		for i, err := range errs {
+			if err == nil {
+				payments = append(payments, attempts[i])
+			}
+		}
+
+		errs = parallel(2*len(payments), func(i int) error {
+			_, err := store.Payments.SetStatus(ctx, payments[i/2].ID, models.PaymentPending, models.PaymentPaid, time.Now())
+			return err
+		})
+		if ok, _ := countErrors(t, errs, ErrStatusConflict); ok != len(payments) {
+			t.Errorf("%d payments settled, want %d", ok, len(payments))
+		}
+		for _, id := range buyers {
+			user, err := store.Users.GetByID(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(user.EnrolledCourses, []string{course.ID}) {
+				t.Errorf("buyer %s enrolled in %v, want [%s]", id, user.EnrolledCourses, course.ID)
+			}
+		}
+		got, err := store.Courses.GetByID(ctx, course.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.EnrolledCount != len(buyers) {
+			t.Errorf("enrolled count = %d, want %d", got.EnrolledCount, len(buyers))
+		}
+	})
+
+	t.Run("redeem", func(t *testing.T) {
+		coupon := models.Coupon{
+			ID:             uuid.New().String(),
+			Code:           "RACE",
+			PercentOff:     10,
+			CourseIDs:      []string{},
+			Categories:     []string{},
+			MaxRedemptions: 5,
+			PerUserLimit:   1,
+			CreatedAt:      time.Now().UTC().Truncate(time.Millisecond),
+		}
+		if err := store.Coupons.Create(ctx, coupon); err != nil {
+			t.Fatal(err)
+		}
+		// Half the attempts come from one buyer, who may redeem it once
+		var users []string
+		for i := range concurrency / 2 {
+			user := newTestUser("redeemer" + strconv.Itoa(i) + "@example.com")
+			if err := store.Users.Create(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+			users = append(users, user.ID)
+		}
+
+		errs := parallel(concurrency, func(i int) error {
+			userID := users[0]
+			if i%2 == 0 {
+				userID = users[i/2]
+			}
+			return store.Coupons.Redeem(ctx, coupon.ID, userID, uuid.New().String(), time.Now())
+		})
+		ok := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				ok++
+			case !errors.Is(err, ErrCouponExhausted) && !errors.Is(err, ErrCouponUserLimit):
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+		if ok != coupon.MaxRedemptions {
+			t.Errorf("%d redemptions, want %d", ok, coupon.MaxRedemptions)
+		}
+		if used, err := store.Coupons.CountRedemptions(ctx, coupon.ID, users[0]); err != nil || used != 1 {
+			t.Errorf("redemptions by one buyer = %d, %v, want 1", used, err)
+		}
+		got, err := store.Coupons.GetByID(ctx, coupon.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Redemptions != coupon.MaxRedemptions {
+			t.Errorf("coupon redemptions = %d, want %d", got.Redemptions, coupon.MaxRedemptions)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/cuanin/emergent-backend/search"
+)
+
+// indexCourses loads the course catalog into index.
+func indexCourses(ctx context.Context, courses repository.CourseRepository, index *search.Index) error {
+	list, err := courses.List(ctx)
+	if err != nil {
+		return err
+	}
+	index.Reset(list)
+	return nil
+}
+
+// refreshSearchIndex reloads index from the store every interval until ctx
+// is cancelled. Each instance updates its own index when courses change
+// through it; the refresh picks up changes made through other instances.
+func refreshSearchIndex(ctx context.Context, courses repository.CourseRepository, index *search.Index, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := indexCourses(ctx, courses, index); err != nil {
+				log.Printf("Failed to refresh search index: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// token is a word of a text, lower-cased, with its byte offsets in the
+// original text.
+type token struct {
+	text       string
+	start, end int
+}
+
+// tokenize splits text into runs of letters and digits.
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+// terms returns the index terms of a lower-cased word: its English and
+// Indonesian stems. Course text mixes both languages, often within one
+// title, so every word is stemmed both ways rather than guessing. Stop
+// words and single letters have no terms.
+func terms(word string) []string {
+	if stopWords[word] || utf8.RuneCountInString(word) < 2 {
+		return nil
+	}
+	en, id := stemEnglish(word), stemIndonesian(word)
+	if en == id {
+		return []string{en}
+	}
+	return []string{en, id}
+}
+
+var stopWords = makeSet(
+	// English
+	"a", "about", "all", "an", "and", "are", "as", "at", "be", "by", "can", "do", "for", "from",
+	"how", "if", "in", "into", "is", "it", "its", "of", "on", "or", "our", "so", "that", "the",
+	"their", "them", "this", "to", "up", "was", "we", "what", "when", "which", "will", "with",
+	"you", "your",
+	// Indonesian
+	"ada", "adalah", "agar", "akan", "anda", "apa", "atau", "bagaimana", "bagi", "belum", "bisa",
+	"cara", "dalam", "dan", "dapat", "dari", "dengan", "di", "hingga", "ini", "itu", "jika",
+	"juga", "kalau", "kami", "kamu", "karena", "ke", "kita", "maka", "mereka", "oleh", "pada",
+	"para", "sampai", "saya", "secara", "sebagai", "serta", "sudah", "supaya", "telah", "tentang",
+	"tidak", "untuk", "yang",
+)
+
+func makeSet(words ...string) map[string]bool {
+	set := make(map[string]bool, len(words))
+	for _, w := range words {
+		set[w] = true
+	}
+	return set
+}
+
+// stemEnglish strips common English inflections, in the spirit of the first
+// steps of the Porter stemmer: "budgeting" and "budgets" become "budget".
+func stemEnglish(w string) string {
+	if len(w) <= 3 {
+		return w
+	}
+	switch {
+	case strings.HasSuffix(w, "sses"):
+		w = w[:len(w)-2]
+	case strings.HasSuffix(w, "ies") && len(w) > 4:
+		w = w[:len(w)-3] + "y"
+	case strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss") && !strings.HasSuffix(w, "us") && !strings.HasSuffix(w, "is"):
+		w = w[:len(w)-1]
+	}
+	for _, suffix := range []string{"ing", "ed"} {
+		if stem, ok := strings.CutSuffix(w, suffix); ok && len(stem) >= 3 && strings.ContainsAny(stem, "aeiouy") {
+			w = undouble(stem)
+			break
+		}
+	}
+	for _, suffix := range []string{"ment", "ly"} {
+		if stem, ok := strings.CutSuffix(w, suffix); ok && len(stem) >= 4 {
+			w = stem
+			break
+		}
+	}
+	if stem, ok := strings.CutSuffix(w, "e"); ok && len(stem) >= 3 {
+		w = stem
+	}
+	return w
+}
+
+// undouble removes one letter of a doubled final consonant, as in
+// "running" -> "runn" -> "run".
+func undouble(w string) string {
+	n := len(w)
+	if n >= 2 && w[n-1] == w[n-2] && !strings.ContainsRune("aeioulsz", rune(w[n-1])) {
+		return w[:n-1]
+	}
+	return w
+}
+
+// stemIndonesian removes Indonesian affixes following the order of the
+// Nazief-Adriani algorithm, without its dictionary lookups: particles,
+// possessive pronouns and derivational suffixes, then up to two prefixes.
+// "keuangannya" becomes "uang" and "menabung" becomes "tabung".
+func stemIndonesian(w string) string {
+	const minRoot = 4
+	cut := func(suffixes ...string) {
+		for _, suffix := range suffixes {
+			if stem, ok := strings.CutSuffix(w, suffix); ok && len(stem) >= minRoot {
+				w = stem
+				return
+			}
+		}
+	}
+	cut("lah", "kah", "tah", "pun")
+	cut("nya", "ku", "mu")
+	cut("kan", "an", "i")
+
+	for range 2 {
+		root, ok := cutPrefix(w)
+		if !ok || len(root) < minRoot {
+			break
+		}
+		w = root
+	}
+	return w
+}
+
+// cutPrefix removes one Indonesian prefix from w, restoring the first
+// letter of the root that the nasal prefixes replace, as in "menyimpan" ->
+// "simpan" and "memilih" -> "pilih".
+func cutPrefix(w string) (string, bool) {
+	isVowel := func(s string) bool { return s != "" && strings.ContainsRune("aeiou", rune(s[0])) }
+	startsWithAny := func(s, letters string) bool { return s != "" && strings.ContainsRune(letters, rune(s[0])) }
+
+	for _, p := range []string{"me", "pe"} {
+		rest, ok := strings.CutPrefix(w, p)
+		if !ok {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(rest, "ny") && isVowel(rest[2:]):
+			return "s" + rest[2:], true
+		case strings.HasPrefix(rest, "ng"):
+			return rest[2:], true
+		case strings.HasPrefix(rest, "m") && isVowel(rest[1:]):
+			return "p" + rest[1:], true
+		case strings.HasPrefix(rest, "m") && startsWithAny(rest[1:], "bfv"):
+			return rest[1:], true
+		case strings.HasPrefix(rest, "n") && isVowel(rest[1:]):
+			return "t" + rest[1:], true
+		case strings.HasPrefix(rest, "n") && startsWithAny(rest[1:], "cdjz"):
+			return rest[1:], true
+		case p == "pe" && strings.HasPrefix(rest, "r") && !isVowel(rest[1:]):
+			// per- before a consonant, as in "pertanian" -> "tani"
+			return rest[1:], true
+		case startsWithAny(rest, "lmnrwy"):
+			return rest, true
+		}
+	}
+	if rest, ok := strings.CutPrefix(w, "bel"); ok && strings.HasPrefix(rest, "ajar") {
+		return rest, true
+	}
+	for _, p := range []string{"ber", "ter", "di", "ke", "se"} {
+		if rest, ok := strings.CutPrefix(w, p); ok {
+			return rest, true
+		}
+	}
+	return w, false
+}
@@ -0,0 +1,56 @@
+package search
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTerms(t *testing.T) {
+	for _, tt := range []struct {
+		word string
+		want []string
+	}{
+		// English inflections
+		{"budgeting", []string{"budget", "budgeting"}},
+		{"budgetting", []string{"budget", "budgetting"}},
+		{"budgets", []string{"budget", "budgets"}},
+		{"stocks", []string{"stock", "stocks"}},
+		{"strategies", []string{"strategy", "strategies"}},
+		{"management", []string{"manag", "management"}},
+		{"managed", []string{"manag", "managed"}},
+		// Indonesian affixes
+		{"keuangannya", []string{"keuangannya", "uang"}},
+		{"menabung", []string{"menabung", "tabung"}},
+		{"investasi", []string{"investasi", "investas"}},
+		{"berinvestasi", []string{"berinvestasi", "investas"}},
+		{"belajar", []string{"belajar", "ajar"}},
+		{"saham", []string{"saham"}},
+		// Stop words and single letters are not indexed
+		{"the", nil},
+		{"yang", nil},
+		{"x", nil},
+	} {
+		if got := terms(tt.word); !slices.Equal(got, tt.want) {
+			t.Errorf("terms(%q) = %q, want %q", tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, tt := range []struct {
+		a, b  string
+		limit int
+		want  int
+	}{
+		{"stok", "stock", 1, 1},
+		{"sahm", "saham", 1, 1},
+		{"budgte", "budget", 1, 1}, // a transposition is one edit
+		{"budget", "budget", 2, 0},
+		{"invest", "saham", 2, 3},
+		{"a", "abcd", 1, 2},
+	} {
+		if got := editDistance(tt.a, tt.b, tt.limit); got != tt.want {
+			t.Errorf("editDistance(%q, %q, %d) = %d, want %d", tt.a, tt.b, tt.limit, got, tt.want)
+		}
+	}
+}
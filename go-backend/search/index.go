@@ -0,0 +1,372 @@
+// Package search keeps an in-memory inverted index of the course catalog
+// for full-text search with relevance ranking. Words are stemmed for both
+// English and Indonesian, common words are ignored, misspelt query words
+// match similar indexed words, and results carry highlighted snippets.
+package search
+
+import (
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+// Fields of a course that are searched, and how much a match in each
+// counts towards relevance.
+const (
+	FieldTitle       = "title"
+	FieldTopics      = "topics"
+	FieldMentor      = "mentor_name"
+	FieldDescription = "description"
+)
+
+var fieldWeights = map[string]float64{
+	FieldTitle:       3,
+	FieldTopics:      2,
+	FieldMentor:      2,
+	FieldDescription: 1,
+}
+
+// BM25 parameters
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// maxQueryWords caps the words of a query that are looked up.
+const maxQueryWords = 16
+
+// Result is a course matching a query.
+type Result struct {
+	ID    string
+	Score float64
+	// Highlights holds, for each field that matched, its text as HTML with
+	// the matching words in <mark> elements. The description is cut to a
+	// snippet around the first match.
+	Highlights map[string]string
+}
+
+// document is an indexed course.
+type document struct {
+	fields map[string]string  // field -> original text
+	tf     map[string]float64 // term -> weighted term frequency
+	length float64            // weighted number of terms
+}
+
+// Index is an inverted index of courses. It is safe for concurrent use.
+type Index struct {
+	mu        sync.RWMutex
+	docs      map[string]*document
+	postings  map[string]map[string]float64 // term -> course ID -> weighted term frequency
+	totalSize float64                       // sum of document lengths
+}
+
+// New returns an empty Index.
+func New() *Index {
+	return &Index{docs: make(map[string]*document), postings: make(map[string]map[string]float64)}
+}
+
+// Reset replaces the contents of the index with courses.
+func (ix *Index) Reset(courses []models.Course) {
+	fresh := New()
+	for _, course := range courses {
+		fresh.put(course)
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.docs, ix.postings, ix.totalSize = fresh.docs, fresh.postings, fresh.totalSize
+}
+
+// Put adds a course to the index, replacing any earlier version. Courses
+// that are not listed in the catalog, such as drafts and archived courses,
+// are removed instead.
+func (ix *Index) Put(course models.Course) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.put(course)
+}
+
+// Remove deletes a course from the index.
+func (ix *Index) Remove(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(id)
+}
+
+func (ix *Index) put(course models.Course) {
+	ix.remove(course.ID)
+	if !course.Listed() {
+		return
+	}
+
+	doc := &document{
+		fields: map[string]string{
+			FieldTitle:       course.Title,
+			FieldTopics:      strings.Join(course.Topics, ", "),
+			FieldMentor:      course.MentorName,
+			FieldDescription: course.Description,
+		},
+		tf: make(map[string]float64),
+	}
+	for field, text := range doc.fields {
+		weight := fieldWeights[field]
+		for _, tok := range tokenize(text) {
+			for _, term := range terms(tok.text) {
+				doc.tf[term] += weight
+			}
+			doc.length += weight
+		}
+	}
+	for term, tf := range doc.tf {
+		if ix.postings[term] == nil {
+			ix.postings[term] = make(map[string]float64)
+		}
+		ix.postings[term][course.ID] = tf
+	}
+	ix.docs[course.ID] = doc
+	ix.totalSize += doc.length
+}
+
+func (ix *Index) remove(id string) {
+	doc, ok := ix.docs[id]
+	if !ok {
+		return
+	}
+	for term := range doc.tf {
+		delete(ix.postings[term], id)
+		if len(ix.postings[term]) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+	ix.totalSize -= doc.length
+	delete(ix.docs, id)
+}
+
+// Search returns the courses matching query, most relevant first. A course
+// matches if it contains any of the query's words; courses containing more
+// of them rank higher.
+func (ix *Index) Search(query string) []Result {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	var words [][]string
+	for _, tok := range tokenize(query) {
+		if t := terms(tok.text); t != nil {
+			words = append(words, t)
+		}
+		if len(words) == maxQueryWords {
+			break
+		}
+	}
+	if len(words) == 0 || len(ix.docs) == 0 {
+		return []Result{}
+	}
+
+	scores := make(map[string]float64)
+	matchedWords := make(map[string]int)
+	matchedTerms := make(map[string]map[string]bool)
+	for _, wordTerms := range words {
+		// Score each course by the best of the word's terms
+		best := make(map[string]float64)
+		for term, weight := range ix.candidates(wordTerms) {
+			idf := ix.idf(term)
+			for id, tf := range ix.postings[term] {
+				score := weight * ix.bm25(tf, idf, ix.docs[id].length)
+				if score > best[id] {
+					best[id] = score
+				}
+				if matchedTerms[id] == nil {
+					matchedTerms[id] = make(map[string]bool)
+				}
+				matchedTerms[id][term] = true
+			}
+		}
+		for id, score := range best {
+			scores[id] += score
+			matchedWords[id]++
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, Result{
+			ID:         id,
+			Score:      score * float64(matchedWords[id]) / float64(len(words)),
+			Highlights: ix.docs[id].highlights(matchedTerms[id]),
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
+
+// candidates returns the indexed terms a query word matches, with the
+// weight of each match. Exact terms match fully; if there are none, terms
+// within a small edit distance match with less weight, so that typos like
+// "budgetting" or "sahm" still find something.
+func (ix *Index) candidates(wordTerms []string) map[string]float64 {
+	matches := make(map[string]float64)
+	for _, term := range wordTerms {
+		if _, ok := ix.postings[term]; ok {
+			matches[term] = 1
+		}
+	}
+	if len(matches) > 0 {
+		return matches
+	}
+	for _, term := range wordTerms {
+		maxEdits := allowedEdits(term)
+		if maxEdits == 0 {
+			continue
+		}
+		for indexed := range ix.postings {
+			d := editDistance(term, indexed, maxEdits)
+			if d <= maxEdits {
+				weight := 1 / float64(1+d)
+				if weight > matches[indexed] {
+					matches[indexed] = weight
+				}
+			}
+		}
+	}
+	return matches
+}
+
+func (ix *Index) idf(term string) float64 {
+	n, df := float64(len(ix.docs)), float64(len(ix.postings[term]))
+	return math.Log(1 + (n-df+0.5)/(df+0.5))
+}
+
+func (ix *Index) bm25(tf, idf, length float64) float64 {
+	avg := ix.totalSize / float64(len(ix.docs))
+	if avg == 0 {
+		return 0
+	}
+	return idf * tf * (k1 + 1) / (tf + k1*(1-b+b*length/avg))
+}
+
+// allowedEdits is how many typos a query term of this length may contain.
+func allowedEdits(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance returns the Damerau-Levenshtein distance between a and b
+// (optimal string alignment), or limit+1 if it is more than limit.
+func editDistance(a, b string, limit int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > limit || -d > limit {
+		return limit + 1
+	}
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+// Words of context kept around the first match in a description snippet
+const (
+	snippetBefore = 8
+	snippetAfter  = 24
+)
+
+// highlights marks the words of each field whose terms are in matched.
+func (d *document) highlights(matched map[string]bool) map[string]string {
+	out := make(map[string]string)
+	for field, text := range d.fields {
+		if h, ok := highlight(text, matched, field == FieldDescription); ok {
+			out[field] = h
+		}
+	}
+	return out
+}
+
+// highlight returns text as HTML with the words whose terms are in matched
+// wrapped in <mark>. With snippet set, only the words around the first
+// match are kept. ok is false if no word matched.
+func highlight(text string, matched map[string]bool, snippet bool) (string, bool) {
+	tokens := tokenize(text)
+	marks := make([]bool, len(tokens))
+	first := -1
+	for i, tok := range tokens {
+		for _, term := range terms(tok.text) {
+			if matched[term] {
+				marks[i] = true
+			}
+		}
+		if marks[i] && first < 0 {
+			first = i
+		}
+	}
+	if first < 0 {
+		return "", false
+	}
+
+	from, to := 0, len(text)
+	lo, hi := 0, len(tokens)
+	if snippet {
+		lo, hi = max(0, first-snippetBefore), min(len(tokens), first+snippetAfter)
+		if lo > 0 {
+			from = tokens[lo].start
+		}
+		if hi < len(tokens) {
+			to = tokens[hi-1].end
+		}
+	}
+
+	var sb strings.Builder
+	if from > 0 {
+		sb.WriteString("…")
+	}
+	pos := from
+	for i := lo; i < hi; i++ {
+		if !marks[i] {
+			continue
+		}
+		tok := tokens[i]
+		sb.WriteString(html.EscapeString(text[pos:tok.start]))
+		sb.WriteString("<mark>" + html.EscapeString(text[tok.start:tok.end]) + "</mark>")
+		pos = tok.end
+	}
+	sb.WriteString(html.EscapeString(text[pos:to]))
+	if to < len(text) {
+		sb.WriteString("…")
+	}
+	return sb.String(), true
+}
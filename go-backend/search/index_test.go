@@ -0,0 +1,174 @@
+package search
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cuanin/emergent-backend/models"
+)
+
+var testCourses = []models.Course{
+	{
+		ID:          "budgeting",
+		Title:       "Budgeting for Students",
+		Description: "Plan a monthly budget & stick to it.",
+		MentorName:  "Ana Putri",
+		Topics:      []string{"Budgeting", "Saving"},
+		Status:      models.CoursePublished,
+	},
+	{
+		ID:          "stocks",
+		Title:       "Stock Market Basics",
+		Description: "How shares are bought and sold.",
+		MentorName:  "Budi Santoso",
+		Topics:      []string{"Stocks"},
+		Status:      models.CoursePublished,
+	},
+	{
+		ID:          "saham",
+		Title:       "Investasi Saham untuk Pemula",
+		Description: "Belajar berinvestasi di pasar modal.",
+		MentorName:  "Citra Lestari",
+		Topics:      []string{"Saham"},
+		Status:      models.CoursePublished,
+	},
+	{
+		ID:          "draft",
+		Title:       "Budgeting Secrets",
+		Description: "Not out yet.",
+		Status:      models.CourseDraft,
+	},
+	{
+		ID:          "unlisted",
+		Title:       "Stock Picking Club",
+		Description: "Only for members with the link.",
+		Status:      models.CourseUnlisted,
+	},
+}
+
+func newTestIndex() *Index {
+	ix := New()
+	ix.Reset(testCourses)
+	return ix
+}
+
+func resultIDs(results []Result) []string {
+	ids := []string{}
+	for _, r := range results {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func TestSearch(t *testing.T) {
+	ix := newTestIndex()
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"budget", []string{"budgeting"}},
+		{"BUDGETS", []string{"budgeting"}},
+		// Typos
+		{"budgetting", []string{"budgeting"}},
+		{"budgting", []string{"budgeting"}},
+		{"stok market", []string{"stocks"}},
+		{"sahm", []string{"saham"}},
+		// Indonesian stems match across affixes
+		{"investasi", []string{"saham"}},
+		{"belajar berinvestasi", []string{"saham"}},
+		// Mentors and topics are searched too
+		{"santoso", []string{"stocks"}},
+		{"saving", []string{"budgeting"}},
+		// Courses matching more words rank first
+		{"stock budgeting students", []string{"budgeting", "stocks"}},
+		// Drafts and unlisted courses are never found
+		{"secrets", []string{}},
+		{"picking club", []string{}},
+		// Nothing to look up
+		{"the and yang", []string{}},
+		{"", []string{}},
+		{"xyzzy", []string{}},
+	} {
+		if got := resultIDs(ix.Search(tt.query)); !slices.Equal(got, tt.want) {
+			t.Errorf("Search(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSearchHighlights(t *testing.T) {
+	ix := newTestIndex()
+	for _, tt := range []struct {
+		query string
+		want  map[string]string
+	}{
+		{"budgets", map[string]string{
+			FieldTitle:       "<mark>Budgeting</mark> for Students",
+			FieldTopics:      "<mark>Budgeting</mark>, Saving",
+			FieldDescription: "Plan a monthly <mark>budget</mark> &amp; stick to it.",
+		}},
+		{"stok", map[string]string{
+			FieldTitle:  "<mark>Stock</mark> Market Basics",
+			FieldTopics: "<mark>Stocks</mark>",
+		}},
+		{"investasi", map[string]string{
+			FieldTitle:       "<mark>Investasi</mark> Saham untuk Pemula",
+			FieldDescription: "Belajar <mark>berinvestasi</mark> di pasar modal.",
+		}},
+	} {
+		results := ix.Search(tt.query)
+		if len(results) != 1 {
+			t.Errorf("Search(%q) = %q, want one course", tt.query, resultIDs(results))
+			continue
+		}
+		if got := results[0].Highlights; !maps.Equal(got, tt.want) {
+			t.Errorf("Search(%q) highlights = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	words := strings.Fields(strings.Repeat("lorem ipsum ", 40))
+	text := strings.Join(words[:20], " ") + " budget " + strings.Join(words[20:], " ")
+	got, ok := highlight(text, map[string]bool{"budget": true}, true)
+	if !ok {
+		t.Fatal("highlight found no match")
+	}
+	if !strings.HasPrefix(got, "…") || !strings.HasSuffix(got, "…") || !strings.Contains(got, "<mark>budget</mark>") {
+		t.Errorf("snippet = %q, want the words around <mark>budget</mark> between ellipses", got)
+	}
+	if n := len(strings.Fields(got)); n != snippetBefore+snippetAfter {
+		t.Errorf("snippet has %d words, want %d", n, snippetBefore+snippetAfter)
+	}
+	if _, ok := highlight(text, map[string]bool{"saham": true}, true); ok {
+		t.Error("highlight matched a word that is not in the text")
+	}
+}
+
+func TestPutAndRemove(t *testing.T) {
+	ix := newTestIndex()
+
+	// An archived course disappears; published again, it is back
+	course := testCourses[1]
+	course.Status = models.CourseArchived
+	ix.Put(course)
+	if got := resultIDs(ix.Search("market")); len(got) != 0 {
+		t.Errorf("archived course is found: %q", got)
+	}
+	course.Status = models.CoursePublished
+	course.Title = "Bond Market Basics"
+	ix.Put(course)
+	if got := resultIDs(ix.Search("bond")); !slices.Equal(got, []string{"stocks"}) {
+		t.Errorf("Search(bond) after renaming = %q, want [stocks]", got)
+	}
+	if got := resultIDs(ix.Search("market")); !slices.Equal(got, []string{"stocks"}) {
+		t.Errorf("Search(market) after renaming = %q, want [stocks]", got)
+	}
+
+	ix.Remove("stocks")
+	ix.Remove("missing")
+	if got := resultIDs(ix.Search("bond market")); len(got) != 0 {
+		t.Errorf("removed course is found: %q", got)
+	}
+}
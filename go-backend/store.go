@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/cuanin/emergent-backend/repository"
+)
+
+// newStore opens the storage backend selected by the DB_DRIVER environment
+// variable. The in-memory store is used when no driver is configured.
+func newStore() (repository.Store, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var (
+		store repository.Store
+		err   error
+	)
+	switch driver := os.Getenv("DB_DRIVER"); driver {
+	case "", "memory":
+		return repository.NewMemoryStore(), nil
+	case "mongo", "mongodb":
+		uri := os.Getenv("MONGODB_URI")
+		if uri == "" {
+			uri = "mongodb://localhost:27017"
+		}
+		store, err = repository.NewMongoStore(ctx, uri, getEnv("DB_NAME", "emergent"))
+	case "sqlite", "postgres":
+		store, err = openSQLStore(ctx, driver)
+	default:
+		return repository.Store{}, fmt.Errorf("unknown DB_DRIVER %q", driver)
+	}
+	if err != nil {
+		return repository.Store{}, err
+	}
+
+	if os.Getenv("DB_SEED") == "true" {
+		if err := repository.Seed(ctx, store); err != nil {
+			store.Close(ctx)
+			return repository.Store{}, fmt.Errorf("seed database: %w", err)
+		}
+	}
+	return store, nil
+}
+
+// openSQLDatabase opens the SQL database configured by DATABASE_URL.
+func openSQLDatabase(driver string) (*repository.SQLDatabase, error) {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		if driver != "sqlite" {
+			return nil, fmt.Errorf("DATABASE_URL is required for DB_DRIVER=%s", driver)
+		}
+		dsn = "emergent.db"
+	}
+	return repository.OpenSQL(driver, dsn)
+}
+
+// openSQLStore opens the SQL database and applies any pending migrations.
+func openSQLStore(ctx context.Context, driver string) (repository.Store, error) {
+	db, err := openSQLDatabase(driver)
+	if err != nil {
+		return repository.Store{}, err
+	}
+	applied, err := db.MigrateUp(ctx)
+	if err != nil {
+		db.Close()
+		return repository.Store{}, err
+	}
+	for _, version := range applied {
+		log.Printf("Applied migration %04d", version)
+	}
+	return db.Store(), nil
+}
+
+// getEnv returns the value of the environment variable key, or fallback if it is unset.
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// envDuration returns the duration in the environment variable key, or
+// fallback if it is unset or invalid.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
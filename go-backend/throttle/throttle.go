@@ -0,0 +1,144 @@
+// Package throttle protects the login endpoint against password guessing by
+// counting failures per client IP and per account and locking them out with
+// exponential backoff.
+package throttle
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cuanin/emergent-backend/models"
+	"github.com/cuanin/emergent-backend/repository"
+	"github.com/google/uuid"
+)
+
+// Limit is the number of failures allowed within a window before a lockout.
+type Limit struct {
+	MaxFailures int
+	Window      time.Duration
+}
+
+// Policy configures a Guard.
+type Policy struct {
+	PerIP      Limit
+	PerAccount Limit
+	// The first lockout lasts BaseLockout; each further lockout doubles it,
+	// up to MaxLockout.
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	// LockoutDecay is how long after the last failure the lockout count is
+	// forgotten and backoff starts again from BaseLockout.
+	LockoutDecay time.Duration
+}
+
+// DefaultPolicy returns the limits used when none are configured.
+func DefaultPolicy() Policy {
+	return Policy{
+		PerIP:        Limit{MaxFailures: 20, Window: 15 * time.Minute},
+		PerAccount:   Limit{MaxFailures: 5, Window: 15 * time.Minute},
+		BaseLockout:  time.Minute,
+		MaxLockout:   time.Hour,
+		LockoutDecay: 24 * time.Hour,
+	}
+}
+
+// Guard decides whether a login attempt may proceed.
+type Guard struct {
+	repo   repository.LoginThrottleRepository
+	policy Policy
+}
+
+// New returns a Guard that keeps its counters in repo.
+func New(repo repository.LoginThrottleRepository, policy Policy) *Guard {
+	return &Guard{repo: repo, policy: policy}
+}
+
+type scope struct {
+	name  string
+	key   string
+	limit Limit
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+func (g *Guard) scopes(ip, email string) []scope {
+	return []scope{
+		{"ip", "ip:" + ip, g.policy.PerIP},
+		{"account", accountKey(email), g.policy.PerAccount},
+	}
+}
+
+// Check returns how long the client must wait before trying to log in again,
+// or zero if neither the IP address nor the account is locked.
+func (g *Guard) Check(ctx context.Context, ip, email string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for _, s := range g.scopes(ip, email) {
+		t, err := g.repo.GetLoginThrottle(ctx, s.key)
+		if errors.Is(err, repository.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if t.LockedUntil != nil && t.LockedUntil.After(now) {
+			wait = max(wait, t.LockedUntil.Sub(now))
+		}
+	}
+	return wait, nil
+}
+
+// Fail records a failed login. If it crosses a limit, the IP address or
+// account is locked and the lockout duration is returned.
+func (g *Guard) Fail(ctx context.Context, ip, email string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for _, s := range g.scopes(ip, email) {
+		t, err := g.repo.RecordLoginFailure(ctx, s.key, now, s.limit.Window, g.policy.LockoutDecay)
+		if err != nil {
+			return 0, err
+		}
+		if t.Failures < s.limit.MaxFailures {
+			continue
+		}
+
+		d := g.lockoutDuration(t.Lockouts)
+		until := now.Add(d)
+		if err := g.repo.LockLogin(ctx, s.key, until); err != nil {
+			return 0, err
+		}
+		if err := g.repo.RecordLockout(ctx, models.LockoutEvent{
+			ID:          uuid.New().String(),
+			Scope:       s.name,
+			IP:          ip,
+			Email:       email,
+			Failures:    t.Failures,
+			LockedUntil: until,
+			CreatedAt:   now,
+		}); err != nil {
+			return 0, err
+		}
+		wait = max(wait, d)
+	}
+	return wait, nil
+}
+
+// Succeed clears the account's failures after a successful login. The IP
+// counter is kept so that one valid account cannot be used to reset it.
+func (g *Guard) Succeed(ctx context.Context, email string) error {
+	return g.repo.ResetLogin(ctx, accountKey(email))
+}
+
+// lockoutDuration returns the backoff for a key that has already been
+// locked out the given number of times.
+func (g *Guard) lockoutDuration(lockouts int) time.Duration {
+	d := g.policy.BaseLockout
+	for i := 0; i < lockouts && d < g.policy.MaxLockout; i++ {
+		d *= 2
+	}
+	return min(d, g.policy.MaxLockout)
+}
@@ -0,0 +1,147 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cuanin/emergent-backend/repository"
+)
+
+const testIP = "192.0.2.1"
+
+func newTestGuard(policy Policy) *Guard {
+	return New(repository.NewMemoryStore().Throttles, policy)
+}
+
+// fail records n failed logins and returns the lockout of the last one.
+func fail(t *testing.T, g *Guard, ip, email string, n int) time.Duration {
+	t.Helper()
+	var wait time.Duration
+	for range n {
+		var err error
+		if wait, err = g.Fail(context.Background(), ip, email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return wait
+}
+
+func check(t *testing.T, g *Guard, ip, email string) time.Duration {
+	t.Helper()
+	wait, err := g.Check(context.Background(), ip, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wait
+}
+
+func TestGuardLocksAccount(t *testing.T) {
+	g := newTestGuard(Policy{
+		PerIP:        Limit{MaxFailures: 100, Window: time.Minute},
+		PerAccount:   Limit{MaxFailures: 3, Window: time.Minute},
+		BaseLockout:  time.Minute,
+		MaxLockout:   time.Hour,
+		LockoutDecay: time.Hour,
+	})
+
+	if wait := fail(t, g, testIP, "a@example.com", 2); wait != 0 {
+		t.Fatalf("lockout after 2 failures = %v, want none", wait)
+	}
+	if wait := check(t, g, testIP, "a@example.com"); wait != 0 {
+		t.Fatalf("Check after 2 failures = %v, want 0", wait)
+	}
+	if wait := fail(t, g, testIP, "a@example.com", 1); wait != time.Minute {
+		t.Fatalf("lockout after 3 failures = %v, want 1m", wait)
+	}
+	if wait := check(t, g, testIP, "A@example.com"); wait <= 0 || wait > time.Minute {
+		t.Errorf("Check of the locked account = %v, want up to 1m", wait)
+	}
+	if wait := check(t, g, testIP, "b@example.com"); wait != 0 {
+		t.Errorf("Check of another account = %v, want 0", wait)
+	}
+}
+
+func TestGuardLocksIP(t *testing.T) {
+	g := newTestGuard(Policy{
+		PerIP:        Limit{MaxFailures: 3, Window: time.Minute},
+		PerAccount:   Limit{MaxFailures: 100, Window: time.Minute},
+		BaseLockout:  time.Minute,
+		MaxLockout:   time.Hour,
+		LockoutDecay: time.Hour,
+	})
+
+	fail(t, g, testIP, "a@example.com", 1)
+	fail(t, g, testIP, "b@example.com", 1)
+	if wait := fail(t, g, testIP, "c@example.com", 1); wait != time.Minute {
+		t.Fatalf("lockout after 3 failures from one IP = %v, want 1m", wait)
+	}
+	if wait := check(t, g, testIP, "d@example.com"); wait <= 0 {
+		t.Errorf("Check from the locked IP = %v, want a lockout", wait)
+	}
+	if wait := check(t, g, "198.51.100.1", "a@example.com"); wait != 0 {
+		t.Errorf("Check from another IP = %v, want 0", wait)
+	}
+}
+
+func TestGuardForgetsFailuresOutsideWindow(t *testing.T) {
+	const window = 50 * time.Millisecond
+	g := newTestGuard(Policy{
+		PerIP:        Limit{MaxFailures: 100, Window: time.Minute},
+		PerAccount:   Limit{MaxFailures: 3, Window: window},
+		BaseLockout:  time.Minute,
+		MaxLockout:   time.Hour,
+		LockoutDecay: time.Hour,
+	})
+
+	fail(t, g, testIP, "a@example.com", 2)
+	time.Sleep(2 * window)
+	if wait := fail(t, g, testIP, "a@example.com", 2); wait != 0 {
+		t.Fatalf("lockout after failures in two windows = %v, want none", wait)
+	}
+	if wait := fail(t, g, testIP, "a@example.com", 1); wait == 0 {
+		t.Fatal("no lockout after 3 failures in one window")
+	}
+}
+
+func TestGuardBacksOff(t *testing.T) {
+	const base = 20 * time.Millisecond
+	g := newTestGuard(Policy{
+		PerIP:        Limit{MaxFailures: 100, Window: time.Minute},
+		PerAccount:   Limit{MaxFailures: 1, Window: time.Minute},
+		BaseLockout:  base,
+		MaxLockout:   3 * base,
+		LockoutDecay: time.Hour,
+	})
+
+	// Each lockout doubles the next, up to MaxLockout
+	for _, want := range []time.Duration{base, 2 * base, 3 * base, 3 * base} {
+		wait := fail(t, g, testIP, "a@example.com", 1)
+		if wait != want {
+			t.Fatalf("lockout = %v, want %v", wait, want)
+		}
+		time.Sleep(wait)
+	}
+}
+
+func TestGuardSucceedResetsAccountOnly(t *testing.T) {
+	g := newTestGuard(Policy{
+		PerIP:        Limit{MaxFailures: 3, Window: time.Minute},
+		PerAccount:   Limit{MaxFailures: 3, Window: time.Minute},
+		BaseLockout:  time.Minute,
+		MaxLockout:   time.Hour,
+		LockoutDecay: time.Hour,
+	})
+
+	fail(t, g, testIP, "a@example.com", 2)
+	if err := g.Succeed(context.Background(), "a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// The account starts over but the IP address keeps counting
+	if wait := fail(t, g, testIP, "a@example.com", 1); wait != time.Minute {
+		t.Errorf("lockout after a success and 3 failures from the IP = %v, want 1m", wait)
+	}
+	if wait := check(t, g, "198.51.100.1", "a@example.com"); wait != 0 {
+		t.Errorf("Check of the reset account from another IP = %v, want 0", wait)
+	}
+}
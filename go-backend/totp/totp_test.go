@@ -0,0 +1,94 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed of RFC 6238 Appendix B, "12345678901234567890",
+// base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The test vectors of RFC 6238 Appendix B for SHA-1, cut from 8 digits to
+// the last 6 that authenticator apps show.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestGenerateRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		got, err := Generate(rfcSecret, time.Unix(v.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != v.code {
+			t.Errorf("Generate at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+	// Secrets are accepted in lower case too
+	if got, _ := Generate(strings.ToLower(rfcSecret), time.Unix(59, 0)); got != "287082" {
+		t.Errorf("Generate with a lower case secret = %s, want 287082", got)
+	}
+}
+
+func TestValidateRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		at := time.Unix(v.unix, 0)
+		step, ok := Validate(rfcSecret, v.code, at)
+		if !ok || step != Step(at) {
+			t.Errorf("Validate(%s) at %d = %d, %v, want %d, true", v.code, v.unix, step, ok, Step(at))
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	// 1111111109 and 1111111111 fall in neighbouring steps
+	const code = "081804"
+	at := time.Unix(1111111109, 0)
+	for _, tc := range []struct {
+		offset time.Duration
+		ok     bool
+	}{
+		{-period, true},
+		{0, true},
+		{period, true},
+		{-2 * period, false},
+		{2 * period, false},
+	} {
+		step, ok := Validate(rfcSecret, code, at.Add(tc.offset))
+		if ok != tc.ok {
+			t.Errorf("Validate %v from the code's step = %v, want %v", tc.offset, ok, tc.ok)
+		}
+		if ok && step != Step(at) {
+			t.Errorf("Validate %v from the code's step matched step %d, want %d", tc.offset, step, Step(at))
+		}
+	}
+}
+
+func TestValidateRejectsMalformed(t *testing.T) {
+	at := time.Unix(59, 0)
+	for _, tc := range []struct {
+		secret, code string
+		ok           bool
+	}{
+		{rfcSecret, "287 082", true},
+		{rfcSecret, "287083", false},
+		{rfcSecret, "28708", false},
+		{rfcSecret, "94287082", false},
+		{rfcSecret, "", false},
+		{"not base32!", "287082", false},
+	} {
+		if _, ok := Validate(tc.secret, tc.code, at); ok != tc.ok {
+			t.Errorf("Validate(%q, %q) = %v, want %v", tc.secret, tc.code, ok, tc.ok)
+		}
+	}
+}